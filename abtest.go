@@ -0,0 +1,146 @@
+package main
+
+import (
+	"fmt"
+	"hash/fnv"
+	"math/rand/v2"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Sticky A/B bucketing: new clients get a weighted random variant, pinned
+// through a cookie so later requests keep going to the same upstream
+type ABTestConfig struct {
+	Variants []ABVariantConfig `yaml:"variants"`
+	// Attribute the variant is derived from instead of the cookie, e.g.
+	// "claim:sub" to keep a user on one variant across devices ("ip",
+	// "header:<name>", "cookie:<name>" or "claim:<name>"). Requests without
+	// it fall back to the cookie.
+	StickyKey string `yaml:"sticky_key"`
+	// Cookie holding the variant name; gateway_variant by default
+	Cookie string        `yaml:"cookie"`
+	MaxAge time.Duration `yaml:"max_age"`
+	// Request header telling the upstream which variant it serves; none when empty
+	Header string `yaml:"header"`
+}
+
+type ABVariantConfig struct {
+	Name   string `yaml:"name"`
+	Target string `yaml:"target"`
+	Weight int    `yaml:"weight"`
+}
+
+func (cfg ABTestConfig) validate() error {
+	seen := make(map[string]bool)
+	for _, v := range cfg.Variants {
+		if v.Name == "" || v.Target == "" || v.Weight <= 0 {
+			return fmt.Errorf("ab_test: variants need a name, target and positive weight")
+		}
+		if seen[v.Name] {
+			return fmt.Errorf("ab_test: duplicate variant %q", v.Name)
+		}
+		seen[v.Name] = true
+	}
+	if cfg.StickyKey != "" && !validAttribute(cfg.StickyKey) {
+		return fmt.Errorf("ab_test: unknown sticky_key %q", cfg.StickyKey)
+	}
+	return nil
+}
+
+// Context key holding the name of the request's A/B variant
+const abVariantKey = "ab_variant"
+
+type abTest struct {
+	cfg    ABTestConfig
+	total  int
+	byName map[string]ABVariantConfig
+	// Uniform in [0, n); replaced in tests
+	pick func(n int) int
+}
+
+func newABTest(cfg ABTestConfig) *abTest {
+	if cfg.Cookie == "" {
+		cfg.Cookie = "gateway_variant"
+	}
+	if cfg.MaxAge <= 0 {
+		cfg.MaxAge = 30 * 24 * time.Hour
+	}
+	t := &abTest{cfg: cfg, byName: make(map[string]ABVariantConfig), pick: rand.IntN}
+	for _, v := range cfg.Variants {
+		t.total += v.Weight
+		t.byName[v.Name] = v
+	}
+	return t
+}
+
+func (t *abTest) assign() ABVariantConfig {
+	return t.variantAt(t.pick(t.total))
+}
+
+// Variant for a sticky key value: the same value always gets the same
+// variant, and values spread across variants by weight. Only the value is
+// hashed, so a user is on the same side of every route splitting alike.
+func (t *abTest) assignKey(key string) ABVariantConfig {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return t.variantAt(int(h.Sum32() % uint32(t.total)))
+}
+
+// Variant covering n in [0, total)
+func (t *abTest) variantAt(n int) ABVariantConfig {
+	for _, v := range t.cfg.Variants {
+		if n < v.Weight {
+			return v
+		}
+		n -= v.Weight
+	}
+	return t.cfg.Variants[len(t.cfg.Variants)-1]
+}
+
+// Middleware routing the request to its A/B variant's upstream. Runs after
+// ext_authz so the variant can follow a claim.
+func ABTestMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		route := routeFromContext(c)
+		t := route.abTest
+		// A debug override already picked the upstream
+		if t == nil || c.GetString(upstreamKey) != "" {
+			c.Next()
+			return
+		}
+
+		var (
+			variant ABVariantConfig
+			ok      bool
+		)
+		if t.cfg.StickyKey != "" {
+			if key := requestAttribute(c, t.cfg.StickyKey); key != "" {
+				variant, ok = t.assignKey(key), true
+			}
+		}
+		if !ok {
+			name, _ := c.Cookie(t.cfg.Cookie)
+			variant, ok = t.byName[name]
+		}
+		if !ok {
+			variant = t.assign()
+			http.SetCookie(c.Writer, &http.Cookie{
+				Name:     t.cfg.Cookie,
+				Value:    variant.Name,
+				Path:     route.Prefix,
+				MaxAge:   int(t.cfg.MaxAge.Seconds()),
+				HttpOnly: true,
+				SameSite: http.SameSiteLaxMode,
+			})
+		}
+
+		c.Set(upstreamKey, variant.Target)
+		c.Set(abVariantKey, variant.Name)
+		if t.cfg.Header != "" {
+			c.Request.Header.Set(t.cfg.Header, variant.Name)
+		}
+		c.Next()
+	}
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Gateway splitting /ab between upstreams answering with their variant's name
+func newABGateway(t *testing.T, abTest string) (*Gateway, http.Handler) {
+	t.Helper()
+	target := func(name string) string {
+		up := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { w.Write([]byte(name)) }))
+		t.Cleanup(up.Close)
+		return up.URL
+	}
+	return newTestGateway(t, "routes:\n- prefix: /ab\n  target: "+target("default")+"\n  rate_limit: {rate: 10000, burst: 10000}\n"+
+		"  ab_test:\n    variants:\n"+
+		"    - {name: control, target: "+target("control")+", weight: 3}\n"+
+		"    - {name: treatment, target: "+target("treatment")+", weight: 1}\n"+abTest)
+}
+
+func TestABTestStickyCookie(t *testing.T) {
+	g, r := newABGateway(t, "")
+	ab := g.routes()[0].abTest
+
+	for pick, want := range map[int]string{0: "control", 2: "control", 3: "treatment"} {
+		ab.pick = func(n int) int { return pick }
+		w := serve(r, httptest.NewRequest(http.MethodGet, "/ab/", nil))
+		cookies := w.Result().Cookies()
+		if len(cookies) != 1 || cookies[0].Name != "gateway_variant" || cookies[0].Value != want || cookies[0].Path != "/ab" {
+			t.Fatalf("new client drawn %d: cookies %v, want gateway_variant=%s", pick, cookies, want)
+		}
+		if w.Body.String() != want {
+			t.Fatalf("new client drawn %d: served by %q, want %s", pick, w.Body, want)
+		}
+
+		// Pinned from then on, though a new draw would pick the other variant
+		other := 3
+		if want == "treatment" {
+			other = 0
+		}
+		ab.pick = func(n int) int { return other }
+		for range 5 {
+			req := httptest.NewRequest(http.MethodGet, "/ab/", nil)
+			req.AddCookie(cookies[0])
+			w := serve(r, req)
+			if w.Body.String() != want || len(w.Result().Cookies()) != 0 {
+				t.Fatalf("returning %s client: served by %q, cookies %v", want, w.Body, w.Result().Cookies())
+			}
+		}
+	}
+
+	// A cookie naming no variant gets a fresh assignment
+	ab.pick = func(n int) int { return 3 }
+	req := httptest.NewRequest(http.MethodGet, "/ab/", nil)
+	req.AddCookie(&http.Cookie{Name: "gateway_variant", Value: "retired"})
+	if w := serve(r, req); w.Body.String() != "treatment" || len(w.Result().Cookies()) != 1 {
+		t.Errorf("unknown variant cookie: served by %q, cookies %v", w.Body, w.Result().Cookies())
+	}
+}
+
+// With sticky_key claim:sub a subject gets the same variant on every request,
+// whatever its cookie says, and subjects split by the variants' weights
+func TestABTestStickySubject(t *testing.T) {
+	authz := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var check authzCheck
+		json.NewDecoder(r.Body).Decode(&check)
+		sub := strings.TrimPrefix(check.Headers["Authorization"], "Bearer ")
+		json.NewEncoder(w).Encode(authzResult{Claims: map[string]string{"sub": sub}})
+	}))
+	defer authz.Close()
+	_, r := newABGateway(t, "    sticky_key: claim:sub\n  ext_authz: {url: "+authz.URL+", headers: [Authorization]}\n")
+
+	const subjects = 400
+	served := map[string]int{}
+	for i := range subjects {
+		sub := fmt.Sprint("user-", i)
+		var first string
+		for _, cookie := range []string{"", "control", "treatment"} {
+			req := httptest.NewRequest(http.MethodGet, "/ab/", nil)
+			req.Header.Set("Authorization", "Bearer "+sub)
+			if cookie != "" {
+				req.AddCookie(&http.Cookie{Name: "gateway_variant", Value: cookie})
+			}
+			got := serve(r, req).Body.String()
+			if first == "" {
+				first = got
+			} else if got != first {
+				t.Fatalf("%s with cookie %s: served by %s, before by %s", sub, cookie, got, first)
+			}
+		}
+		served[first]++
+	}
+	// Weights 3:1, so a quarter of the subjects on treatment
+	if share := float64(served["treatment"]) / subjects; share < 0.18 || share > 0.32 || served["control"]+served["treatment"] != subjects {
+		t.Errorf("subjects per variant %v, want about 3:1", served)
+	}
+}
+
+// Each request is counted and timed under the variant that served it, and
+// the upstreams' different outcomes show apart
+func TestABTestVariantMetrics(t *testing.T) {
+	upstream := func(status int, delay time.Duration) string {
+		up := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			time.Sleep(delay)
+			w.Header().Set("X-Seen-Variant", r.Header.Get("X-Variant"))
+			w.WriteHeader(status)
+		}))
+		t.Cleanup(up.Close)
+		return up.URL
+	}
+	g, r := newTestGateway(t, "routes:\n- prefix: /exp\n  target: "+upstream(http.StatusOK, 0)+"\n  rate_limit: {rate: 10000, burst: 10000}\n"+
+		"  ab_test:\n    header: X-Variant\n    variants:\n"+
+		"    - {name: control, target: "+upstream(http.StatusOK, 0)+", weight: 1}\n"+
+		"    - {name: treatment, target: "+upstream(http.StatusInternalServerError, 50*time.Millisecond)+", weight: 1}\n")
+	ab := g.routes()[0].abTest
+
+	for i, variant := range []string{"control", "treatment", "control", "control", "treatment"} {
+		pick := 0
+		if variant == "treatment" {
+			pick = 1
+		}
+		ab.pick = func(n int) int { return pick }
+		if seen := serve(r, httptest.NewRequest(http.MethodGet, "/exp/", nil)).Header().Get("X-Seen-Variant"); seen != variant {
+			t.Fatalf("request %d: upstream told variant %q, want %s", i, seen, variant)
+		}
+	}
+
+	for _, tc := range []struct {
+		variant, status string
+		want            float64
+	}{
+		{"control", "200", 3},
+		{"control", "500", 0},
+		{"treatment", "200", 0},
+		{"treatment", "500", 2},
+	} {
+		if got := counterValue(t, abVariantRequests.WithLabelValues("/exp", tc.variant, tc.status)); got != tc.want {
+			t.Errorf("%s %s requests = %v, want %v", tc.variant, tc.status, got, tc.want)
+		}
+	}
+	controlCount, controlSum := histogramValue(t, abVariantDuration.WithLabelValues("/exp", "control"))
+	treatmentCount, treatmentSum := histogramValue(t, abVariantDuration.WithLabelValues("/exp", "treatment"))
+	if controlCount != 3 || treatmentCount != 2 {
+		t.Errorf("latency observations control %d, treatment %d, want 3 and 2", controlCount, treatmentCount)
+	}
+	if treatmentSum/2 < 0.05 || controlSum/3 >= treatmentSum/2 {
+		t.Errorf("mean latency control %.3fs, treatment %.3fs, want treatment at least 50ms and slower", controlSum/3, treatmentSum/2)
+	}
+}
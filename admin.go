@@ -0,0 +1,278 @@
+package main
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"net"
+	"net/http"
+	"slices"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/rs/zerolog/log"
+)
+
+// Admin API settings; the admin routes are only registered when an auth method is configured
+type AdminConfig struct {
+	Auth AdminAuthConfig `yaml:"auth"`
+	// Serve per-route load under /admin/load for autoscalers
+	LoadEndpoint bool        `yaml:"load_endpoint"`
+	Audit        AuditConfig `yaml:"audit"`
+}
+
+// Methods guarding the admin API. Mode "all" requires every configured method
+// to pass, "any" (the default) accepts the first one that does.
+type AdminAuthConfig struct {
+	Mode        string   `yaml:"mode"`
+	Token       string   `yaml:"token"`
+	ClientCerts []string `yaml:"client_certs"`
+	RequireCert bool     `yaml:"require_client_cert"`
+	IPAllowlist []string `yaml:"ip_allowlist"`
+}
+
+// Context key holding the identity the admin request was authenticated as
+const adminIdentityKey = "admin_identity"
+
+type adminCheck struct {
+	name  string
+	check func(c *gin.Context) (string, bool)
+}
+
+func (a AdminAuthConfig) enabled() bool {
+	return a.Token != "" || a.RequireCert || len(a.ClientCerts) > 0 || len(a.IPAllowlist) > 0
+}
+
+func (a AdminAuthConfig) validate() error {
+	switch a.Mode {
+	case "", "any", "all":
+	default:
+		return fmt.Errorf("admin auth: unknown mode %q", a.Mode)
+	}
+	if _, err := parseCIDRs(a.IPAllowlist); err != nil {
+		return fmt.Errorf("admin auth: %w", err)
+	}
+	return nil
+}
+
+// Parse plain IPs and CIDRs into networks
+func parseCIDRs(entries []string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, entry := range entries {
+		if !strings.Contains(entry, "/") {
+			if ip := net.ParseIP(entry); ip != nil && ip.To4() != nil {
+				entry += "/32"
+			} else {
+				entry += "/128"
+			}
+		}
+		_, ipNet, err := net.ParseCIDR(entry)
+		if err != nil {
+			return nil, fmt.Errorf("invalid address %q", entry)
+		}
+		nets = append(nets, ipNet)
+	}
+	return nets, nil
+}
+
+func adminChecks(cfg AdminAuthConfig) []adminCheck {
+	var checks []adminCheck
+
+	if cfg.Token != "" {
+		expected := []byte(cfg.Token)
+		checks = append(checks, adminCheck{"token", func(c *gin.Context) (string, bool) {
+			// X-Admin-Token lets proxied requests carry admin credentials
+			// without taking over their Authorization header
+			got := c.GetHeader("X-Admin-Token")
+			if got == "" {
+				got, _ = strings.CutPrefix(c.GetHeader("Authorization"), "Bearer ")
+			}
+			return "token", subtle.ConstantTimeCompare([]byte(got), expected) == 1
+		}})
+	}
+
+	if cfg.RequireCert || len(cfg.ClientCerts) > 0 {
+		checks = append(checks, adminCheck{"client_cert", func(c *gin.Context) (string, bool) {
+			// Only certificates verified against the server's client CA count
+			tlsState := c.Request.TLS
+			if tlsState == nil || len(tlsState.VerifiedChains) == 0 {
+				return "", false
+			}
+			subject := tlsState.VerifiedChains[0][0].Subject.CommonName
+			if len(cfg.ClientCerts) > 0 && !slices.Contains(cfg.ClientCerts, subject) {
+				return "", false
+			}
+			return "cert:" + subject, true
+		}})
+	}
+
+	if len(cfg.IPAllowlist) > 0 {
+		nets, _ := parseCIDRs(cfg.IPAllowlist)
+		checks = append(checks, adminCheck{"ip", func(c *gin.Context) (string, bool) {
+			// Use the peer address; forwarded headers are client controlled
+			ip := net.ParseIP(c.RemoteIP())
+			if ip == nil {
+				return "", false
+			}
+			for _, n := range nets {
+				if n.Contains(ip) {
+					return "ip:" + ip.String(), true
+				}
+			}
+			return "", false
+		}})
+	}
+
+	return checks
+}
+
+// Evaluates the configured admin auth methods with any/all semantics
+type adminAuthenticator struct {
+	checks     []adminCheck
+	requireAll bool
+}
+
+func newAdminAuthenticator(cfg AdminAuthConfig) *adminAuthenticator {
+	return &adminAuthenticator{checks: adminChecks(cfg), requireAll: cfg.Mode == "all"}
+}
+
+// Identity the request authenticated as, if it passes the configured methods
+func (a *adminAuthenticator) authenticate(c *gin.Context) (string, bool) {
+	var identities []string
+	passed := 0
+	for _, ac := range a.checks {
+		identity, ok := ac.check(c)
+		if ok {
+			passed++
+			identities = append(identities, identity)
+			if !a.requireAll {
+				break
+			}
+		} else if a.requireAll {
+			break
+		}
+	}
+
+	if passed == 0 || (a.requireAll && passed != len(a.checks)) {
+		return "", false
+	}
+	return strings.Join(identities, ","), true
+}
+
+// Middleware for admin API authentication
+func AdminAuthMiddleware(cfg AdminAuthConfig) gin.HandlerFunc {
+	auth := newAdminAuthenticator(cfg)
+
+	return func(c *gin.Context) {
+		identity, ok := auth.authenticate(c)
+		if !ok {
+			log.Warn().Str("remote_ip", c.RemoteIP()).Str("path", c.Request.URL.Path).Msg("Admin authentication failed")
+			sendLogToLoki("Admin authentication failed", map[string]string{"level": "warn", "path": c.Request.URL.Path})
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+			c.Abort()
+			return
+		}
+
+		c.Set(adminIdentityKey, identity)
+		c.Next()
+	}
+}
+
+// Register the admin endpoints behind the configured authentication
+func registerAdminRoutes(r *gin.Engine, cfg AdminConfig, g *Gateway) error {
+	if !cfg.Auth.enabled() {
+		log.Warn().Msg("Admin API disabled: no admin authentication configured")
+		return nil
+	}
+	audit, err := openAuditSink(cfg.Audit)
+	if err != nil {
+		return err
+	}
+
+	admin := r.Group("/admin", AuditMiddleware(audit), AdminAuthMiddleware(cfg.Auth))
+
+	admin.GET("/routes", func(c *gin.Context) {
+		routes := g.routes()
+		list := make([]gin.H, 0, len(routes))
+		for _, route := range routes {
+			list = append(list, gin.H{
+				"prefix":          route.Prefix,
+				"target":          redactURL(route.Target),
+				"enabled":         route.Enabled,
+				"circuit_breaker": route.breaker.State().String(),
+			})
+		}
+		c.JSON(http.StatusOK, gin.H{"routes": list})
+	})
+
+	// Switch fault injection on or off for a route that has faults configured
+	admin.POST("/faults", func(c *gin.Context) {
+		var body struct {
+			Route   string `json:"route"`
+			Enabled bool   `json:"enabled"`
+		}
+		if err := c.ShouldBindJSON(&body); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request", "msg": err.Error()})
+			return
+		}
+		for _, route := range g.routes() {
+			if route.Prefix != normalizePrefix(body.Route) {
+				continue
+			}
+			if route.faults == nil {
+				c.JSON(http.StatusConflict, gin.H{"error": "No faults configured for route"})
+				return
+			}
+			route.faults.enabled.Store(body.Enabled)
+			log.Warn().Str("route", route.Prefix).Bool("enabled", body.Enabled).Str("admin", c.GetString(adminIdentityKey)).Msg("Fault injection toggled")
+			c.JSON(http.StatusOK, gin.H{"route": route.Prefix, "enabled": body.Enabled})
+			return
+		}
+		c.JSON(http.StatusNotFound, gin.H{"error": "Unknown route"})
+	})
+
+	// Switch added response latency on or off for a route that has it configured
+	admin.POST("/latency", func(c *gin.Context) {
+		var body struct {
+			Route   string `json:"route"`
+			Enabled bool   `json:"enabled"`
+		}
+		if err := c.ShouldBindJSON(&body); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request", "msg": err.Error()})
+			return
+		}
+		for _, route := range g.routes() {
+			if route.Prefix != normalizePrefix(body.Route) {
+				continue
+			}
+			if route.latency == nil {
+				c.JSON(http.StatusConflict, gin.H{"error": "No latency configured for route"})
+				return
+			}
+			route.latency.enabled.Store(body.Enabled)
+			log.Warn().Str("route", route.Prefix).Bool("enabled", body.Enabled).Str("admin", c.GetString(adminIdentityKey)).Msg("Latency injection toggled")
+			c.JSON(http.StatusOK, gin.H{"route": route.Prefix, "enabled": body.Enabled})
+			return
+		}
+		c.JSON(http.StatusNotFound, gin.H{"error": "Unknown route"})
+	})
+
+	admin.POST("/reload", func(c *gin.Context) {
+		if err := g.requestReload(); err != nil {
+			c.JSON(http.StatusUnprocessableEntity, gin.H{"error": "Reload failed", "msg": err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"routes": len(g.routes())})
+	})
+
+	if cfg.LoadEndpoint {
+		admin.GET("/load", func(c *gin.Context) {
+			routes := g.routes()
+			load := make(map[string]gin.H, len(routes))
+			for _, route := range routes {
+				load[route.id()] = gin.H{"inflight": route.inflight.Load()}
+			}
+			c.JSON(http.StatusOK, gin.H{"routes": load})
+		})
+	}
+	return nil
+}
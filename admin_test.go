@@ -0,0 +1,94 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func newAdminEngine(cfg AdminAuthConfig) *gin.Engine {
+	gin.SetMode(gin.ReleaseMode)
+	r := gin.New()
+	r.GET("/admin/whoami", AdminAuthMiddleware(cfg), func(c *gin.Context) {
+		c.String(http.StatusOK, c.GetString(adminIdentityKey))
+	})
+	return r
+}
+
+type adminRequest struct {
+	remoteAddr string
+	header     map[string]string
+	certCN     string
+}
+
+func (ar adminRequest) send(r http.Handler) (int, string) {
+	req := httptest.NewRequest(http.MethodGet, "/admin/whoami", nil)
+	if ar.remoteAddr != "" {
+		req.RemoteAddr = ar.remoteAddr
+	}
+	for k, v := range ar.header {
+		req.Header.Set(k, v)
+	}
+	if ar.certCN != "" {
+		cert := &x509.Certificate{Subject: pkix.Name{CommonName: ar.certCN}}
+		req.TLS = &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{cert}}}
+	}
+	w := serve(r, req)
+	return w.Code, w.Body.String()
+}
+
+func TestAdminAuthMethods(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		cfg      AdminAuthConfig
+		req      adminRequest
+		code     int
+		identity string
+	}{
+		{"valid bearer token", AdminAuthConfig{Token: "s3cret"}, adminRequest{header: map[string]string{"Authorization": "Bearer s3cret"}}, 200, "token"},
+		{"valid X-Admin-Token", AdminAuthConfig{Token: "s3cret"}, adminRequest{header: map[string]string{"X-Admin-Token": "s3cret"}}, 200, "token"},
+		{"invalid token", AdminAuthConfig{Token: "s3cret"}, adminRequest{header: map[string]string{"Authorization": "Bearer guess"}}, 401, ""},
+		{"missing token", AdminAuthConfig{Token: "s3cret"}, adminRequest{}, 401, ""},
+
+		{"allowed IP", AdminAuthConfig{IPAllowlist: []string{"10.0.0.0/8"}}, adminRequest{remoteAddr: "10.1.2.3:5000"}, 200, "ip:10.1.2.3"},
+		{"allowed single IP", AdminAuthConfig{IPAllowlist: []string{"192.0.2.7"}}, adminRequest{remoteAddr: "192.0.2.7:5000"}, 200, "ip:192.0.2.7"},
+		{"denied IP", AdminAuthConfig{IPAllowlist: []string{"10.0.0.0/8"}}, adminRequest{remoteAddr: "192.0.2.1:5000"}, 401, ""},
+		{"forwarded header ignored", AdminAuthConfig{IPAllowlist: []string{"10.0.0.0/8"}},
+			adminRequest{remoteAddr: "192.0.2.1:5000", header: map[string]string{"X-Forwarded-For": "10.1.2.3"}}, 401, ""},
+
+		{"allowed client cert", AdminAuthConfig{ClientCerts: []string{"ops"}}, adminRequest{certCN: "ops"}, 200, "cert:ops"},
+		{"other client cert", AdminAuthConfig{ClientCerts: []string{"ops"}}, adminRequest{certCN: "intruder"}, 401, ""},
+		{"no client cert", AdminAuthConfig{RequireCert: true}, adminRequest{}, 401, ""},
+
+		{"all: every method passes", AdminAuthConfig{Mode: "all", Token: "s3cret", IPAllowlist: []string{"10.0.0.0/8"}},
+			adminRequest{remoteAddr: "10.1.2.3:5000", header: map[string]string{"X-Admin-Token": "s3cret"}}, 200, "token,ip:10.1.2.3"},
+		{"all: one method fails", AdminAuthConfig{Mode: "all", Token: "s3cret", IPAllowlist: []string{"10.0.0.0/8"}},
+			adminRequest{remoteAddr: "192.0.2.1:5000", header: map[string]string{"X-Admin-Token": "s3cret"}}, 401, ""},
+		{"any: one method passes", AdminAuthConfig{Mode: "any", Token: "s3cret", IPAllowlist: []string{"10.0.0.0/8"}},
+			adminRequest{remoteAddr: "192.0.2.1:5000", header: map[string]string{"X-Admin-Token": "s3cret"}}, 200, "token"},
+		{"any: no method passes", AdminAuthConfig{Token: "s3cret", IPAllowlist: []string{"10.0.0.0/8"}},
+			adminRequest{remoteAddr: "192.0.2.1:5000"}, 401, ""},
+	} {
+		if err := tc.cfg.validate(); err != nil {
+			t.Fatalf("%s: %v", tc.name, err)
+		}
+		code, body := tc.req.send(newAdminEngine(tc.cfg))
+		if code != tc.code || (code == http.StatusOK && body != tc.identity) {
+			t.Errorf("%s: %d %q, want %d %q", tc.name, code, body, tc.code, tc.identity)
+		}
+	}
+}
+
+func TestAdminAuthConfigValidation(t *testing.T) {
+	if err := (AdminAuthConfig{Mode: "some"}).validate(); err == nil {
+		t.Error("unknown mode accepted")
+	}
+	if err := (AdminAuthConfig{IPAllowlist: []string{"10.0.0.0/33"}}).validate(); err == nil {
+		t.Error("invalid CIDR accepted")
+	}
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestAuditRecordsPeerAddress(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "audit.log")
+	sink, err := openAuditSink(AuditConfig{File: file})
+	if err != nil {
+		t.Fatal(err)
+	}
+	gin.SetMode(gin.ReleaseMode)
+	r := gin.New()
+	r.Use(AuditMiddleware(sink))
+	r.POST("/admin/reload", func(c *gin.Context) { c.Status(http.StatusNoContent) })
+
+	req := httptest.NewRequest(http.MethodPost, "/admin/reload", strings.NewReader(`{"force": true}`))
+	req.RemoteAddr = "198.51.100.7:4000"
+	req.Header.Set("X-Forwarded-For", "203.0.113.1")
+	serve(r, req)
+
+	line, err := os.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var record auditRecord
+	if err := json.Unmarshal(line, &record); err != nil {
+		t.Fatal(err)
+	}
+	if record.RemoteIP != "198.51.100.7" {
+		t.Fatalf("recorded remote_ip %q, want the peer address", record.RemoteIP)
+	}
+	if record.Status != http.StatusNoContent || string(record.Action) != `{"force":true}` {
+		t.Fatalf("record %+v", record)
+	}
+}
+
+// An admin action through the admin routes leaves one record with every field
+// filled in; a refused attempt is recorded too, without an admin
+func TestAuditRecordComplete(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "audit.log")
+	up := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer up.Close()
+	g, r := newTestGateway(t, "routes:\n- prefix: /f\n  target: "+up.URL+"\n  rate_limit: {rate: 1000, burst: 1000}\n"+
+		"  fault: {abort: {percent: 100, status: 500}}\n")
+	if err := registerAdminRoutes(r, AdminConfig{Auth: AdminAuthConfig{Token: "s3cret"}, Audit: AuditConfig{File: file}}, g); err != nil {
+		t.Fatal(err)
+	}
+	toggle := func(token string) {
+		req := httptest.NewRequest(http.MethodPost, "/admin/faults", strings.NewReader("{\n  \"route\": \"/f\",\n  \"enabled\": true\n}"))
+		req.RemoteAddr = "198.51.100.7:4000"
+		req.Header.Set("X-Admin-Token", token)
+		req.Header.Set("Content-Type", "application/json")
+		serve(r, req)
+	}
+	before := time.Now().UTC()
+	toggle("s3cret")
+	toggle("wrong")
+	serve(r, httptest.NewRequest(http.MethodGet, "/admin/faults", nil))
+
+	data, err := os.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("%d audit records, want one per POST: %s", len(lines), data)
+	}
+	var records [2]auditRecord
+	for i, line := range lines {
+		if err := json.Unmarshal([]byte(line), &records[i]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	done := records[0]
+	if done.Time.Before(before.Add(-time.Second)) || done.Time.After(time.Now().Add(time.Second)) {
+		t.Errorf("time %v, want the time of the request", done.Time)
+	}
+	want := auditRecord{Time: done.Time, Admin: "token", RemoteIP: "198.51.100.7", Method: http.MethodPost, Path: "/admin/faults",
+		Action: json.RawMessage(`{"route":"/f","enabled":true}`), Status: http.StatusOK}
+	got, _ := json.Marshal(done)
+	if wantJSON, _ := json.Marshal(want); string(got) != string(wantJSON) {
+		t.Errorf("record %s, want %s", got, wantJSON)
+	}
+	if refused := records[1]; refused.Admin != "" || refused.Status != http.StatusUnauthorized || refused.Path != "/admin/faults" {
+		t.Errorf("refused attempt recorded as %+v", refused)
+	}
+}
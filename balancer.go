@@ -0,0 +1,124 @@
+package main
+
+import (
+	"math"
+	"net/http"
+	"strings"
+	"sync/atomic"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Upstream members a route balances requests across: round robin, or the
+// member scoring highest when scorers are configured
+type balancer struct {
+	members []string
+	next    atomic.Uint64
+	// Requests in flight per member, counted against the member first picked
+	inflight map[string]*atomic.Int64
+	// Member attributes from scoring.upstreams
+	attributes map[string]map[string]string
+	scorers    []weightedScorer
+	// nil without health_check
+	health *poolHealth
+	// nil without failover tiers
+	failover *failover
+}
+
+func newBalancer(rc RouteConfig) *balancer {
+	members, scoring, health := rc.Pool, rc.Scoring, rc.HealthCheck
+	b := &balancer{members: members, inflight: make(map[string]*atomic.Int64, len(members)), attributes: scoring.Upstreams, failover: newFailover(rc.Prefix, rc.Failover)}
+	if health.Path != "" {
+		b.health = newPoolHealth(health, members)
+	}
+	for _, member := range members {
+		b.inflight[member] = new(atomic.Int64)
+	}
+	for _, cfg := range scoring.Scorers {
+		weight := cfg.Weight
+		if weight == 0 {
+			weight = 1
+		}
+		// Validated with the config
+		scorer, _ := scorerTypes[cfg.Type](cfg)
+		b.scorers = append(b.scorers, weightedScorer{scorer: scorer, weight: weight})
+	}
+	return b
+}
+
+// Member for a new request, counted in flight until release
+func (b *balancer) pick(c *gin.Context) string {
+	members := b.failover.candidates(b.health, b.members)
+	start := b.next.Add(1) - 1
+	member := members[start%uint64(len(members))]
+	if len(b.scorers) > 0 {
+		best := math.Inf(-1)
+		var tied []string
+		for _, candidate := range members {
+			switch score := b.score(c, candidate); {
+			case score > best:
+				best, tied = score, append(tied[:0], candidate)
+			case score == best:
+				tied = append(tied, candidate)
+			}
+		}
+		// Ties go round robin
+		member = tied[start%uint64(len(tied))]
+	}
+	b.inflight[member].Add(1)
+	return member
+}
+
+func (b *balancer) release(member string) {
+	if n, ok := b.inflight[member]; ok {
+		n.Add(-1)
+	}
+}
+
+// Member for a retry of a request that just failed on exclude: the next one
+// in rotation that isn't exclude, or exclude itself when it is the only member
+func (b *balancer) pickOther(exclude string) string {
+	members := b.failover.candidates(b.health, b.members)
+	start := b.next.Add(1) - 1
+	for i := range uint64(len(members)) {
+		if member := members[(start+i)%uint64(len(members))]; member != exclude {
+			return member
+		}
+	}
+	return exclude
+}
+
+// Health check state of the pool, nil without a pool or health_check
+func (b *balancer) healthChecks() *poolHealth {
+	if b == nil {
+		return nil
+	}
+	return b.health
+}
+
+// Member req is addressed to, "" when it went elsewhere (e.g. a debug override)
+func (b *balancer) memberOf(req *http.Request) string {
+	u := req.URL.String()
+	for _, member := range b.members {
+		// http://a:80 is no prefix of http://a:8080/x
+		if rest, ok := strings.CutPrefix(u, member); ok && (rest == "" || rest[0] == '/' || rest[0] == '?') {
+			return member
+		}
+	}
+	return ""
+}
+
+// Move a request about to be retried to another pool member
+func (route *Route) rotateUpstream(req *http.Request) {
+	if route.balancer == nil {
+		return
+	}
+	current := route.balancer.memberOf(req)
+	if current == "" {
+		return
+	}
+	next := route.balancer.pickOther(current)
+	if next != current {
+		retarget(req, next, strings.TrimPrefix(req.URL.String(), current))
+	}
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+)
+
+// Each retry of a request goes to a pool member it hasn't tried yet
+func TestRetriesRotateThroughPool(t *testing.T) {
+	var (
+		mu   sync.Mutex
+		hits []string
+	)
+	member := func(name string) string {
+		up := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			mu.Lock()
+			hits = append(hits, name)
+			mu.Unlock()
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}))
+		t.Cleanup(up.Close)
+		return up.URL
+	}
+	_, r := newTestGateway(t, "routes:\n- prefix: /p\n  pool: ['"+member("a")+"', '"+member("b")+"', '"+member("c")+"']\n"+
+		"  rate_limit: {rate: 1000, burst: 1000}\n"+
+		"  retry: {attempts: 3, on_statuses: [503], backoff: {strategy: fixed, base: 1ms}}\n")
+
+	for i := range 3 {
+		mu.Lock()
+		hits = nil
+		mu.Unlock()
+		if w := serve(r, httptest.NewRequest(http.MethodGet, "/p/", nil)); w.Code != http.StatusServiceUnavailable {
+			t.Fatalf("request %d: status %d, want the last member's 503", i+1, w.Code)
+		}
+		mu.Lock()
+		seen := map[string]bool{}
+		for _, hit := range hits {
+			seen[hit] = true
+		}
+		if len(hits) != 3 || len(seen) != 3 {
+			t.Errorf("request %d: attempts went to %v, want each member once", i+1, hits)
+		}
+		mu.Unlock()
+	}
+}
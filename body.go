@@ -0,0 +1,44 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/rs/zerolog/log"
+)
+
+// Methods whose requests shouldn't carry a body. Backends disagree on what to
+// do with one, which is also how requests get smuggled past a proxy.
+var bodylessMethods = map[string]bool{
+	http.MethodGet:    true,
+	http.MethodHead:   true,
+	http.MethodDelete: true,
+}
+
+func validateUnexpectedBody(policy string) error {
+	switch policy {
+	case "", "strip", "forward":
+		return nil
+	}
+	return fmt.Errorf("unknown unexpected_body policy %q", policy)
+}
+
+// Middleware dropping the body of GET, HEAD and DELETE requests unless the
+// route forwards them
+func UnexpectedBodyMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		req := c.Request
+		if !bodylessMethods[req.Method] || req.Body == nil || req.Body == http.NoBody || routeFromContext(c).UnexpectedBody == "forward" {
+			c.Next()
+			return
+		}
+		log.Debug().Str("method", req.Method).Str("path", req.URL.Path).Msg("Stripping request body")
+		// net/http still drains the original body before reusing the connection
+		req.Body = http.NoBody
+		req.ContentLength = 0
+		req.Header.Del("Content-Length")
+		req.Header.Del("Transfer-Encoding")
+		c.Next()
+	}
+}
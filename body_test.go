@@ -0,0 +1,39 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// A body sent with GET is dropped unless the route forwards it; POST bodies
+// go through either way
+func TestUnexpectedBody(t *testing.T) {
+	up := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		w.Write(body)
+	}))
+	defer up.Close()
+	_, r := newTestGateway(t, "routes:\n"+
+		"- prefix: /strip\n  target: "+up.URL+"\n  rate_limit: {rate: 1000, burst: 1000}\n"+
+		"- prefix: /fwd\n  target: "+up.URL+"\n  rate_limit: {rate: 1000, burst: 1000}\n  unexpected_body: forward\n")
+
+	for _, tc := range []struct{ method, path, want string }{
+		{http.MethodGet, "/strip/", ""},
+		{http.MethodDelete, "/strip/", ""},
+		{http.MethodPost, "/strip/", "payload"},
+		{http.MethodGet, "/fwd/", "payload"},
+		{http.MethodPost, "/fwd/", "payload"},
+	} {
+		w := serve(r, httptest.NewRequest(tc.method, tc.path, strings.NewReader("payload")))
+		if w.Code != http.StatusOK || w.Body.String() != tc.want {
+			t.Errorf("%s %s: status %d, upstream got %q, want %q", tc.method, tc.path, w.Code, w.Body, tc.want)
+		}
+	}
+
+	if _, err := parseConfig([]byte("routes:\n- prefix: /x\n  target: " + up.URL + "\n  unexpected_body: keep\n")); err == nil {
+		t.Error("unknown unexpected_body policy accepted")
+	}
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"slices"
+	"sync/atomic"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	"github.com/sony/gobreaker/v2"
+)
+
+// Outcomes of a proxied request that never count against the breaker
+type BreakerIgnoreConfig struct {
+	Statuses       []int `yaml:"statuses"`
+	ClientCancel   bool  `yaml:"client_cancel"`
+	ClientDeadline bool  `yaml:"client_deadline"`
+}
+
+var (
+	errClientCanceled = errors.New("client canceled request")
+	errClientDeadline = errors.New("client deadline exceeded")
+)
+
+// Returned from the breaker closure when the upstream answered with a failure
+// status. The response has already been forwarded to the client.
+type upstreamStatusError struct {
+	status int
+}
+
+func (e *upstreamStatusError) Error() string {
+	return fmt.Sprintf("upstream responded with status %d", e.status)
+}
+
+// Attribute a failed upstream call to the client when its own context ended
+func classifyClientError(ctx context.Context, err error) error {
+	// Ended by the route's size-aware timeout rather than by the client
+	if errors.Is(context.Cause(ctx), errUpstreamTimeout) {
+		return fmt.Errorf("%w: %v", errUpstreamTimeout, err)
+	}
+	switch ctx.Err() {
+	case context.Canceled:
+		return fmt.Errorf("%w: %v", errClientCanceled, err)
+	case context.DeadlineExceeded:
+		return fmt.Errorf("%w: %v", errClientDeadline, err)
+	}
+	return err
+}
+
+// Decide whether an error returned from the breaker closure is a success
+func breakerIsSuccessful(cfg BreakerConfig) func(err error) bool {
+	return func(err error) bool {
+		if err == nil {
+			return true
+		}
+		// The client stalled or left mid-body, or stopped reading the
+		// response; the upstream did nothing wrong
+		if errors.Is(err, errClientBodyTimeout) || errors.Is(err, errClientGone) || errors.Is(err, errClientWrite) {
+			return true
+		}
+		// Never sent: the deadline left no time to connect, a failed connect
+		// is cooling down or the upstream asked for a cooldown, the failure
+		// behind it already counted
+		if errors.Is(err, errConnectDeadline) || errors.Is(err, errConnectBackoff) || errors.As(err, new(*cooldownError)) {
+			return true
+		}
+		if cfg.Ignore.ClientCancel && errors.Is(err, errClientCanceled) {
+			return true
+		}
+		if cfg.Ignore.ClientDeadline && errors.Is(err, errClientDeadline) {
+			return true
+		}
+		var statusErr *upstreamStatusError
+		if errors.As(err, &statusErr) {
+			return slices.Contains(cfg.Ignore.Statuses, statusErr.status)
+		}
+		return false
+	}
+}
+
+// Whether an upstream status should be reported to the breaker
+func (cfg BreakerConfig) isFailureStatus(status int) bool {
+	return slices.Contains(cfg.FailureStatuses, status)
+}
+
+// Share of requests let through right after the breaker closed again
+const rampMinShare = 0.1
+
+// Requests shed while a just-recovered upstream ramps back up
+var errRecoveryRamp = errors.New("upstream recovering, request shed")
+
+// Traffic let through after a breaker closes again: from rampMinShare of
+// requests rising evenly to all of them over window, so a backend back from
+// an outage isn't hit by the full load at once
+type recoveryRamp struct {
+	window time.Duration
+	// When the breaker last closed, as Unix nanoseconds; 0 for no ramp
+	closed atomic.Int64
+	// Uniform in [0, 1); replaced in tests
+	rand func() float64
+	now  func() time.Time
+}
+
+// Ramp for cfg, nil without recovery_ramp
+func newRecoveryRamp(cfg BreakerConfig) *recoveryRamp {
+	if cfg.RecoveryRamp <= 0 {
+		return nil
+	}
+	return &recoveryRamp{window: cfg.RecoveryRamp, rand: rand.Float64, now: time.Now}
+}
+
+// Share of requests let through now
+func (r *recoveryRamp) share() float64 {
+	if r == nil {
+		return 1
+	}
+	closed := r.closed.Load()
+	if closed == 0 {
+		return 1
+	}
+	elapsed := r.now().Sub(time.Unix(0, closed))
+	if elapsed >= r.window {
+		r.closed.CompareAndSwap(closed, 0)
+		return 1
+	}
+	return max(rampMinShare, float64(elapsed)/float64(r.window))
+}
+
+func (r *recoveryRamp) admit() bool {
+	share := r.share()
+	return share >= 1 || r.rand() < share
+}
+
+func (r *recoveryRamp) stateChanged(from, to gobreaker.State) {
+	if r == nil {
+		return
+	}
+	switch {
+	case from == gobreaker.StateHalfOpen && to == gobreaker.StateClosed:
+		r.closed.Store(r.now().UnixNano())
+	case to == gobreaker.StateOpen:
+		r.closed.Store(0)
+	}
+}
+
+func newBreaker(name string, cfg BreakerConfig, ramp *recoveryRamp) *gobreaker.CircuitBreaker[any] {
+	maxFailures := cfg.ConsecutiveFailures
+	cbSetting := gobreaker.Settings{
+		Name: name,
+		ReadyToTrip: func(counts gobreaker.Counts) bool {
+			// consecutive_failures: 5 opens on the 5th failure in a row
+			return counts.ConsecutiveFailures >= maxFailures
+		},
+		OnStateChange: func(name string, from, to gobreaker.State) {
+			log.Printf("Circuit breaker for %s changed state from %s to %s", name, from.String(), to.String())
+			ramp.stateChanged(from, to)
+		},
+		IsSuccessful: breakerIsSuccessful(cfg),
+		MaxRequests:  cfg.MaxRequests,
+		Timeout:      cfg.Timeout,
+	}
+	return gobreaker.NewCircuitBreaker[any](cbSetting)
+}
+
+// Run fn through the route's breaker, counting the outcome: allowed or
+// rejected by an open (or saturated half-open) breaker, then success or
+// failure as the breaker judged it. Calls made while half-open also count as
+// probes; the state is read just before the call. While the route's
+// recovery ramp runs, requests beyond its share are rejected before reaching
+// the breaker.
+func (route *Route) callBreaker(fn func() (any, error)) (any, error) {
+	if !route.ramp.admit() {
+		breakerRequests.WithLabelValues(route.Prefix, "rejected").Inc()
+		return nil, errRecoveryRamp
+	}
+	probe := route.breaker.State() == gobreaker.StateHalfOpen
+	result, err := route.breaker.Execute(fn)
+	if errors.Is(err, gobreaker.ErrOpenState) || errors.Is(err, gobreaker.ErrTooManyRequests) {
+		breakerRequests.WithLabelValues(route.Prefix, "rejected").Inc()
+		return result, err
+	}
+
+	breakerRequests.WithLabelValues(route.Prefix, "allowed").Inc()
+	if probe {
+		breakerRequests.WithLabelValues(route.Prefix, "half_open_probe").Inc()
+	}
+	if breakerIsSuccessful(route.CircuitBreaker)(err) {
+		breakerRequests.WithLabelValues(route.Prefix, "success").Inc()
+	} else {
+		breakerRequests.WithLabelValues(route.Prefix, "failure").Inc()
+	}
+	return result, err
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/sony/gobreaker/v2"
+)
+
+func TestBreakerTripsOnLastConsecutiveFailure(t *testing.T) {
+	cb := newBreaker("/b", BreakerConfig{ConsecutiveFailures: 5, Timeout: time.Minute}, nil)
+	fail := func() (any, error) { return nil, errors.New("down") }
+
+	for i := 1; i < 5; i++ {
+		cb.Execute(fail)
+		if cb.State() != gobreaker.StateClosed {
+			t.Fatalf("open after %d failures, want closed until the 5th", i)
+		}
+	}
+	cb.Execute(fail)
+	if cb.State() != gobreaker.StateOpen {
+		t.Fatalf("%s after 5 failures, want open", cb.State())
+	}
+}
+
+// Driving a route's breaker closed -> open -> half-open -> closed moves each
+// outcome counter by the requests that had it
+func TestBreakerOutcomeCounters(t *testing.T) {
+	g, _ := newTestGateway(t, "routes:\n- prefix: /bo\n  target: http://127.0.0.1:1\n  rate_limit: {rate: 1000, burst: 1000}\n"+
+		"  circuit_breaker: {consecutive_failures: 2, timeout: 100ms, max_requests: 1}\n")
+	route := g.routes()[0]
+	outcomes := []string{"allowed", "rejected", "success", "failure", "half_open_probe"}
+	last := map[string]float64{}
+	for _, outcome := range outcomes {
+		last[outcome] = counterValue(t, breakerRequests.WithLabelValues("/bo", outcome))
+	}
+	expect := func(step string, want map[string]float64) {
+		t.Helper()
+		for _, outcome := range outcomes {
+			now := counterValue(t, breakerRequests.WithLabelValues("/bo", outcome))
+			if now-last[outcome] != want[outcome] {
+				t.Errorf("%s: %s moved by %v, want %v", step, outcome, now-last[outcome], want[outcome])
+			}
+			last[outcome] = now
+		}
+	}
+	ok := func() (any, error) { return nil, nil }
+	fail := func() (any, error) { return nil, errors.New("down") }
+
+	route.callBreaker(ok)
+	expect("closed, success", map[string]float64{"allowed": 1, "success": 1})
+	route.callBreaker(fail)
+	route.callBreaker(fail)
+	expect("closed, two failures", map[string]float64{"allowed": 2, "failure": 2})
+	if route.breaker.State() != gobreaker.StateOpen {
+		t.Fatalf("%s after 2 failures, want open", route.breaker.State())
+	}
+	route.callBreaker(ok)
+	expect("open", map[string]float64{"rejected": 1})
+
+	time.Sleep(150 * time.Millisecond)
+	route.callBreaker(ok)
+	expect("half-open probe", map[string]float64{"allowed": 1, "half_open_probe": 1, "success": 1})
+	if route.breaker.State() != gobreaker.StateClosed {
+		t.Fatalf("%s after a successful probe, want closed", route.breaker.State())
+	}
+}
+
+// A client hanging up halfway through a large response is no failure of the
+// upstream: the breaker, tripping on a single failure, stays closed
+func TestClientDisconnectMidResponseSparesBreaker(t *testing.T) {
+	up := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		chunk := bytes.Repeat([]byte("x"), 64<<10)
+		for range 1024 {
+			if _, err := w.Write(chunk); err != nil {
+				return
+			}
+		}
+	}))
+	defer up.Close()
+	g, r := newTestGateway(t, "routes:\n- prefix: /big\n  target: "+up.URL+"\n  rate_limit: {rate: 1000, burst: 1000}\n"+
+		"  circuit_breaker: {consecutive_failures: 1, timeout: 1m}\n")
+	gw := httptest.NewServer(r)
+	defer gw.Close()
+	route := g.routes()[0]
+	writeErrors, disconnects := clientWriteErrors.WithLabelValues("/big"), requestTimeouts.WithLabelValues("/big", "client_disconnect")
+	before := counterValue(t, writeErrors) + counterValue(t, disconnects)
+
+	conn, err := net.Dial("tcp", gw.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.WriteString(conn, "GET /big/ HTTP/1.1\r\nHost: gw\r\n\r\n")
+	if _, err := io.ReadFull(conn, make([]byte, 256<<10)); err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+
+	// Counted against the client once the gateway notices
+	for deadline := time.Now().Add(5 * time.Second); counterValue(t, writeErrors)+counterValue(t, disconnects) == before; time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("the client's departure was never counted")
+		}
+	}
+	if failures := route.breaker.Counts().TotalFailures; failures != 0 || route.breaker.State() != gobreaker.StateClosed {
+		t.Errorf("breaker %s with %d failures, want closed and none", route.breaker.State(), failures)
+	}
+	if w := serve(r, httptest.NewRequest(http.MethodHead, "/big/", nil)); w.Code != http.StatusOK {
+		t.Errorf("next request: status %d, want it let through", w.Code)
+	}
+}
+
+// Once the breaker closes again, the share of requests let through rises
+// from a tenth to all of them over recovery_ramp instead of jumping back
+func TestBreakerRecoveryRamp(t *testing.T) {
+	var failing atomic.Bool
+	up := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if failing.Load() {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+	defer up.Close()
+	g, r := newTestGateway(t, "routes:\n- prefix: /ramp\n  target: "+up.URL+"\n  rate_limit: {rate: 100000, burst: 100000}\n"+
+		"  circuit_breaker: {consecutive_failures: 1, max_requests: 1, timeout: 50ms, failure_statuses: [500], recovery_ramp: 1m}\n")
+	route := g.routes()[0]
+	clock := newFakeClock()
+	// Evenly spread draws: exactly share*100 of every 100 requests pass
+	var draws int
+	route.ramp.now = clock.now
+	route.ramp.rand = func() float64 {
+		draws++
+		return float64(draws%100) / 100
+	}
+	passed := func() int {
+		ok := 0
+		for range 100 {
+			if serve(r, httptest.NewRequest(http.MethodGet, "/ramp/", nil)).Code == http.StatusOK {
+				ok++
+			}
+		}
+		return ok
+	}
+
+	failing.Store(true)
+	serve(r, httptest.NewRequest(http.MethodGet, "/ramp/", nil))
+	if route.breaker.State() != gobreaker.StateOpen {
+		t.Fatalf("breaker %s after a failure, want open", route.breaker.State())
+	}
+	failing.Store(false)
+	time.Sleep(60 * time.Millisecond)
+	// The half-open probe succeeds and closes the breaker
+	if w := serve(r, httptest.NewRequest(http.MethodGet, "/ramp/", nil)); w.Code != http.StatusOK || route.breaker.State() != gobreaker.StateClosed {
+		t.Fatalf("probe: %d, breaker %s, want it closed", w.Code, route.breaker.State())
+	}
+
+	for _, step := range []struct {
+		after time.Duration
+		want  int
+	}{
+		{0, 10},
+		{15 * time.Second, 25},
+		{15 * time.Second, 50},
+		{31 * time.Second, 100},
+	} {
+		clock.advance(step.after)
+		if got := passed(); got != step.want {
+			t.Errorf("%s into the ramp: %d of 100 let through, want %d", clock.t.Sub(newFakeClock().t), got, step.want)
+		}
+	}
+}
@@ -0,0 +1,295 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Caps concurrent requests per route and queues the overflow
+type BulkheadConfig struct {
+	MaxConcurrent int             `yaml:"max_concurrent"`
+	MaxQueue      int             `yaml:"max_queue"`
+	QueueTimeout  time.Duration   `yaml:"queue_timeout"`
+	Fair          FairQueueConfig `yaml:"fair_queue"`
+	Priority      PriorityConfig  `yaml:"priority"`
+}
+
+// Queue priority taken from a request header: waiters of a higher level are
+// served first, and may take the queue slot of a lower one when it is full
+type PriorityConfig struct {
+	Header string `yaml:"header"`
+	// Header value -> level; higher levels go first
+	Levels map[string]int `yaml:"levels"`
+	// Level of requests without one of the values
+	Default int `yaml:"default"`
+}
+
+func (cfg PriorityConfig) level(c *gin.Context) int {
+	if cfg.Header == "" {
+		return 0
+	}
+	if level, ok := cfg.Levels[c.GetHeader(cfg.Header)]; ok {
+		return level
+	}
+	return cfg.Default
+}
+
+// Weighted fair sharing of the queue between clients
+type FairQueueConfig struct {
+	Enabled bool `yaml:"enabled"`
+	// "ip" (default) or "header:<name>"
+	Key     string         `yaml:"key"`
+	Weights map[string]int `yaml:"weights"`
+}
+
+var (
+	errBulkheadFull    = errors.New("bulkhead queue full")
+	errBulkheadTimeout = errors.New("bulkhead queue timeout")
+	errBulkheadEvicted = errors.New("bulkhead queue slot reclaimed")
+)
+
+type bulkheadWaiter struct {
+	client   string
+	priority int
+	// Receives nil when the waiter got a slot, or the reason it was dropped
+	done chan error
+}
+
+type clientQueue struct {
+	waiters []*bulkheadWaiter
+	weight  float64
+	// Virtual finish time of the last request served; lowest goes first
+	vtime float64
+}
+
+type bulkhead struct {
+	cfg BulkheadConfig
+
+	mu      sync.Mutex
+	active  int
+	queued  int
+	clients map[string]*clientQueue
+	// Virtual time of the most recently dispatched request
+	vclock float64
+}
+
+func newBulkhead(cfg BulkheadConfig) *bulkhead {
+	return &bulkhead{cfg: cfg, clients: make(map[string]*clientQueue)}
+}
+
+func (b *bulkhead) weight(client string) float64 {
+	if w, ok := b.cfg.Fair.Weights[client]; ok && w > 0 {
+		return float64(w)
+	}
+	return 1
+}
+
+// Queue slots client may hold, sharing with everyone waiting plus the arriving client
+func (b *bulkhead) fairShare(client, arriving string) float64 {
+	total := b.weight(client)
+	for name, q := range b.clients {
+		if name != client && (len(q.waiters) > 0 || name == arriving) {
+			total += q.weight
+		}
+	}
+	return float64(b.cfg.MaxQueue) * b.weight(client) / total
+}
+
+// Drop the newest waiter of the client furthest above its share, if any is above it
+func (b *bulkhead) evictFor(client string) bool {
+	var victim *clientQueue
+	worst := 0.0
+	for name, q := range b.clients {
+		if name == client || len(q.waiters) == 0 {
+			continue
+		}
+		over := float64(len(q.waiters)) - b.fairShare(name, client)
+		if over > worst {
+			worst, victim = over, q
+		}
+	}
+	if victim == nil {
+		return false
+	}
+	last := victim.waiters[len(victim.waiters)-1]
+	victim.waiters = victim.waiters[:len(victim.waiters)-1]
+	b.queued--
+	last.done <- errBulkheadEvicted
+	return true
+}
+
+// Drop a waiter of the lowest level below priority, the newest of its client
+func (b *bulkhead) evictBelow(priority int) bool {
+	var victim *clientQueue
+	at := -1
+	for _, q := range b.clients {
+		for i, w := range q.waiters {
+			if w.priority >= priority {
+				continue
+			}
+			if victim == nil || w.priority < victim.waiters[at].priority ||
+				(w.priority == victim.waiters[at].priority && q == victim && i > at) {
+				victim, at = q, i
+			}
+		}
+	}
+	if victim == nil {
+		return false
+	}
+	w := victim.waiters[at]
+	victim.waiters = append(victim.waiters[:at], victim.waiters[at+1:]...)
+	b.queued--
+	w.done <- errBulkheadEvicted
+	return true
+}
+
+// Free a queue slot for a client arriving at a full queue: from a client
+// above its fair share, or from a lower priority waiter
+func (b *bulkhead) makeRoom(client string, q *clientQueue, priority int) bool {
+	if b.cfg.Fair.Enabled && float64(len(q.waiters)+1) <= b.fairShare(client, client) && b.evictFor(client) {
+		return true
+	}
+	return b.evictBelow(priority)
+}
+
+// Wait for a slot; the caller must call release once done
+func (b *bulkhead) acquire(ctx context.Context, client string, priority int) error {
+	if !b.cfg.Fair.Enabled {
+		client = ""
+	}
+
+	b.mu.Lock()
+	if b.active < b.cfg.MaxConcurrent && b.queued == 0 {
+		b.active++
+		b.mu.Unlock()
+		return nil
+	}
+
+	q := b.clients[client]
+	if q == nil {
+		q = &clientQueue{weight: b.weight(client)}
+		b.clients[client] = q
+	}
+
+	if b.queued >= b.cfg.MaxQueue && !b.makeRoom(client, q, priority) {
+		b.mu.Unlock()
+		return errBulkheadFull
+	}
+
+	if len(q.waiters) == 0 {
+		// An idle client doesn't bank credit while away
+		q.vtime = max(q.vtime, b.vclock)
+	}
+	w := &bulkheadWaiter{client: client, priority: priority, done: make(chan error, 1)}
+	q.waiters = append(q.waiters, w)
+	b.queued++
+	b.mu.Unlock()
+
+	var timeout <-chan time.Time
+	if b.cfg.QueueTimeout > 0 {
+		timer := time.NewTimer(b.cfg.QueueTimeout)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	select {
+	case err := <-w.done:
+		return err
+	case <-ctx.Done():
+		return b.abandon(w, ctx.Err())
+	case <-timeout:
+		return b.abandon(w, errBulkheadTimeout)
+	}
+}
+
+// Remove a waiter that gave up; if it was granted a slot meanwhile, hand it back
+func (b *bulkhead) abandon(w *bulkheadWaiter, reason error) error {
+	b.mu.Lock()
+	q := b.clients[w.client]
+	for i, queued := range q.waiters {
+		if queued == w {
+			q.waiters = append(q.waiters[:i], q.waiters[i+1:]...)
+			b.queued--
+			b.mu.Unlock()
+			return reason
+		}
+	}
+	b.mu.Unlock()
+
+	if err := <-w.done; err == nil {
+		b.release()
+	}
+	return reason
+}
+
+// Pick the next waiter: highest priority first, then lowest virtual time
+// across clients, FIFO within a client
+func (b *bulkhead) next() *bulkheadWaiter {
+	var pick *clientQueue
+	at, top := -1, 0
+	for _, q := range b.clients {
+		for i, w := range q.waiters {
+			if pick == nil || w.priority > top || (w.priority == top && q != pick && q.vtime < pick.vtime) {
+				pick, at, top = q, i, w.priority
+			}
+		}
+	}
+	if pick == nil {
+		return nil
+	}
+	w := pick.waiters[at]
+	pick.waiters = append(pick.waiters[:at], pick.waiters[at+1:]...)
+	b.queued--
+	pick.vtime += 1 / pick.weight
+	b.vclock = pick.vtime
+	return w
+}
+
+func (b *bulkhead) release() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if w := b.next(); w != nil {
+		// The slot passes straight to the waiter
+		w.done <- nil
+		return
+	}
+	b.active--
+
+	// Forget idle clients so the map doesn't grow with every caller
+	for name, q := range b.clients {
+		if len(q.waiters) == 0 && q.vtime <= b.vclock {
+			delete(b.clients, name)
+		}
+	}
+}
+
+// Identify the client a request is queued for
+func bulkheadClient(c *gin.Context, cfg FairQueueConfig) string {
+	return clientKey(c, cfg.Key)
+}
+
+// Middleware limiting concurrent requests per route
+func BulkheadMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		bh := routeFromContext(c).bulkhead
+		if bh == nil {
+			c.Next()
+			return
+		}
+
+		if err := bh.acquire(c.Request.Context(), bulkheadClient(c, bh.cfg.Fair), bh.cfg.Priority.level(c)); err != nil {
+			sendLogToLoki("Bulkhead rejected request", map[string]string{"level": "warn", "path": c.Request.URL.Path})
+			c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Too many concurrent requests", "msg": err.Error()})
+			c.Abort()
+			return
+		}
+		defer bh.release()
+		c.Next()
+	}
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+// Queue a waiter for client at priority and return once the bulkhead holds
+// it. What acquire returned is sent on result. Without fair queueing all
+// clients share one queue, told apart here by priority.
+func enqueue(t *testing.T, b *bulkhead, client string, priority int, result chan<- [2]string) {
+	t.Helper()
+	key := client
+	if !b.cfg.Fair.Enabled {
+		key = ""
+	}
+	waiting := func() int {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		n := 0
+		if q := b.clients[key]; q != nil {
+			for _, w := range q.waiters {
+				if w.priority == priority {
+					n++
+				}
+			}
+		}
+		return n
+	}
+	before := waiting()
+	go func() {
+		err := b.acquire(context.Background(), client, priority)
+		outcome := "served"
+		if err != nil {
+			outcome = err.Error()
+		}
+		result <- [2]string{client, outcome}
+	}()
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(time.Millisecond) {
+		if waiting() > before {
+			return
+		}
+	}
+	t.Fatalf("%s never queued", client)
+}
+
+// A client that filled the queue gives up its newest slots to a newcomer down
+// to a fair share, and the queue is then served alternately
+func TestBulkheadFairQueue(t *testing.T) {
+	b := newBulkhead(BulkheadConfig{MaxConcurrent: 1, MaxQueue: 4, Fair: FairQueueConfig{Enabled: true}})
+	if err := b.acquire(context.Background(), "holder", 0); err != nil {
+		t.Fatal(err)
+	}
+	results := make(chan [2]string, 10)
+	for range 4 {
+		enqueue(t, b, "a", 0, results)
+	}
+
+	// Each newcomer takes a slot from a, until both hold an equal share
+	for range 2 {
+		enqueue(t, b, "b", 0, results)
+		if got := <-results; got != [2]string{"a", errBulkheadEvicted.Error()} {
+			t.Fatalf("b arriving at a full queue: %v, want one of a's waiters evicted", got)
+		}
+	}
+	if err := b.acquire(context.Background(), "b", 0); !errors.Is(err, errBulkheadFull) {
+		t.Fatalf("b beyond its share: %v, want %v", err, errBulkheadFull)
+	}
+
+	var order []string
+	served := map[string]int{}
+	for range 4 {
+		b.release()
+		got := <-results
+		if got[1] != "served" {
+			t.Fatalf("queued %s: %s", got[0], got[1])
+		}
+		order = append(order, got[0])
+		served[got[0]]++
+		if d := served["a"] - served["b"]; d < -1 || d > 1 {
+			t.Fatalf("served %v, want the clients taking turns", order)
+		}
+	}
+}
+
+// Weights divide the queue in proportion
+func TestBulkheadFairQueueWeights(t *testing.T) {
+	b := newBulkhead(BulkheadConfig{MaxConcurrent: 1, MaxQueue: 4, Fair: FairQueueConfig{Enabled: true, Weights: map[string]int{"b": 3}}})
+	if err := b.acquire(context.Background(), "holder", 0); err != nil {
+		t.Fatal(err)
+	}
+	results := make(chan [2]string, 10)
+	for range 4 {
+		enqueue(t, b, "a", 0, results)
+	}
+	for range 3 {
+		enqueue(t, b, "b", 0, results)
+	}
+	for range 3 {
+		if got := <-results; got != [2]string{"a", errBulkheadEvicted.Error()} {
+			t.Fatalf("b arriving at a full queue: %v, want one of a's waiters evicted", got)
+		}
+	}
+	if err := b.acquire(context.Background(), "b", 0); !errors.Is(err, errBulkheadFull) {
+		t.Fatalf("b beyond its weighted share: %v, want %v", err, errBulkheadFull)
+	}
+	for range 4 {
+		b.release()
+		<-results
+	}
+}
+
+// A high priority request arriving at a full queue takes the slot of the
+// newest low priority waiter and is served before those queued earlier
+func TestBulkheadPriority(t *testing.T) {
+	b := newBulkhead(BulkheadConfig{MaxConcurrent: 1, MaxQueue: 3})
+	if err := b.acquire(context.Background(), "holder", 0); err != nil {
+		t.Fatal(err)
+	}
+	results := make(chan [2]string, 10)
+	for _, name := range []string{"low1", "low2", "low3"} {
+		enqueue(t, b, name, 0, results)
+	}
+	enqueue(t, b, "high", 10, results)
+	if got := <-results; got != [2]string{"low3", errBulkheadEvicted.Error()} {
+		t.Fatalf("high arriving at a full queue: %v, want the newest low waiter evicted", got)
+	}
+	if err := b.acquire(context.Background(), "low4", 0); !errors.Is(err, errBulkheadFull) {
+		t.Fatalf("low arriving at a queue of equal or higher levels: %v, want %v", err, errBulkheadFull)
+	}
+
+	for _, want := range []string{"high", "low1", "low2"} {
+		b.release()
+		if got := <-results; got != [2]string{want, "served"} {
+			t.Fatalf("served %v, want %s", got, want)
+		}
+	}
+}
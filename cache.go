@@ -0,0 +1,379 @@
+package main
+
+import (
+	"bytes"
+	"container/list"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/rs/zerolog/log"
+	"github.com/sony/gobreaker/v2"
+)
+
+// In-memory caching of successful GET/HEAD responses
+type CacheConfig struct {
+	TTL time.Duration `yaml:"ttl"`
+	// How long past TTL an entry is still served, marked X-Cache: STALE, while
+	// one background request refreshes it. Not on routes transforming the
+	// upstream request after the cache, see refreshSkippedTransforms.
+	StaleWhileRevalidate time.Duration  `yaml:"stale_while_revalidate"`
+	MaxEntries           int            `yaml:"max_entries"`
+	MaxBody              int            `yaml:"max_body_bytes"`
+	Key                  CacheKeyConfig `yaml:"key"`
+}
+
+// What distinguishes two requests for the cache besides method and path
+type CacheKeyConfig struct {
+	// Request headers whose values become part of the key
+	Headers []string `yaml:"headers"`
+	// Query parameters left out of the key, such as cache busters
+	IgnoreQuery []string `yaml:"ignore_query"`
+}
+
+// Request transforms of rc applied by the handlers after CacheMiddleware,
+// which a background refresh doesn't run: it would store a response to a
+// different request than the route's clients get theirs from
+func refreshSkippedTransforms(rc RouteConfig) []string {
+	var names []string
+	for name, set := range map[string]bool{
+		"method_map":         len(rc.MethodMap) > 0,
+		"path_normalization": rc.PathNormalization.enabled(),
+		"geo_headers":        rc.GeoHeaders,
+		"cookie_headers":     len(rc.CookieHeaders) > 0,
+		"wasm":               rc.WASM.Module != "",
+		"header_limit":       rc.HeaderLimit.MaxSize > 0,
+		"timestamp":          rc.Timestamp.Enabled,
+	} {
+		if set {
+			names = append(names, name)
+		}
+	}
+	slices.Sort(names)
+	return names
+}
+
+func (cfg CacheConfig) validate(rc RouteConfig) error {
+	if names := refreshSkippedTransforms(rc); cfg.StaleWhileRevalidate > 0 && len(names) > 0 {
+		return fmt.Errorf("cache: stale_while_revalidate can't be combined with %s, its background refresh doesn't apply them", strings.Join(names, ", "))
+	}
+	return nil
+}
+
+type cacheEntry struct {
+	key     string
+	status  int
+	header  http.Header
+	body    []byte
+	expires time.Time
+	// Set once a background refresh of the stale entry started
+	refreshing atomic.Bool
+}
+
+type responseCache struct {
+	cfg CacheConfig
+
+	mu      sync.Mutex
+	entries map[string]*list.Element
+	lru     *list.List
+}
+
+func newResponseCache(cfg CacheConfig) *responseCache {
+	if cfg.MaxEntries <= 0 {
+		cfg.MaxEntries = 1000
+	}
+	if cfg.MaxBody <= 0 {
+		cfg.MaxBody = 1 << 20
+	}
+	return &responseCache{cfg: cfg, entries: make(map[string]*list.Element), lru: list.New()}
+}
+
+// Build the cache key from method, path, the query minus ignored params and the configured headers
+func (rc *responseCache) key(r *http.Request) string {
+	var b strings.Builder
+	b.WriteString(r.Method)
+	b.WriteByte(' ')
+	b.WriteString(r.URL.Path)
+
+	query := r.URL.Query()
+	for _, name := range rc.cfg.Key.IgnoreQuery {
+		query.Del(name)
+	}
+	if len(query) > 0 {
+		// Encode sorts by key; sort values too so ordering doesn't split entries
+		for _, values := range query {
+			sort.Strings(values)
+		}
+		b.WriteByte('?')
+		b.WriteString(query.Encode())
+	}
+
+	for _, name := range rc.cfg.Key.Headers {
+		b.WriteByte('\n')
+		b.WriteString(http.CanonicalHeaderKey(name))
+		b.WriteByte(':')
+		b.WriteString(url.QueryEscape(strings.Join(r.Header.Values(name), ",")))
+	}
+	return b.String()
+}
+
+// Entry for key, fresh or within the stale-while-revalidate window
+func (rc *responseCache) get(key string) (entry *cacheEntry, stale bool, ok bool) {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	el, ok := rc.entries[key]
+	if !ok {
+		return nil, false, false
+	}
+	entry = el.Value.(*cacheEntry)
+	now := time.Now()
+	if now.After(entry.expires.Add(rc.cfg.StaleWhileRevalidate)) {
+		rc.lru.Remove(el)
+		delete(rc.entries, key)
+		return nil, false, false
+	}
+	rc.lru.MoveToFront(el)
+	return entry, now.After(entry.expires), true
+}
+
+func (rc *responseCache) set(entry *cacheEntry) {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	if el, ok := rc.entries[entry.key]; ok {
+		el.Value = entry
+		rc.lru.MoveToFront(el)
+		return
+	}
+	rc.entries[entry.key] = rc.lru.PushFront(entry)
+	for rc.lru.Len() > rc.cfg.MaxEntries {
+		oldest := rc.lru.Back()
+		rc.lru.Remove(oldest)
+		delete(rc.entries, oldest.Value.(*cacheEntry).key)
+	}
+}
+
+// Whether the response to req may be stored in the shared cache. Responses
+// varying on headers the key doesn't hold are not: all clients would get one
+// variant. Neither are responses to requests with credentials the key doesn't
+// hold, unless the upstream marked them shared (RFC 9111 section 3.5).
+func (rc *responseCache) cacheable(req *http.Request, status int, header http.Header) bool {
+	if status != http.StatusOK || header.Get("Set-Cookie") != "" {
+		return false
+	}
+	directives := cacheDirectives(header)
+	if directives["no-store"] || directives["private"] {
+		return false
+	}
+	for _, value := range header.Values("Vary") {
+		for _, name := range strings.Split(value, ",") {
+			if name = strings.TrimSpace(name); name != "" && (name == "*" || !rc.keyed(name)) {
+				return false
+			}
+		}
+	}
+	shared := directives["public"] || directives["s-maxage"] || directives["must-revalidate"]
+	for _, name := range []string{"Authorization", "Cookie"} {
+		if req.Header.Get(name) != "" && !rc.keyed(name) && !shared {
+			return false
+		}
+	}
+	return true
+}
+
+// Whether the key holds the request header name
+func (rc *responseCache) keyed(name string) bool {
+	return slices.ContainsFunc(rc.cfg.Key.Headers, func(h string) bool { return strings.EqualFold(h, name) })
+}
+
+// Cache-Control directive names of a response, lowercased
+func cacheDirectives(header http.Header) map[string]bool {
+	directives := make(map[string]bool)
+	for _, value := range header.Values("Cache-Control") {
+		for _, directive := range strings.Split(value, ",") {
+			name, _, _ := strings.Cut(directive, "=")
+			if name = strings.ToLower(strings.TrimSpace(name)); name != "" {
+				directives[name] = true
+			}
+		}
+	}
+	return directives
+}
+
+// Response writer keeping a copy of the body for the cache
+type cacheWriter struct {
+	gin.ResponseWriter
+	buf      bytes.Buffer
+	limit    int
+	overflow bool
+}
+
+func (w *cacheWriter) Write(p []byte) (int, error) {
+	if !w.overflow {
+		if w.buf.Len()+len(p) > w.limit {
+			w.overflow = true
+			w.buf.Reset()
+		} else {
+			w.buf.Write(p)
+		}
+	}
+	return w.ResponseWriter.Write(p)
+}
+
+func (w *cacheWriter) WriteString(s string) (int, error) {
+	return w.Write([]byte(s))
+}
+
+func (w *cacheWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+func writeCached(c *gin.Context, entry *cacheEntry, state string) {
+	for k, v := range entry.header {
+		c.Writer.Header()[k] = v
+	}
+	c.Header("X-Cache", state)
+	c.Status(entry.status)
+	if c.Request.Method != http.MethodHead {
+		c.Writer.Write(entry.body)
+	}
+}
+
+// Middleware serving and filling the route's response cache
+func CacheMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		route := routeFromContext(c)
+		cache := route.cache
+		// Debug upstreams must not leak into the shared cache
+		if cache == nil || (c.Request.Method != http.MethodGet && c.Request.Method != http.MethodHead) || c.GetBool(debugUpstreamKey) {
+			c.Next()
+			return
+		}
+
+		key := cache.key(c.Request)
+		// A/B variants and schedule windows are served by different upstreams
+		if variant := c.GetString(abVariantKey); variant != "" {
+			key += "\nvariant:" + variant
+		}
+		if window := c.GetString(scheduleWindowKey); window != "" {
+			key += "\nwindow:" + window
+		}
+		// So are clients with different feature flags
+		if flags := c.GetString(featureFlagsKey); flags != "" {
+			key += "\nflags:" + flags
+		}
+		if entry, stale, ok := cache.get(key); ok {
+			if !stale {
+				writeCached(c, entry, "HIT")
+				c.Abort()
+				return
+			}
+			if entry.refreshing.CompareAndSwap(false, true) {
+				go cache.refresh(c.Copy(), route, entry, upstreamTarget(c, route)+upstreamPath(c, route))
+			}
+			writeCached(c, entry, "STALE")
+			c.Abort()
+			return
+		}
+
+		c.Header("X-Cache", "MISS")
+		writer := &cacheWriter{ResponseWriter: c.Writer, limit: cache.cfg.MaxBody}
+		c.Writer = writer
+		c.Next()
+		c.Writer = writer.ResponseWriter
+
+		header := c.Writer.Header().Clone()
+		if writer.overflow || !cache.cacheable(c.Request, c.Writer.Status(), header) {
+			return
+		}
+		header.Del("X-Cache")
+		cache.set(&cacheEntry{
+			key:     key,
+			status:  c.Writer.Status(),
+			header:  header,
+			body:    slices.Clone(writer.buf.Bytes()),
+			expires: time.Now().Add(cache.cfg.TTL),
+		})
+	}
+}
+
+// Fetch a stale entry's response from the upstream outside of any client
+// request and store it if it is still cacheable. c is a copy of the context
+// of the request that found the entry stale. The fetch goes through the
+// route's breaker like client requests, so a failing upstream isn't refreshed
+// while its circuit is open.
+func (rc *responseCache) refresh(c *gin.Context, route *Route, stale *cacheEntry, target string) {
+	// A failed refresh leaves the entry to the next stale hit
+	defer stale.refreshing.Store(false)
+
+	ctx, cancel := context.WithTimeout(context.Background(), route.Timeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, c.Request.Method, target, nil)
+	if err != nil {
+		return
+	}
+	req.Header = c.Request.Header.Clone()
+	if route.Decompression.Enabled {
+		req.Header.Set("Accept-Encoding", "gzip")
+	}
+	token, err := route.upstreamToken(ctx)
+	if err != nil {
+		log.Warn().Err(err).Str("route", route.Prefix).Msg("Background cache refresh failed")
+		return
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	var resp *http.Response
+	_, err = route.callBreaker(func() (any, error) {
+		var err error
+		resp, err = route.send(req)
+		if err != nil {
+			return nil, err
+		}
+		if route.CircuitBreaker.isFailureStatus(resp.StatusCode) {
+			return nil, &upstreamStatusError{status: resp.StatusCode}
+		}
+		return nil, nil
+	})
+	if resp != nil {
+		defer resp.Body.Close()
+	}
+	if errors.Is(err, gobreaker.ErrOpenState) || errors.Is(err, gobreaker.ErrTooManyRequests) || errors.Is(err, errRecoveryRamp) {
+		log.Debug().Str("route", route.Prefix).Msg("Background cache refresh skipped, circuit breaker not letting requests through")
+		return
+	}
+	if err != nil {
+		log.Warn().Err(err).Str("route", route.Prefix).Msg("Background cache refresh failed")
+		return
+	}
+	for _, modify := range route.modifyResponse {
+		if err := modify(c, resp); err != nil {
+			return
+		}
+	}
+	normalizeFraming(resp)
+	body, err := io.ReadAll(io.LimitReader(resp.Body, int64(rc.cfg.MaxBody)+1))
+	if err != nil || len(body) > rc.cfg.MaxBody || !rc.cacheable(c.Request, resp.StatusCode, resp.Header) {
+		// Keeps serving the stale entry until its window ends
+		log.Debug().Str("route", route.Prefix).Int("status", resp.StatusCode).Msg("Background cache refresh not stored")
+		return
+	}
+	rc.set(&cacheEntry{
+		key:     stale.key,
+		status:  resp.StatusCode,
+		header:  resp.Header.Clone(),
+		body:    body,
+		expires: time.Now().Add(rc.cfg.TTL),
+	})
+}
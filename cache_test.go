@@ -0,0 +1,263 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/sony/gobreaker/v2"
+)
+
+func newCacheTestGateway(t *testing.T, keyHeaders string) (http.Handler, *atomic.Int64) {
+	t.Helper()
+	var hits atomic.Int64
+	up := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		switch r.URL.Path {
+		case "/public":
+			w.Header().Set("Cache-Control", "public, max-age=60")
+		case "/vary":
+			w.Header().Set("Vary", "Accept-Language")
+		case "/vary-star":
+			w.Header().Set("Vary", "*")
+		}
+		w.Write([]byte("auth=" + r.Header.Get("Authorization") + " cookie=" + r.Header.Get("Cookie") + " lang=" + r.Header.Get("Accept-Language")))
+	}))
+	t.Cleanup(up.Close)
+	_, r := newTestGateway(t, "routes:\n- prefix: /c\n  target: "+up.URL+"\n  rate_limit: {rate: 1000, burst: 1000}\n  cache: {ttl: 1m, key: {headers: "+keyHeaders+"}}\n")
+	return r, &hits
+}
+
+func get(h http.Handler, path string, header ...string) (string, string) {
+	req := httptest.NewRequest(http.MethodGet, path, nil)
+	for i := 0; i+1 < len(header); i += 2 {
+		req.Header.Set(header[i], header[i+1])
+	}
+	w := serve(h, req)
+	return w.Body.String(), w.Header().Get("X-Cache")
+}
+
+func TestCacheKey(t *testing.T) {
+	rc := newResponseCache(CacheConfig{Key: CacheKeyConfig{Headers: []string{"accept-language", "X-Tenant"}, IgnoreQuery: []string{"_", "utm_source"}}})
+	key := func(target string, header ...string) string {
+		req := httptest.NewRequest(http.MethodGet, target, nil)
+		for i := 0; i+1 < len(header); i += 2 {
+			req.Header.Add(header[i], header[i+1])
+		}
+		return rc.key(req)
+	}
+
+	base := key("/items?page=2", "Accept-Language", "de", "X-Tenant", "acme")
+	for _, tc := range []struct {
+		name string
+		key  string
+		same bool
+	}{
+		{"ignored params", key("/items?page=2&_=1697040000&utm_source=mail", "Accept-Language", "de", "X-Tenant", "acme"), true},
+		{"unkeyed header", key("/items?page=2", "Accept-Language", "de", "X-Tenant", "acme", "User-Agent", "curl"), true},
+		{"other keyed header value", key("/items?page=2", "Accept-Language", "fr", "X-Tenant", "acme"), false},
+		{"keyed header missing", key("/items?page=2", "Accept-Language", "de"), false},
+		{"other param", key("/items?page=3", "Accept-Language", "de", "X-Tenant", "acme"), false},
+	} {
+		if same := tc.key == base; same != tc.same {
+			t.Errorf("%s: key %q, base %q, same %v, want %v", tc.name, tc.key, base, same, tc.same)
+		}
+	}
+
+	if key("/items?a=1&b=2&a=0") != key("/items?b=2&a=0&a=1") {
+		t.Error("query parameter order splits the key")
+	}
+}
+
+func TestCacheKeepsAuthorizedResponsesPerUser(t *testing.T) {
+	r, _ := newCacheTestGateway(t, "[]")
+
+	for _, credential := range []string{"Authorization", "Cookie"} {
+		path := "/c/private-" + credential
+		get(r, path, credential, "alice")
+		if body, state := get(r, path, credential, "bob"); state == "HIT" {
+			t.Fatalf("%s: bob got alice's cached response %q", credential, body)
+		}
+		if body, _ := get(r, path); body != "auth= cookie= lang=" {
+			t.Fatalf("%s: anonymous request got %q", credential, body)
+		}
+	}
+}
+
+func TestCacheStoresSharedAuthorizedResponses(t *testing.T) {
+	r, hits := newCacheTestGateway(t, "[]")
+
+	get(r, "/c/public", "Authorization", "alice")
+	if _, state := get(r, "/c/public", "Authorization", "bob"); state != "HIT" {
+		t.Fatalf("public response: X-Cache %q, want HIT", state)
+	}
+	if hits.Load() != 1 {
+		t.Fatalf("upstream hit %d times, want 1", hits.Load())
+	}
+}
+
+func TestCacheKeyedCredentials(t *testing.T) {
+	r, _ := newCacheTestGateway(t, "[Authorization]")
+
+	get(r, "/c/private", "Authorization", "alice")
+	if body, state := get(r, "/c/private", "Authorization", "alice"); state != "HIT" || body != "auth=alice cookie= lang=" {
+		t.Fatalf("same user: %q %q, want alice's HIT", body, state)
+	}
+	if body, _ := get(r, "/c/private", "Authorization", "bob"); body != "auth=bob cookie= lang=" {
+		t.Fatalf("other user: %q", body)
+	}
+}
+
+func TestCacheHonorsVary(t *testing.T) {
+	r, _ := newCacheTestGateway(t, "[]")
+	get(r, "/c/vary", "Accept-Language", "de")
+	if body, state := get(r, "/c/vary", "Accept-Language", "fr"); state == "HIT" {
+		t.Fatalf("Vary on a header outside the key was cached: %q", body)
+	}
+	get(r, "/c/vary-star")
+	if _, state := get(r, "/c/vary-star"); state == "HIT" {
+		t.Fatal("Vary: * was cached")
+	}
+
+	r, _ = newCacheTestGateway(t, "[Accept-Language]")
+	get(r, "/c/vary", "Accept-Language", "de")
+	if body, state := get(r, "/c/vary", "Accept-Language", "de"); state != "HIT" || body != "auth= cookie= lang=de" {
+		t.Fatalf("keyed Vary, same language: %q %q", body, state)
+	}
+	if body, _ := get(r, "/c/vary", "Accept-Language", "fr"); body != "auth= cookie= lang=fr" {
+		t.Fatalf("keyed Vary, other language: %q", body)
+	}
+}
+
+// Wait for the background refresh of the entry for req to finish
+func awaitRefresh(t *testing.T, rc *responseCache, req *http.Request) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		entry, _, ok := rc.get(rc.key(req))
+		if !ok || !entry.refreshing.Load() {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("background refresh still running")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestCacheRefreshGoesThroughBreaker(t *testing.T) {
+	var hits atomic.Int64
+	var status atomic.Int64
+	status.Store(http.StatusOK)
+	up := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		w.WriteHeader(int(status.Load()))
+	}))
+	defer up.Close()
+	g, r := newTestGateway(t, "routes:\n- prefix: /c\n  target: "+up.URL+"\n  rate_limit: {rate: 1000, burst: 1000}\n"+
+		"  circuit_breaker: {consecutive_failures: 100, timeout: 1m, failure_statuses: [500]}\n"+
+		"  cache: {ttl: 1ms, stale_while_revalidate: 1m}\n")
+	route := g.routes()[0]
+	req := httptest.NewRequest(http.MethodGet, "/c/x", nil)
+
+	get(r, "/c/x")
+	time.Sleep(5 * time.Millisecond)
+
+	// A failing refresh is a failure to the breaker
+	status.Store(http.StatusInternalServerError)
+	if _, state := get(r, "/c/x"); state != "STALE" {
+		t.Fatalf("X-Cache %q, want STALE", state)
+	}
+	awaitRefresh(t, route.cache, req)
+	if failures := route.breaker.Counts().TotalFailures; failures != 1 {
+		t.Fatalf("breaker saw %d failures, want the refresh's", failures)
+	}
+
+	// No refresh reaches an upstream whose circuit is open
+	for route.breaker.State() != gobreaker.StateOpen {
+		route.callBreaker(func() (any, error) { return nil, errors.New("down") })
+	}
+	before := hits.Load()
+	if _, state := get(r, "/c/x"); state != "STALE" {
+		t.Fatalf("X-Cache %q, want STALE", state)
+	}
+	awaitRefresh(t, route.cache, req)
+	if hits.Load() != before {
+		t.Fatal("refresh sent to the upstream while the circuit is open")
+	}
+}
+
+// A stale entry within stale_while_revalidate is served at once, while the
+// upstream is still working on the refresh it set off; the refreshed entry
+// is served after that
+func TestCacheStaleWhileRevalidate(t *testing.T) {
+	var hits atomic.Int64
+	release := make(chan struct{})
+	up := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := hits.Add(1)
+		if n > 1 {
+			<-release
+		}
+		w.Write([]byte(fmt.Sprint("v", n)))
+	}))
+	defer up.Close()
+	g, r := newTestGateway(t, "routes:\n- prefix: /c\n  target: "+up.URL+"\n  rate_limit: {rate: 1000, burst: 1000}\n"+
+		"  cache: {ttl: 100ms, stale_while_revalidate: 1m}\n")
+	req := httptest.NewRequest(http.MethodGet, "/c/x", nil)
+
+	if body, state := get(r, "/c/x"); body != "v1" || state != "MISS" {
+		t.Fatalf("first: %q %s", body, state)
+	}
+	time.Sleep(150 * time.Millisecond)
+
+	// Answered while the refresh is held up at the upstream
+	served := make(chan [2]string, 1)
+	go func() {
+		body, state := get(r, "/c/x")
+		served <- [2]string{body, state}
+	}()
+	select {
+	case got := <-served:
+		if got != [2]string{"v1", "STALE"} {
+			t.Fatalf("stale hit: %q %s, want v1 STALE", got[0], got[1])
+		}
+	case <-time.After(2 * time.Second):
+		close(release)
+		t.Fatal("stale hit waited for the refresh")
+	}
+	for deadline := time.Now().Add(5 * time.Second); hits.Load() < 2; time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("no background refresh reached the upstream")
+		}
+	}
+
+	close(release)
+	awaitRefresh(t, g.routes()[0].cache, req)
+	if body, state := get(r, "/c/x"); body != "v2" || state != "HIT" {
+		t.Errorf("after the refresh: %q %s, want v2 HIT", body, state)
+	}
+	if hits.Load() != 2 {
+		t.Errorf("upstream hit %d times, want 2", hits.Load())
+	}
+}
+
+func TestCacheStaleWhileRevalidateTransforms(t *testing.T) {
+	const route = "routes:\n- prefix: /c\n  target: http://backend.internal\n"
+	for transform, want := range map[string]string{
+		"  method_map: {GET: POST}\n":                      "method_map",
+		"  timestamp: {enabled: true}\n":                   "timestamp",
+		"  method_map: {GET: POST}\n  geo_headers: true\n": "geo_headers, method_map",
+	} {
+		if _, err := parseConfig([]byte(route + transform + "  cache: {ttl: 1m, stale_while_revalidate: 1m}\n")); err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("%q with stale_while_revalidate: err %v, want it refused naming %s", transform, err, want)
+		}
+		if _, err := parseConfig([]byte(route + transform + "  cache: {ttl: 1m}\n")); err != nil {
+			t.Errorf("%q without stale_while_revalidate: %v", transform, err)
+		}
+	}
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"strings"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/rs/zerolog/log"
+)
+
+// Label combinations kept per metric unless metrics.max_series says otherwise
+const defaultMaxSeries = 10000
+
+// Label value of the series absorbing combinations past the cap
+const overflowLabel = "other"
+
+// Counter, gauge and histogram vectors alike
+type labeledVec[T any] interface {
+	prometheus.Collector
+	WithLabelValues(lvs ...string) T
+}
+
+// Metric vector holding at most max label combinations. Past that, new
+// combinations are folded into one series with every label "other", so a
+// flood of distinct values can't grow the registry until scrapes crawl and
+// the gateway runs out of memory.
+type cappedVec[T any] struct {
+	labeledVec[T]
+	name string
+	max  int
+
+	mu     sync.RWMutex
+	seen   map[string]struct{}
+	warned bool
+}
+
+func capVec[T any](max int, name string, vec labeledVec[T]) *cappedVec[T] {
+	if max <= 0 {
+		max = defaultMaxSeries
+	}
+	return &cappedVec[T]{labeledVec: vec, name: name, max: max, seen: make(map[string]struct{})}
+}
+
+func (v *cappedVec[T]) WithLabelValues(lvs ...string) T {
+	if v.admit(lvs) {
+		return v.labeledVec.WithLabelValues(lvs...)
+	}
+	other := make([]string, len(lvs))
+	for i := range other {
+		other[i] = overflowLabel
+	}
+	return v.labeledVec.WithLabelValues(other...)
+}
+
+// Whether lvs has a series of its own, taking a free slot for new ones
+func (v *cappedVec[T]) admit(lvs []string) bool {
+	key := strings.Join(lvs, "\xff")
+	v.mu.RLock()
+	_, ok := v.seen[key]
+	v.mu.RUnlock()
+	if ok {
+		return true
+	}
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if _, ok := v.seen[key]; ok {
+		return true
+	}
+	if len(v.seen) >= v.max {
+		if !v.warned {
+			v.warned = true
+			log.Warn().Str("metric", v.name).Int("max_series", v.max).Msg("Metric reached its series cap, new label values are reported as \"other\"")
+			sendLogToLoki("Metric "+v.name+" reached its series cap", map[string]string{"level": "warn"})
+		}
+		return false
+	}
+	v.seen[key] = struct{}{}
+	return true
+}
+
+func newCounterVec(max int, opts prometheus.CounterOpts, labels []string) *cappedVec[prometheus.Counter] {
+	return capVec[prometheus.Counter](max, opts.Name, prometheus.NewCounterVec(opts, labels))
+}
+
+func newGaugeVec(max int, opts prometheus.GaugeOpts, labels []string) *cappedVec[prometheus.Gauge] {
+	return capVec[prometheus.Gauge](max, opts.Name, prometheus.NewGaugeVec(opts, labels))
+}
+
+func newHistogramVec(max int, opts prometheus.HistogramOpts, labels []string) *cappedVec[prometheus.Observer] {
+	return capVec[prometheus.Observer](max, opts.Name, prometheus.NewHistogramVec(opts, labels))
+}
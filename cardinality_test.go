@@ -0,0 +1,36 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Past the cap, new label combinations share the all-"other" series while
+// the ones admitted earlier keep their own
+func TestSeriesCapFoldsIntoOther(t *testing.T) {
+	vec := newCounterVec(2, prometheus.CounterOpts{Name: "test_capped_total"}, []string{"route", "code"})
+	reg := prometheus.NewRegistry()
+	reg.MustRegister(vec)
+
+	vec.WithLabelValues("/a", "200").Inc()
+	vec.WithLabelValues("/b", "200").Inc()
+	vec.WithLabelValues("/c", "200").Inc()
+	vec.WithLabelValues("/d", "500").Add(2)
+	vec.WithLabelValues("/a", "200").Inc()
+
+	if got := counterValue(t, vec.labeledVec.WithLabelValues("/a", "200")); got != 2 {
+		t.Errorf("admitted series = %v, want 2", got)
+	}
+	if got := counterValue(t, vec.labeledVec.WithLabelValues("other", "other")); got != 3 {
+		t.Errorf("other series = %v, want 3", got)
+	}
+
+	families, err := reg.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := len(families[0].GetMetric()); n != 3 {
+		t.Errorf("%d series exported, want the 2 admitted plus other", n)
+	}
+}
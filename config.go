@@ -0,0 +1,516 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Path of the gateway config file, overridable through GATEWAY_CONFIG
+const defaultConfigPath = "config/gateway.yaml"
+
+// Gateway configuration
+type Config struct {
+	Listen  string    `yaml:"listen"`
+	LokiURL string    `yaml:"loki_url"`
+	TLS     TLSConfig `yaml:"tls"`
+	// Concurrent connections accepted from one client IP; 0 means unlimited
+	MaxConnsPerIP int `yaml:"max_conns_per_ip"`
+	// Proxies (IPs or CIDRs) whose X-Forwarded-For and X-Real-IP are believed
+	// for the client address used by rate limits, GeoIP and flag bucketing;
+	// none by default, so it is the connection's peer address
+	TrustedProxies []string `yaml:"trusted_proxies"`
+	// Limit for each startup phase (config, metrics, health, warmup, listen)
+	StartupTimeout time.Duration `yaml:"startup_timeout"`
+	// How long shutdown waits for in-flight requests
+	ShutdownTimeout time.Duration `yaml:"shutdown_timeout"`
+	// Limits of individual shutdown phases (unready, drain, flush_logs,
+	// push_metrics, stop_background, close_transports); drain defaults to
+	// shutdown_timeout, flush_logs and push_metrics to log_shipper.flush_timeout
+	ShutdownPhaseTimeouts map[string]time.Duration `yaml:"shutdown_phase_timeouts"`
+	// Response to requests with an HTTP version other than 1.x
+	UnsupportedProtocol UnsupportedProtocolConfig `yaml:"unsupported_protocol"`
+	// Reject requests with ambiguous body framing or several Host headers
+	// (possible request smuggling); on by default
+	StrictFraming bool `yaml:"strict_framing"`
+	// Passes through the gateway a request may have made, per its
+	// X-Gateway-Hops header, before it is rejected as a routing loop with a
+	// 508; 10 by default, 0 turns loop detection off
+	MaxHops int `yaml:"max_hops"`
+	// Header fields a request may carry before it gets a 431; 100 by
+	// default, 0 turns the limit off
+	MaxRequestHeaders int `yaml:"max_request_headers"`
+	// Keep trying to bind listen while its address is in use, e.g. by the
+	// previous process during a fast restart
+	ListenRetry ListenRetryConfig `yaml:"listen_retry"`
+
+	// Batching of the logs pushed to loki_url
+	LogShipper LogShipperConfig `yaml:"log_shipper"`
+	Admin      AdminConfig      `yaml:"admin"`
+	Metrics    MetricsConfig    `yaml:"metrics"`
+	Tracing    TracingConfig    `yaml:"tracing"`
+	// Periodic export of how close rate limits run to their limit
+	RateLimitReport RateLimitReportConfig `yaml:"rate_limit_report"`
+	// Header based upstream override for staging; requires admin auth
+	DebugUpstream DebugUpstreamConfig `yaml:"debug_upstream"`
+	// Via, X-Gateway-Node and X-Served-By response headers
+	GatewayHeaders GatewayHeadersConfig `yaml:"gateway_headers"`
+	// Tenant label on request metrics and access logs
+	Tenant TenantConfig `yaml:"tenant"`
+	GeoIP  GeoIPConfig  `yaml:"geoip"`
+	// Flags forwarded to upstreams as X-Feature-<Name> request headers
+	FeatureFlags []FeatureFlagConfig `yaml:"feature_flags"`
+	// CONNECT tunnels to allowlisted hosts
+	ForwardProxy ForwardProxyConfig `yaml:"forward_proxy"`
+	// Accept a config without routes, e.g. for a forward proxy only, with a
+	// warning. Off by default: no routes is usually a mistake, and the gateway
+	// would start answering everything with a 404.
+	AllowEmptyRoutes bool `yaml:"allow_empty_routes"`
+
+	Routes []RouteConfig `yaml:"-"`
+}
+
+// Per-route settings, resolved from defaults, the referenced profile and the route itself
+type RouteConfig struct {
+	Prefix  string `yaml:"prefix"`
+	Target  string `yaml:"target"`
+	Profile string `yaml:"profile"`
+	// Request hosts the route is limited to: "host", "host:port" or
+	// "*.domain", compared without case or a trailing dot. A route with hosts
+	// takes precedence over one without for the same prefix.
+	Hosts []string `yaml:"hosts"`
+	// Paths under Prefix the route doesn't match, as path.Match patterns
+	// (e.g. /api/internal/*); they go to the next less specific route, or 404
+	Exclude []string `yaml:"exclude"`
+	// Upstreams tried in order when Target (or the previous one) fails or is unhealthy
+	Fallback []string `yaml:"fallback"`
+	// Upstreams requests are balanced across round robin, retries going to
+	// another member than the one that failed; Target defaults to the first
+	Pool []string `yaml:"pool"`
+	// Pick pool members by weighted score instead of round robin
+	Scoring ScoringConfig `yaml:"scoring"`
+	// Active checks keeping failing pool members out of balancing
+	HealthCheck HealthCheckConfig `yaml:"health_check"`
+	// Pool members in tiers tried in order, e.g. local region first; a tier
+	// only gets traffic while the ones before it are unhealthy
+	Failover []FailoverTierConfig `yaml:"failover"`
+	// A disabled route keeps its config but answers with DisabledStatus (404 or 503)
+	Enabled        bool           `yaml:"enabled"`
+	DisabledStatus int            `yaml:"disabled_status"`
+	Timeout        time.Duration  `yaml:"timeout"`
+	ConnPool       ConnPoolConfig `yaml:"conn_pool"`
+	// Upstream responses whose headers add up to more bytes get a 502 (0 = no limit)
+	MaxResponseHeaderBytes int `yaml:"max_response_header_bytes"`
+	// Follow upstream redirects to the upstream's own host or RedirectHosts;
+	// otherwise, and for any other host, the 3xx goes back to the client
+	FollowRedirects bool     `yaml:"follow_redirects"`
+	RedirectHosts   []string `yaml:"redirect_hosts"`
+	// Time the client gets to send the request body before the request fails
+	// with a 408 (0 = only Timeout applies)
+	BodyTimeout time.Duration `yaml:"body_timeout"`
+	// Handling of the request body rest when the upstream answers early
+	EarlyResponse EarlyResponseConfig `yaml:"early_response"`
+	// Extra time per KiB of request and response body, up to a ceiling
+	SizeTimeout SizeTimeoutConfig `yaml:"size_timeout"`
+	// Longer timeout for long-polling requests
+	LongPoll LongPollConfig `yaml:"long_poll"`
+	// Deadline a request needs left to open a new upstream connection; with
+	// less it fails with a 504 right away instead of dialing (0 = always dial)
+	MinConnectTime time.Duration `yaml:"min_connect_time"`
+	// Time the upstream gets to start answering before the request fails with a 504
+	ResponseHeaderTimeout time.Duration   `yaml:"response_header_timeout"`
+	RateLimit             RateLimitConfig `yaml:"rate_limit"`
+	CircuitBreaker        BreakerConfig   `yaml:"circuit_breaker"`
+	Warmup                WarmupConfig    `yaml:"warmup"`
+	ExtAuthz              ExtAuthzConfig  `yaml:"ext_authz"`
+	Bulkhead              BulkheadConfig  `yaml:"bulkhead"`
+	Cache                 CacheConfig     `yaml:"cache"`
+	Dedup                 DedupConfig     `yaml:"dedup"`
+	Mirror                MirrorConfig    `yaml:"mirror"`
+	Retry                 RetryConfig     `yaml:"retry"`
+	Fault                 FaultConfig     `yaml:"fault"`
+	Latency               LatencyConfig   `yaml:"latency"`
+	ABTest                ABTestConfig    `yaml:"ab_test"`
+	// Further limits a request must also be within, e.g. 1000 an hour on top of
+	// 10 a second; the most restrictive decides and sets Retry-After
+	RateLimits []RateLimitConfig `yaml:"rate_limits"`
+	// What the gateway makes of an upstream's 503 with Retry-After
+	RetryAfter RetryAfterConfig `yaml:"retry_after"`
+	// Upstreams replacing Target during time windows
+	Schedule []ScheduleWindowConfig `yaml:"schedule"`
+	// Upstream picked by a query parameter's value
+	QueryRouting QueryRoutingConfig `yaml:"query_routing"`
+	// Lowest TLS version and accepted cipher suites of client connections
+	TLSPolicy TLSPolicyConfig `yaml:"tls_policy"`
+	// Query parameters added to the upstream URL unless the client sent them
+	DefaultQuery map[string]string `yaml:"default_query"`
+	// Path prepended to the forwarded path once the route prefix is stripped,
+	// e.g. /api/v1/account for a backend living under a base path
+	AddPrefix string `yaml:"add_prefix"`
+	// Whose Authorization an upstream URL with user:pass@ gets: the client's
+	// when it sent one ("client", the default) or always the URL's ("override")
+	URLCredentials string `yaml:"url_credentials"`
+	// OAuth2 client credentials token sent to the upstream as bearer token
+	UpstreamAuth UpstreamAuthConfig `yaml:"upstream_auth"`
+	// Cookie name -> upstream request header carrying its value
+	CookieHeaders map[string]string `yaml:"cookie_headers"`
+	HeaderLimit   HeaderLimitConfig `yaml:"header_limit"`
+	// X-Gateway-Timestamp with the gateway's time on upstream requests
+	Timestamp TimestampConfig `yaml:"timestamp"`
+	// Add X-Geo-Country/X-Geo-Region from the geoip database
+	GeoHeaders bool `yaml:"geo_headers"`
+	// Client method -> upstream method, e.g. PUT: POST
+	MethodMap MethodMap `yaml:"method_map"`
+	// Upstream status -> status sent to the client, e.g. 422: 400
+	StatusMap StatusMap `yaml:"status_map"`
+	// What happens to a body sent with GET, HEAD or DELETE: "strip" (the
+	// default) drops it, "forward" sends it on
+	UnexpectedBody string `yaml:"unexpected_body"`
+	// Request and response media types the route's API allows
+	ContentTypes ContentTypeConfig `yaml:"content_types"`
+	// Path segments reported as metric labels, e.g. the resource type
+	PathParams PathParamsConfig `yaml:"path_params"`
+	// How a response cut off by the upstream is signalled: "abort" or "trailer"
+	TruncatedResponse string `yaml:"truncated_response"`
+	// Forward upstream 103 Early Hints, e.g. preload links, to the client
+	// ahead of the final response; other 1xx responses aren't passed on
+	EarlyHints bool `yaml:"early_hints"`
+	// Flush streamed response bodies every so many bytes or so often
+	Flush FlushConfig `yaml:"flush"`
+	// Structured records of the route's requests, written to a sink of their own
+	RequestLog RequestLogConfig `yaml:"request_log"`
+	// Send a Content-Digest header with the SHA-256 of response bodies up to
+	// 1MiB; the body is buffered to hash it
+	ContentDigest bool `yaml:"content_digest"`
+	// WebAssembly module inspecting and rewriting requests and responses
+	WASM WASMConfig `yaml:"wasm"`
+
+	PathNormalization  PathNormalizationConfig  `yaml:"path_normalization"`
+	Decompression      DecompressionConfig      `yaml:"decompression"`
+	ErrorNormalization ErrorNormalizationConfig `yaml:"error_normalization"`
+	JSONFormat         JSONFormatConfig         `yaml:"json_format"`
+	// Hypermedia links added to successful JSON object responses
+	Links LinksConfig `yaml:"links"`
+}
+
+type RateLimitConfig struct {
+	// token_bucket (default), fixed_window, sliding_window or adaptive_burst
+	Algorithm string `yaml:"algorithm"`
+	// Token bucket refill rate per second and bucket size
+	Rate  float64 `yaml:"rate"`
+	Burst int     `yaml:"burst"`
+	// adaptive_burst: bucket size reached after burst_recovery (1m by
+	// default) without spikes; a spike shrinks it back to burst
+	MaxBurst      int           `yaml:"max_burst"`
+	BurstRecovery time.Duration `yaml:"burst_recovery"`
+	// Requests allowed per window for the window algorithms
+	Limit  int           `yaml:"limit"`
+	Window time.Duration `yaml:"window"`
+	// Limit each client separately: "ip" or "header:<name>"; empty shares one limiter per route
+	Key string `yaml:"key"`
+	// What a config reload does to existing limiters: "update" (default) applies the
+	// new rate keeping consumed budget, "reset" starts every client afresh
+	OnReload string `yaml:"on_reload"`
+}
+
+type BreakerConfig struct {
+	MaxRequests uint32        `yaml:"max_requests"`
+	Timeout     time.Duration `yaml:"timeout"`
+	// Failures in a row that open the circuit: 5 opens it on the 5th. Earlier
+	// releases waited for one more, so configs tuned to that now trip a
+	// failure sooner.
+	ConsecutiveFailures uint32 `yaml:"consecutive_failures"`
+	// Upstream statuses counted as failures; transport errors always are
+	FailureStatuses []int               `yaml:"failure_statuses"`
+	Ignore          BreakerIgnoreConfig `yaml:"ignore"`
+	// Once closed again after an outage, let traffic back in gradually over
+	// this long, starting at a tenth of it; the rest is answered with a 503
+	RecoveryRamp time.Duration `yaml:"recovery_ramp"`
+}
+
+// Raw file layout; profiles and routes are kept as nodes so they can be layered
+type fileConfig struct {
+	Config   `yaml:",inline"`
+	Profiles map[string]yaml.Node `yaml:"profiles"`
+	Routes   []yaml.Node          `yaml:"routes"`
+}
+
+// Settings every route starts from before profiles and overrides are applied
+func defaultRouteConfig() RouteConfig {
+	return RouteConfig{
+		Enabled:        true,
+		DisabledStatus: http.StatusNotFound,
+		Timeout:        10 * time.Second,
+		RateLimit:      RateLimitConfig{Rate: 10, Burst: 20},
+		Mirror:         MirrorConfig{SampleRate: 1},
+		Retry: RetryConfig{
+			OnStatuses: []int{502, 503, 504},
+			MaxBody:    1 << 20,
+			Backoff:    BackoffConfig{Strategy: "full_jitter", Base: 100 * time.Millisecond, Cap: 2 * time.Second},
+		},
+		CircuitBreaker: BreakerConfig{
+			MaxRequests:         5,
+			Timeout:             5 * time.Second,
+			ConsecutiveFailures: 5,
+			FailureStatuses:     []int{500, 502, 503, 504},
+		},
+	}
+}
+
+func configPath() string {
+	if path := os.Getenv("GATEWAY_CONFIG"); path != "" {
+		return path
+	}
+	return defaultConfigPath
+}
+
+// Read and resolve the config file at path
+func loadConfig(path string) (*Config, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("reading config: %w", err)
+	}
+	return parseConfig(data)
+}
+
+func parseConfig(data []byte) (*Config, error) {
+	raw := fileConfig{Config: Config{StrictFraming: true, MaxHops: defaultMaxHops, MaxRequestHeaders: defaultMaxRequestHeaders}}
+	if err := yaml.Unmarshal(data, &raw); err != nil {
+		return nil, fmt.Errorf("parsing config: %w", err)
+	}
+
+	cfg := &raw.Config
+	if cfg.Listen == "" {
+		cfg.Listen = ":8080"
+	}
+	if cfg.LokiURL == "" {
+		cfg.LokiURL = LokiURL
+	}
+	cfg.LogShipper.setDefaults()
+	cfg.UnsupportedProtocol.setDefaults()
+
+	if err := cfg.Admin.Auth.validate(); err != nil {
+		return nil, err
+	}
+	if err := validateFeatureFlags(cfg.FeatureFlags); err != nil {
+		return nil, err
+	}
+	if err := cfg.Tenant.validate(); err != nil {
+		return nil, err
+	}
+	if err := cfg.ListenRetry.validate(); err != nil {
+		return nil, err
+	}
+	if err := cfg.RateLimitReport.validate(); err != nil {
+		return nil, err
+	}
+	if _, err := parseCIDRs(cfg.TrustedProxies); err != nil {
+		return nil, fmt.Errorf("trusted_proxies: %w", err)
+	}
+	if cfg.MaxHops < 0 {
+		return nil, fmt.Errorf("max_hops can't be negative")
+	}
+	if cfg.MaxRequestHeaders < 0 {
+		return nil, fmt.Errorf("max_request_headers can't be negative")
+	}
+	for name := range cfg.ShutdownPhaseTimeouts {
+		if !slices.Contains(shutdownPhaseNames, name) {
+			return nil, fmt.Errorf("shutdown_phase_timeouts: unknown phase %q", name)
+		}
+	}
+
+	for i := range raw.Routes {
+		route, err := resolveRoute(&raw.Routes[i], raw.Profiles)
+		if err != nil {
+			return nil, err
+		}
+		cfg.Routes = append(cfg.Routes, route)
+	}
+	if len(cfg.Routes) == 0 && !cfg.AllowEmptyRoutes {
+		return nil, errors.New("no routes configured; set allow_empty_routes to run without any")
+	}
+	return cfg, nil
+}
+
+// Layer defaults, the referenced profile and the route's own fields, in that order
+func resolveRoute(node *yaml.Node, profiles map[string]yaml.Node) (RouteConfig, error) {
+	route := defaultRouteConfig()
+
+	// Decode once to find the profile reference
+	var ref struct {
+		Prefix  string `yaml:"prefix"`
+		Profile string `yaml:"profile"`
+	}
+	if err := node.Decode(&ref); err != nil {
+		return route, fmt.Errorf("parsing route: %w", err)
+	}
+
+	if ref.Profile != "" {
+		profile, ok := profiles[ref.Profile]
+		if !ok {
+			return route, fmt.Errorf("route %s: unknown profile %q", ref.Prefix, ref.Profile)
+		}
+		if err := profile.Decode(&route); err != nil {
+			return route, fmt.Errorf("profile %s: %w", ref.Profile, err)
+		}
+	}
+
+	if err := node.Decode(&route); err != nil {
+		return route, fmt.Errorf("route %s: %w", ref.Prefix, err)
+	}
+
+	if route.Prefix == "" {
+		return route, errors.New("route without prefix")
+	}
+	route.Prefix = normalizePrefix(route.Prefix)
+	if route.Target == "" && len(route.Pool) > 0 {
+		route.Target = route.Pool[0]
+	}
+	if route.Target == "" {
+		return route, fmt.Errorf("route %s: missing target", route.Prefix)
+	}
+	// Checked here so a bad target fails the load, not the requests
+	if err := validateUpstreams("target", []string{route.Target}); err != nil {
+		return route, fmt.Errorf("route %s: %w", route.Prefix, err)
+	}
+	if err := validateRouteHosts(route.Hosts); err != nil {
+		return route, fmt.Errorf("route %s: %w", route.Prefix, err)
+	}
+	if route.DisabledStatus != http.StatusNotFound && route.DisabledStatus != http.StatusServiceUnavailable {
+		return route, fmt.Errorf("route %s: disabled_status must be 404 or 503", route.Prefix)
+	}
+	switch route.TruncatedResponse {
+	case "", "abort", "trailer":
+	default:
+		return route, fmt.Errorf("route %s: unknown truncated_response mode %q", route.Prefix, route.TruncatedResponse)
+	}
+	if err := route.RateLimit.validate(); err != nil {
+		return route, fmt.Errorf("route %s: %w", route.Prefix, err)
+	}
+	for _, limit := range route.RateLimits {
+		if err := limit.validate(); err != nil {
+			return route, fmt.Errorf("route %s: rate_limits: %w", route.Prefix, err)
+		}
+	}
+	if route.Mirror.SampleRate < 0 || route.Mirror.SampleRate > 1 {
+		return route, fmt.Errorf("route %s: mirror sample_rate must be between 0 and 1", route.Prefix)
+	}
+	if err := route.HeaderLimit.validate(); err != nil {
+		return route, fmt.Errorf("route %s: %w", route.Prefix, err)
+	}
+	if err := route.Timestamp.validate(); err != nil {
+		return route, fmt.Errorf("route %s: %w", route.Prefix, err)
+	}
+	if _, err := newSchedule(route.Schedule); err != nil {
+		return route, fmt.Errorf("route %s: %w", route.Prefix, err)
+	}
+	if err := route.ABTest.validate(); err != nil {
+		return route, fmt.Errorf("route %s: %w", route.Prefix, err)
+	}
+	if err := route.QueryRouting.validate(); err != nil {
+		return route, fmt.Errorf("route %s: %w", route.Prefix, err)
+	}
+	if err := route.TLSPolicy.validate(); err != nil {
+		return route, fmt.Errorf("route %s: %w", route.Prefix, err)
+	}
+	if err := route.Fault.validate(); err != nil {
+		return route, fmt.Errorf("route %s: %w", route.Prefix, err)
+	}
+	if err := route.Latency.validate(); err != nil {
+		return route, fmt.Errorf("route %s: %w", route.Prefix, err)
+	}
+	if err := route.Retry.validate(); err != nil {
+		return route, fmt.Errorf("route %s: %w", route.Prefix, err)
+	}
+	if err := route.RetryAfter.validate(); err != nil {
+		return route, fmt.Errorf("route %s: %w", route.Prefix, err)
+	}
+	if err := route.PathNormalization.validate(); err != nil {
+		return route, fmt.Errorf("route %s: %w", route.Prefix, err)
+	}
+	if err := route.StatusMap.validate(); err != nil {
+		return route, fmt.Errorf("route %s: %w", route.Prefix, err)
+	}
+	if err := route.MethodMap.validate(); err != nil {
+		return route, fmt.Errorf("route %s: %w", route.Prefix, err)
+	}
+	if err := route.Cache.validate(route); err != nil {
+		return route, fmt.Errorf("route %s: %w", route.Prefix, err)
+	}
+	if err := route.Dedup.validate(); err != nil {
+		return route, fmt.Errorf("route %s: %w", route.Prefix, err)
+	}
+	if err := route.JSONFormat.validate(); err != nil {
+		return route, fmt.Errorf("route %s: %w", route.Prefix, err)
+	}
+	if err := route.RequestLog.validate(); err != nil {
+		return route, fmt.Errorf("route %s: %w", route.Prefix, err)
+	}
+	if err := route.Flush.validate(); err != nil {
+		return route, fmt.Errorf("route %s: %w", route.Prefix, err)
+	}
+	if err := route.Links.validate(); err != nil {
+		return route, fmt.Errorf("route %s: %w", route.Prefix, err)
+	}
+	if err := route.ConnPool.validate(); err != nil {
+		return route, fmt.Errorf("route %s: %w", route.Prefix, err)
+	}
+	if err := route.ContentTypes.validate(); err != nil {
+		return route, fmt.Errorf("route %s: %w", route.Prefix, err)
+	}
+	if err := route.PathParams.validate(); err != nil {
+		return route, fmt.Errorf("route %s: %w", route.Prefix, err)
+	}
+	if err := validateUnexpectedBody(route.UnexpectedBody); err != nil {
+		return route, fmt.Errorf("route %s: %w", route.Prefix, err)
+	}
+	if err := validateURLCredentials(route.URLCredentials); err != nil {
+		return route, fmt.Errorf("route %s: %w", route.Prefix, err)
+	}
+	if err := route.UpstreamAuth.validate(); err != nil {
+		return route, fmt.Errorf("route %s: %w", route.Prefix, err)
+	}
+	if err := route.SizeTimeout.validate(route.Timeout); err != nil {
+		return route, fmt.Errorf("route %s: %w", route.Prefix, err)
+	}
+	if err := route.LongPoll.validate(route); err != nil {
+		return route, fmt.Errorf("route %s: %w", route.Prefix, err)
+	}
+	if err := route.EarlyResponse.validate(); err != nil {
+		return route, fmt.Errorf("route %s: %w", route.Prefix, err)
+	}
+	if err := route.WASM.validate(); err != nil {
+		return route, fmt.Errorf("route %s: %w", route.Prefix, err)
+	}
+	if err := validateExclude(route.Exclude); err != nil {
+		return route, fmt.Errorf("route %s: %w", route.Prefix, err)
+	}
+	if err := validateUpstreams("fallback", route.Fallback); err != nil {
+		return route, fmt.Errorf("route %s: %w", route.Prefix, err)
+	}
+	if err := validateUpstreams("pool", route.Pool); err != nil {
+		return route, fmt.Errorf("route %s: %w", route.Prefix, err)
+	}
+	if err := route.Scoring.validate(route.Pool); err != nil {
+		return route, fmt.Errorf("route %s: %w", route.Prefix, err)
+	}
+	if err := route.HealthCheck.validate(route.Pool); err != nil {
+		return route, fmt.Errorf("route %s: %w", route.Prefix, err)
+	}
+	if err := validateFailover(route.Failover, route.Pool, route.HealthCheck); err != nil {
+		return route, fmt.Errorf("route %s: %w", route.Prefix, err)
+	}
+	if len(route.Pool) > 0 && len(route.Fallback) > 0 {
+		return route, fmt.Errorf("route %s: pool and fallback can't be combined", route.Prefix)
+	}
+	if route.AddPrefix != "" && (!strings.HasPrefix(route.AddPrefix, "/") || strings.ContainsAny(route.AddPrefix, "?#")) {
+		return route, fmt.Errorf("route %s: add_prefix must be a path starting with /", route.Prefix)
+	}
+	return route, nil
+}
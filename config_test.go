@@ -0,0 +1,100 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRouteProfiles(t *testing.T) {
+	cfg, err := parseConfig([]byte(`
+profiles:
+  strict:
+    timeout: 2s
+    rate_limit: {rate: 5, burst: 5}
+    circuit_breaker: {max_requests: 1, timeout: 10s, consecutive_failures: 3}
+routes:
+  - prefix: /plain
+    target: http://plain:8080
+  - prefix: /strict
+    target: http://strict:8080
+    profile: strict
+  - prefix: /custom
+    target: http://custom:8080
+    profile: strict
+    timeout: 7s
+    rate_limit: {rate: 9}
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	plain, strict, custom := cfg.Routes[0], cfg.Routes[1], cfg.Routes[2]
+
+	defaults := defaultRouteConfig()
+	if plain.Timeout != defaults.Timeout || plain.RateLimit.Rate != defaults.RateLimit.Rate {
+		t.Errorf("route without profile: timeout %v, rate %v, want the defaults", plain.Timeout, plain.RateLimit.Rate)
+	}
+
+	if strict.Timeout != 2*time.Second || strict.RateLimit.Rate != 5 || strict.RateLimit.Burst != 5 {
+		t.Errorf("profile values: timeout %v, rate_limit %+v", strict.Timeout, strict.RateLimit)
+	}
+	if cb := strict.CircuitBreaker; cb.MaxRequests != 1 || cb.Timeout != 10*time.Second || cb.ConsecutiveFailures != 3 {
+		t.Errorf("profile circuit_breaker: %+v", cb)
+	}
+	// Profile fields left unset keep the defaults
+	if len(strict.CircuitBreaker.FailureStatuses) == 0 {
+		t.Error("profile dropped the default failure_statuses")
+	}
+
+	if custom.Timeout != 7*time.Second || custom.RateLimit.Rate != 9 {
+		t.Errorf("route overrides: timeout %v, rate %v", custom.Timeout, custom.RateLimit.Rate)
+	}
+	if custom.RateLimit.Burst != 5 || custom.CircuitBreaker.ConsecutiveFailures != 3 {
+		t.Errorf("fields the route doesn't set come from the profile: burst %d, consecutive_failures %d",
+			custom.RateLimit.Burst, custom.CircuitBreaker.ConsecutiveFailures)
+	}
+}
+
+func TestRouteUnknownProfile(t *testing.T) {
+	_, err := parseConfig([]byte("routes:\n- prefix: /x\n  target: http://x:8080\n  profile: missing\n"))
+	if err == nil || !strings.Contains(err.Error(), `unknown profile "missing"`) {
+		t.Fatalf("got %v, want an unknown profile error", err)
+	}
+}
+
+// A config without routes stops startup unless allow_empty_routes says it's meant
+func TestEmptyRoutesRefused(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "gateway.yaml")
+	for _, data := range []string{"", "routes: []\n", "trusted_proxies: [10.0.0.0/8]\n"} {
+		if err := os.WriteFile(path, []byte(data), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := loadConfig(path); err == nil || !strings.Contains(err.Error(), "no routes configured") || !strings.Contains(err.Error(), "allow_empty_routes") {
+			t.Errorf("%q: error %v, want one naming the missing routes and allow_empty_routes", data, err)
+		}
+	}
+
+	_, r := newTestGateway(t, "allow_empty_routes: true\n")
+	if w := serve(r, httptest.NewRequest(http.MethodGet, "/anything", nil)); w.Code != http.StatusNotFound {
+		t.Errorf("allowed empty config: status %d, want 404", w.Code)
+	}
+}
+
+// Unparsable or relative upstreams fail the load instead of the requests
+func TestInvalidTargetsRefused(t *testing.T) {
+	for _, route := range []string{
+		"  target: '%zz'\n",
+		"  target: backend.internal:8080\n",
+		"  target: /relative\n",
+		"  target: http://backend.internal\n  schedule: [{name: nightly, target: '%zz', start: '01:00', end: '02:00'}]\n",
+		"  target: http://backend.internal\n  schedule: [{name: nightly, target: replica.internal, start: '01:00', end: '02:00'}]\n",
+	} {
+		if _, err := parseConfig([]byte("routes:\n- prefix: /x\n" + route)); err == nil || !strings.Contains(err.Error(), "invalid upstream") {
+			t.Errorf("%s: err %v, want an invalid upstream", route, err)
+		}
+	}
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"slices"
+	"sync/atomic"
+)
+
+// Written to a connection that must not carry another request. The transport
+// sees nothing was written and resends the request on another connection.
+var errConnClosing = errors.New("upstream connection closed after a failed response")
+
+// Upstream connection that can be taken out of the pool once a response on it
+// showed the upstream in a bad state, whether or not the upstream closes it
+type closableConn struct {
+	net.Conn
+	closing atomic.Bool
+}
+
+// Lets pooledConnOf look through to the connection underneath
+func (c *closableConn) NetConn() net.Conn {
+	return c.Conn
+}
+
+func (c *closableConn) Write(p []byte) (int, error) {
+	// Picked from the pool before its response was done with
+	if c.closing.Load() {
+		c.Conn.Close()
+		return 0, errConnClosing
+	}
+	return c.Conn.Write(p)
+}
+
+// The closableConn under conn, which is a TLS connection for https upstreams
+func closableConnOf(conn net.Conn) *closableConn {
+	for conn != nil {
+		if cc, ok := conn.(*closableConn); ok {
+			return cc
+		}
+		inner, ok := conn.(interface{ NetConn() net.Conn })
+		if !ok {
+			return nil
+		}
+		conn = inner.NetConn()
+	}
+	return nil
+}
+
+// Response body closing its connection once read to the end or closed, before
+// the next request could be sent on it
+type closingBody struct {
+	io.ReadCloser
+	conn *closableConn
+}
+
+func (b *closingBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if err == io.EOF {
+		b.conn.Conn.Close()
+	}
+	return n, err
+}
+
+func (b *closingBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.conn.Conn.Close()
+	return err
+}
+
+// Transport taking the HTTP/1 connection of responses with one of statuses
+// out of the pool. HTTP/2 connections carry other requests' streams and are
+// left alone.
+type connClosingTransport struct {
+	http.RoundTripper
+	statuses []int
+}
+
+func (t connClosingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	// Reported before RoundTrip returns, on this goroutine
+	var conn net.Conn
+	trace := &httptrace.ClientTrace{GotConn: func(info httptrace.GotConnInfo) { conn = info.Conn }}
+	resp, err := t.RoundTripper.RoundTrip(req.WithContext(httptrace.WithClientTrace(req.Context(), trace)))
+	if err != nil || resp.ProtoMajor != 1 || !slices.Contains(t.statuses, resp.StatusCode) {
+		return resp, err
+	}
+	if cc := closableConnOf(conn); cc != nil {
+		cc.closing.Store(true)
+		resp.Body = &closingBody{ReadCloser: resp.Body, conn: cc}
+	}
+	return resp, nil
+}
+
+func (t connClosingTransport) CloseIdleConnections() {
+	closeIdleConnections(t.RoundTripper)
+}
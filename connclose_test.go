@@ -0,0 +1,42 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// After a response with one of close_on_statuses its connection is closed
+// even though the upstream kept it open, so the next request goes out on a
+// new one; other routes keep reusing theirs
+func TestConnectionClosedAfterFailedResponse(t *testing.T) {
+	up := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/fail" {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+		// Identifies the connection by its client port
+		w.Write([]byte(r.RemoteAddr))
+	}))
+	defer up.Close()
+	_, r := newTestGateway(t, "routes:\n"+
+		"- prefix: /closing\n  target: "+up.URL+"\n  rate_limit: {rate: 1000, burst: 1000}\n  conn_pool: {close_on_statuses: [503]}\n"+
+		"- prefix: /keeping\n  target: "+up.URL+"\n  rate_limit: {rate: 1000, burst: 1000}\n")
+
+	for prefix, wantReused := range map[string]bool{"/closing": false, "/keeping": true} {
+		failed := serve(r, httptest.NewRequest(http.MethodGet, prefix+"/fail", nil))
+		if failed.Code != http.StatusServiceUnavailable {
+			t.Fatalf("%s: status %d, want the upstream's 503", prefix, failed.Code)
+		}
+		next := serve(r, httptest.NewRequest(http.MethodGet, prefix+"/ok", nil))
+		if next.Code != http.StatusOK {
+			t.Fatalf("%s: next request %d, want 200", prefix, next.Code)
+		}
+		if reused := next.Body.String() == failed.Body.String(); reused != wantReused {
+			t.Errorf("%s: connection of the 503 reused %v, want %v", prefix, reused, wantReused)
+		}
+	}
+
+	if _, err := parseConfig([]byte("routes:\n- prefix: /x\n  target: " + up.URL + "\n  conn_pool: {close_on_statuses: [5030]}\n")); err == nil {
+		t.Error("invalid close_on_statuses accepted")
+	}
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/rs/zerolog/log"
+)
+
+// Forward-proxy mode: CONNECT requests open a TCP tunnel to an allowlisted
+// host, next to the reverse-proxy routes. Off unless enabled.
+type ForwardProxyConfig struct {
+	Enabled bool `yaml:"enabled"`
+	// Tunnel destinations: "host", "host:port" or "*.domain"; nothing is
+	// reachable when empty
+	AllowedHosts []string      `yaml:"allowed_hosts"`
+	DialTimeout  time.Duration `yaml:"dial_timeout"`
+}
+
+func (cfg *ForwardProxyConfig) setDefaults() {
+	if cfg.DialTimeout <= 0 {
+		cfg.DialTimeout = 10 * time.Second
+	}
+}
+
+// Middleware answering CONNECT requests when forward-proxy mode is on. The
+// client connection is hijacked and bytes are piped both ways until either
+// side closes; tunnels aren't waited for by a graceful shutdown.
+func ForwardProxyMiddleware(cfg ForwardProxyConfig) gin.HandlerFunc {
+	cfg.setDefaults()
+	return func(c *gin.Context) {
+		if !cfg.Enabled || c.Request.Method != http.MethodConnect {
+			c.Next()
+			return
+		}
+		c.Abort()
+
+		host := c.Request.Host
+		if _, _, err := net.SplitHostPort(host); err != nil {
+			connectTunnels.WithLabelValues("invalid").Inc()
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Bad request", "msg": "CONNECT needs a host:port"})
+			return
+		}
+		if !hostAllowed(cfg.AllowedHosts, host) {
+			connectTunnels.WithLabelValues("denied").Inc()
+			log.Warn().Str("host", host).Str("client", c.ClientIP()).Msg("CONNECT to host outside allowed_hosts refused")
+			sendLogToLoki("CONNECT to disallowed host refused: "+host, map[string]string{"level": "warn"})
+			c.JSON(http.StatusForbidden, gin.H{"error": "Forbidden", "msg": "tunnel destination not allowed"})
+			return
+		}
+		if c.Request.ProtoMajor != 1 {
+			// HTTP/2 CONNECT runs over a stream, there is no connection to hand over
+			connectTunnels.WithLabelValues("invalid").Inc()
+			c.JSON(http.StatusHTTPVersionNotSupported, gin.H{"error": "HTTP version not supported", "msg": "CONNECT tunnels need HTTP/1.1"})
+			return
+		}
+
+		upstream, err := net.DialTimeout("tcp", host, cfg.DialTimeout)
+		if err != nil {
+			connectTunnels.WithLabelValues("dial_error").Inc()
+			log.Warn().Err(err).Str("host", host).Msg("CONNECT dial failed")
+			c.JSON(http.StatusBadGateway, gin.H{"error": "Bad gateway", "msg": "could not reach tunnel destination"})
+			return
+		}
+
+		client, buffered, err := c.Writer.Hijack()
+		if err != nil {
+			upstream.Close()
+			connectTunnels.WithLabelValues("invalid").Inc()
+			log.Error().Err(err).Msg("Hijacking connection for CONNECT failed")
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal server error"})
+			return
+		}
+		// Tunnel bytes are no longer checked as requests
+		switchedProtocols(c)
+		connectTunnels.WithLabelValues("established").Inc()
+		log.Info().Str("host", host).Str("client", c.ClientIP()).Msg("CONNECT tunnel established")
+		// The deadlines net/http set for reading requests don't apply to a tunnel
+		client.SetDeadline(time.Time{})
+		if _, err := io.WriteString(client, "HTTP/1.1 200 Connection Established\r\n\r\n"); err != nil {
+			client.Close()
+			upstream.Close()
+			return
+		}
+		go tunnel(client, buffered.Reader, upstream)
+	}
+}
+
+// Pipe bytes between the client and the upstream; clientReader holds what the
+// server had already read from the client. Each direction's end is passed on
+// as a half close where possible, both connections close once both are done.
+func tunnel(client net.Conn, clientReader io.Reader, upstream net.Conn) {
+	defer client.Close()
+	defer upstream.Close()
+
+	var wg sync.WaitGroup
+	pipe := func(dst net.Conn, src io.Reader) {
+		defer wg.Done()
+		io.Copy(dst, src)
+		if cw, ok := dst.(interface{ CloseWrite() error }); ok {
+			cw.CloseWrite()
+		} else {
+			dst.Close()
+		}
+	}
+	wg.Add(2)
+	go pipe(upstream, clientReader)
+	go pipe(client, upstream)
+	wg.Wait()
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+// TCP server echoing what it reads
+func echoServer(t *testing.T) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+	return ln.Addr().String()
+}
+
+// A CONNECT to an allowed host opens a tunnel bytes go through both ways; one
+// to any other host is refused with a 403
+func TestConnectTunnel(t *testing.T) {
+	registerMetrics(MetricsConfig{})
+	gin.SetMode(gin.ReleaseMode)
+	allowed, other := echoServer(t), echoServer(t)
+	r := gin.New()
+	r.Use(ForwardProxyMiddleware(ForwardProxyConfig{Enabled: true, AllowedHosts: []string{allowed}}))
+	gw := httptest.NewServer(r)
+	defer gw.Close()
+	connect := func(host string) (net.Conn, *bufio.Reader, *http.Response) {
+		conn, err := net.Dial("tcp", gw.Listener.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { conn.Close() })
+		fmt.Fprintf(conn, "CONNECT %s HTTP/1.1\r\nHost: %s\r\n\r\n", host, host)
+		br := bufio.NewReader(conn)
+		resp, err := http.ReadResponse(br, &http.Request{Method: http.MethodConnect})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return conn, br, resp
+	}
+	established, denied := connectTunnels.WithLabelValues("established"), connectTunnels.WithLabelValues("denied")
+	establishedBefore, deniedBefore := counterValue(t, established), counterValue(t, denied)
+
+	conn, br, resp := connect(allowed)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("allowed host: status %d, want 200", resp.StatusCode)
+	}
+	fmt.Fprint(conn, "ping\n")
+	if line, err := br.ReadString('\n'); err != nil || line != "ping\n" {
+		t.Errorf("through the tunnel: %q, %v, want the echo", line, err)
+	}
+
+	if _, _, resp := connect(other); resp.StatusCode != http.StatusForbidden {
+		t.Errorf("disallowed host: status %d, want 403", resp.StatusCode)
+	}
+	if got := counterValue(t, established) - establishedBefore; got != 1 {
+		t.Errorf("tunnels established: %v, want 1", got)
+	}
+	if got := counterValue(t, denied) - deniedBefore; got != 1 {
+		t.Errorf("tunnels denied: %v, want 1", got)
+	}
+}
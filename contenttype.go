@@ -0,0 +1,130 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"slices"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/rs/zerolog/log"
+)
+
+// Media types a route's API contract allows, e.g. application/json. Entries
+// may end in /* to allow a whole type, like text/*; parameters such as
+// charset are ignored. An empty list allows anything.
+type ContentTypeConfig struct {
+	// Request bodies of another type are refused with a 415
+	Request []string `yaml:"request"`
+	// Upstream responses of another type are passed on but logged and counted
+	// in gateway_content_type_mismatches_total, as a backend breaking the contract
+	Response []string `yaml:"response"`
+	// Content-Type given to upstream responses that lack one: a media type,
+	// or "sniff" to detect it from the first 512 bytes of the body as
+	// http.DetectContentType does. Compressed bodies aren't sniffed.
+	Default string `yaml:"default"`
+}
+
+func (cfg ContentTypeConfig) validate() error {
+	for _, entry := range slices.Concat(cfg.Request, cfg.Response) {
+		if _, _, err := mime.ParseMediaType(entry); err != nil {
+			return fmt.Errorf("content_types: invalid media type %q", entry)
+		}
+	}
+	if cfg.Default != "" && cfg.Default != "sniff" {
+		if _, _, err := mime.ParseMediaType(cfg.Default); err != nil || strings.Contains(cfg.Default, "*") {
+			return fmt.Errorf("content_types: invalid default %q", cfg.Default)
+		}
+	}
+	return nil
+}
+
+// Whether contentType is one of allowed
+func contentTypeAllowed(allowed []string, contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	for _, entry := range allowed {
+		entry = strings.ToLower(entry)
+		if prefix, ok := strings.CutSuffix(entry, "/*"); ok {
+			if strings.HasPrefix(mediaType, prefix+"/") {
+				return true
+			}
+		} else if mediaType == entry {
+			return true
+		}
+	}
+	return false
+}
+
+// Middleware refusing request bodies whose type the route doesn't accept
+func ContentTypeMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		allowed := routeFromContext(c).ContentTypes.Request
+		req := c.Request
+		if len(allowed) == 0 || req.Body == nil || req.Body == http.NoBody {
+			c.Next()
+			return
+		}
+		if contentType := req.Header.Get("Content-Type"); !contentTypeAllowed(allowed, contentType) {
+			sendLogToLoki("Request content type not accepted: "+contentType, map[string]string{"level": "warn", "path": req.URL.Path})
+			c.JSON(http.StatusUnsupportedMediaType, gin.H{"error": "Unsupported media type", "msg": "accepted: " + strings.Join(allowed, ", ")})
+			c.Abort()
+			return
+		}
+		c.Next()
+	}
+}
+
+// Flag upstream responses whose type is outside the contract
+func contentTypeChecker(route string, allowed []string) responseModifier {
+	return func(c *gin.Context, resp *http.Response) error {
+		if resp.StatusCode == http.StatusNoContent || resp.StatusCode == http.StatusNotModified {
+			return nil
+		}
+		contentType := resp.Header.Get("Content-Type")
+		if contentType == "" && resp.ContentLength == 0 {
+			return nil
+		}
+		if !contentTypeAllowed(allowed, contentType) {
+			contentTypeMismatches.WithLabelValues(route).Inc()
+			log.Warn().Str("route", route).Str("content_type", contentType).Int("status", resp.StatusCode).Msg("Upstream response has an unexpected content type")
+			sendLogToLoki("Upstream response has an unexpected content type: "+contentType, map[string]string{"level": "warn", "path": c.Request.URL.Path})
+		}
+		return nil
+	}
+}
+
+// Fill in the Content-Type of upstream responses without one
+func contentTypeDefaulter(fallback string) responseModifier {
+	return func(c *gin.Context, resp *http.Response) error {
+		if resp.Header.Get("Content-Type") != "" || resp.StatusCode == http.StatusNoContent || resp.StatusCode == http.StatusNotModified || resp.ContentLength == 0 {
+			return nil
+		}
+		if fallback != "sniff" {
+			resp.Header.Set("Content-Type", fallback)
+			return nil
+		}
+		if encoding := resp.Header.Get("Content-Encoding"); encoding != "" && !strings.EqualFold(encoding, "identity") {
+			return nil
+		}
+		buf := make([]byte, 512)
+		n, err := io.ReadFull(resp.Body, buf)
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			return fmt.Errorf("sniffing response content type: %w", err)
+		}
+		buf = buf[:n]
+		resp.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(buf), resp.Body), resp.Body}
+		if n > 0 {
+			resp.Header.Set("Content-Type", http.DetectContentType(buf))
+		}
+		return nil
+	}
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+// Responses outside content_types.response are passed on, logged and
+// counted; compliant ones aren't. Requests of another type get a 415.
+func TestContentTypeContract(t *testing.T) {
+	up := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", r.URL.Query().Get("type"))
+		w.Write([]byte("body"))
+	}))
+	defer up.Close()
+	logs := captureLogs(t)
+	_, r := newTestGateway(t, "routes:\n- prefix: /ct\n  target: "+up.URL+"\n  rate_limit: {rate: 1000, burst: 1000}\n"+
+		"  content_types: {request: [application/json], response: [application/json, 'text/*']}\n")
+	mismatches := contentTypeMismatches.WithLabelValues("/ct")
+
+	for _, tc := range []struct {
+		contentType string
+		mismatch    bool
+	}{
+		{"application/json", false},
+		{"application/json; charset=utf-8", false},
+		{"text/csv", false},
+		{"text/html; charset=utf-8", false},
+		{"image/png", true},
+		{"application/xml", true},
+	} {
+		before, logged := counterValue(t, mismatches), strings.Count(logs.String(), "unexpected content type")
+		w := serve(r, httptest.NewRequest(http.MethodGet, "/ct/?type="+url.QueryEscape(tc.contentType), nil))
+		if w.Code != http.StatusOK || w.Body.String() != "body" {
+			t.Errorf("%s: status %d, body %q, want the response passed on", tc.contentType, w.Code, w.Body)
+		}
+		counted := counterValue(t, mismatches) - before
+		newLogs := strings.Count(logs.String(), "unexpected content type") - logged
+		if want := map[bool]int{false: 0, true: 1}[tc.mismatch]; counted != float64(want) || newLogs != want {
+			t.Errorf("%s: counted %v, logged %d times, want %d", tc.contentType, counted, newLogs, want)
+		}
+	}
+
+	for contentType, want := range map[string]int{"application/json": http.StatusOK, "text/plain": http.StatusUnsupportedMediaType} {
+		req := httptest.NewRequest(http.MethodPost, "/ct/?type=application/json", strings.NewReader("{}"))
+		req.Header.Set("Content-Type", contentType)
+		if got := serve(r, req).Code; got != want {
+			t.Errorf("request body of %s: %d, want %d", contentType, got, want)
+		}
+	}
+}
+
+// Responses without a Content-Type get the configured one, or one sniffed
+// from the body; a type the upstream did send is left alone
+func TestDefaultContentType(t *testing.T) {
+	up := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if typ := r.URL.Query().Get("type"); typ != "" {
+			w.Header().Set("Content-Type", typ)
+		} else {
+			// Keeps net/http from sniffing it itself
+			w.Header()["Content-Type"] = nil
+		}
+		w.Write([]byte(r.URL.Query().Get("body")))
+	}))
+	defer up.Close()
+	_, r := newTestGateway(t, "routes:\n"+
+		"- prefix: /fixed\n  target: "+up.URL+"\n  rate_limit: {rate: 1000, burst: 1000}\n  content_types: {default: application/json}\n"+
+		"- prefix: /sniff\n  target: "+up.URL+"\n  rate_limit: {rate: 1000, burst: 1000}\n  content_types: {default: sniff}\n")
+
+	for _, tc := range []struct{ path, body, typ, want string }{
+		{"/fixed/", `{"a": 1}`, "", "application/json"},
+		{"/fixed/", "x", "text/plain", "text/plain"},
+		{"/sniff/", "<!DOCTYPE html><html><body>hi</body></html>", "", "text/html; charset=utf-8"},
+		{"/sniff/", "%PDF-1.7 ...", "", "application/pdf"},
+		{"/sniff/", "just words", "", "text/plain; charset=utf-8"},
+		{"/sniff/", "<html>", "image/png", "image/png"},
+	} {
+		w := serve(r, httptest.NewRequest(http.MethodGet, tc.path+"?body="+url.QueryEscape(tc.body)+"&type="+url.QueryEscape(tc.typ), nil))
+		if got := w.Header().Get("Content-Type"); got != tc.want || w.Body.String() != tc.body {
+			t.Errorf("%s %q sent as %q: Content-Type %q with body %q, want %q and the body intact", tc.path, tc.body, tc.typ, got, w.Body, tc.want)
+		}
+	}
+}
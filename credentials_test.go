@@ -0,0 +1,91 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+)
+
+// Log output, safe to write from the handlers' goroutines
+type logBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *logBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *logBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+// Capture the global logger's output for the rest of the test
+func captureLogs(t *testing.T) *logBuffer {
+	t.Helper()
+	buf := &logBuffer{}
+	prev := log.Logger
+	log.Logger = zerolog.New(buf).Level(zerolog.DebugLevel)
+	t.Cleanup(func() { log.Logger = prev })
+	return buf
+}
+
+// user:pass@ in the target becomes the upstream's basic auth; the client's
+// own Authorization wins unless url_credentials is override, and the
+// password shows up in no log line nor the admin API
+func TestURLCredentials(t *testing.T) {
+	up := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.Header.Get("Authorization")))
+	}))
+	defer up.Close()
+	logs := captureLogs(t)
+	target := strings.Replace(up.URL, "http://", "http://svc:p%40ss-w0rd@", 1)
+	g, r := newTestGateway(t, "routes:\n"+
+		"- prefix: /c\n  target: "+target+"\n  rate_limit: {rate: 1000, burst: 1000}\n"+
+		"- prefix: /o\n  target: "+target+"\n  rate_limit: {rate: 1000, burst: 1000}\n  url_credentials: override\n")
+	if err := registerAdminRoutes(r, AdminConfig{Auth: AdminAuthConfig{Token: "s3cret"}}, g); err != nil {
+		t.Fatal(err)
+	}
+	fromURL := "Basic " + base64.StdEncoding.EncodeToString([]byte("svc:p@ss-w0rd"))
+
+	for _, tc := range []struct{ path, client, want string }{
+		{"/c/", "", fromURL},
+		{"/c/", "Bearer mine", "Bearer mine"},
+		{"/o/", "", fromURL},
+		{"/o/", "Bearer mine", fromURL},
+	} {
+		req := httptest.NewRequest(http.MethodGet, tc.path, nil)
+		if tc.client != "" {
+			req.Header.Set("Authorization", tc.client)
+		}
+		if got := serve(r, req).Body.String(); got != tc.want {
+			t.Errorf("%s with %q: upstream got %q, want %q", tc.path, tc.client, got, tc.want)
+		}
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/admin/routes", nil)
+	req.Header.Set("X-Admin-Token", "s3cret")
+	routes := serve(r, req).Body.String()
+	if !strings.Contains(routes, up.Listener.Addr().String()) {
+		t.Fatalf("admin routes don't list the target: %s", routes)
+	}
+	for what, out := range map[string]string{"logs": logs.String(), "admin routes": routes} {
+		if strings.Contains(out, "p%40ss") || strings.Contains(out, "p@ss") || strings.Contains(out, "svc:") {
+			t.Errorf("%s expose the URL credentials:\n%s", what, out)
+		}
+	}
+	if !strings.Contains(logs.String(), "Proxy URL") {
+		t.Errorf("nothing logged for the proxied requests:\n%s", logs)
+	}
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/rs/zerolog/log"
+)
+
+// Staging aid: lets an admin-authenticated request pick its upstream through a
+// header. Never enable this in production.
+type DebugUpstreamConfig struct {
+	Enabled bool   `yaml:"enabled"`
+	Header  string `yaml:"header"`
+	// host:port values the header may point at; any host when empty
+	AllowedHosts []string `yaml:"allowed_hosts"`
+}
+
+// Context key overriding the upstream base URL for the request
+const upstreamKey = "upstream"
+
+// Context key set when the upstream came from the debug header
+const debugUpstreamKey = "debug_upstream"
+
+// Base URL the request is proxied to
+func upstreamTarget(c *gin.Context, route *Route) string {
+	if target := c.GetString(upstreamKey); target != "" {
+		return target
+	}
+	return route.Target
+}
+
+// Middleware applying the debug upstream override for authorized requests
+func DebugUpstreamMiddleware(cfg DebugUpstreamConfig, admin AdminAuthConfig) gin.HandlerFunc {
+	header := cfg.Header
+	if header == "" {
+		header = "X-Debug-Upstream"
+	}
+	// Without admin auth configured nobody can be authorized, so the override stays off
+	enabled := cfg.Enabled && admin.enabled()
+	auth := newAdminAuthenticator(admin)
+
+	return func(c *gin.Context) {
+		override := c.GetHeader(header)
+		c.Request.Header.Del(header)
+		if override == "" || !enabled {
+			stripAdminToken(c, admin)
+			c.Next()
+			return
+		}
+
+		identity, ok := auth.authenticate(c)
+		stripAdminToken(c, admin)
+		if !ok {
+			log.Warn().Str("remote_ip", c.RemoteIP()).Msg("Ignoring debug upstream override from unauthorized request")
+			c.Next()
+			return
+		}
+
+		target, err := url.Parse(override)
+		if err != nil || (target.Scheme != "http" && target.Scheme != "https") || target.Host == "" ||
+			(len(cfg.AllowedHosts) > 0 && !slices.Contains(cfg.AllowedHosts, target.Host)) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid debug upstream"})
+			c.Abort()
+			return
+		}
+
+		log.Warn().Str("admin", identity).Str("upstream", target.Host).Str("path", c.Request.URL.Path).Msg("Debug upstream override applied")
+		c.Set(upstreamKey, target.Scheme+"://"+target.Host)
+		c.Set(debugUpstreamKey, true)
+		c.Next()
+	}
+}
+
+// Drop the admin token from the upstream request, in either header adminChecks
+// takes it from; any other Authorization is the client's and stays
+func stripAdminToken(c *gin.Context, admin AdminAuthConfig) {
+	c.Request.Header.Del("X-Admin-Token")
+	if admin.Token == "" {
+		return
+	}
+	if bearer, ok := strings.CutPrefix(c.GetHeader("Authorization"), "Bearer "); ok && subtle.ConstantTimeCompare([]byte(bearer), []byte(admin.Token)) == 1 {
+		c.Request.Header.Del("Authorization")
+	}
+}
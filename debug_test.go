@@ -0,0 +1,74 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestDebugUpstreamOverride(t *testing.T) {
+	upstream := func(name string) *httptest.Server {
+		up := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(name + " token=" + r.Header.Get("X-Admin-Token") + " authorization=" + r.Header.Get("Authorization")))
+		}))
+		t.Cleanup(up.Close)
+		return up
+	}
+	regular, staging := upstream("regular"), upstream("staging")
+	route := "routes:\n- prefix: /d\n  target: " + regular.URL + "\n  rate_limit: {rate: 1000, burst: 1000}\n"
+	admin := "admin: {auth: {token: s3cret}}\n"
+	enabled := "debug_upstream: {enabled: true}\n"
+
+	for _, tc := range []struct {
+		name, config, token string
+		bearer              bool
+		want                string
+	}{
+		{"enabled and authorized", admin + enabled + route, "s3cret", false, "staging"},
+		{"enabled and bearer authorized", admin + enabled + route, "s3cret", true, "staging"},
+		{"enabled, wrong token", admin + enabled + route, "guess", false, "regular"},
+		{"enabled, no token", admin + enabled + route, "", false, "regular"},
+		{"disabled", admin + route, "s3cret", false, "regular"},
+		{"disabled, bearer", admin + route, "s3cret", true, "regular"},
+		{"enabled without admin auth", enabled + route, "s3cret", false, "regular"},
+	} {
+		_, r := newTestGateway(t, tc.config)
+		req := httptest.NewRequest(http.MethodGet, "/d/", nil)
+		req.Header.Set("X-Debug-Upstream", staging.URL)
+		if tc.token != "" && tc.bearer {
+			req.Header.Set("Authorization", "Bearer "+tc.token)
+		} else if tc.token != "" {
+			req.Header.Set("X-Admin-Token", tc.token)
+		}
+		w := serve(r, req)
+		// The admin token never reaches an upstream, in either header
+		if w.Code != http.StatusOK || w.Body.String() != tc.want+" token= authorization=" {
+			t.Errorf("%s: %d %q, want %s without credentials", tc.name, w.Code, w.Body, tc.want)
+		}
+	}
+
+	// A client's own Authorization is no admin token and goes through
+	_, r := newTestGateway(t, admin+enabled+route)
+	req := httptest.NewRequest(http.MethodGet, "/d/", nil)
+	req.Header.Set("Authorization", "Bearer user-token")
+	if got := serve(r, req).Body.String(); got != "regular token= authorization=Bearer user-token" {
+		t.Errorf("client credentials: %q", got)
+	}
+}
+
+func TestDebugUpstreamAllowedHosts(t *testing.T) {
+	up := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer up.Close()
+	_, r := newTestGateway(t, "admin: {auth: {token: s3cret}}\ndebug_upstream: {enabled: true, allowed_hosts: [staging.internal:8080]}\n"+
+		"routes:\n- prefix: /d\n  target: "+up.URL+"\n  rate_limit: {rate: 1000, burst: 1000}\n")
+
+	for _, override := range []string{up.URL, "ftp://staging.internal:8080", "not a url"} {
+		req := httptest.NewRequest(http.MethodGet, "/d/", nil)
+		req.Header.Set("X-Debug-Upstream", override)
+		req.Header.Set("X-Admin-Token", "s3cret")
+		if w := serve(r, req); w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), "Invalid debug upstream") {
+			t.Errorf("override %q: %d %s, want 400", override, w.Code, w.Body)
+		}
+	}
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/rs/zerolog/log"
+)
+
+// Content-based de-duplication of mutating requests: a request identical to
+// one from the same client within Window gets the first one's response
+// instead of reaching the upstream again
+type DedupConfig struct {
+	Window time.Duration `yaml:"window"`
+	// Client identity that is part of the key: "ip" (default) or "header:<name>"
+	Key string `yaml:"key"`
+	// Requests with larger bodies, and responses larger than this, aren't deduplicated
+	MaxBody int64 `yaml:"max_body"`
+	// Requests remembered at once; when full, new requests pass undeduplicated
+	MaxEntries int `yaml:"max_entries"`
+}
+
+func (cfg DedupConfig) validate() error {
+	if cfg.Key != "" && cfg.Key != "ip" && !strings.HasPrefix(cfg.Key, "header:") {
+		return fmt.Errorf("dedup: unknown key %q", cfg.Key)
+	}
+	return nil
+}
+
+func (cfg *DedupConfig) setDefaults() {
+	if cfg.MaxBody <= 0 {
+		cfg.MaxBody = 1 << 20
+	}
+	if cfg.MaxEntries <= 0 {
+		cfg.MaxEntries = 10000
+	}
+}
+
+type dedupEntry struct {
+	expires time.Time
+	// Closed once the first request finished; the fields below are set before
+	done chan struct{}
+	ok   bool
+	// The upstream failed (5xx), or the first request panicked or its client
+	// left; the entry was dropped so duplicates are sent again rather than
+	// handed the error
+	failed bool
+	status int
+	header http.Header
+	body   []byte
+}
+
+type dedup struct {
+	cfg DedupConfig
+
+	mu      sync.Mutex
+	entries map[string]*dedupEntry
+}
+
+func newDedup(cfg DedupConfig) *dedup {
+	cfg.setDefaults()
+	return &dedup{cfg: cfg, entries: make(map[string]*dedupEntry)}
+}
+
+func (d *dedup) key(c *gin.Context, body []byte) string {
+	h := sha256.New()
+	for _, part := range []string{clientKey(c, d.cfg.Key), c.Request.Method, c.Request.URL.RequestURI()} {
+		h.Write([]byte(part))
+		h.Write([]byte{0})
+	}
+	h.Write(body)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// The entry of an identical earlier request, or a new one registered for
+// this request. nil when the table is full.
+func (d *dedup) claim(key string) (entry *dedupEntry, first bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	now := time.Now()
+	if entry, ok := d.entries[key]; ok && now.Before(entry.expires) {
+		return entry, false
+	}
+	if len(d.entries) >= d.cfg.MaxEntries {
+		d.sweep(now)
+		if len(d.entries) >= d.cfg.MaxEntries {
+			return nil, false
+		}
+	}
+	entry = &dedupEntry{expires: now.Add(d.cfg.Window), done: make(chan struct{})}
+	d.entries[key] = entry
+	return entry, true
+}
+
+// Drop the entry of a failed request, unless already replaced
+func (d *dedup) forget(key string, entry *dedupEntry) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.entries[key] == entry {
+		delete(d.entries, key)
+	}
+}
+
+// Drop expired entries; those still in flight stay until they finish
+func (d *dedup) sweep(now time.Time) {
+	for key, entry := range d.entries {
+		select {
+		case <-entry.done:
+			if now.After(entry.expires) {
+				delete(d.entries, key)
+			}
+		default:
+		}
+	}
+}
+
+func isMutatingMethod(method string) bool {
+	switch method {
+	case http.MethodPost, http.MethodPut, http.MethodPatch, http.MethodDelete:
+		return true
+	}
+	return false
+}
+
+// Middleware answering duplicates of a recent request with its response.
+// A duplicate arriving while the first is still in flight waits for it. Only
+// 2xx and 4xx responses are replayed: after a 5xx, or when the first request
+// panicked or its client left, the waiting duplicates, and any arriving
+// later, go to the upstream themselves, one at a time.
+func DedupMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		d := routeFromContext(c).dedup
+		if d == nil || !isMutatingMethod(c.Request.Method) {
+			c.Next()
+			return
+		}
+
+		var body []byte
+		if c.Request.Body != nil && c.Request.Body != http.NoBody {
+			var err error
+			body, err = io.ReadAll(io.LimitReader(c.Request.Body, d.cfg.MaxBody+1))
+			c.Request.Body = struct {
+				io.Reader
+				io.Closer
+			}{io.MultiReader(bytes.NewReader(body), c.Request.Body), c.Request.Body}
+			if err != nil || int64(len(body)) > d.cfg.MaxBody {
+				c.Next()
+				return
+			}
+		}
+
+		key := d.key(c, body)
+		entry, first := d.claim(key)
+		for entry != nil && !first {
+			select {
+			case <-entry.done:
+			case <-c.Request.Context().Done():
+				c.Abort()
+				return
+			}
+			if !entry.failed {
+				break
+			}
+			entry, first = d.claim(key)
+		}
+		switch {
+		case entry == nil:
+			c.Next()
+
+		case first:
+			writer := &cacheWriter{ResponseWriter: c.Writer, limit: int(d.cfg.MaxBody)}
+			c.Writer = writer
+			completed := false
+			defer func() {
+				// Also reached when a handler panicked, as when the connection
+				// is dropped on a truncated upstream response
+				if !completed {
+					entry.failed = true
+					d.forget(key, entry)
+				}
+				close(entry.done)
+			}()
+			c.Next()
+			c.Writer = writer.ResponseWriter
+			entry.ok = !writer.overflow
+			entry.status = c.Writer.Status()
+			entry.header = c.Writer.Header().Clone()
+			entry.body = slices.Clone(writer.buf.Bytes())
+			// After a 5xx or the client leaving, the response isn't the upstream's answer to replay
+			completed = entry.status < http.StatusInternalServerError && c.Request.Context().Err() == nil
+
+		default:
+			c.Abort()
+			if !entry.ok {
+				// The first response was too large to replay; forwarding again
+				// would defeat the point
+				c.JSON(http.StatusConflict, gin.H{"error": "Duplicate request"})
+				return
+			}
+			log.Info().Str("path", c.Request.URL.Path).Msg("Duplicate request answered from the first response")
+			for k, v := range entry.header {
+				c.Writer.Header()[k] = v
+			}
+			c.Header("X-Deduplicated", "true")
+			c.Status(entry.status)
+			c.Writer.Write(entry.body)
+		}
+	}
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+// Gateway deduplicating /d, in front of an upstream answering with the
+// statuses in order, repeating the last; arrived, when set, gets a value
+// as each request comes in and the upstream waits on release to answer
+func newDedupGateway(t *testing.T, arrived chan struct{}, release chan struct{}, statuses ...int) (http.Handler, *atomic.Int64) {
+	t.Helper()
+	var calls atomic.Int64
+	up := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := int(calls.Add(1))
+		if arrived != nil {
+			arrived <- struct{}{}
+			<-release
+		}
+		w.WriteHeader(statuses[min(n, len(statuses))-1])
+	}))
+	t.Cleanup(up.Close)
+	_, r := newTestGateway(t, "routes:\n- prefix: /d\n  target: "+up.URL+"\n  rate_limit: {rate: 1000, burst: 1000}\n  dedup: {window: 1m}\n")
+	return r, &calls
+}
+
+func post(h http.Handler) *httptest.ResponseRecorder {
+	return serve(h, httptest.NewRequest(http.MethodPost, "/d/orders", strings.NewReader(`{"item": 1}`)))
+}
+
+// Two identical POSTs within the window make one upstream call; a different
+// body is a different request
+func TestDedupIdenticalPosts(t *testing.T) {
+	r, calls := newDedupGateway(t, nil, nil, http.StatusCreated)
+
+	if w := post(r); w.Code != http.StatusCreated || w.Header().Get("X-Deduplicated") != "" {
+		t.Fatalf("first: %d, X-Deduplicated %q", w.Code, w.Header().Get("X-Deduplicated"))
+	}
+	if w := post(r); w.Code != http.StatusCreated || w.Header().Get("X-Deduplicated") != "true" {
+		t.Fatalf("duplicate: %d, X-Deduplicated %q", w.Code, w.Header().Get("X-Deduplicated"))
+	}
+	if calls.Load() != 1 {
+		t.Fatalf("upstream called %d times for two identical POSTs, want 1", calls.Load())
+	}
+	serve(r, httptest.NewRequest(http.MethodPost, "/d/orders", strings.NewReader(`{"item": 2}`)))
+	if calls.Load() != 2 {
+		t.Fatalf("upstream called %d times after another body, want 2", calls.Load())
+	}
+}
+
+func TestDedupDoesNotReplayServerErrors(t *testing.T) {
+	r, calls := newDedupGateway(t, nil, nil, http.StatusBadGateway, http.StatusCreated)
+
+	if w := post(r); w.Code != http.StatusBadGateway {
+		t.Fatalf("first: %d", w.Code)
+	}
+	if w := post(r); w.Code != http.StatusCreated || w.Header().Get("X-Deduplicated") != "" {
+		t.Fatalf("retry after a 502: %d, X-Deduplicated %q", w.Code, w.Header().Get("X-Deduplicated"))
+	}
+	if w := post(r); w.Code != http.StatusCreated || w.Header().Get("X-Deduplicated") != "true" {
+		t.Fatalf("duplicate of the 201: %d, X-Deduplicated %q", w.Code, w.Header().Get("X-Deduplicated"))
+	}
+	if calls.Load() != 2 {
+		t.Fatalf("upstream called %d times, want 2", calls.Load())
+	}
+}
+
+func TestDedupReplaysClientErrors(t *testing.T) {
+	r, calls := newDedupGateway(t, nil, nil, http.StatusUnprocessableEntity, http.StatusCreated)
+
+	post(r)
+	if w := post(r); w.Code != http.StatusUnprocessableEntity || w.Header().Get("X-Deduplicated") != "true" {
+		t.Fatalf("duplicate of the 422: %d, X-Deduplicated %q", w.Code, w.Header().Get("X-Deduplicated"))
+	}
+	if calls.Load() != 1 {
+		t.Fatalf("upstream called %d times, want 1", calls.Load())
+	}
+}
+
+func TestDedupWaitingDuplicateSentAfterServerError(t *testing.T) {
+	arrived, release := make(chan struct{}, 2), make(chan struct{})
+	r, calls := newDedupGateway(t, arrived, release, http.StatusServiceUnavailable, http.StatusCreated)
+
+	first := make(chan int)
+	go func() { first <- post(r).Code }()
+	<-arrived
+	second := make(chan *httptest.ResponseRecorder)
+	go func() { second <- post(r) }()
+	close(release)
+
+	if code := <-first; code != http.StatusServiceUnavailable {
+		t.Fatalf("first: %d", code)
+	}
+	if w := <-second; w.Code != http.StatusCreated || w.Header().Get("X-Deduplicated") != "" {
+		t.Fatalf("duplicate waiting on a 503: %d, X-Deduplicated %q", w.Code, w.Header().Get("X-Deduplicated"))
+	}
+	if calls.Load() != 2 {
+		t.Fatalf("upstream called %d times, want 2", calls.Load())
+	}
+}
+
+// A first request whose client leaves isn't replayed: the duplicate waiting
+// on it is sent to the upstream itself
+func TestDedupWaitingDuplicateSentAfterClientLeft(t *testing.T) {
+	arrived, release := make(chan struct{}, 2), make(chan struct{})
+	r, calls := newDedupGateway(t, arrived, release, http.StatusCreated)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	first := make(chan int)
+	go func() {
+		req := httptest.NewRequestWithContext(ctx, http.MethodPost, "/d/orders", strings.NewReader(`{"item": 1}`))
+		first <- serve(r, req).Code
+	}()
+	<-arrived
+	second := make(chan *httptest.ResponseRecorder)
+	go func() { second <- post(r) }()
+	cancel()
+	if code := <-first; code != statusClientClosedRequest {
+		t.Fatalf("first: %d, want %d", code, statusClientClosedRequest)
+	}
+	close(release)
+
+	if w := <-second; w.Code != http.StatusCreated || w.Header().Get("X-Deduplicated") != "" {
+		t.Fatalf("duplicate of a request whose client left: %d, X-Deduplicated %q", w.Code, w.Header().Get("X-Deduplicated"))
+	}
+	if calls.Load() != 2 {
+		t.Fatalf("upstream called %d times, want 2", calls.Load())
+	}
+}
+
+// A first request ending in a panic, here the connection dropped on a
+// truncated upstream response, leaves no entry answering 409
+func TestDedupDuplicateSentAfterPanic(t *testing.T) {
+	var calls atomic.Int64
+	up := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if calls.Add(1) == 1 {
+			w.Header().Set("Content-Length", "100")
+			w.Write([]byte("partial"))
+			w.(http.Flusher).Flush()
+			conn, _, _ := w.(http.Hijacker).Hijack()
+			conn.Close()
+			return
+		}
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer up.Close()
+	_, r := newTestGateway(t, "routes:\n- prefix: /d\n  target: "+up.URL+"\n  rate_limit: {rate: 1000, burst: 1000}\n  dedup: {window: 1m}\n")
+	gw := httptest.NewServer(r)
+	defer gw.Close()
+
+	send := func() (*http.Response, error) {
+		resp, err := http.Post(gw.URL+"/d/orders", "application/json", strings.NewReader(`{"item": 1}`))
+		if err == nil {
+			_, err = io.ReadAll(resp.Body)
+			resp.Body.Close()
+		}
+		return resp, err
+	}
+	if _, err := send(); err == nil {
+		t.Fatal("truncated first response read in full")
+	}
+	resp, err := send()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusCreated || resp.Header.Get("X-Deduplicated") != "" {
+		t.Fatalf("duplicate after a panic: %d, X-Deduplicated %q", resp.StatusCode, resp.Header.Get("X-Deduplicated"))
+	}
+	if calls.Load() != 2 {
+		t.Fatalf("upstream called %d times, want 2", calls.Load())
+	}
+}
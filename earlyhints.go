@@ -0,0 +1,77 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptrace"
+	"net/textproto"
+	"sync"
+
+	"github.com/gin-gonic/gin"
+)
+
+// The net/http writer under c.Writer's wrappers, which only record the
+// status until the final response is written
+func netWriter(w http.ResponseWriter) http.ResponseWriter {
+	for {
+		inner, ok := w.(interface{ Unwrap() http.ResponseWriter })
+		if !ok {
+			return w
+		}
+		w = inner.Unwrap()
+	}
+}
+
+// Passes an upstream's 103 Early Hints on to the client while the request
+// waits for the final response. Other 1xx responses are consumed by the
+// transport as before.
+type earlyHints struct {
+	w  http.ResponseWriter
+	mu sync.Mutex
+	// Set once the upstream call returned; the handler owns the writer then
+	done bool
+}
+
+// Forward the 103s req gets with the route's early_hints; stop must be called
+// once the upstream call returned. HTTP/1.0 clients get none, they can't
+// handle interim responses.
+func (route *Route) forwardEarlyHints(c *gin.Context, req *http.Request) (*http.Request, *earlyHints) {
+	if !route.EarlyHints || !c.Request.ProtoAtLeast(1, 1) {
+		return req, nil
+	}
+	hints := &earlyHints{w: netWriter(c.Writer)}
+	trace := &httptrace.ClientTrace{Got1xxResponse: hints.forward}
+	return req.WithContext(httptrace.WithClientTrace(req.Context(), trace)), hints
+}
+
+func (e *earlyHints) forward(code int, header textproto.MIMEHeader) error {
+	links := header.Values("Link")
+	if code != http.StatusEarlyHints || len(links) == 0 {
+		return nil
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.done {
+		return nil
+	}
+	// The 103 carries the links alone; headers set for the final response so
+	// far are put back after it
+	h := e.w.Header()
+	saved := h.Clone()
+	clear(h)
+	h["Link"] = links
+	e.w.WriteHeader(code)
+	clear(h)
+	for name, values := range saved {
+		h[name] = values
+	}
+	return nil
+}
+
+func (e *earlyHints) stop() {
+	if e == nil {
+		return
+	}
+	e.mu.Lock()
+	e.done = true
+	e.mu.Unlock()
+}
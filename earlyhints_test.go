@@ -0,0 +1,58 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httptrace"
+	"net/textproto"
+	"testing"
+)
+
+// An upstream's 103 reaches the client ahead of the final 200 on routes with
+// early_hints, and only there
+func TestEarlyHintsForwarded(t *testing.T) {
+	up := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Link", "</app.css>; rel=preload; as=style")
+		w.WriteHeader(http.StatusEarlyHints)
+		w.Header().Del("Link")
+		w.Header().Set("X-Final", "yes")
+		w.Write([]byte("page"))
+	}))
+	defer up.Close()
+	_, r := newTestGateway(t, "routes:\n"+
+		"- prefix: /hints\n  target: "+up.URL+"\n  rate_limit: {rate: 1000, burst: 1000}\n  early_hints: true\n"+
+		"- prefix: /plain\n  target: "+up.URL+"\n  rate_limit: {rate: 1000, burst: 1000}\n")
+	gw := httptest.NewServer(r)
+	defer gw.Close()
+
+	for path, wantHints := range map[string]bool{"/hints/": true, "/plain/": false} {
+		var interim []int
+		var links []string
+		trace := &httptrace.ClientTrace{Got1xxResponse: func(code int, header textproto.MIMEHeader) error {
+			interim = append(interim, code)
+			links = append(links, header.Values("Link")...)
+			return nil
+		}}
+		req, _ := http.NewRequest(http.MethodGet, gw.URL+path, nil)
+		resp, err := http.DefaultClient.Do(req.WithContext(httptrace.WithClientTrace(req.Context(), trace)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+
+		if resp.StatusCode != http.StatusOK || string(body) != "page" || resp.Header.Get("X-Final") != "yes" {
+			t.Errorf("%s: final response %d %q, X-Final %q", path, resp.StatusCode, body, resp.Header.Get("X-Final"))
+		}
+		if resp.Header.Get("Link") != "" {
+			t.Errorf("%s: final response carries the hint's Link %q", path, resp.Header.Get("Link"))
+		}
+		switch {
+		case wantHints && (len(interim) != 1 || interim[0] != http.StatusEarlyHints || len(links) != 1 || links[0] != "</app.css>; rel=preload; as=style"):
+			t.Errorf("%s: interim responses %v with links %q, want one 103 with the preload link", path, interim, links)
+		case !wantHints && len(interim) > 0:
+			t.Errorf("%s: interim responses %v passed on without early_hints", path, interim)
+		}
+	}
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/rs/zerolog/log"
+)
+
+// What happens to the rest of a request body once the upstream answered
+// without reading all of it, e.g. a 400 or 413 to a large upload. The
+// gateway always stops sending it, forwards the response and reads the
+// rest itself, discarding it, so the client gets the answer instead of
+// waiting for an upload nobody takes.
+type EarlyResponseConfig struct {
+	// Bytes of the rest read and discarded to keep the client connection;
+	// a longer rest closes it after the response. 256KiB by default, as
+	// net/http reads past a handler; -1 always closes.
+	Drain int64 `yaml:"drain"`
+}
+
+const defaultEarlyResponseDrain = 256 << 10
+
+func (cfg EarlyResponseConfig) validate() error {
+	if cfg.Drain < -1 {
+		return fmt.Errorf("early_response: drain must be -1 or more")
+	}
+	return nil
+}
+
+func (cfg EarlyResponseConfig) drain() int64 {
+	switch {
+	case cfg.Drain < 0:
+		return 0
+	case cfg.Drain == 0:
+		return defaultEarlyResponseDrain
+	}
+	return cfg.Drain
+}
+
+// The upstream answered, the rest of the request body isn't sent
+var errEarlyResponse = errors.New("upstream responded before reading the request body")
+
+const (
+	// Time the transport gets to stop reading the body before the read it
+	// is blocked in, waiting for the client, is cut short
+	earlyResponseRelease = time.Second
+	// Limit for draining the rest, when the route has no body_timeout
+	earlyResponseDrainTimeout = 5 * time.Second
+)
+
+// Stop sending the body after the upstream answered with part of it unread.
+// A rest longer than the route drains closes the client connection,
+// announced with the response.
+func (b *clientBody) stopEarly(c *gin.Context, route *Route) {
+	if b == nil {
+		return
+	}
+	length := c.Request.ContentLength
+	b.mu.Lock()
+	// A sized body can be sent in full without EOF being read
+	if b.eof || b.stopped || (length >= 0 && b.read >= length) {
+		b.mu.Unlock()
+		return
+	}
+	select {
+	case <-b.closed:
+		// The transport already gave up on it; net/http deals with the rest
+		b.mu.Unlock()
+		return
+	default:
+	}
+	b.stopped = true
+	read := b.read
+	b.mu.Unlock()
+
+	drain := route.EarlyResponse.drain()
+	if drain == 0 || (length >= 0 && length-read > drain) {
+		c.Header("Connection", "close")
+	}
+	log.Info().Str("route", route.Prefix).Int64("sent", read).Int64("length", length).Msg("Upstream responded before reading the request body, stopped sending it")
+}
+
+// Once the response is out and the upstream's closed, wait for the transport
+// to be done with a body cut short by stopEarly and drain what the route
+// allows of the rest
+func (b *clientBody) finishEarly(c *gin.Context, route *Route) {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	stopped := b.stopped
+	b.mu.Unlock()
+	if !stopped {
+		return
+	}
+	control := http.NewResponseController(c.Writer)
+	select {
+	case <-b.closed:
+	case <-time.After(earlyResponseRelease):
+		// Blocked reading from a stalled client; the connection can't be reused
+		control.SetReadDeadline(time.Now())
+		select {
+		case <-b.closed:
+		case <-time.After(earlyResponseRelease):
+			log.Warn().Str("route", route.Prefix).Msg("Transport still holds the request body after an early response")
+		}
+		return
+	}
+	if drain := route.EarlyResponse.drain(); drain > 0 && c.Writer.Header().Get("Connection") != "close" {
+		timeout := route.BodyTimeout
+		if timeout <= 0 {
+			timeout = earlyResponseDrainTimeout
+		}
+		control.SetReadDeadline(time.Now().Add(timeout))
+		io.Copy(io.Discard, io.LimitReader(b.ReadCloser, drain))
+	}
+	b.ReadCloser.Close()
+}
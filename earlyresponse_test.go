@@ -0,0 +1,106 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httptrace"
+	"strings"
+	"testing"
+	"time"
+)
+
+// An upstream refusing a large upload straight away: the client, still
+// trickling its body, gets the 400 without having to finish, and its
+// connection is closed since the rest is too long to drain
+func TestEarlyResponseDuringUpload(t *testing.T) {
+	up := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("rejected"))
+	}))
+	defer up.Close()
+	_, r := newTestGateway(t, "routes:\n- prefix: /up\n  target: "+up.URL+"\n  rate_limit: {rate: 1000, burst: 1000}\n  timeout: 30s\n")
+	gw := httptest.NewServer(r)
+	defer gw.Close()
+
+	conn, err := net.Dial("tcp", gw.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	const length = 10 << 20
+	fmt.Fprintf(conn, "POST /up/ HTTP/1.1\r\nHost: gw\r\nContent-Length: %d\r\n\r\n", length)
+	conn.Write(make([]byte, 64<<10))
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		chunk := make([]byte, 1024)
+		for {
+			select {
+			case <-stop:
+				return
+			case <-time.After(50 * time.Millisecond):
+				if _, err := conn.Write(chunk); err != nil {
+					return
+				}
+			}
+		}
+	}()
+
+	started := time.Now()
+	conn.SetReadDeadline(started.Add(5 * time.Second))
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		t.Fatalf("no response while uploading: %v", err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusBadRequest || string(body) != "rejected" {
+		t.Errorf("status %d %q, want the upstream's 400", resp.StatusCode, body)
+	}
+	if took := time.Since(started); took > 2*time.Second {
+		t.Errorf("response took %s", took)
+	}
+	if !resp.Close {
+		t.Error("connection kept though most of the 10MiB body is unread")
+	}
+}
+
+// A rest within the drain limit is read and discarded, keeping the client
+// connection for its next request
+func TestEarlyResponseDrainKeepsConnection(t *testing.T) {
+	up := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadRequest)
+	}))
+	defer up.Close()
+	_, r := newTestGateway(t, "routes:\n- prefix: /up\n  target: "+up.URL+"\n  rate_limit: {rate: 1000, burst: 1000}\n")
+	gw := httptest.NewServer(r)
+	defer gw.Close()
+
+	client := gw.Client()
+	var addrs []string
+	for range 2 {
+		req, _ := http.NewRequest(http.MethodPost, gw.URL+"/up/", strings.NewReader(strings.Repeat("x", 200<<10)))
+		req = req.WithContext(httptrace.WithClientTrace(req.Context(), &httptrace.ClientTrace{
+			GotConn: func(info httptrace.GotConnInfo) { addrs = append(addrs, info.Conn.LocalAddr().String()) },
+		}))
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusBadRequest || resp.Close {
+			t.Fatalf("status %d, close %v, want a 400 on a kept connection", resp.StatusCode, resp.Close)
+		}
+	}
+	if len(addrs) != 2 || addrs[0] != addrs[1] {
+		t.Errorf("requests sent from %v, want one connection", addrs)
+	}
+
+	if _, err := parseConfig([]byte("routes:\n- prefix: /x\n  target: " + up.URL + "\n  early_response: {drain: -2}\n")); err == nil {
+		t.Error("drain -2 accepted")
+	}
+}
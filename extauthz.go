@@ -0,0 +1,226 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/textproto"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/rs/zerolog/log"
+)
+
+// External authorization service consulted before proxying
+type ExtAuthzConfig struct {
+	URL     string        `yaml:"url"`
+	Timeout time.Duration `yaml:"timeout"`
+	// Request headers sent to the authz service; all of them when empty
+	Headers []string `yaml:"headers"`
+	// How long allow decisions are reused for identical requests; 0 disables caching
+	CacheTTL time.Duration `yaml:"cache_ttl"`
+	// Let requests through when the authz service can't be reached or answers
+	// with a 5xx
+	FailureModeAllow bool `yaml:"failure_mode_allow"`
+}
+
+// Body sent to the authz service
+type authzCheck struct {
+	Method  string            `json:"method"`
+	Path    string            `json:"path"`
+	Headers map[string]string `json:"headers"`
+}
+
+// Optional body of an allow response; headers are added to the upstream request,
+// claims describe the caller to the gateway (e.g. for tenant tagging)
+type authzResult struct {
+	Headers map[string]string `json:"headers"`
+	Claims  map[string]string `json:"claims"`
+}
+
+// Context key holding the claims returned by the authz service
+const authClaimsKey = "auth_claims"
+
+type authzDecision struct {
+	result  authzResult
+	expires time.Time
+}
+
+type extAuthzClient struct {
+	cfg    ExtAuthzConfig
+	client *http.Client
+
+	mu    sync.Mutex
+	cache map[string]authzDecision
+}
+
+// Upper bound on cached decisions before expired ones are swept
+const maxAuthzCacheEntries = 10000
+
+func newExtAuthzClient(cfg ExtAuthzConfig) *extAuthzClient {
+	timeout := cfg.Timeout
+	if timeout <= 0 {
+		timeout = time.Second
+	}
+	return &extAuthzClient{
+		cfg:    cfg,
+		client: &http.Client{Timeout: timeout},
+		cache:  make(map[string]authzDecision),
+	}
+}
+
+func (a *extAuthzClient) checkRequest(c *gin.Context) authzCheck {
+	check := authzCheck{
+		Method:  c.Request.Method,
+		Path:    c.Request.URL.Path,
+		Headers: make(map[string]string),
+	}
+	if len(a.cfg.Headers) == 0 {
+		for k, v := range c.Request.Header {
+			check.Headers[k] = v[0]
+		}
+	} else {
+		for _, name := range a.cfg.Headers {
+			if v := c.Request.Header.Get(name); v != "" {
+				check.Headers[textproto.CanonicalMIMEHeaderKey(name)] = v
+			}
+		}
+	}
+	return check
+}
+
+func (check authzCheck) cacheKey() string {
+	keys := make([]string, 0, len(check.Headers))
+	for k := range check.Headers {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	h := sha256.New()
+	io.WriteString(h, check.Method+"\n"+check.Path+"\n")
+	for _, k := range keys {
+		io.WriteString(h, k+": "+check.Headers[k]+"\n")
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+func (a *extAuthzClient) cached(key string) (authzDecision, bool) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	decision, ok := a.cache[key]
+	if !ok || time.Now().After(decision.expires) {
+		return authzDecision{}, false
+	}
+	return decision, true
+}
+
+func (a *extAuthzClient) store(key string, result authzResult) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	now := time.Now()
+	if len(a.cache) >= maxAuthzCacheEntries {
+		for k, d := range a.cache {
+			if now.After(d.expires) {
+				delete(a.cache, k)
+			}
+		}
+	}
+	if len(a.cache) < maxAuthzCacheEntries {
+		a.cache[key] = authzDecision{result: result, expires: now.Add(a.cfg.CacheTTL)}
+	}
+}
+
+// Ask the authz service about the request. On deny the service's response is
+// returned. A 5xx is the service failing, not a decision, and an error.
+func (a *extAuthzClient) check(ctx context.Context, check authzCheck) (allowed bool, result authzResult, deny *http.Response, err error) {
+	body, err := json.Marshal(check)
+	if err != nil {
+		return false, result, nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, a.cfg.URL, bytes.NewReader(body))
+	if err != nil {
+		return false, result, nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := a.client.Do(req)
+	if err != nil {
+		return false, result, nil, err
+	}
+	if resp.StatusCode >= 500 {
+		resp.Body.Close()
+		return false, result, nil, fmt.Errorf("authorization service responded with status %d", resp.StatusCode)
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return false, result, resp, nil
+	}
+	defer resp.Body.Close()
+
+	if data, _ := io.ReadAll(io.LimitReader(resp.Body, 64<<10)); len(bytes.TrimSpace(data)) > 0 {
+		if err := json.Unmarshal(data, &result); err != nil {
+			return false, result, nil, err
+		}
+	}
+	return true, result, nil, nil
+}
+
+// Middleware asking the route's external authorization service before proxying
+func ExtAuthzMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		authz := routeFromContext(c).extAuthz
+		if authz == nil {
+			c.Next()
+			return
+		}
+
+		check := authz.checkRequest(c)
+		key := check.cacheKey()
+
+		var result authzResult
+		if decision, ok := authz.cached(key); ok {
+			result = decision.result
+		} else {
+			allowed, allowResult, deny, err := authz.check(c.Request.Context(), check)
+			switch {
+			case err != nil:
+				log.Error().Err(err).Str("path", c.Request.URL.Path).Msg("External authorization failed")
+				sendLogToLoki("External authorization failed", map[string]string{"level": "error", "path": c.Request.URL.Path})
+				if !authz.cfg.FailureModeAllow {
+					c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Authorization service unavailable"})
+					c.Abort()
+					return
+				}
+			case !allowed:
+				defer deny.Body.Close()
+				sendLogToLoki("Request denied by external authorization", map[string]string{"level": "warn", "path": c.Request.URL.Path})
+				contentType := deny.Header.Get("Content-Type")
+				if contentType == "" {
+					contentType = "application/json"
+				}
+				c.DataFromReader(deny.StatusCode, -1, contentType, io.LimitReader(deny.Body, 64<<10), nil)
+				c.Abort()
+				return
+			default:
+				result = allowResult
+				if authz.cfg.CacheTTL > 0 {
+					authz.store(key, result)
+				}
+			}
+		}
+
+		for k, v := range result.Headers {
+			c.Request.Header.Set(k, v)
+		}
+		if result.Claims != nil {
+			c.Set(authClaimsKey, result.Claims)
+		}
+		c.Next()
+	}
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+func newAuthzGateway(t *testing.T, authzStatus int, failureModeAllow bool) http.Handler {
+	t.Helper()
+	authz := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(authzStatus)
+		w.Write([]byte(`{"error":"from authz"}`))
+	}))
+	t.Cleanup(authz.Close)
+	up := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("upstream"))
+	}))
+	t.Cleanup(up.Close)
+	mode := "false"
+	if failureModeAllow {
+		mode = "true"
+	}
+	_, r := newTestGateway(t, "routes:\n- prefix: /a\n  target: "+up.URL+"\n  rate_limit: {rate: 1000, burst: 1000}\n"+
+		"  ext_authz: {url: "+authz.URL+", failure_mode_allow: "+mode+"}\n")
+	return r
+}
+
+func TestExtAuthzServerErrorIsFailure(t *testing.T) {
+	for _, status := range []int{http.StatusInternalServerError, http.StatusServiceUnavailable} {
+		w := serve(newAuthzGateway(t, status, false), httptest.NewRequest(http.MethodGet, "/a/", nil))
+		if w.Code != http.StatusServiceUnavailable || !strings.Contains(w.Body.String(), "Authorization service unavailable") {
+			t.Errorf("authz %d, failure_mode_allow off: %d %s", status, w.Code, w.Body)
+		}
+
+		w = serve(newAuthzGateway(t, status, true), httptest.NewRequest(http.MethodGet, "/a/", nil))
+		if w.Code != http.StatusOK || w.Body.String() != "upstream" {
+			t.Errorf("authz %d, failure_mode_allow on: %d %s", status, w.Code, w.Body)
+		}
+	}
+}
+
+func TestExtAuthzDenyPassedThrough(t *testing.T) {
+	// failure_mode_allow doesn't apply to decisions
+	w := serve(newAuthzGateway(t, http.StatusForbidden, true), httptest.NewRequest(http.MethodGet, "/a/", nil))
+	if w.Code != http.StatusForbidden || !strings.Contains(w.Body.String(), "from authz") {
+		t.Fatalf("deny: %d %s", w.Code, w.Body)
+	}
+}
+
+// The authz service sees the request and allows it with headers for the
+// upstream, or denies it and the client gets its response
+func TestExtAuthzAllowDenyAndHeaders(t *testing.T) {
+	var checks atomic.Int64
+	authz := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		checks.Add(1)
+		var check authzCheck
+		if err := json.NewDecoder(r.Body).Decode(&check); err != nil {
+			t.Error(err)
+		}
+		if check.Headers["Authorization"] != "Bearer good" {
+			w.WriteHeader(http.StatusUnauthorized)
+			w.Write([]byte(`{"error":"bad credentials"}`))
+			return
+		}
+		json.NewEncoder(w).Encode(authzResult{Headers: map[string]string{"X-User-Id": "u-42", "X-Checked-Path": check.Path}})
+	}))
+	defer authz.Close()
+	up := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.Header.Get("X-User-Id") + " " + r.Header.Get("X-Checked-Path")))
+	}))
+	defer up.Close()
+	_, r := newTestGateway(t, "routes:\n- prefix: /a\n  target: "+up.URL+"\n  rate_limit: {rate: 1000, burst: 1000}\n"+
+		"  ext_authz: {url: "+authz.URL+", headers: [Authorization], cache_ttl: 1m}\n")
+
+	request := func(token string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/a/orders", nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		return serve(r, req)
+	}
+	if w := request("good"); w.Code != http.StatusOK || w.Body.String() != "u-42 /a/orders" {
+		t.Errorf("allowed: %d %q, want the injected headers upstream", w.Code, w.Body)
+	}
+	if w := request("bad"); w.Code != http.StatusUnauthorized || !strings.Contains(w.Body.String(), "bad credentials") {
+		t.Errorf("denied: %d %s", w.Code, w.Body)
+	}
+
+	// The allow decision is cached, denials are not
+	request("good")
+	request("bad")
+	if got := checks.Load(); got != 3 {
+		t.Errorf("authz service asked %d times, want 3", got)
+	}
+}
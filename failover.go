@@ -0,0 +1,114 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"sync/atomic"
+
+	"github.com/rs/zerolog/log"
+)
+
+// One tier of a pool's ordered failover, e.g. the members of one region.
+// Traffic goes to the first tier with at least min_healthy members passing
+// their health checks.
+type FailoverTierConfig struct {
+	Name    string   `yaml:"name"`
+	Members []string `yaml:"members"`
+	// Healthy members the tier needs to take traffic; 1 by default. A tier
+	// down to fewer hands its traffic to the next one as a whole.
+	MinHealthy int `yaml:"min_healthy"`
+}
+
+func validateFailover(tiers []FailoverTierConfig, pool []string, health HealthCheckConfig) error {
+	if len(tiers) == 0 {
+		return nil
+	}
+	if health.Path == "" {
+		return fmt.Errorf("failover: needs a health_check to gate tiers")
+	}
+	var seen []string
+	for i, tier := range tiers {
+		if len(tier.Members) == 0 {
+			return fmt.Errorf("failover: tier %d has no members", i+1)
+		}
+		if tier.MinHealthy < 0 || tier.MinHealthy > len(tier.Members) {
+			return fmt.Errorf("failover: tier %d min_healthy must be between 0 and its %d members", i+1, len(tier.Members))
+		}
+		for _, member := range tier.Members {
+			if !slices.Contains(pool, member) {
+				return fmt.Errorf("failover: %q is not a pool member", member)
+			}
+			if slices.Contains(seen, member) {
+				return fmt.Errorf("failover: %q is in more than one tier", member)
+			}
+			seen = append(seen, member)
+		}
+	}
+	if len(seen) != len(pool) {
+		return fmt.Errorf("failover: every pool member must be in a tier")
+	}
+	return nil
+}
+
+type failoverTier struct {
+	name       string
+	members    []string
+	minHealthy int
+}
+
+// A pool's tiers and the one traffic went to last, to log failovers once
+type failover struct {
+	prefix string
+	tiers  []failoverTier
+	active atomic.Int64
+}
+
+func newFailover(prefix string, cfg []FailoverTierConfig) *failover {
+	if len(cfg) == 0 {
+		return nil
+	}
+	f := &failover{prefix: prefix}
+	for i, tier := range cfg {
+		name := tier.Name
+		if name == "" {
+			name = fmt.Sprintf("tier %d", i+1)
+		}
+		f.tiers = append(f.tiers, failoverTier{name: name, members: tier.Members, minHealthy: max(tier.MinHealthy, 1)})
+	}
+	return f
+}
+
+// Members of the tier taking traffic. Before any check passed that is the
+// first tier; with no tier healthy enough, the healthy members of any tier,
+// or every member in panic mode.
+func (f *failover) candidates(h *poolHealth, members []string) []string {
+	if f == nil {
+		return h.usable(members)
+	}
+	if h == nil || !h.anyPassed.Load() {
+		return f.tiers[0].members
+	}
+	for i, tier := range f.tiers {
+		healthy := h.healthyOf(tier.members)
+		if len(healthy) >= tier.minHealthy {
+			f.activate(i)
+			return healthy
+		}
+	}
+	f.activate(-1)
+	return h.usable(members)
+}
+
+func (f *failover) activate(tier int) {
+	previous := int(f.active.Swap(int64(tier)))
+	if previous == tier {
+		return
+	}
+	if tier < 0 {
+		log.Warn().Str("route", f.prefix).Msg("No failover tier healthy enough, balancing across every healthy member")
+		sendLogToLoki("No failover tier healthy enough", map[string]string{"level": "warn", "path": f.prefix})
+		return
+	}
+	log.Warn().Str("route", f.prefix).Str("tier", f.tiers[tier].name).Msg("Failover tier now taking traffic")
+	sendLogToLoki("Failover tier now taking traffic: "+f.tiers[tier].name, map[string]string{"level": "warn", "path": f.prefix})
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"maps"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// Regions going unhealthy one after the other move traffic down the tiers,
+// and back up as they recover. Checks run on the health loop's 1s tick, so
+// each step takes about a second.
+func TestFailoverTiers(t *testing.T) {
+	healthy := map[string]*atomic.Bool{}
+	urls := map[string]string{}
+	for _, name := range []string{"eu1", "eu2", "us1", "ap1"} {
+		healthy[name] = new(atomic.Bool)
+		healthy[name].Store(true)
+		up := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path == "/healthz" {
+				if !healthy[name].Load() {
+					w.WriteHeader(http.StatusServiceUnavailable)
+				}
+				return
+			}
+			w.Write([]byte(name))
+		}))
+		t.Cleanup(up.Close)
+		urls[name] = "'" + up.URL + "'"
+	}
+	_, r := newTestGateway(t, "routes:\n- prefix: /geo\n  rate_limit: {rate: 10000, burst: 10000}\n"+
+		"  pool: ["+urls["eu1"]+", "+urls["eu2"]+", "+urls["us1"]+", "+urls["ap1"]+"]\n"+
+		"  health_check: {path: /healthz, interval: 20ms, timeout: 1s}\n  failover:\n"+
+		"  - {name: eu, members: ["+urls["eu1"]+", "+urls["eu2"]+"], min_healthy: 2}\n"+
+		"  - {name: us, members: ["+urls["us1"]+"]}\n"+
+		"  - {name: ap, members: ["+urls["ap1"]+"]}\n")
+
+	// Members serving a round of requests
+	served := func() []string {
+		seen := map[string]bool{}
+		for range 8 {
+			seen[serve(r, httptest.NewRequest(http.MethodGet, "/geo/", nil)).Body.String()] = true
+		}
+		return slices.Sorted(maps.Keys(seen))
+	}
+	expect := func(step string, want ...string) {
+		t.Helper()
+		var got []string
+		for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+			if got = served(); slices.Equal(got, want) {
+				return
+			}
+		}
+		t.Fatalf("%s: served by %v, want %v", step, got, want)
+	}
+
+	expect("all healthy", "eu1", "eu2")
+	healthy["eu2"].Store(false)
+	expect("eu under min_healthy", "us1")
+	healthy["us1"].Store(false)
+	expect("us down", "ap1")
+	healthy["ap1"].Store(false)
+	// No tier left: the one healthy member anywhere
+	expect("ap down", "eu1")
+	healthy["eu1"].Store(false)
+	expect("all down", "ap1", "eu1", "eu2", "us1")
+	healthy["us1"].Store(true)
+	expect("us back", "us1")
+	healthy["eu1"].Store(true)
+	healthy["eu2"].Store(true)
+	expect("eu back", "eu1", "eu2")
+
+	pool := "\n  pool: ['http://a', 'http://b']\n  health_check: {path: /healthz}\n"
+	for _, failover := range []string{
+		"  failover: [{members: ['http://a']}]\n",
+		"  failover: [{members: ['http://a', 'http://b']}, {members: ['http://b']}]\n",
+		"  failover: [{members: ['http://a', 'http://c']}]\n",
+		"  failover: [{members: ['http://a'], min_healthy: 2}, {members: ['http://b']}]\n",
+	} {
+		if _, err := parseConfig([]byte("routes:\n- prefix: /x" + pool + failover)); err == nil {
+			t.Errorf("accepted %s", failover)
+		}
+	}
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/rs/zerolog/log"
+	"github.com/sony/gobreaker/v2"
+)
+
+// Every upstream of a fallback chain failed or was skipped as unhealthy
+var errFallbackExhausted = errors.New("all upstreams failed")
+
+// Check upstream base URLs listed under field
+func validateUpstreams(field string, targets []string) error {
+	for _, target := range targets {
+		u, err := url.Parse(target)
+		if err != nil || u.Scheme == "" || u.Host == "" {
+			return fmt.Errorf("%s: invalid upstream %q", field, target)
+		}
+	}
+	return nil
+}
+
+type chainUpstream struct {
+	target string
+	// Tracks this upstream alone; open means unhealthy and skipped
+	breaker *gobreaker.CircuitBreaker[any]
+}
+
+// The route's target followed by its fallbacks, in priority order
+type upstreamChain struct {
+	upstreams []chainUpstream
+}
+
+func newUpstreamChain(rc RouteConfig) *upstreamChain {
+	chain := &upstreamChain{}
+	for _, target := range append([]string{rc.Target}, rc.Fallback...) {
+		chain.upstreams = append(chain.upstreams, chainUpstream{
+			target:  target,
+			breaker: newBreaker(rc.Prefix+" "+redactURL(target), rc.CircuitBreaker, nil),
+		})
+	}
+	return chain
+}
+
+// Point req at the same path on another upstream
+func retarget(req *http.Request, target, rest string) error {
+	u, err := url.Parse(target + rest)
+	if err != nil {
+		return err
+	}
+	req.URL = u
+	req.Host = u.Host
+	return nil
+}
+
+// Send req through the route's fallback chain: each upstream in turn, with
+// the route's retries, until one answers below 500. Upstreams are only moved
+// past for requests the retry settings allow resending; anything else goes
+// to the first healthy upstream only. Requests sent to an overridden upstream
+// (debug header, A/B variant, schedule) don't fall back.
+func (route *Route) sendChain(c *gin.Context, req *http.Request) (*http.Response, error) {
+	if route.fallback == nil || c.GetString(upstreamKey) != "" {
+		return route.send(req)
+	}
+	resendable := route.Retry.retryableMethod(req.Method) && bufferBody(req, route.Retry.MaxBody)
+
+	// Soonest an upstream that failed said it could take requests again,
+	// passed on to the client when none answered
+	var retryAfter time.Duration
+	noteRetryAfter := func(d time.Duration) {
+		if d > 0 && (retryAfter == 0 || d < retryAfter) {
+			retryAfter = d
+		}
+	}
+	for i, upstream := range route.fallback.upstreams {
+		if upstream.breaker.State() == gobreaker.StateOpen {
+			log.Debug().Str("route", route.Prefix).Str("upstream", redactURL(upstream.target)).Msg("Skipping unhealthy upstream")
+			continue
+		}
+		if err := retarget(req, upstream.target, upstreamPath(c, route)); err != nil {
+			return nil, err
+		}
+		if left := route.cooldowns.remaining(req.URL); left > 0 && resendable {
+			noteRetryAfter(left)
+			continue
+		}
+		if req.GetBody != nil {
+			req.Body, _ = req.GetBody()
+		}
+
+		var (
+			resp    *http.Response
+			sendErr error
+		)
+		_, err := upstream.breaker.Execute(func() (any, error) {
+			resp, sendErr = route.send(req)
+			if sendErr != nil {
+				return nil, classifyClientError(req.Context(), sendErr)
+			}
+			if resp.StatusCode >= 500 {
+				return nil, &upstreamStatusError{status: resp.StatusCode}
+			}
+			return nil, nil
+		})
+		if errors.Is(err, gobreaker.ErrOpenState) || errors.Is(err, gobreaker.ErrTooManyRequests) {
+			continue
+		}
+		if err == nil || !resendable || req.Context().Err() != nil {
+			if i > 0 {
+				upstreamFallbacks.WithLabelValues(route.Prefix, redactURL(upstream.target)).Inc()
+				// Lets the served-by header name the upstream that answered
+				c.Set(upstreamKey, upstream.target)
+			}
+			return resp, sendErr
+		}
+
+		log.Warn().Err(err).Str("route", route.Prefix).Str("upstream", redactURL(upstream.target)).Msg("Upstream failed, trying next fallback")
+		sendLogToLoki("Upstream failed, trying next fallback", map[string]string{"level": "warn", "path": c.Request.URL.Path})
+		noteRetryAfter(retryAfterOf(resp, sendErr))
+		if resp != nil {
+			io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+			resp.Body.Close()
+		}
+	}
+	if retryAfter > 0 {
+		c.Header("Retry-After", retryAfterValue(retryAfter))
+	}
+	return nil, errFallbackExhausted
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// A failing primary, erroring or unreachable, is passed over for the healthy
+// secondary, which serves the request; with every upstream failing it's a 502
+func TestFallbackChain(t *testing.T) {
+	upstream := func(status int, body string) string {
+		up := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(status)
+			w.Write([]byte(body))
+		}))
+		t.Cleanup(up.Close)
+		return up.URL
+	}
+	failing, secondary := upstream(http.StatusServiceUnavailable, "primary"), upstream(http.StatusOK, "secondary")
+	const unreachable = "http://127.0.0.1:1"
+	_, r := newTestGateway(t, "routes:\n"+
+		"- prefix: /erroring\n  target: "+failing+"\n  fallback: ['"+secondary+"']\n  rate_limit: {rate: 1000, burst: 1000}\n"+
+		"- prefix: /down\n  target: "+unreachable+"\n  fallback: ['"+secondary+"']\n  rate_limit: {rate: 1000, burst: 1000}\n"+
+		"- prefix: /all\n  target: "+failing+"\n  fallback: ['"+unreachable+"']\n  rate_limit: {rate: 1000, burst: 1000}\n")
+
+	for _, prefix := range []string{"/erroring", "/down"} {
+		fallbacks := upstreamFallbacks.WithLabelValues(prefix, secondary)
+		before := counterValue(t, fallbacks)
+		if w := serve(r, httptest.NewRequest(http.MethodGet, prefix+"/", nil)); w.Code != http.StatusOK || w.Body.String() != "secondary" {
+			t.Errorf("%s: %d %q, want the secondary's answer", prefix, w.Code, w.Body)
+		}
+		if got := counterValue(t, fallbacks) - before; got != 1 {
+			t.Errorf("%s: fallbacks counted: %v, want 1", prefix, got)
+		}
+	}
+	if w := serve(r, httptest.NewRequest(http.MethodGet, "/all/", nil)); w.Code != http.StatusBadGateway {
+		t.Errorf("every upstream failing: status %d, want 502", w.Code)
+	}
+}
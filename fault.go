@@ -0,0 +1,96 @@
+package main
+
+import (
+	"fmt"
+	"math/rand/v2"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/rs/zerolog/log"
+)
+
+// Failures injected into a share of a route's requests for chaos testing.
+// Nothing is injected unless Enabled is set, here or through the admin API.
+type FaultConfig struct {
+	Enabled bool             `yaml:"enabled"`
+	Delay   FaultDelayConfig `yaml:"delay"`
+	Abort   FaultAbortConfig `yaml:"abort"`
+	// Percentage of requests whose client connection is dropped without a response
+	ResetPercent float64 `yaml:"reset_percent"`
+}
+
+type FaultDelayConfig struct {
+	Percent  float64       `yaml:"percent"`
+	Duration time.Duration `yaml:"duration"`
+}
+
+type FaultAbortConfig struct {
+	Percent float64 `yaml:"percent"`
+	// Status sent instead of proxying; 503 by default
+	Status int `yaml:"status"`
+}
+
+func (cfg FaultConfig) configured() bool {
+	return cfg.Delay.Percent > 0 || cfg.Abort.Percent > 0 || cfg.ResetPercent > 0
+}
+
+func (cfg FaultConfig) validate() error {
+	for _, p := range []float64{cfg.Delay.Percent, cfg.Abort.Percent, cfg.ResetPercent} {
+		if p < 0 || p > 100 {
+			return fmt.Errorf("fault: percentages must be between 0 and 100")
+		}
+	}
+	if cfg.Abort.Percent+cfg.ResetPercent > 100 {
+		return fmt.Errorf("fault: abort and reset percentages add up to more than 100")
+	}
+	return nil
+}
+
+type faultInjector struct {
+	cfg     FaultConfig
+	enabled atomic.Bool
+	// Uniform in [0, 100); replaced in tests
+	roll func() float64
+}
+
+func newFaultInjector(cfg FaultConfig) *faultInjector {
+	if cfg.Abort.Status == 0 {
+		cfg.Abort.Status = http.StatusServiceUnavailable
+	}
+	f := &faultInjector{cfg: cfg, roll: func() float64 { return rand.Float64() * 100 }}
+	f.enabled.Store(cfg.Enabled)
+	return f
+}
+
+// Middleware injecting the route's configured failures while they are enabled
+func FaultMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		f := routeFromContext(c).faults
+		if f == nil || !f.enabled.Load() {
+			c.Next()
+			return
+		}
+
+		if f.cfg.Delay.Percent > 0 && f.roll() < f.cfg.Delay.Percent {
+			select {
+			case <-time.After(f.cfg.Delay.Duration):
+			case <-c.Request.Context().Done():
+			}
+		}
+
+		// One roll decides between abort, reset and passing through
+		switch roll := f.roll(); {
+		case roll < f.cfg.Abort.Percent:
+			log.Debug().Str("path", c.Request.URL.Path).Msg("Injected fault: abort")
+			c.JSON(f.cfg.Abort.Status, gin.H{"error": "Injected fault"})
+			c.Abort()
+			return
+		case roll < f.cfg.Abort.Percent+f.cfg.ResetPercent:
+			log.Debug().Str("path", c.Request.URL.Path).Msg("Injected fault: connection reset")
+			panic(http.ErrAbortHandler)
+		}
+		c.Next()
+	}
+}
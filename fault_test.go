@@ -0,0 +1,113 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// Rolls stepping evenly through [0, 100), so every percentage is hit exactly
+func evenRolls() func() float64 {
+	var n atomic.Int64
+	return func() float64 { return float64((n.Add(1) - 1) % 100) }
+}
+
+func TestFaultInjectionPercentages(t *testing.T) {
+	up := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer up.Close()
+	g, r := newTestGateway(t, "routes:\n- prefix: /f\n  target: "+up.URL+"\n  rate_limit: {rate: 10000, burst: 10000}\n"+
+		"  fault: {enabled: true, abort: {percent: 20}, reset_percent: 10}\n")
+	g.routes()[0].faults.roll = evenRolls()
+	// A reset drops the connection, which needs a real server
+	gateway := httptest.NewServer(r)
+	defer gateway.Close()
+
+	// Fresh connections, as net/http silently retries a GET on a reused one that drops
+	client := &http.Client{Transport: &http.Transport{DisableKeepAlives: true}}
+	outcomes := map[string]int{}
+	for range 200 {
+		resp, err := client.Get(gateway.URL + "/f/")
+		if err != nil {
+			outcomes["reset"]++
+			continue
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		switch {
+		case resp.StatusCode == http.StatusServiceUnavailable && strings.Contains(string(body), "Injected fault"):
+			outcomes["abort"]++
+		case resp.StatusCode == http.StatusOK:
+			outcomes["ok"]++
+		default:
+			t.Fatalf("status %d: %s", resp.StatusCode, body)
+		}
+	}
+	if outcomes["abort"] != 40 || outcomes["reset"] != 20 || outcomes["ok"] != 140 {
+		t.Errorf("outcomes %v, want 20%% aborted and 10%% reset of 200", outcomes)
+	}
+}
+
+func TestFaultInjectionDelay(t *testing.T) {
+	up := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer up.Close()
+	g, r := newTestGateway(t, "routes:\n- prefix: /f\n  target: "+up.URL+"\n  rate_limit: {rate: 10000, burst: 10000}\n"+
+		"  fault: {enabled: true, delay: {percent: 50, duration: 20ms}}\n")
+	// The delay roll alternates under and over 50; the abort roll never aborts
+	var n atomic.Int64
+	g.routes()[0].faults.roll = func() float64 {
+		if n.Add(1)%4 == 1 {
+			return 0
+		}
+		return 99
+	}
+
+	delayed := 0
+	for range 10 {
+		started := time.Now()
+		if w := serve(r, httptest.NewRequest(http.MethodGet, "/f/", nil)); w.Code != http.StatusOK {
+			t.Fatalf("status %d", w.Code)
+		}
+		if time.Since(started) >= 20*time.Millisecond {
+			delayed++
+		}
+	}
+	if delayed != 5 {
+		t.Errorf("%d of 10 requests delayed, want 5", delayed)
+	}
+}
+
+// Faults stay off until enabled, and the admin API toggles them
+func TestFaultInjectionAdminToggle(t *testing.T) {
+	up := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer up.Close()
+	g, r := newTestGateway(t, "routes:\n- prefix: /f\n  target: "+up.URL+"\n  rate_limit: {rate: 10000, burst: 10000}\n"+
+		"  fault: {abort: {percent: 100, status: 500}}\n")
+	if err := registerAdminRoutes(r, AdminConfig{Auth: AdminAuthConfig{Token: "s3cret"}}, g); err != nil {
+		t.Fatal(err)
+	}
+	toggle := func(enabled string) int {
+		req := httptest.NewRequest(http.MethodPost, "/admin/faults", strings.NewReader(`{"route": "/f", "enabled": `+enabled+`}`))
+		req.Header.Set("X-Admin-Token", "s3cret")
+		req.Header.Set("Content-Type", "application/json")
+		return serve(r, req).Code
+	}
+	status := func() int { return serve(r, httptest.NewRequest(http.MethodGet, "/f/", nil)).Code }
+
+	if got := status(); got != http.StatusOK {
+		t.Fatalf("before enabling: %d, want no fault", got)
+	}
+	if code := toggle("true"); code != http.StatusOK {
+		t.Fatalf("enabling: %d", code)
+	}
+	if got := status(); got != http.StatusInternalServerError {
+		t.Fatalf("enabled: %d, want the injected 500", got)
+	}
+	toggle("false")
+	if got := status(); got != http.StatusOK {
+		t.Fatalf("disabled again: %d", got)
+	}
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"fmt"
+	"hash/fnv"
+	"slices"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Flag resolved for every request and forwarded to the upstream as
+// X-Feature-<Name>: on|off, so backends roll a feature out consistently
+type FeatureFlagConfig struct {
+	Name string `yaml:"name"`
+	// Share of clients, 0-100, the flag is on for
+	Percent float64 `yaml:"percent"`
+	// Attribute keeping a client's percentage decision stable: "ip" (default),
+	// "header:<name>", "cookie:<name>" or "claim:<name>"
+	StickyKey string `yaml:"sticky_key"`
+	// The flag is on for requests matching any rule, whatever Percent says
+	Rules []FlagRule `yaml:"rules"`
+}
+
+// Matches requests whose attribute has one of Values
+type FlagRule struct {
+	Attribute string   `yaml:"attribute"`
+	Values    []string `yaml:"values"`
+}
+
+// Context key holding the resolved flags, e.g. "NewCheckout=on"
+const featureFlagsKey = "feature_flags"
+
+// Names go into a header name, so letters, digits and dashes only
+func validFlagName(name string) bool {
+	if name == "" {
+		return false
+	}
+	for _, r := range name {
+		if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '-') {
+			return false
+		}
+	}
+	return true
+}
+
+func validAttribute(spec string) bool {
+	if spec == "ip" {
+		return true
+	}
+	for _, prefix := range []string{"header:", "cookie:", "claim:"} {
+		if name, ok := strings.CutPrefix(spec, prefix); ok && name != "" {
+			return true
+		}
+	}
+	return false
+}
+
+func validateFeatureFlags(flags []FeatureFlagConfig) error {
+	seen := make(map[string]bool, len(flags))
+	for _, flag := range flags {
+		if !validFlagName(flag.Name) {
+			return fmt.Errorf("feature_flags: invalid name %q", flag.Name)
+		}
+		key := strings.ToLower(flag.Name)
+		if seen[key] {
+			return fmt.Errorf("feature_flags: duplicate flag %q", flag.Name)
+		}
+		seen[key] = true
+		if flag.Percent < 0 || flag.Percent > 100 {
+			return fmt.Errorf("feature_flags: %s: percent must be between 0 and 100", flag.Name)
+		}
+		if flag.StickyKey != "" && !validAttribute(flag.StickyKey) {
+			return fmt.Errorf("feature_flags: %s: unknown sticky_key %q", flag.Name, flag.StickyKey)
+		}
+		for _, rule := range flag.Rules {
+			if !validAttribute(rule.Attribute) {
+				return fmt.Errorf("feature_flags: %s: unknown rule attribute %q", flag.Name, rule.Attribute)
+			}
+		}
+	}
+	return nil
+}
+
+// Value of an attribute spec for the request, "" when absent
+func requestAttribute(c *gin.Context, spec string) string {
+	if name, ok := strings.CutPrefix(spec, "header:"); ok {
+		return c.GetHeader(name)
+	}
+	if name, ok := strings.CutPrefix(spec, "cookie:"); ok {
+		value, _ := c.Cookie(name)
+		return value
+	}
+	if name, ok := strings.CutPrefix(spec, "claim:"); ok {
+		claims, _ := c.Value(authClaimsKey).(map[string]string)
+		return claims[name]
+	}
+	// Forwarded for only behind trusted_proxies, so clients can't pick their bucket
+	return c.ClientIP()
+}
+
+func (flag FeatureFlagConfig) enabled(c *gin.Context) bool {
+	for _, rule := range flag.Rules {
+		if slices.Contains(rule.Values, requestAttribute(c, rule.Attribute)) {
+			return true
+		}
+	}
+	if flag.Percent >= 100 {
+		return true
+	}
+	spec := flag.StickyKey
+	if spec == "" {
+		spec = "ip"
+	}
+	key := requestAttribute(c, spec)
+	if key == "" || flag.Percent <= 0 {
+		return false
+	}
+	// Hashing the name too keeps flags from switching on for the same clients
+	h := fnv.New32a()
+	h.Write([]byte(flag.Name + "\x00" + key))
+	return float64(h.Sum32()%10000) < flag.Percent*100
+}
+
+// Middleware resolving the configured flags and setting them as request
+// headers, replacing any sent by the client. Runs after ext_authz so rules
+// can look at claims.
+func FeatureFlagsMiddleware(flags []FeatureFlagConfig) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if len(flags) == 0 {
+			c.Next()
+			return
+		}
+		resolved := make([]string, 0, len(flags))
+		for _, flag := range flags {
+			state := "off"
+			if flag.enabled(c) {
+				state = "on"
+			}
+			c.Request.Header.Set("X-Feature-"+flag.Name, state)
+			resolved = append(resolved, flag.Name+"="+state)
+		}
+		c.Set(featureFlagsKey, strings.Join(resolved, ","))
+		c.Next()
+	}
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func newFlagsEngine(t *testing.T, trusted []string, flags ...FeatureFlagConfig) *gin.Engine {
+	t.Helper()
+	if err := validateFeatureFlags(flags); err != nil {
+		t.Fatal(err)
+	}
+	gin.SetMode(gin.ReleaseMode)
+	r := gin.New()
+	if err := r.SetTrustedProxies(trusted); err != nil {
+		t.Fatal(err)
+	}
+	r.Use(FeatureFlagsMiddleware(flags))
+	r.GET("/", func(c *gin.Context) { c.String(http.StatusOK, c.GetString(featureFlagsKey)) })
+	return r
+}
+
+func flagsFor(r http.Handler, forwardedFor string) string {
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.RemoteAddr = "198.51.100.7:4000"
+	req.Header.Set("X-Forwarded-For", forwardedFor)
+	return serve(r, req).Body.String()
+}
+
+func TestFlagIPRuleIgnoresUntrustedForwardedFor(t *testing.T) {
+	flag := FeatureFlagConfig{Name: "Internal", Rules: []FlagRule{{Attribute: "ip", Values: []string{"203.0.113.1"}}}}
+
+	if got := flagsFor(newFlagsEngine(t, nil, flag), "203.0.113.1"); got != "Internal=off" {
+		t.Fatalf("spoofed X-Forwarded-For: %s", got)
+	}
+	if got := flagsFor(newFlagsEngine(t, []string{"198.51.100.0/24"}, flag), "203.0.113.1"); got != "Internal=on" {
+		t.Fatalf("behind a trusted proxy: %s", got)
+	}
+}
+
+func TestFlagBucketIgnoresUntrustedForwardedFor(t *testing.T) {
+	r := newFlagsEngine(t, nil, FeatureFlagConfig{Name: "Half", Percent: 50})
+
+	// One peer lands in one bucket, whatever it claims to forward for
+	want := flagsFor(r, "203.0.113.0")
+	for i := 1; i < 50; i++ {
+		if got := flagsFor(r, fmt.Sprint("203.0.113.", i)); got != want {
+			t.Fatalf("X-Forwarded-For 203.0.113.%d moved the peer from %s to %s", i, want, got)
+		}
+	}
+}
+
+// A percentage flag lands a sticky key in the same bucket on every request,
+// and the upstream gets the decision as X-Feature-<Name>, not what the client sent
+func TestFlagForwardedConsistentlyPerStickyKey(t *testing.T) {
+	_, r := newTestGateway(t, "feature_flags:\n- {name: Half, percent: 50, sticky_key: 'header:X-User'}\n"+
+		"routes:\n- prefix: /f\n  target: "+headerEcho(t)+"\n  rate_limit: {rate: 1000, burst: 1000}\n")
+
+	states := map[string]int{}
+	for i := range 40 {
+		user := fmt.Sprint("user-", i)
+		var first string
+		for j := range 3 {
+			req := httptest.NewRequest(http.MethodGet, "/f/", nil)
+			req.Header.Set("X-User", user)
+			req.Header.Set("X-Feature-Half", "spoofed")
+			// Another address each time: the sticky key decides, not the IP
+			req.RemoteAddr = fmt.Sprintf("198.51.100.%d:4000", j+1)
+			got := upstreamHeaders(t, r, req).Get("X-Feature-Half")
+			if j == 0 {
+				first = got
+			} else if got != first {
+				t.Fatalf("%s: flag went from %q to %q", user, first, got)
+			}
+		}
+		if first != "on" && first != "off" {
+			t.Fatalf("%s: X-Feature-Half %q, want on or off", user, first)
+		}
+		states[first]++
+	}
+	if states["on"] == 0 || states["off"] == 0 {
+		t.Errorf("50%% flag over 40 users: %v", states)
+	}
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// When streamed response bodies are flushed to the client, e.g. for SSE:
+// once bytes are buffered since the last flush or interval after the first
+// unflushed write, whichever comes first. Without either the body goes out
+// as net/http's buffer fills.
+type FlushConfig struct {
+	Bytes    int           `yaml:"bytes"`
+	Interval time.Duration `yaml:"interval"`
+}
+
+func (cfg FlushConfig) configured() bool {
+	return cfg.Bytes > 0 || cfg.Interval > 0
+}
+
+func (cfg FlushConfig) validate() error {
+	if cfg.Bytes < 0 || cfg.Interval < 0 {
+		return fmt.Errorf("flush: bytes and interval can't be negative")
+	}
+	return nil
+}
+
+// Writer flushing per FlushConfig. The interval flush runs on a timer, so
+// writes and flushes are serialized; stop must be called before the handler
+// uses the underlying writer again.
+type flushingWriter struct {
+	w   flushWriter
+	cfg FlushConfig
+
+	mu        sync.Mutex
+	unflushed int
+	timer     *time.Timer
+	stopped   bool
+}
+
+type flushWriter interface {
+	io.Writer
+	http.Flusher
+}
+
+func newFlushingWriter(w flushWriter, cfg FlushConfig) *flushingWriter {
+	return &flushingWriter{w: w, cfg: cfg}
+}
+
+func (f *flushingWriter) Write(p []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	n, err := f.w.Write(p)
+	f.unflushed += n
+	switch {
+	case f.cfg.Bytes > 0 && f.unflushed >= f.cfg.Bytes:
+		f.flushLocked()
+	case f.cfg.Interval > 0 && f.unflushed > 0 && f.timer == nil:
+		f.timer = time.AfterFunc(f.cfg.Interval, f.flushTimed)
+	}
+	return n, err
+}
+
+func (f *flushingWriter) flushTimed() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.timer = nil
+	if !f.stopped && f.unflushed > 0 {
+		f.flushLocked()
+	}
+}
+
+func (f *flushingWriter) flushLocked() {
+	if f.timer != nil {
+		f.timer.Stop()
+		f.timer = nil
+	}
+	f.unflushed = 0
+	f.w.Flush()
+}
+
+// Flush what is left and hand the writer back
+func (f *flushingWriter) stop() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.unflushed > 0 {
+		f.flushLocked()
+	}
+	if f.timer != nil {
+		f.timer.Stop()
+		f.timer = nil
+	}
+	f.stopped = true
+}
+
+// Where the route's response body is copied to, with stop to call once it was
+func (route *Route) bodyWriter(w flushWriter) (dst io.Writer, stop func()) {
+	if !route.Flush.configured() {
+		return w, func() {}
+	}
+	f := newFlushingWriter(w, route.Flush)
+	return f, f.stop
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"bytes"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Writer recording the bytes written by the time of each flush
+type flushRecorder struct {
+	mu      sync.Mutex
+	buf     bytes.Buffer
+	flushed []int
+}
+
+func (r *flushRecorder) Write(p []byte) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.buf.Write(p)
+}
+
+func (r *flushRecorder) Flush() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.flushed = append(r.flushed, r.buf.Len())
+}
+
+func (r *flushRecorder) flushes() []int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]int(nil), r.flushed...)
+}
+
+func TestFlushThresholds(t *testing.T) {
+	t.Run("bytes", func(t *testing.T) {
+		rec := &flushRecorder{}
+		f := newFlushingWriter(rec, FlushConfig{Bytes: 10})
+		for range 7 {
+			f.Write([]byte("abcd"))
+		}
+		// At 12 and 24 bytes; the last 4 go out on stop
+		if got := rec.flushes(); len(got) != 2 || got[0] != 12 || got[1] != 24 {
+			t.Errorf("flushed at %v, want [12 24]", got)
+		}
+		f.stop()
+		if got := rec.flushes(); len(got) != 3 || got[2] != 28 {
+			t.Errorf("after stop flushed at %v, want a last flush at 28", got)
+		}
+	})
+
+	t.Run("interval", func(t *testing.T) {
+		rec := &flushRecorder{}
+		f := newFlushingWriter(rec, FlushConfig{Interval: 50 * time.Millisecond})
+		defer f.stop()
+		start := time.Now()
+		f.Write([]byte("event: 1\n\n"))
+		if got := rec.flushes(); len(got) != 0 {
+			t.Fatalf("flushed at %v right after the write, want it held for the interval", got)
+		}
+		for len(rec.flushes()) == 0 {
+			if time.Since(start) > 2*time.Second {
+				t.Fatal("never flushed")
+			}
+			time.Sleep(time.Millisecond)
+		}
+		if took := time.Since(start); took < 50*time.Millisecond {
+			t.Errorf("flushed after %s, before the 50ms interval", took)
+		}
+		// Nothing new written, nothing more flushed
+		time.Sleep(100 * time.Millisecond)
+		if got := rec.flushes(); len(got) != 1 {
+			t.Errorf("flushed at %v, want once", got)
+		}
+	})
+
+	t.Run("bytes before interval", func(t *testing.T) {
+		rec := &flushRecorder{}
+		f := newFlushingWriter(rec, FlushConfig{Bytes: 8, Interval: time.Hour})
+		defer f.stop()
+		f.Write([]byte("1234"))
+		f.Write([]byte("5678"))
+		if got := rec.flushes(); len(got) != 1 || got[0] != 8 {
+			t.Errorf("flushed at %v, want at 8 bytes without waiting the hour", got)
+		}
+	})
+}
@@ -0,0 +1,284 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"os"
+	"os/signal"
+	"reflect"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// Route state that can be swapped while serving. Only routes and the geo-IP
+// database are reloaded; listener, TLS, admin and other global settings need a restart.
+type Gateway struct {
+	configPath string
+	state      atomic.Pointer[gatewayState]
+
+	// Reloads run one at a time on the reload loop; triggers arriving before
+	// a pending reload started share its outcome
+	mu      sync.Mutex
+	pending *reloadRequest
+	wake    chan struct{}
+	// Set by Close; the reload loop exits once done is closed
+	closed   bool
+	loopDone chan struct{}
+	signals  chan os.Signal
+	// Closed by Close to end the health and rate limit report loops
+	stopBackground chan struct{}
+}
+
+var errGatewayClosed = errors.New("gateway is shutting down")
+
+// What a reload swaps, replaced as a whole so requests never see the routes
+// of one config with the geo-IP database of another
+type gatewayState struct {
+	table *routeTable
+	geo   geoLookup
+}
+
+type reloadRequest struct {
+	done chan struct{}
+	err  error
+}
+
+func newGateway(configPath string, cfg *Config) (*Gateway, error) {
+	table, err := buildRouteTable(cfg, nil)
+	if err != nil {
+		return nil, err
+	}
+	geo, err := openGeoLookup(cfg.GeoIP)
+	if err != nil {
+		return nil, err
+	}
+	g := &Gateway{configPath: configPath, wake: make(chan struct{}, 1), loopDone: make(chan struct{}), stopBackground: make(chan struct{})}
+	g.state.Store(&gatewayState{table: table, geo: geo})
+	go g.reloadLoop()
+	go g.healthLoop()
+	if cfg.RateLimitReport.Interval > 0 {
+		go g.rateLimitReportLoop(cfg.RateLimitReport)
+	}
+	return g, nil
+}
+
+// Database for cfg, nil when geo-IP lookups are off
+func openGeoLookup(cfg GeoIPConfig) (geoLookup, error) {
+	if cfg.Database == "" {
+		return nil, nil
+	}
+	db, err := openGeoDB(cfg.Database)
+	if err != nil {
+		return nil, err
+	}
+	return db, nil
+}
+
+// Routes currently served, most specific first
+func (g *Gateway) routes() []*Route {
+	return g.state.Load().table.routes
+}
+
+// Build the routes of cfg, carrying over runtime state from prev for
+// prefixes (and hosts) that are still configured
+func buildRouteTable(cfg *Config, prev *routeTable) (*routeTable, error) {
+	previous := make(map[string]*Route)
+	if prev != nil {
+		for _, route := range prev.routes {
+			previous[route.id()] = route
+		}
+	}
+
+	if len(cfg.Routes) == 0 {
+		log.Warn().Msg("No routes configured, every request will get a 404")
+	}
+	routes := make([]*Route, 0, len(cfg.Routes))
+	for _, rc := range cfg.Routes {
+		route := newRoute(rc)
+		if old, ok := previous[rc.id()]; ok {
+			route.inherit(old)
+		}
+		routes = append(routes, route)
+	}
+	return newRouteTable(routes)
+}
+
+// Keep the state of the route this one replaces where its config allows
+func (route *Route) inherit(old *Route) {
+	old.limiter.update(route.RateLimit)
+	route.limiter = old.limiter
+	if len(route.limiters) == len(old.limiters) {
+		for i, l := range old.limiters {
+			l.update(route.RateLimits[i])
+			route.limiters[i] = l
+		}
+	}
+
+	// Keeps the cached token
+	if old.upstreamTokens != nil && reflect.DeepEqual(route.UpstreamAuth, old.UpstreamAuth) {
+		route.upstreamTokens = old.upstreamTokens
+	}
+
+	// Keeps member health, so a reload doesn't send traffic back to failing
+	// members or hold readiness again
+	if old.balancer != nil && slices.Equal(route.Pool, old.Pool) && reflect.DeepEqual(route.Scoring, old.Scoring) && reflect.DeepEqual(route.HealthCheck, old.HealthCheck) &&
+		reflect.DeepEqual(route.Failover, old.Failover) {
+		route.balancer = old.balancer
+	}
+
+	// Keeps the cooldowns upstreams asked for
+	if old.cooldowns != nil && route.RetryAfter == old.RetryAfter {
+		route.cooldowns = old.cooldowns
+	}
+
+	if route.Target == old.Target && reflect.DeepEqual(route.CircuitBreaker, old.CircuitBreaker) {
+		route.breaker, route.ramp = old.breaker, old.ramp
+		if old.fallback != nil && slices.Equal(route.Fallback, old.Fallback) {
+			route.fallback = old.fallback
+		}
+	}
+}
+
+// How often a retired route is checked for requests still in flight
+const retireCheckInterval = 100 * time.Millisecond
+
+// Drop the upstream connections of a route a reload replaced. Every reload
+// builds new transports, so a changed scheme or transport setting never meets
+// a connection pooled under the old one; the old pool goes in two steps: its
+// idle connections now, and those in-flight requests hand back once they are
+// done, or once the route's timeout would have ended them.
+func (route *Route) retire() {
+	route.closeIdleConnections()
+	if route.inflight.Load() == 0 {
+		return
+	}
+	limit := route.clientTimeout()
+	if limit <= 0 {
+		limit = time.Minute
+	}
+	go func() {
+		ticker := time.NewTicker(retireCheckInterval)
+		defer ticker.Stop()
+		deadline := time.Now().Add(limit)
+		for route.inflight.Load() > 0 && time.Now().Before(deadline) {
+			<-ticker.C
+		}
+		route.closeIdleConnections()
+	}()
+}
+
+// Re-read the config file and swap in its routes. Only called from the reload loop.
+func (g *Gateway) reload() error {
+	cfg, err := loadConfig(g.configPath)
+	if err != nil {
+		return err
+	}
+	old := g.state.Load()
+	table, err := buildRouteTable(cfg, old.table)
+	if err != nil {
+		return err
+	}
+	geo, err := openGeoLookup(cfg.GeoIP)
+	if err != nil {
+		return err
+	}
+	warmupRoutes(table.routes)
+	g.state.Store(&gatewayState{table: table, geo: geo})
+
+	// In-flight requests keep using their route, and its transport, to the end
+	for _, route := range old.table.routes {
+		route.retire()
+	}
+	log.Info().Int("routes", len(table.routes)).Msg("Config reloaded")
+	return nil
+}
+
+// Ask for a reload and wait for its outcome
+func (g *Gateway) requestReload() error {
+	g.mu.Lock()
+	if g.closed {
+		g.mu.Unlock()
+		return errGatewayClosed
+	}
+	req := g.pending
+	if req == nil {
+		req = &reloadRequest{done: make(chan struct{})}
+		g.pending = req
+		select {
+		case g.wake <- struct{}{}:
+		default:
+		}
+	}
+	g.mu.Unlock()
+
+	<-req.done
+	return req.err
+}
+
+func (g *Gateway) reloadLoop() {
+	defer close(g.loopDone)
+	for range g.wake {
+		g.mu.Lock()
+		req := g.pending
+		g.pending = nil
+		g.mu.Unlock()
+		if req == nil {
+			continue
+		}
+		req.err = g.reload()
+		close(req.done)
+	}
+}
+
+// Reload the config on SIGHUP
+func (g *Gateway) watchSignals() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+	g.mu.Lock()
+	g.signals = signals
+	g.mu.Unlock()
+	go func() {
+		for range signals {
+			if err := g.requestReload(); err != nil {
+				log.Error().Err(err).Msg("Config reload failed, keeping current routes")
+			}
+		}
+	}()
+}
+
+// Stop taking reload triggers and wait, within ctx, for a reload already
+// pending or running to finish
+func (g *Gateway) Close(ctx context.Context) error {
+	g.mu.Lock()
+	if !g.closed {
+		g.closed = true
+		close(g.wake)
+		close(g.stopBackground)
+		if g.signals != nil {
+			signal.Stop(g.signals)
+		}
+	}
+	g.mu.Unlock()
+
+	select {
+	case <-g.loopDone:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Drop the idle upstream connections of every route
+func (g *Gateway) closeIdleConnections() {
+	for _, route := range g.routes() {
+		route.closeIdleConnections()
+	}
+	// ext_authz and mirror clients share the default transport
+	http.DefaultTransport.(*http.Transport).CloseIdleConnections()
+}
@@ -0,0 +1,285 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Gateway serving the routes of config, a YAML document, with the proxy
+// handlers the way main sets them up. The config is written to a file, so
+// tests can rewrite g.configPath and reload.
+func newTestGateway(t testing.TB, config string) (*Gateway, *gin.Engine) {
+	t.Helper()
+	registerMetrics(MetricsConfig{})
+	gin.SetMode(gin.ReleaseMode)
+	cfg, err := parseConfig([]byte(config))
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "gateway.yaml")
+	if err := os.WriteFile(path, []byte(config), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	g, err := newGateway(path, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { g.Close(context.Background()) })
+	r := gin.New()
+	if err := r.SetTrustedProxies(cfg.TrustedProxies); err != nil {
+		t.Fatal(err)
+	}
+	r.NoRoute(proxyHandlers(cfg, g)...)
+	return g, r
+}
+
+func serve(h http.Handler, req *http.Request) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	return w
+}
+
+// Replace the gateway's config file with config and reload it
+func reloadWith(t testing.TB, g *Gateway, config string) {
+	t.Helper()
+	if err := os.WriteFile(g.configPath, []byte(config), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := g.requestReload(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Requests in flight during a reload finish on the config they started with:
+// the upstream that answers is that of the snapshot RouteMiddleware took,
+// whatever was swapped in since. Limits aren't part of the snapshot: the
+// reload updates the route's limiter in place, so requests on either config
+// draw from the one limiter the gateway now has.
+func TestReloadKeepsRequestSnapshot(t *testing.T) {
+	arrived := make(chan string, 100)
+	release := make(chan struct{})
+	upstream := func(name string) *httptest.Server {
+		up := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			arrived <- name
+			<-release
+			w.Header().Set("X-Upstream", name)
+		}))
+		t.Cleanup(up.Close)
+		return up
+	}
+	upA, upB := upstream("a"), upstream("b")
+	config := func(up *httptest.Server, rate int) string {
+		return fmt.Sprintf("routes:\n- prefix: /r\n  target: %s\n  rate_limit: {rate: %d, burst: %d}\n", up.URL, rate, rate)
+	}
+	g, _ := newTestGateway(t, config(upA, 1000))
+	cfg, err := parseConfig([]byte(config(upA, 1000)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Checks each request against the snapshot it was routed with. Inserted
+	// right after RouteMiddleware, second in the chain.
+	var mu sync.Mutex
+	var failures []string
+	fail := func(format string, args ...any) {
+		mu.Lock()
+		defer mu.Unlock()
+		failures = append(failures, fmt.Sprintf(format, args...))
+	}
+	probe := func(c *gin.Context) {
+		route, state := routeFromContext(c), stateFromContext(c)
+		if !slices.Contains(state.table.routes, route) {
+			fail("route %p not in the table of its snapshot", route)
+		}
+		c.Next()
+		if routeFromContext(c) != route || stateFromContext(c) != state {
+			fail("route or snapshot changed while the request was served")
+		}
+		name := c.Writer.Header().Get("X-Upstream")
+		if route.Target != map[string]string{"a": upA.URL, "b": upB.URL}[name] {
+			fail("request routed to %s answered by upstream %q", route.Target, name)
+		}
+		if current := g.routes()[0].limiter; route.limiter != current || current.Limit() != 2000 {
+			fail("upstream %q answered a request limited by %p at %v, want the updated limiter %p", name, route.limiter, route.limiter.Limit(), current)
+		}
+	}
+	handlers := proxyHandlers(cfg, g)
+	r := gin.New()
+	r.NoRoute(slices.Insert(handlers, 2, probe)...)
+
+	var wg sync.WaitGroup
+	send := func(n int, upstream string) {
+		for range n {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				if w := serve(r, httptest.NewRequest(http.MethodGet, "/r/", nil)); w.Code != http.StatusOK {
+					fail("status %d", w.Code)
+				}
+			}()
+		}
+		for range n {
+			if name := <-arrived; name != upstream {
+				t.Errorf("request sent to %q, want %q", name, upstream)
+			}
+		}
+	}
+	send(10, "a")
+	reloadWith(t, g, config(upB, 2000))
+	send(10, "b")
+	close(release)
+	wg.Wait()
+
+	for _, failure := range failures {
+		t.Error(failure)
+	}
+}
+
+// Many reload triggers at once, each after rewriting the config: the reloads
+// run one at a time, every snapshot a reader sees is one whole config, and the
+// last one loaded is the file as it ended up
+func TestConcurrentReloadsStayConsistent(t *testing.T) {
+	config := func(gen int) string {
+		return fmt.Sprintf("routes:\n- prefix: /a\n  target: http://127.0.0.1:1/%d\n  rate_limit: {rate: %d, burst: 1}\n"+
+			"- prefix: /b\n  target: http://127.0.0.1:1/%d\n  rate_limit: {rate: %d, burst: 1}\n", gen, gen, gen, gen)
+	}
+	g, _ := newTestGateway(t, config(1))
+
+	// Whole config or nothing: both routes of a snapshot come from one
+	// generation. Limiters carry over between tables, so only the config counts.
+	check := func(state *gatewayState) (int, bool) {
+		routes := state.table.routes
+		if len(routes) != 2 {
+			return 0, false
+		}
+		gen := int(routes[0].RateLimit.Rate)
+		for _, route := range routes {
+			if route.Target != fmt.Sprint("http://127.0.0.1:1/", gen) || int(route.RateLimit.Rate) != gen {
+				return gen, false
+			}
+		}
+		return gen, true
+	}
+	stop := make(chan struct{})
+	readerDone := make(chan struct{})
+	go func() {
+		defer close(readerDone)
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			if gen, ok := check(g.state.Load()); !ok {
+				t.Errorf("partial snapshot of generation %d", gen)
+				return
+			}
+		}
+	}()
+
+	var (
+		writeMu sync.Mutex
+		last    int
+		wg      sync.WaitGroup
+	)
+	for gen := 2; gen <= 50; gen++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			// Renamed into place so the reload never reads a half-written file
+			writeMu.Lock()
+			tmp := g.configPath + ".tmp"
+			if err := os.WriteFile(tmp, []byte(config(gen)), 0o600); err == nil {
+				err = os.Rename(tmp, g.configPath)
+			}
+			last = gen
+			writeMu.Unlock()
+			if err := g.requestReload(); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+	close(stop)
+	<-readerDone
+
+	gen, ok := check(g.state.Load())
+	if !ok || gen != last {
+		t.Errorf("final snapshot generation %d (whole: %v), want %d", gen, ok, last)
+	}
+}
+
+// A reload moving a route from an http to an https upstream: new requests go
+// over TLS on the new transport, the one in flight finishes on the old one,
+// and the old pool's connections are closed once it is done
+func TestReloadToHTTPSUpstream(t *testing.T) {
+	arrived, release := make(chan struct{}), make(chan struct{})
+	var opened, closed atomic.Int32
+	plain := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow" {
+			arrived <- struct{}{}
+			<-release
+		}
+		w.Header().Set("X-TLS", fmt.Sprint(r.TLS != nil))
+	}))
+	plain.Config.ConnState = func(_ net.Conn, state http.ConnState) {
+		switch state {
+		case http.StateNew:
+			opened.Add(1)
+		case http.StateClosed, http.StateHijacked:
+			closed.Add(1)
+		}
+	}
+	plain.Start()
+	defer plain.Close()
+	secure := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-TLS", fmt.Sprint(r.TLS != nil))
+	}))
+	defer secure.Close()
+	// Route transports are cloned from the default one; have it trust the test CA
+	def := http.DefaultTransport.(*http.Transport)
+	saved := def.TLSClientConfig
+	def.TLSClientConfig = secure.Client().Transport.(*http.Transport).TLSClientConfig
+	defer func() { def.TLSClientConfig = saved }()
+
+	config := func(target string) string {
+		return "routes:\n- prefix: /r\n  target: " + target + "\n  rate_limit: {rate: 1000, burst: 1000}\n"
+	}
+	g, r := newTestGateway(t, config(plain.URL))
+	if w := serve(r, httptest.NewRequest(http.MethodGet, "/r/", nil)); w.Code != http.StatusOK || w.Header().Get("X-TLS") != "false" {
+		t.Fatalf("before reload: status %d, X-TLS %q", w.Code, w.Header().Get("X-TLS"))
+	}
+	slow := make(chan *httptest.ResponseRecorder)
+	go func() { slow <- serve(r, httptest.NewRequest(http.MethodGet, "/r/slow", nil)) }()
+	<-arrived
+
+	reloadWith(t, g, config(secure.URL))
+	for range 3 {
+		if w := serve(r, httptest.NewRequest(http.MethodGet, "/r/", nil)); w.Code != http.StatusOK || w.Header().Get("X-TLS") != "true" {
+			t.Fatalf("after reload: status %d, X-TLS %q, want the https upstream", w.Code, w.Header().Get("X-TLS"))
+		}
+	}
+
+	close(release)
+	if w := <-slow; w.Code != http.StatusOK || w.Header().Get("X-TLS") != "false" {
+		t.Errorf("in-flight request: status %d, X-TLS %q, want it answered by the http upstream", w.Code, w.Header().Get("X-TLS"))
+	}
+	deadline := time.Now().Add(2 * time.Second)
+	for closed.Load() < opened.Load() {
+		if time.Now().After(deadline) {
+			t.Fatalf("%d of %d connections to the old upstream still open", opened.Load()-closed.Load(), opened.Load())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+
+	"github.com/gin-gonic/gin"
+	"github.com/oschwald/maxminddb-golang"
+)
+
+// MaxMind database used by routes with geo_headers; re-read on reload
+type GeoIPConfig struct {
+	Database string `yaml:"database"`
+}
+
+// Country and region of a client IP
+type geoLookup interface {
+	lookup(ip net.IP) (country, region string, ok bool)
+}
+
+type maxmindDB struct {
+	reader *maxminddb.Reader
+}
+
+// The file is read into memory, so a replaced database needs no closing while
+// requests may still use it
+func openGeoDB(path string) (*maxmindDB, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("geoip: %w", err)
+	}
+	reader, err := maxminddb.FromBytes(data)
+	if err != nil {
+		return nil, fmt.Errorf("geoip: %w", err)
+	}
+	return &maxmindDB{reader: reader}, nil
+}
+
+func (db *maxmindDB) lookup(ip net.IP) (string, string, bool) {
+	var record struct {
+		Country struct {
+			ISOCode string `maxminddb:"iso_code"`
+		} `maxminddb:"country"`
+		Subdivisions []struct {
+			ISOCode string `maxminddb:"iso_code"`
+		} `maxminddb:"subdivisions"`
+	}
+	if err := db.reader.Lookup(ip, &record); err != nil || record.Country.ISOCode == "" {
+		return "", "", false
+	}
+	region := ""
+	if len(record.Subdivisions) > 0 {
+		region = record.Subdivisions[0].ISOCode
+	}
+	return record.Country.ISOCode, region, true
+}
+
+// Geo headers are only trusted when set by the gateway
+var geoHeaders = []string{"X-Geo-Country", "X-Geo-Region"}
+
+// Middleware adding the client's country and region to the upstream request,
+// looked up in the database of the config the request was routed with
+func GeoIPMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !routeFromContext(c).GeoHeaders {
+			c.Next()
+			return
+		}
+		for _, header := range geoHeaders {
+			c.Request.Header.Del(header)
+		}
+
+		if db := stateFromContext(c).geo; db != nil {
+			// X-Forwarded-For counts only from trusted_proxies; anyone else could
+			// claim to be from anywhere
+			if ip := net.ParseIP(c.ClientIP()); ip != nil {
+				if country, region, ok := db.lookup(ip); ok {
+					c.Request.Header.Set("X-Geo-Country", country)
+					if region != "" {
+						c.Request.Header.Set("X-Geo-Region", region)
+					}
+				}
+			}
+		}
+		c.Next()
+	}
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// "country" or "country/region" by client IP
+type stubGeo map[string]string
+
+func (s stubGeo) lookup(ip net.IP) (string, string, bool) {
+	location, ok := s[ip.String()]
+	country, region, _ := strings.Cut(location, "/")
+	return country, region, ok
+}
+
+func TestGeoHeaders(t *testing.T) {
+	g, r := newTestGateway(t, "routes:\n- prefix: /g\n  target: "+headerEcho(t)+"\n  rate_limit: {rate: 1000, burst: 1000}\n  geo_headers: true\n")
+	state := *g.state.Load()
+	state.geo = stubGeo{"198.51.100.7": "DE/BE", "198.51.100.8": "LU"}
+	g.state.Store(&state)
+
+	for _, tc := range []struct {
+		remoteAddr, country, region string
+	}{
+		{"198.51.100.7:4000", "DE", "BE"},
+		{"198.51.100.8:4000", "LU", ""},
+		{"192.0.2.1:4000", "", ""},
+	} {
+		req := httptest.NewRequest(http.MethodGet, "/g/", nil)
+		req.RemoteAddr = tc.remoteAddr
+		// Whatever the client claims is replaced or dropped
+		req.Header.Set("X-Geo-Country", "US")
+		req.Header.Set("X-Geo-Region", "CA")
+		h := upstreamHeaders(t, r, req)
+		if h.Get("X-Geo-Country") != tc.country || h.Get("X-Geo-Region") != tc.region {
+			t.Errorf("from %s: country %q region %q, want %q %q", tc.remoteAddr, h.Get("X-Geo-Country"), h.Get("X-Geo-Region"), tc.country, tc.region)
+		}
+	}
+}
+
+func TestGeoHeadersUseTrustedClientAddress(t *testing.T) {
+	for _, tc := range []struct {
+		trusted string
+		want    string
+	}{
+		{"[]", "DE"},
+		{"[198.51.100.0/24]", "FR"},
+	} {
+		var country string
+		up := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			country = r.Header.Get("X-Geo-Country")
+		}))
+		g, r := newTestGateway(t, "trusted_proxies: "+tc.trusted+"\nroutes:\n- prefix: /g\n  target: "+up.URL+"\n  rate_limit: {rate: 1000, burst: 1000}\n  geo_headers: true\n")
+		state := *g.state.Load()
+		state.geo = stubGeo{"198.51.100.7": "DE", "203.0.113.1": "FR"}
+		g.state.Store(&state)
+
+		req := httptest.NewRequest(http.MethodGet, "/g/", nil)
+		req.RemoteAddr = "198.51.100.7:4000"
+		req.Header.Set("X-Forwarded-For", "203.0.113.1")
+		req.Header.Set("X-Geo-Country", "US")
+		serve(r, req)
+		up.Close()
+		if country != tc.want {
+			t.Errorf("trusted_proxies %s: X-Geo-Country %q, want %q", tc.trusted, country, tc.want)
+		}
+	}
+}
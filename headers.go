@@ -0,0 +1,272 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/rs/zerolog/log"
+)
+
+// Middleware copying configured cookies into upstream request headers. A
+// header the client sent itself is dropped so backends can trust the value.
+func CookieHeadersMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		for cookie, header := range routeFromContext(c).CookieHeaders {
+			c.Request.Header.Del(header)
+			if value, err := c.Cookie(cookie); err == nil && value != "" {
+				c.Request.Header.Set(header, value)
+			}
+		}
+		c.Next()
+	}
+}
+
+// Cap on individual request header values forwarded upstream
+type HeaderLimitConfig struct {
+	// Largest value in bytes; 0 disables the limit
+	MaxSize int `yaml:"max_size"`
+	// "drop" (default) removes an oversized header, "truncate" cuts it to max_size
+	Action string `yaml:"action"`
+}
+
+func (cfg HeaderLimitConfig) validate() error {
+	switch cfg.Action {
+	case "", "drop", "truncate":
+		return nil
+	}
+	return fmt.Errorf("header_limit: unknown action %q", cfg.Action)
+}
+
+// Request header fields accepted by default, as in Apache's LimitRequestFields
+const defaultMaxRequestHeaders = 100
+
+// Middleware answering 431 to requests with more than max header fields, a
+// repeated header counting once per value; 0 turns the limit off. Many small
+// headers stay within the size limit but still cost every hop to parse and copy.
+func HeaderCountMiddleware(max int) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if max <= 0 {
+			c.Next()
+			return
+		}
+		count := 0
+		for _, values := range c.Request.Header {
+			count += len(values)
+		}
+		if count > max {
+			log.Warn().Str("path", c.Request.URL.Path).Int("headers", count).Int("max", max).Msg("Too many request headers")
+			sendLogToLoki("Too many request headers", map[string]string{"level": "warn", "path": c.Request.URL.Path})
+			c.JSON(http.StatusRequestHeaderFieldsTooLarge, gin.H{"error": "Request header fields too large", "msg": fmt.Sprintf("more than %d header fields", max)})
+			c.Abort()
+			return
+		}
+		c.Next()
+	}
+}
+
+// Middleware dropping or truncating request headers too large for fragile upstreams
+func HeaderLimitMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		limit := routeFromContext(c).HeaderLimit
+		if limit.MaxSize <= 0 {
+			c.Next()
+			return
+		}
+
+		for name, values := range c.Request.Header {
+			if !slices.ContainsFunc(values, func(v string) bool { return len(v) > limit.MaxSize }) {
+				continue
+			}
+			kept := values[:0]
+			for _, value := range values {
+				if len(value) > limit.MaxSize {
+					log.Warn().Str("path", c.Request.URL.Path).Str("header", name).Int("size", len(value)).Str("action", limit.Action).Msg("Oversized request header")
+					sendLogToLoki("Oversized request header "+name, map[string]string{"level": "warn", "path": c.Request.URL.Path})
+					if limit.Action != "truncate" {
+						continue
+					}
+					value = value[:limit.MaxSize]
+				}
+				kept = append(kept, value)
+			}
+			if len(kept) == 0 {
+				c.Request.Header.Del(name)
+			} else {
+				c.Request.Header[name] = kept
+			}
+		}
+		c.Next()
+	}
+}
+
+// Response headers identifying the gateway instance
+type GatewayHeadersConfig struct {
+	// Append this hop to Via (RFC 7230 section 5.7.1)
+	Via bool `yaml:"via"`
+	// Set X-Gateway-Node to the node identifier
+	Node bool `yaml:"node"`
+	// Set X-Served-By to the upstream host the route forwards to
+	ServedBy bool `yaml:"served_by"`
+	// Node identifier; defaults to the hostname
+	NodeID string `yaml:"node_id"`
+}
+
+func (cfg GatewayHeadersConfig) enabled() bool {
+	return cfg.Via || cfg.Node || cfg.ServedBy
+}
+
+func (cfg GatewayHeadersConfig) nodeID() string {
+	if cfg.NodeID != "" {
+		return cfg.NodeID
+	}
+	if host, err := os.Hostname(); err == nil {
+		return host
+	}
+	return "my-go-gateway"
+}
+
+// Applies a header change once, right before the response headers go out, so
+// it sees and can extend whatever the handlers set
+type decoratingWriter struct {
+	gin.ResponseWriter
+	decorate func(http.Header)
+	done     bool
+}
+
+func (w *decoratingWriter) apply() {
+	if !w.done {
+		w.done = true
+		w.decorate(w.Header())
+	}
+}
+
+func (w *decoratingWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+func (w *decoratingWriter) WriteHeaderNow() {
+	w.apply()
+	w.ResponseWriter.WriteHeaderNow()
+}
+
+func (w *decoratingWriter) Write(data []byte) (int, error) {
+	w.apply()
+	return w.ResponseWriter.Write(data)
+}
+
+func (w *decoratingWriter) WriteString(s string) (int, error) {
+	w.apply()
+	return w.ResponseWriter.WriteString(s)
+}
+
+func (w *decoratingWriter) Flush() {
+	w.apply()
+	w.ResponseWriter.Flush()
+}
+
+// Middleware adding the configured gateway metadata headers to every response
+func GatewayHeadersMiddleware(cfg GatewayHeadersConfig) gin.HandlerFunc {
+	if !cfg.enabled() {
+		return func(c *gin.Context) { c.Next() }
+	}
+	node := cfg.nodeID()
+
+	return func(c *gin.Context) {
+		proto := fmt.Sprintf("%d.%d", c.Request.ProtoMajor, c.Request.ProtoMinor)
+
+		c.Writer = &decoratingWriter{ResponseWriter: c.Writer, decorate: func(h http.Header) {
+			if cfg.Via {
+				// Upstream hops come first, ours is the last one before the client
+				via := append(h.Values("Via"), proto+" "+node)
+				h.Set("Via", strings.Join(via, ", "))
+			}
+			if cfg.Node {
+				h.Set("X-Gateway-Node", node)
+			}
+			// Resolved at write time, a fallback upstream may have answered
+			if cfg.ServedBy {
+				if target, err := url.Parse(upstreamTarget(c, routeFromContext(c))); err == nil && target.Host != "" {
+					h.Set("X-Served-By", target.Host)
+				}
+			}
+		}}
+		c.Next()
+	}
+}
+
+// Size of h on the wire, as "Name: value\r\n" lines
+func headerSize(h http.Header) int {
+	size := 0
+	for name, values := range h {
+		for _, v := range values {
+			size += len(name) + len(v) + 4
+		}
+	}
+	return size
+}
+
+// Trusted request time for backends that can't rely on the client's clock
+type TimestampConfig struct {
+	// Set X-Gateway-Timestamp on upstream requests; one sent by the client is dropped
+	Enabled bool `yaml:"enabled"`
+	// HMAC-SHA256 key signing the timestamp with the method and upstream path
+	// into X-Gateway-Timestamp-Signature, so a backend can tell the gateway set it
+	Secret string `yaml:"secret"`
+}
+
+func (cfg TimestampConfig) validate() error {
+	if cfg.Secret != "" && !cfg.Enabled {
+		return fmt.Errorf("timestamp: secret needs enabled")
+	}
+	return nil
+}
+
+const (
+	timestampHeader          = "X-Gateway-Timestamp"
+	timestampSignatureHeader = "X-Gateway-Timestamp-Signature"
+)
+
+// Wall clock read at startup and advanced by the monotonic clock since, so
+// timestamps never jump when the system clock is stepped
+var clockBase = time.Now()
+
+func gatewayNow() time.Time {
+	return clockBase.Add(time.Since(clockBase)).Round(0)
+}
+
+// Hex HMAC-SHA256 over "timestamp\nmethod\npath"
+func signTimestamp(secret, timestamp, method, path string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp + "\n" + method + "\n" + path))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Middleware adding the gateway's request time, and its signature, to upstream
+// requests of routes with timestamp enabled
+func TimestampMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		route := routeFromContext(c)
+		if !route.Timestamp.Enabled {
+			c.Next()
+			return
+		}
+		c.Request.Header.Del(timestampSignatureHeader)
+		timestamp := gatewayNow().UTC().Format("2006-01-02T15:04:05.000Z07:00")
+		c.Request.Header.Set(timestampHeader, timestamp)
+		if route.Timestamp.Secret != "" {
+			path, _, _ := strings.Cut(upstreamPath(c, route), "?")
+			method := route.MethodMap.upstream(c.Request.Method)
+			c.Request.Header.Set(timestampSignatureHeader, signTimestamp(route.Timestamp.Secret, timestamp, method, path))
+		}
+		c.Next()
+	}
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Upstream answering with the request headers it received, as JSON
+func headerEcho(t *testing.T) string {
+	t.Helper()
+	up := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(r.Header)
+	}))
+	t.Cleanup(up.Close)
+	return up.URL
+}
+
+// Headers the upstream received for req
+func upstreamHeaders(t *testing.T, h http.Handler, req *http.Request) http.Header {
+	t.Helper()
+	w := serve(h, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("%s: status %d: %s", req.URL, w.Code, w.Body)
+	}
+	var header http.Header
+	if err := json.Unmarshal(w.Body.Bytes(), &header); err != nil {
+		t.Fatal(err)
+	}
+	return header
+}
+
+func TestCookieHeaders(t *testing.T) {
+	_, r := newTestGateway(t, "routes:\n- prefix: /c\n  target: "+headerEcho(t)+"\n  rate_limit: {rate: 1000, burst: 1000}\n"+
+		"  cookie_headers: {sid: X-Session-ID}\n")
+
+	req := httptest.NewRequest(http.MethodGet, "/c/", nil)
+	req.AddCookie(&http.Cookie{Name: "theme", Value: "dark"})
+	req.AddCookie(&http.Cookie{Name: "sid", Value: "abc123"})
+	if got := upstreamHeaders(t, r, req).Get("X-Session-ID"); got != "abc123" {
+		t.Errorf("with the cookie: X-Session-ID %q, want abc123", got)
+	}
+
+	// Without the cookie the header is absent, even one the client sent itself
+	req = httptest.NewRequest(http.MethodGet, "/c/", nil)
+	req.AddCookie(&http.Cookie{Name: "theme", Value: "dark"})
+	req.Header.Set("X-Session-ID", "forged")
+	if got := upstreamHeaders(t, r, req).Values("X-Session-ID"); len(got) != 0 {
+		t.Errorf("without the cookie: X-Session-ID %q, want none", got)
+	}
+
+	req = httptest.NewRequest(http.MethodGet, "/c/", nil)
+	if got := upstreamHeaders(t, r, req).Values("X-Session-ID"); len(got) != 0 {
+		t.Errorf("without cookies: X-Session-ID %q, want none", got)
+	}
+}
+
+func TestGatewayHeaders(t *testing.T) {
+	up := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Via", "1.1 backend")
+		w.Write([]byte("ok"))
+	}))
+	defer up.Close()
+	route := "routes:\n- prefix: /g\n  target: " + up.URL + "\n  rate_limit: {rate: 1000, burst: 1000}\n"
+
+	_, r := newTestGateway(t, "gateway_headers: {via: true, node: true, served_by: true, node_id: node-7}\n"+route)
+	h := serve(r, httptest.NewRequest(http.MethodGet, "/g/", nil)).Header()
+	want := map[string]string{
+		"Via":            "1.1 backend, 1.1 node-7",
+		"X-Gateway-Node": "node-7",
+		"X-Served-By":    strings.TrimPrefix(up.URL, "http://"),
+	}
+	for name, value := range want {
+		if got := h.Get(name); got != value {
+			t.Errorf("%s: %q, want %q", name, got, value)
+		}
+	}
+
+	_, r = newTestGateway(t, route)
+	h = serve(r, httptest.NewRequest(http.MethodGet, "/g/", nil)).Header()
+	if h.Get("Via") != "1.1 backend" || h.Get("X-Gateway-Node") != "" || h.Get("X-Served-By") != "" {
+		t.Errorf("disabled: Via %q, X-Gateway-Node %q, X-Served-By %q", h.Get("Via"), h.Get("X-Gateway-Node"), h.Get("X-Served-By"))
+	}
+}
+
+func TestHeaderLimit(t *testing.T) {
+	long := strings.Repeat("x", 100)
+	for _, tc := range []struct {
+		action string
+		want   []string
+	}{
+		{"drop", []string{"short"}},
+		{"truncate", []string{"short", long[:32]}},
+	} {
+		_, r := newTestGateway(t, "routes:\n- prefix: /h\n  target: "+headerEcho(t)+"\n  rate_limit: {rate: 1000, burst: 1000}\n"+
+			"  header_limit: {max_size: 32, action: "+tc.action+"}\n")
+		req := httptest.NewRequest(http.MethodGet, "/h/", nil)
+		req.Header.Add("X-Mixed", "short")
+		req.Header.Add("X-Mixed", long)
+		req.Header.Set("X-Huge", long)
+		req.Header.Set("X-Normal", "fine")
+		h := upstreamHeaders(t, r, req)
+
+		if got := h.Values("X-Mixed"); !slices.Equal(got, tc.want) {
+			t.Errorf("%s: X-Mixed %q, want %q", tc.action, got, tc.want)
+		}
+		if got := h.Get("X-Huge"); (tc.action == "drop" && got != "") || (tc.action == "truncate" && got != long[:32]) {
+			t.Errorf("%s: X-Huge %q", tc.action, got)
+		}
+		if got := h.Get("X-Normal"); got != "fine" {
+			t.Errorf("%s: X-Normal %q, want it passed through", tc.action, got)
+		}
+	}
+}
+
+// A request with more header fields than max_request_headers gets a 431, a
+// repeated header counting once per value; up to the limit it goes through
+func TestHeaderCountLimit(t *testing.T) {
+	r := gin.New()
+	r.Use(HeaderCountMiddleware(defaultMaxRequestHeaders))
+	r.GET("/", func(c *gin.Context) { c.Status(http.StatusOK) })
+	withHeaders := func(distinct, repeats int) int {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		for i := range distinct {
+			req.Header.Set(fmt.Sprintf("X-Bomb-%d", i), "x")
+		}
+		for range repeats {
+			req.Header.Add("X-Repeated", "x")
+		}
+		return serve(r, req).Code
+	}
+
+	for _, tc := range []struct{ distinct, repeats, want int }{
+		{100, 0, http.StatusOK},
+		{101, 0, http.StatusRequestHeaderFieldsTooLarge},
+		{5000, 0, http.StatusRequestHeaderFieldsTooLarge},
+		{60, 40, http.StatusOK},
+		{60, 41, http.StatusRequestHeaderFieldsTooLarge},
+	} {
+		if got := withHeaders(tc.distinct, tc.repeats); got != tc.want {
+			t.Errorf("%d headers plus %d values of one: %d, want %d", tc.distinct, tc.repeats, got, tc.want)
+		}
+	}
+
+	path := filepath.Join(t.TempDir(), "gateway.yaml")
+	if err := os.WriteFile(path, []byte("routes:\n- prefix: /x\n  target: http://x:8080\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := loadConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.MaxRequestHeaders != defaultMaxRequestHeaders {
+		t.Errorf("max_request_headers left unset: %d, want the default %d", cfg.MaxRequestHeaders, defaultMaxRequestHeaders)
+	}
+}
+
+// Upstreams get the gateway's time in X-Gateway-Timestamp, replacing any the
+// client sent, and with a secret its signature over the upstream request
+func TestTimestampHeader(t *testing.T) {
+	up := headerEcho(t)
+	_, r := newTestGateway(t, "routes:\n"+
+		"- prefix: /ts\n  target: "+up+"\n  rate_limit: {rate: 1000, burst: 1000}\n  timestamp: {enabled: true}\n"+
+		"- prefix: /signed\n  target: "+up+"\n  rate_limit: {rate: 1000, burst: 1000}\n  timestamp: {enabled: true, secret: k3y}\n"+
+		"- prefix: /plain\n  target: "+up+"\n  rate_limit: {rate: 1000, burst: 1000}\n")
+
+	forged := func(path string) *http.Request {
+		req := httptest.NewRequest(http.MethodPost, path, nil)
+		req.Header.Set(timestampHeader, "2000-01-01T00:00:00.000Z")
+		req.Header.Set(timestampSignatureHeader, "forged")
+		return req
+	}
+
+	before := time.Now()
+	header := upstreamHeaders(t, r, forged("/ts/orders"))
+	at, err := time.Parse(time.RFC3339Nano, header.Get(timestampHeader))
+	if err != nil {
+		t.Fatalf("timestamp %q: %v", header.Get(timestampHeader), err)
+	}
+	if d := at.Sub(before); d < -time.Second || d > time.Second {
+		t.Errorf("timestamp %s is %s off the current time", at, d)
+	}
+	if header.Get(timestampSignatureHeader) != "" {
+		t.Errorf("client's signature %q forwarded without a secret", header.Get(timestampSignatureHeader))
+	}
+
+	header = upstreamHeaders(t, r, forged("/signed/orders"))
+	ts := header.Get(timestampHeader)
+	if want := signTimestamp("k3y", ts, http.MethodPost, "/orders"); header.Get(timestampSignatureHeader) != want {
+		t.Errorf("signature %q, want %q", header.Get(timestampSignatureHeader), want)
+	}
+
+	header = upstreamHeaders(t, r, httptest.NewRequest(http.MethodGet, "/plain/", nil))
+	if header.Get(timestampHeader) != "" {
+		t.Errorf("timestamp %q set on a route without it", header.Get(timestampHeader))
+	}
+
+	if _, err := parseConfig([]byte("routes:\n- prefix: /x\n  target: " + up + "\n  timestamp: {secret: k3y}\n")); err == nil {
+		t.Error("timestamp secret without enabled accepted")
+	}
+}
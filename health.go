@@ -0,0 +1,30 @@
+package main
+
+import (
+	"net/http"
+	"sync/atomic"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Set once startup finished and the listener is bound
+var ready atomic.Bool
+
+// Register liveness and readiness endpoints. Readiness also waits for the
+// pools of routes with health_check.all_unhealthy: not_ready.
+func registerHealthRoutes(r *gin.Engine, g *Gateway) {
+	r.GET("/healthz", func(c *gin.Context) {
+		c.JSON(http.StatusOK, gin.H{"status": "ok"})
+	})
+	r.GET("/readyz", func(c *gin.Context) {
+		if !ready.Load() {
+			c.JSON(http.StatusServiceUnavailable, gin.H{"status": "starting"})
+			return
+		}
+		if routes := g.unreadyRoutes(); len(routes) > 0 {
+			c.JSON(http.StatusServiceUnavailable, gin.H{"status": "no_healthy_upstream", "routes": routes})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"status": "ready"})
+	})
+}
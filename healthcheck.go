@@ -0,0 +1,189 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// Active health checks of a route's pool members. Members failing their check
+// are left out of balancing; with none healthy, requests go to every member
+// anyway ("panic mode") rather than nowhere.
+type HealthCheckConfig struct {
+	// Path requested from every member; a 2xx or 3xx passes. No checks without one.
+	Path     string        `yaml:"path"`
+	Interval time.Duration `yaml:"interval"`
+	Timeout  time.Duration `yaml:"timeout"`
+	// While no member has passed a check since startup: "panic" (default)
+	// serves in panic mode, "not_ready" also holds /readyz at 503 until one does
+	AllUnhealthy string `yaml:"all_unhealthy"`
+}
+
+func (cfg HealthCheckConfig) validate(pool []string) error {
+	if cfg.Path == "" {
+		return nil
+	}
+	if len(pool) == 0 {
+		return fmt.Errorf("health_check: needs a pool")
+	}
+	if !strings.HasPrefix(cfg.Path, "/") {
+		return fmt.Errorf("health_check: path must start with /")
+	}
+	if cfg.Interval < 0 || cfg.Timeout < 0 {
+		return fmt.Errorf("health_check: durations can't be negative")
+	}
+	switch cfg.AllUnhealthy {
+	case "", "panic", "not_ready":
+	default:
+		return fmt.Errorf("health_check: unknown all_unhealthy mode %q", cfg.AllUnhealthy)
+	}
+	return nil
+}
+
+// Health of a pool's members, kept across reloads that leave the pool and its
+// checks as they were
+type poolHealth struct {
+	cfg     HealthCheckConfig
+	healthy map[string]*atomic.Bool
+	// Some member passed a check since startup
+	anyPassed atomic.Bool
+	// Check rounds don't overlap; next is when the next one is due
+	running atomic.Bool
+	next    atomic.Int64
+}
+
+func newPoolHealth(cfg HealthCheckConfig, members []string) *poolHealth {
+	if cfg.Interval <= 0 {
+		cfg.Interval = 10 * time.Second
+	}
+	if cfg.Timeout <= 0 {
+		cfg.Timeout = 2 * time.Second
+	}
+	h := &poolHealth{cfg: cfg, healthy: make(map[string]*atomic.Bool, len(members))}
+	for _, member := range members {
+		h.healthy[member] = new(atomic.Bool)
+	}
+	return h
+}
+
+// Members to balance across: the healthy ones, or all of them when there are
+// none or no check has passed yet
+func (h *poolHealth) usable(members []string) []string {
+	if h == nil || !h.anyPassed.Load() {
+		return members
+	}
+	usable := h.healthyOf(members)
+	if len(usable) == 0 {
+		return members
+	}
+	return usable
+}
+
+// Members passing their last check, none of them in panic mode
+func (h *poolHealth) healthyOf(members []string) []string {
+	healthy := make([]string, 0, len(members))
+	for _, member := range members {
+		if h.healthy[member].Load() {
+			healthy = append(healthy, member)
+		}
+	}
+	return healthy
+}
+
+// Whether the route holds back readiness: no member passed yet under not_ready
+func (h *poolHealth) holdsReadiness() bool {
+	return h != nil && h.cfg.AllUnhealthy == "not_ready" && !h.anyPassed.Load()
+}
+
+// Check every member of route once
+func (route *Route) checkPool(ctx context.Context) {
+	h := route.balancer.health
+	var wg sync.WaitGroup
+	for _, member := range route.balancer.members {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			err := route.checkMember(ctx, member)
+			healthy := err == nil
+			if h.healthy[member].Swap(healthy) == healthy {
+				return
+			}
+			if healthy {
+				h.anyPassed.Store(true)
+				log.Info().Str("route", route.Prefix).Str("upstream", redactURL(member)).Msg("Pool member passed its health check")
+				return
+			}
+			log.Warn().Err(err).Str("route", route.Prefix).Str("upstream", redactURL(member)).Msg("Pool member failed its health check")
+			sendLogToLoki("Pool member failed its health check: "+redactURL(member), map[string]string{"level": "warn", "path": route.Prefix})
+		}()
+	}
+	wg.Wait()
+}
+
+func (route *Route) checkMember(ctx context.Context, member string) error {
+	ctx, cancel := context.WithTimeout(ctx, route.balancer.health.cfg.Timeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, member+route.balancer.health.cfg.Path, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := route.httpClient().Do(req)
+	if err != nil {
+		return err
+	}
+	// Drained so the connection can be reused
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 400 {
+		return fmt.Errorf("health check responded with status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// How often the health loop looks for due checks
+const healthLoopTick = time.Second
+
+// Run the due health checks of the current routes until the gateway closes
+func (g *Gateway) healthLoop() {
+	ticker := time.NewTicker(healthLoopTick)
+	defer ticker.Stop()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	for {
+		now := time.Now()
+		for _, route := range g.routes() {
+			h := route.balancer.healthChecks()
+			if h == nil || now.UnixNano() < h.next.Load() || !h.running.CompareAndSwap(false, true) {
+				continue
+			}
+			h.next.Store(now.Add(h.cfg.Interval).UnixNano())
+			go func() {
+				defer h.running.Store(false)
+				route.checkPool(ctx)
+			}()
+		}
+		select {
+		case <-ticker.C:
+		case <-g.stopBackground:
+			return
+		}
+	}
+}
+
+// Prefixes of routes holding back readiness
+func (g *Gateway) unreadyRoutes() []string {
+	var prefixes []string
+	for _, route := range g.routes() {
+		if route.balancer.healthChecks().holdsReadiness() {
+			prefixes = append(prefixes, route.Prefix)
+		}
+	}
+	return prefixes
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// With every member failing its checks since startup, /readyz holds at 503;
+// once one passes the gateway is ready and traffic goes to that member
+func TestReadyzWaitsForHealthyMember(t *testing.T) {
+	var healthy atomic.Bool
+	member := func(name string, checked *atomic.Bool) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path == "/healthz" {
+				if checked == nil || !checked.Load() {
+					w.WriteHeader(http.StatusServiceUnavailable)
+				}
+				return
+			}
+			w.Write([]byte(name))
+		}))
+	}
+	a, b := member("a", nil), member("b", &healthy)
+	defer a.Close()
+	defer b.Close()
+	g, r := newTestGateway(t, "routes:\n- prefix: /hc\n  pool: ['"+a.URL+"', '"+b.URL+"']\n  rate_limit: {rate: 1000, burst: 1000}\n"+
+		"  health_check: {path: /healthz, interval: 20ms, timeout: 1s, all_unhealthy: not_ready}\n")
+	registerHealthRoutes(r, g)
+	wasReady := ready.Load()
+	ready.Store(true)
+	defer ready.Store(wasReady)
+	readyz := func() *httptest.ResponseRecorder {
+		return serve(r, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+	}
+
+	// A few check rounds, all failing
+	time.Sleep(100 * time.Millisecond)
+	if w := readyz(); w.Code != http.StatusServiceUnavailable || !strings.Contains(w.Body.String(), "no_healthy_upstream") || !strings.Contains(w.Body.String(), "/hc") {
+		t.Fatalf("all members unhealthy: %d %s, want 503 naming the route", w.Code, w.Body)
+	}
+
+	healthy.Store(true)
+	for deadline := time.Now().Add(5 * time.Second); readyz().Code != http.StatusOK; time.Sleep(5 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("not ready after a member recovered")
+		}
+	}
+	for range 4 {
+		if got := serve(r, httptest.NewRequest(http.MethodGet, "/hc/", nil)).Body.String(); got != "b" {
+			t.Errorf("served by %q, want only the healthy member b", got)
+		}
+	}
+}
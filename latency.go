@@ -0,0 +1,84 @@
+package main
+
+import (
+	"fmt"
+	"math/rand/v2"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Artificial latency added to a route's responses once the upstream has
+// answered, to check how clients cope with a slow gateway. Unlike fault
+// delays it hits every response. Nothing is added unless Enabled is set, here
+// or through the admin API.
+type LatencyConfig struct {
+	Enabled bool `yaml:"enabled"`
+	// "fixed" (default) adds Duration, "uniform" between Min and Max,
+	// "normal" around Duration with StdDev, never below zero
+	Distribution string        `yaml:"distribution"`
+	Duration     time.Duration `yaml:"duration"`
+	Min          time.Duration `yaml:"min"`
+	Max          time.Duration `yaml:"max"`
+	StdDev       time.Duration `yaml:"stddev"`
+}
+
+func (cfg LatencyConfig) configured() bool {
+	return cfg.Duration > 0 || cfg.Max > 0
+}
+
+func (cfg LatencyConfig) validate() error {
+	switch cfg.Distribution {
+	case "", "fixed", "normal":
+	case "uniform":
+		if cfg.Min < 0 || cfg.Max < cfg.Min {
+			return fmt.Errorf("latency: uniform needs 0 <= min <= max")
+		}
+	default:
+		return fmt.Errorf("latency: unknown distribution %q", cfg.Distribution)
+	}
+	if cfg.Duration < 0 || cfg.StdDev < 0 {
+		return fmt.Errorf("latency: durations can't be negative")
+	}
+	return nil
+}
+
+type latencyInjector struct {
+	cfg     LatencyConfig
+	enabled atomic.Bool
+}
+
+func newLatencyInjector(cfg LatencyConfig) *latencyInjector {
+	l := &latencyInjector{cfg: cfg}
+	l.enabled.Store(cfg.Enabled)
+	return l
+}
+
+// Latency for the next response
+func (l *latencyInjector) sample() time.Duration {
+	switch l.cfg.Distribution {
+	case "uniform":
+		return l.cfg.Min + rand.N(l.cfg.Max-l.cfg.Min+1)
+	case "normal":
+		return max(0, l.cfg.Duration+time.Duration(rand.NormFloat64()*float64(l.cfg.StdDev)))
+	}
+	return l.cfg.Duration
+}
+
+// Hold the upstream response back while latency injection is enabled
+func (l *latencyInjector) modifier() responseModifier {
+	return func(c *gin.Context, resp *http.Response) error {
+		if !l.enabled.Load() {
+			return nil
+		}
+		timer := time.NewTimer(l.sample())
+		defer timer.Stop()
+		select {
+		case <-timer.C:
+		case <-c.Request.Context().Done():
+		}
+		return nil
+	}
+}
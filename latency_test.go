@@ -0,0 +1,56 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Enabled latency holds every response back by the configured duration;
+// switched off through the admin API, responses are immediate again
+func TestLatencyAddedToResponses(t *testing.T) {
+	up := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+	defer up.Close()
+	g, r := newTestGateway(t, "routes:\n- prefix: /l\n  target: "+up.URL+"\n  rate_limit: {rate: 1000, burst: 1000}\n"+
+		"  latency: {enabled: true, duration: 150ms}\n")
+	if err := registerAdminRoutes(r, AdminConfig{Auth: AdminAuthConfig{Token: "s3cret"}}, g); err != nil {
+		t.Fatal(err)
+	}
+	timed := func() time.Duration {
+		start := time.Now()
+		if w := serve(r, httptest.NewRequest(http.MethodGet, "/l/", nil)); w.Code != http.StatusOK || w.Body.String() != "ok" {
+			t.Fatalf("status %d, body %q", w.Code, w.Body)
+		}
+		return time.Since(start)
+	}
+
+	for range 3 {
+		if took := timed(); took < 150*time.Millisecond {
+			t.Errorf("enabled: answered in %s, want at least the 150ms added", took)
+		}
+	}
+
+	req := httptest.NewRequest(http.MethodPost, "/admin/latency", strings.NewReader(`{"route": "/l", "enabled": false}`))
+	req.Header.Set("X-Admin-Token", "s3cret")
+	req.Header.Set("Content-Type", "application/json")
+	if w := serve(r, req); w.Code != http.StatusOK {
+		t.Fatalf("disabling: %d", w.Code)
+	}
+	if took := timed(); took >= 150*time.Millisecond {
+		t.Errorf("disabled: answered in %s, want no added latency", took)
+	}
+}
+
+// Uniform latency stays within min and max
+func TestLatencyUniformBounds(t *testing.T) {
+	l := newLatencyInjector(LatencyConfig{Enabled: true, Distribution: "uniform", Min: 10 * time.Millisecond, Max: 20 * time.Millisecond})
+	for range 1000 {
+		if d := l.sample(); d < 10*time.Millisecond || d > 20*time.Millisecond {
+			t.Fatalf("sampled %s, outside 10ms..20ms", d)
+		}
+	}
+}
@@ -0,0 +1,513 @@
+package main
+
+import (
+	"container/list"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"golang.org/x/time/rate"
+)
+
+// Request admission for a route
+type Limiter interface {
+	Allow() bool
+	// Average admitted rate in requests per second
+	Limit() rate.Limit
+	// Time until Allow could succeed, 0 when it can now. Nothing is consumed.
+	RetryAfter() time.Duration
+	// Share of the budget in use now, from 0 (untouched) to 1 (exhausted)
+	Usage() float64
+}
+
+// Token bucket, refilling at Limit up to Burst
+type tokenBucket struct {
+	*rate.Limiter
+}
+
+func (l tokenBucket) RetryAfter() time.Duration {
+	tokens := l.TokensAt(time.Now())
+	// A limit of 0 never refills, there is no time to give
+	if tokens >= 1 || l.Limit() == rate.Inf || l.Limit() <= 0 {
+		return 0
+	}
+	return time.Duration((1 - tokens) / float64(l.Limit()) * float64(time.Second))
+}
+
+func (l tokenBucket) Usage() float64 {
+	if l.Limit() == rate.Inf || l.Burst() <= 0 {
+		return 0
+	}
+	return min(1, max(0, 1-l.TokensAt(time.Now())/float64(l.Burst())))
+}
+
+// Counts requests in windows aligned to multiples of the window length
+type fixedWindowLimiter struct {
+	limit  int
+	window time.Duration
+	now    func() time.Time
+
+	mu    sync.Mutex
+	start time.Time
+	count int
+}
+
+func (l *fixedWindowLimiter) Allow() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	start := l.now().Truncate(l.window)
+	if !start.Equal(l.start) {
+		l.start, l.count = start, 0
+	}
+	if l.count >= l.limit {
+		return false
+	}
+	l.count++
+	return true
+}
+
+func (l *fixedWindowLimiter) Limit() rate.Limit {
+	// Reconfigured in place on reload
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return rate.Limit(float64(l.limit) / l.window.Seconds())
+}
+
+func (l *fixedWindowLimiter) RetryAfter() time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := l.now()
+	start := now.Truncate(l.window)
+	if !start.Equal(l.start) || l.count < l.limit {
+		return 0
+	}
+	return start.Add(l.window).Sub(now)
+}
+
+func (l *fixedWindowLimiter) Usage() float64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if !l.now().Truncate(l.window).Equal(l.start) {
+		return 0
+	}
+	return min(1, float64(l.count)/float64(l.limit))
+}
+
+// Sliding window counter: the previous window's count is weighted by how much
+// of it still overlaps the sliding window ending now.
+type slidingWindowLimiter struct {
+	limit  int
+	window time.Duration
+	now    func() time.Time
+
+	mu       sync.Mutex
+	start    time.Time
+	current  int
+	previous int
+}
+
+func (l *slidingWindowLimiter) Allow() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := l.now()
+	start := now.Truncate(l.window)
+	switch {
+	case start.Equal(l.start):
+	case start.Sub(l.start) == l.window:
+		l.previous, l.current, l.start = l.current, 0, start
+	default:
+		l.previous, l.current, l.start = 0, 0, start
+	}
+
+	overlap := 1 - float64(now.Sub(start))/float64(l.window)
+	if float64(l.previous)*overlap+float64(l.current) >= float64(l.limit) {
+		return false
+	}
+	l.current++
+	return true
+}
+
+func (l *slidingWindowLimiter) Limit() rate.Limit {
+	// Reconfigured in place on reload
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return rate.Limit(float64(l.limit) / l.window.Seconds())
+}
+
+func (l *slidingWindowLimiter) RetryAfter() time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := l.now()
+	start := now.Truncate(l.window)
+	current, previous := float64(l.current), float64(l.previous)
+	switch {
+	case start.Equal(l.start):
+	case start.Sub(l.start) == l.window:
+		previous, current = current, 0
+	default:
+		previous, current = 0, 0
+	}
+
+	limit := float64(l.limit)
+	elapsed := float64(now.Sub(start)) / float64(l.window)
+	if previous*(1-elapsed)+current < limit {
+		return 0
+	}
+	// Just past the point where the weighted count drops below the limit
+	const margin = time.Millisecond
+	if current < limit {
+		// Wait for the previous window's share to fade enough
+		fade := 1 - (limit-current)/previous
+		return time.Duration((fade-elapsed)*float64(l.window)) + margin
+	}
+	// This window alone is full; it has to fade as the previous one
+	fade := 1 - limit/current
+	return start.Add(l.window).Sub(now) + time.Duration(fade*float64(l.window)) + margin
+}
+
+func (l *slidingWindowLimiter) Usage() float64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := l.now()
+	start := now.Truncate(l.window)
+	current, previous := float64(l.current), float64(l.previous)
+	switch {
+	case start.Equal(l.start):
+	case start.Sub(l.start) == l.window:
+		previous, current = current, 0
+	default:
+		previous, current = 0, 0
+	}
+	overlap := 1 - float64(now.Sub(start))/float64(l.window)
+	return min(1, (previous*overlap+current)/float64(l.limit))
+}
+
+// Token bucket whose capacity adapts to how smooth traffic has been: it holds
+// burst tokens after a spike and grows to maxBurst over recovery of spike-free
+// traffic. A spike is a request digging more than burst into the bucket or
+// being rejected. Tokens granted before a spike stay usable, the shrunk
+// capacity only stops refilling past it.
+type adaptiveLimiter struct {
+	rate     float64
+	burst    int
+	maxBurst int
+	recovery time.Duration
+	now      func() time.Time
+
+	mu     sync.Mutex
+	tokens float64
+	last   time.Time
+	spike  time.Time
+}
+
+const defaultBurstRecovery = time.Minute
+
+func newAdaptiveLimiter(cfg RateLimitConfig, now func() time.Time) *adaptiveLimiter {
+	l := &adaptiveLimiter{now: now}
+	l.configure(cfg)
+	// A new client hasn't shown it is steady yet
+	l.tokens, l.last, l.spike = float64(l.burst), now(), now()
+	return l
+}
+
+func (l *adaptiveLimiter) configure(cfg RateLimitConfig) {
+	l.rate, l.burst, l.maxBurst, l.recovery = cfg.Rate, cfg.Burst, max(cfg.MaxBurst, cfg.Burst), cfg.BurstRecovery
+	if l.recovery <= 0 {
+		l.recovery = defaultBurstRecovery
+	}
+}
+
+// Bucket capacity at now, from burst right after a spike up to maxBurst
+func (l *adaptiveLimiter) capacity(now time.Time) float64 {
+	calm := min(1, float64(now.Sub(l.spike))/float64(l.recovery))
+	return float64(l.burst) + float64(l.maxBurst-l.burst)*calm
+}
+
+// Tokens at now; refills stop at the capacity but don't take above it away
+func (l *adaptiveLimiter) tokensAt(now time.Time) float64 {
+	capacity := l.capacity(now)
+	if l.tokens >= capacity {
+		return l.tokens
+	}
+	return min(capacity, l.tokens+now.Sub(l.last).Seconds()*l.rate)
+}
+
+func (l *adaptiveLimiter) Allow() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := l.now()
+	l.tokens, l.last = l.tokensAt(now), now
+	if l.tokens < 1 {
+		l.spike = now
+		return false
+	}
+	l.tokens--
+	// Credit from before a spike still being spent is part of that spike
+	if capacity := l.capacity(now); l.tokens < capacity-float64(l.burst) || l.tokens >= capacity {
+		l.spike = now
+	}
+	return true
+}
+
+func (l *adaptiveLimiter) Limit() rate.Limit {
+	// Reconfigured in place on reload
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return rate.Limit(l.rate)
+}
+
+func (l *adaptiveLimiter) RetryAfter() time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	tokens := l.tokensAt(l.now())
+	if tokens >= 1 || l.rate <= 0 {
+		return 0
+	}
+	return time.Duration((1 - tokens) / l.rate * float64(time.Second))
+}
+
+// Relative to the capacity at the moment, so a shrunk bucket runs fuller
+func (l *adaptiveLimiter) Usage() float64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := l.now()
+	return min(1, max(0, 1-l.tokensAt(now)/l.capacity(now)))
+}
+
+func (c RateLimitConfig) validate() error {
+	switch c.Algorithm {
+	case "", "token_bucket":
+	case "fixed_window", "sliding_window":
+		if c.Limit <= 0 || c.Window <= 0 {
+			return fmt.Errorf("rate_limit: %s needs a positive limit and window", c.Algorithm)
+		}
+	case "adaptive_burst":
+		if c.Rate <= 0 || c.Burst < 1 {
+			return fmt.Errorf("rate_limit: adaptive_burst needs a positive rate and burst")
+		}
+		if c.MaxBurst < c.Burst || c.BurstRecovery < 0 {
+			return fmt.Errorf("rate_limit: max_burst must be at least burst, burst_recovery can't be negative")
+		}
+	default:
+		return fmt.Errorf("rate_limit: unknown algorithm %q", c.Algorithm)
+	}
+	if c.Key != "" && c.Key != "ip" && !strings.HasPrefix(c.Key, "header:") {
+		return fmt.Errorf("rate_limit: unknown key %q", c.Key)
+	}
+	switch c.OnReload {
+	case "", "update", "reset":
+	default:
+		return fmt.Errorf("rate_limit: unknown on_reload %q", c.OnReload)
+	}
+	return nil
+}
+
+func newLimiter(cfg RateLimitConfig) Limiter {
+	switch cfg.Algorithm {
+	case "fixed_window":
+		return &fixedWindowLimiter{limit: cfg.Limit, window: cfg.Window, now: time.Now}
+	case "sliding_window":
+		return &slidingWindowLimiter{limit: cfg.Limit, window: cfg.Window, now: time.Now}
+	case "adaptive_burst":
+		return newAdaptiveLimiter(cfg, time.Now)
+	}
+	return tokenBucket{rate.NewLimiter(rate.Limit(cfg.Rate), cfg.Burst)}
+}
+
+// Apply new settings to a limiter without losing its consumed budget. Reports
+// false when the limiter can't take them, e.g. because the algorithm changed.
+func reconfigureLimiter(l Limiter, cfg RateLimitConfig) bool {
+	switch l := l.(type) {
+	case tokenBucket:
+		if cfg.Algorithm != "" && cfg.Algorithm != "token_bucket" {
+			return false
+		}
+		l.SetLimit(rate.Limit(cfg.Rate))
+		l.SetBurst(cfg.Burst)
+	case *fixedWindowLimiter:
+		if cfg.Algorithm != "fixed_window" {
+			return false
+		}
+		l.mu.Lock()
+		l.limit, l.window = cfg.Limit, cfg.Window
+		l.mu.Unlock()
+	case *slidingWindowLimiter:
+		if cfg.Algorithm != "sliding_window" {
+			return false
+		}
+		l.mu.Lock()
+		l.limit, l.window = cfg.Limit, cfg.Window
+		l.mu.Unlock()
+	case *adaptiveLimiter:
+		if cfg.Algorithm != "adaptive_burst" {
+			return false
+		}
+		l.mu.Lock()
+		l.configure(cfg)
+		l.mu.Unlock()
+	default:
+		return false
+	}
+	return true
+}
+
+// Per-client limiters are dropped once idle this long and the map has grown.
+// Past limiterMaxKeys the least recently seen one goes, idle or not, so
+// clients minting keys can't grow the map without bound.
+const (
+	limiterIdleTTL  = 10 * time.Minute
+	limiterSweepLen = 10000
+	limiterMaxKeys  = 100000
+)
+
+type keyedLimiter struct {
+	Limiter
+	key      string
+	lastSeen time.Time
+}
+
+// Rate limiting state of a route: one shared limiter, or one per client when a key is set
+type routeLimiter struct {
+	mu     sync.Mutex
+	cfg    RateLimitConfig
+	shared Limiter
+	keyed  map[string]*list.Element
+	// Keyed limiters, most recently seen first
+	lru *list.List
+
+	// Activity since the last rate_limit_report window
+	statsMu sync.Mutex
+	stats   limiterStats
+}
+
+func newRouteLimiter(cfg RateLimitConfig) *routeLimiter {
+	l := &routeLimiter{cfg: cfg, stats: limiterStats{since: time.Now()}}
+	if cfg.Key == "" {
+		l.shared = newLimiter(cfg)
+	} else {
+		l.keyed, l.lru = make(map[string]*list.Element), list.New()
+	}
+	return l
+}
+
+// Client identity for a "ip" or "header:<name>" key spec
+func clientKey(c *gin.Context, spec string) string {
+	if name, ok := strings.CutPrefix(spec, "header:"); ok {
+		return c.GetHeader(name)
+	}
+	return c.ClientIP()
+}
+
+// Limiter the request is counted against
+func (l *routeLimiter) limiterFor(c *gin.Context) Limiter {
+	l.mu.Lock()
+	if l.shared != nil {
+		shared := l.shared
+		l.mu.Unlock()
+		return shared
+	}
+
+	now := time.Now()
+	key := clientKey(c, l.cfg.Key)
+	var entry *keyedLimiter
+	if el, ok := l.keyed[key]; ok {
+		entry = el.Value.(*keyedLimiter)
+		l.lru.MoveToFront(el)
+	} else {
+		l.evict(now)
+		entry = &keyedLimiter{Limiter: newLimiter(l.cfg), key: key}
+		l.keyed[key] = l.lru.PushFront(entry)
+	}
+	entry.lastSeen = now
+	l.mu.Unlock()
+	return entry.Limiter
+}
+
+// Admit a request against all of the route's limits. It is counted against
+// them only if every one has room; otherwise the longest wait among the
+// exhausted ones is returned, for Retry-After.
+func (route *Route) allowRequest(c *gin.Context) (bool, time.Duration) {
+	routeLimiters := append([]*routeLimiter{route.limiter}, route.limiters...)
+	limiters := make([]Limiter, len(routeLimiters))
+	for i, l := range routeLimiters {
+		limiters[i] = l.limiterFor(c)
+	}
+
+	var wait time.Duration
+	for i, l := range limiters {
+		if w := l.RetryAfter(); w > 0 {
+			routeLimiters[i].observe(l, false)
+			wait = max(wait, w)
+		}
+	}
+	if wait > 0 {
+		return false, wait
+	}
+	for i, l := range limiters {
+		// Room can be gone since the check, under concurrent requests
+		if !l.Allow() {
+			routeLimiters[i].observe(l, false)
+			return false, l.RetryAfter()
+		}
+		routeLimiters[i].observe(l, true)
+	}
+	return true, 0
+}
+
+// Make room for a new keyed limiter, dropping idle ones from the least
+// recently seen end once the map has grown, and any past limiterMaxKeys
+func (l *routeLimiter) evict(now time.Time) {
+	for oldest := l.lru.Back(); oldest != nil; oldest = l.lru.Back() {
+		entry := oldest.Value.(*keyedLimiter)
+		idle := l.lru.Len() >= limiterSweepLen && now.Sub(entry.lastSeen) > limiterIdleTTL
+		if !idle && l.lru.Len() < limiterMaxKeys {
+			return
+		}
+		l.lru.Remove(oldest)
+		delete(l.keyed, entry.key)
+	}
+}
+
+func (l *routeLimiter) Limit() rate.Limit {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.shared != nil {
+		return l.shared.Limit()
+	}
+	if l.cfg.Algorithm == "fixed_window" || l.cfg.Algorithm == "sliding_window" {
+		return rate.Limit(float64(l.cfg.Limit) / l.cfg.Window.Seconds())
+	}
+	return rate.Limit(l.cfg.Rate)
+}
+
+// Take over the settings of a reloaded route. Existing limiters are adjusted in
+// place so clients keep their consumed budget; they are only dropped when asked
+// to or when the new settings can't be applied to them.
+func (l *routeLimiter) update(cfg RateLimitConfig) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	reset := cfg.OnReload == "reset" || cfg.Key != l.cfg.Key
+	l.cfg = cfg
+	if cfg.Key == "" {
+		l.keyed, l.lru = nil, nil
+		if l.shared == nil || reset || !reconfigureLimiter(l.shared, cfg) {
+			l.shared = newLimiter(cfg)
+		}
+		return
+	}
+
+	l.shared = nil
+	if l.keyed == nil || reset {
+		l.keyed, l.lru = make(map[string]*list.Element), list.New()
+		return
+	}
+	for key, el := range l.keyed {
+		if !reconfigureLimiter(el.Value.(*keyedLimiter).Limiter, cfg) {
+			l.lru.Remove(el)
+			delete(l.keyed, key)
+		}
+	}
+}
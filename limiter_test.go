@@ -0,0 +1,366 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+func newLimitedGateway(t *testing.T, trusted string) http.Handler {
+	t.Helper()
+	up := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	t.Cleanup(up.Close)
+	_, r := newTestGateway(t, "trusted_proxies: "+trusted+"\nroutes:\n- prefix: /l\n  target: "+up.URL+"\n  rate_limit: {rate: 0.001, burst: 1, key: ip}\n")
+	return r
+}
+
+func statusFrom(h http.Handler, remoteAddr, forwardedFor string) int {
+	req := httptest.NewRequest(http.MethodGet, "/l/", nil)
+	req.RemoteAddr = remoteAddr
+	if forwardedFor != "" {
+		req.Header.Set("X-Forwarded-For", forwardedFor)
+	}
+	return serve(h, req).Code
+}
+
+func TestRateLimitKeyIgnoresUntrustedForwardedFor(t *testing.T) {
+	r := newLimitedGateway(t, "[]")
+	if code := statusFrom(r, "198.51.100.7:4000", "203.0.113.1"); code != http.StatusOK {
+		t.Fatalf("first request: %d", code)
+	}
+	if code := statusFrom(r, "198.51.100.7:4000", "203.0.113.2"); code != http.StatusTooManyRequests {
+		t.Fatalf("spoofed X-Forwarded-For got %d, want 429", code)
+	}
+}
+
+func TestRateLimitKeyTrustsConfiguredProxies(t *testing.T) {
+	r := newLimitedGateway(t, "[198.51.100.0/24]")
+	for _, client := range []string{"203.0.113.1", "203.0.113.2"} {
+		if code := statusFrom(r, "198.51.100.7:4000", client); code != http.StatusOK {
+			t.Fatalf("client %s behind a trusted proxy: %d", client, code)
+		}
+	}
+	if code := statusFrom(r, "198.51.100.7:4000", "203.0.113.1"); code != http.StatusTooManyRequests {
+		t.Fatalf("repeated client got %d, want 429", code)
+	}
+}
+
+// Admitted requests out of n sent from remoteAddr
+func admitted(h http.Handler, remoteAddr string, n int) int {
+	ok := 0
+	for range n {
+		if statusFrom(h, remoteAddr, "") == http.StatusOK {
+			ok++
+		}
+	}
+	return ok
+}
+
+// A reload changes the rate of existing clients' limiters but keeps what they
+// consumed; on_reload: reset starts everyone over
+func TestRateLimitReloadKeepsConsumedTokens(t *testing.T) {
+	up := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer up.Close()
+	config := func(rate string, burst int, onReload string) string {
+		return fmt.Sprintf("routes:\n- prefix: /l\n  target: %s\n  rate_limit: {rate: %s, burst: %d, key: ip, on_reload: %s}\n", up.URL, rate, burst, onReload)
+	}
+	g, r := newTestGateway(t, config("0.001", 3, "update"))
+	client := "198.51.100.7:4000"
+	limiter := func() Limiter {
+		c, _ := gin.CreateTestContext(httptest.NewRecorder())
+		c.Request = httptest.NewRequest(http.MethodGet, "/l/", nil)
+		c.Request.RemoteAddr = client
+		return g.routes()[0].limiter.limiterFor(c)
+	}
+
+	if got := admitted(r, client, 2); got != 2 {
+		t.Fatalf("before the reload: %d admitted, want 2", got)
+	}
+	before := limiter()
+	reloadWith(t, g, config("0.002", 5, "update"))
+	if limiter() != before || limiter().Limit() != 0.002 {
+		t.Fatalf("after the reload: rate %v (same limiter %v), want the existing limiter at 0.002", limiter().Limit(), limiter() == before)
+	}
+	// One token left of the first burst, not a fresh burst of 5
+	if got := admitted(r, client, 5); got != 1 {
+		t.Errorf("after the reload: %d admitted, want the 1 token left", got)
+	}
+	if got := admitted(r, "198.51.100.8:4000", 6); got != 5 {
+		t.Errorf("new client after the reload: %d admitted, want the new burst of 5", got)
+	}
+
+	reloadWith(t, g, config("0.002", 5, "reset"))
+	if got := admitted(r, client, 6); got != 5 {
+		t.Errorf("after a resetting reload: %d admitted, want a fresh burst of 5", got)
+	}
+}
+
+// Clock for limiters, advanced by hand
+type fakeClock struct{ t time.Time }
+
+func (c *fakeClock) now() time.Time          { return c.t }
+func (c *fakeClock) advance(d time.Duration) { c.t = c.t.Add(d) }
+
+func newFakeClock() *fakeClock {
+	// On a window boundary, as Truncate computes them
+	return &fakeClock{t: time.Unix(1700000000, 0)}
+}
+
+// Requests let through, out of n tried at the clock's current time
+func allowed(l interface{ Allow() bool }, n int) int {
+	ok := 0
+	for range n {
+		if l.Allow() {
+			ok++
+		}
+	}
+	return ok
+}
+
+// A fixed window lets a full limit through on each side of the boundary
+func TestFixedWindowBoundary(t *testing.T) {
+	clock := newFakeClock()
+	l := &fixedWindowLimiter{limit: 3, window: time.Second, now: clock.now}
+
+	clock.advance(900 * time.Millisecond)
+	if got := allowed(l, 5); got != 3 {
+		t.Fatalf("end of the first window: %d allowed, want 3", got)
+	}
+	if l.RetryAfter() != 100*time.Millisecond {
+		t.Errorf("Retry-After %v, want the 100ms left in the window", l.RetryAfter())
+	}
+	clock.advance(100 * time.Millisecond)
+	if got := allowed(l, 5); got != 3 {
+		t.Fatalf("start of the next window: %d allowed, want a fresh 3", got)
+	}
+}
+
+// A sliding window still counts the previous window's requests right after
+// the boundary, and lets them fade as the window moves on
+func TestSlidingWindowBoundary(t *testing.T) {
+	clock := newFakeClock()
+	l := &slidingWindowLimiter{limit: 3, window: time.Second, now: clock.now}
+
+	clock.advance(900 * time.Millisecond)
+	if got := allowed(l, 5); got != 3 {
+		t.Fatalf("end of the first window: %d allowed, want 3", got)
+	}
+	clock.advance(100 * time.Millisecond)
+	if got := allowed(l, 5); got != 0 {
+		t.Fatalf("just past the boundary: %d allowed, want 0", got)
+	}
+	// The weighted count drops under the limit as soon as the window moves
+	if retry := l.RetryAfter(); retry != time.Millisecond {
+		t.Errorf("Retry-After %v, want 1ms", retry)
+	}
+	// Half the previous window still overlaps: 1.5 of 3 counted
+	clock.advance(500 * time.Millisecond)
+	if got := allowed(l, 5); got != 2 {
+		t.Fatalf("half a window later: %d allowed, want 2", got)
+	}
+	// A window with no requests in between forgets everything
+	clock.advance(2 * time.Second)
+	if got := allowed(l, 5); got != 3 {
+		t.Fatalf("after an idle window: %d allowed, want 3", got)
+	}
+}
+
+// A token bucket has no boundary: after a burst, tokens come back at the rate
+func TestTokenBucketRefill(t *testing.T) {
+	clock := newFakeClock()
+	l := newLimiter(RateLimitConfig{Rate: 3, Burst: 3}).(tokenBucket)
+	allowedAt := func(n int) int {
+		ok := 0
+		for range n {
+			if l.AllowN(clock.now(), 1) {
+				ok++
+			}
+		}
+		return ok
+	}
+
+	if got := allowedAt(5); got != 3 {
+		t.Fatalf("burst: %d allowed, want 3", got)
+	}
+	clock.advance(time.Second / 3)
+	if got := allowedAt(5); got != 1 {
+		t.Fatalf("a third of a second later: %d allowed, want 1", got)
+	}
+	clock.advance(10 * time.Second)
+	if got := allowedAt(5); got != 3 {
+		t.Fatalf("after idling: %d allowed, want the burst of 3", got)
+	}
+}
+
+func TestKeyedLimitersCapped(t *testing.T) {
+	l := newRouteLimiter(RateLimitConfig{Rate: 1, Burst: 1, Key: "header:X-Client"})
+	request := func(key string) Limiter {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.Header.Set("X-Client", key)
+		return l.limiterFor(&gin.Context{Request: req})
+	}
+
+	first := request("client-0")
+	for i := 1; i < limiterMaxKeys+100; i++ {
+		request(fmt.Sprint("client-", i))
+		if i == limiterMaxKeys/2 {
+			// Seen again, so it is the most recent of the first half
+			if request("client-0") != first {
+				t.Fatal("client-0 got a new limiter while under the cap")
+			}
+		}
+	}
+	if len(l.keyed) != limiterMaxKeys || l.lru.Len() != limiterMaxKeys {
+		t.Fatalf("%d keyed limiters (%d in LRU), want the cap of %d", len(l.keyed), l.lru.Len(), limiterMaxKeys)
+	}
+	if _, ok := l.keyed["client-1"]; ok {
+		t.Fatal("least recently seen limiter kept past the cap")
+	}
+	if _, ok := l.keyed["client-0"]; !ok {
+		t.Fatal("recently seen limiter evicted")
+	}
+}
+
+// Requests, reloads, breaker calls and reports racing over the same route
+// state; run with -race
+func TestConcurrentLimiterAndBreakerAccess(t *testing.T) {
+	var calls atomic.Int64
+	up := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if calls.Add(1)%3 == 0 {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+	defer up.Close()
+	configs := []string{
+		"routes:\n- prefix: /l\n  target: " + up.URL + "\n  rate_limit: {rate: 500, burst: 50, key: ip}\n" +
+			"  rate_limits: [{algorithm: fixed_window, limit: 1000, window: 1s}]\n" +
+			"  circuit_breaker: {consecutive_failures: 3, timeout: 10ms, failure_statuses: [500]}\n",
+		"routes:\n- prefix: /l\n  target: " + up.URL + "\n  rate_limit: {rate: 800, burst: 80, key: ip}\n" +
+			"  rate_limits: [{algorithm: fixed_window, limit: 2000, window: 2s}]\n" +
+			"  circuit_breaker: {consecutive_failures: 5, timeout: 10ms, failure_statuses: [500]}\n",
+	}
+	g, r := newTestGateway(t, configs[0])
+
+	// Requests and readers run until done; reloads and reports meanwhile
+	var requests, background sync.WaitGroup
+	stop := make(chan struct{})
+	running := func(fn func(i int)) {
+		background.Add(1)
+		go func() {
+			defer background.Done()
+			for i := 0; ; i++ {
+				select {
+				case <-stop:
+					return
+				default:
+					fn(i)
+				}
+			}
+		}()
+	}
+	running(func(i int) {
+		// Not reloadWith: Fatal must not be called off the test goroutine
+		if err := os.WriteFile(g.configPath, []byte(configs[i%2]), 0o600); err != nil {
+			t.Error(err)
+		}
+		if err := g.requestReload(); err != nil {
+			t.Error(err)
+		}
+		time.Sleep(time.Millisecond)
+	})
+	running(func(int) {
+		for _, route := range g.routes() {
+			route.limiter.Limit()
+			for _, l := range route.limiters {
+				l.Limit()
+			}
+			route.reportLimits(RateLimitReportConfig{Export: []string{"metrics"}}, time.Now())
+			route.breaker.State()
+			route.breaker.Counts()
+		}
+		time.Sleep(time.Millisecond)
+	})
+	for worker := range 8 {
+		requests.Add(1)
+		go func() {
+			defer requests.Done()
+			for i := range 50 {
+				req := httptest.NewRequest(http.MethodGet, "/l/", nil)
+				req.RemoteAddr = fmt.Sprintf("198.51.100.%d:4000", (worker*31+i)%250)
+				switch code := serve(r, req).Code; code {
+				case http.StatusOK, http.StatusTooManyRequests, http.StatusInternalServerError, http.StatusServiceUnavailable:
+				default:
+					t.Errorf("unexpected status %d", code)
+				}
+			}
+		}()
+	}
+	requests.Wait()
+	close(stop)
+	background.Wait()
+}
+
+// A client well within the per-second limit but past the hourly one gets a
+// 429, with the Retry-After of the hourly window
+func TestTieredRateLimits(t *testing.T) {
+	up := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer up.Close()
+	_, r := newTestGateway(t, "routes:\n- prefix: /l\n  target: "+up.URL+"\n  rate_limit: {rate: 100, burst: 100, key: ip}\n"+
+		"  rate_limits:\n  - {algorithm: fixed_window, limit: 3, window: 1h, key: ip}\n")
+
+	for i := range 3 {
+		if code := statusFrom(r, "198.51.100.7:4000", ""); code != http.StatusOK {
+			t.Fatalf("request %d within both limits: %d", i+1, code)
+		}
+	}
+	w := serve(r, httptest.NewRequest(http.MethodGet, "/l/", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("another client: %d, want its own hourly allowance", w.Code)
+	}
+	req := httptest.NewRequest(http.MethodGet, "/l/", nil)
+	req.RemoteAddr = "198.51.100.7:4000"
+	w = serve(r, req)
+	if w.Code != http.StatusTooManyRequests {
+		t.Fatalf("4th request in the hour: %d, want 429", w.Code)
+	}
+	if retryAfter, err := strconv.Atoi(w.Header().Get("Retry-After")); err != nil || retryAfter < 1 || retryAfter > 3600 {
+		t.Errorf("Retry-After %q, want the rest of the hour", w.Header().Get("Retry-After"))
+	}
+}
+
+// The bucket grows to max_burst over a quiet burst_recovery and is back at
+// burst right after a spike
+func TestAdaptiveBurst(t *testing.T) {
+	clock := newFakeClock()
+	l := newAdaptiveLimiter(RateLimitConfig{Algorithm: "adaptive_burst", Rate: 1, Burst: 2, MaxBurst: 10, BurstRecovery: time.Minute}, clock.now)
+
+	if got := allowed(l, 20); got != 2 {
+		t.Errorf("new client: %d let through at once, want burst 2", got)
+	}
+	clock.advance(2 * time.Minute)
+	if got := allowed(l, 20); got != 10 {
+		t.Errorf("after a quiet period: %d let through at once, want max_burst 10", got)
+	}
+	// Just spiked: 5s refill only fills the shrunk bucket
+	clock.advance(5 * time.Second)
+	if got := allowed(l, 20); got != 2 {
+		t.Errorf("right after the spike: %d let through at once, want burst 2", got)
+	}
+	clock.advance(30 * time.Second)
+	// Halfway through recovery, halfway to max_burst
+	if got := allowed(l, 20); got != 6 {
+		t.Errorf("30s after the last spike: %d let through at once, want 6", got)
+	}
+	clock.advance(90 * time.Second)
+	if got := allowed(l, 20); got != 10 {
+		t.Errorf("recovered: %d let through at once, want max_burst 10", got)
+	}
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Hypermedia links added to a route's JSON responses as HAL-style
+// "_links": {"rel": {"href": "..."}}. Link relation -> href template, where
+// {path} is the request path, {prefix} the route prefix and {rest} the path
+// after it, e.g. self: "{path}" or orders: "{path}/orders".
+type LinksConfig map[string]string
+
+var linkPlaceholders = []string{"{path}", "{prefix}", "{rest}"}
+
+func (cfg LinksConfig) validate() error {
+	for rel, template := range cfg {
+		if rel == "" || template == "" {
+			return fmt.Errorf("links: empty relation or href")
+		}
+		// Whatever is left in braces after the known placeholders is a typo
+		rest := template
+		for _, placeholder := range linkPlaceholders {
+			rest = strings.ReplaceAll(rest, placeholder, "")
+		}
+		if strings.ContainsAny(rest, "{}") {
+			return fmt.Errorf("links: unknown placeholder in %q", template)
+		}
+	}
+	return nil
+}
+
+// The _links object for a request to the route at prefix
+func (cfg LinksConfig) render(prefix, path string) map[string]map[string]string {
+	replacer := strings.NewReplacer(
+		"{path}", path,
+		"{prefix}", prefix,
+		"{rest}", strings.TrimPrefix(path, strings.TrimSuffix(prefix, "/")),
+	)
+	links := make(map[string]map[string]string, len(cfg))
+	for rel, template := range cfg {
+		links[rel] = map[string]string{"href": replacer.Replace(template)}
+	}
+	return links
+}
+
+// Add the configured links to successful JSON object responses. Relations the
+// upstream already put in _links are left as it sent them; arrays, other
+// values and bodies that aren't valid JSON pass unchanged.
+func linkInjector(prefix string, cfg LinksConfig) responseModifier {
+	return func(c *gin.Context, resp *http.Response) error {
+		if resp.StatusCode < 200 || resp.StatusCode >= 300 || !isJSONContentType(resp.Header.Get("Content-Type")) {
+			return nil
+		}
+		body, ok, err := readBody(resp)
+		if err != nil || !ok {
+			return err
+		}
+		replaceBody(resp, body)
+
+		var doc map[string]json.RawMessage
+		if !bytes.HasPrefix(bytes.TrimSpace(body), []byte("{")) || json.Unmarshal(body, &doc) != nil {
+			return nil
+		}
+		links := make(map[string]json.RawMessage, len(cfg))
+		if existing, ok := doc["_links"]; ok && json.Unmarshal(existing, &links) != nil {
+			// Not an object; the upstream means something else by it
+			return nil
+		}
+		for rel, link := range cfg.render(prefix, c.Request.URL.Path) {
+			if _, ok := links[rel]; !ok {
+				links[rel], _ = json.Marshal(link)
+			}
+		}
+		doc["_links"], _ = json.Marshal(links)
+		if body, err = json.Marshal(doc); err != nil {
+			return nil
+		}
+		replaceBody(resp, body)
+		return nil
+	}
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+// The configured links land in _links of JSON object responses, next to the
+// upstream's own; other bodies pass unchanged
+func TestLinksInjected(t *testing.T) {
+	up := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/list":
+			w.Header().Set("Content-Type", "application/json")
+			w.Write([]byte(`[1, 2]`))
+		case "/text":
+			w.Write([]byte(`{"not": "json typed"}`))
+		case "/missing":
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`{"error": "no such account"}`))
+		default:
+			w.Header().Set("Content-Type", "application/json")
+			w.Write([]byte(`{"id": 7, "_links": {"self": {"href": "/upstream/self"}}}`))
+		}
+	}))
+	defer up.Close()
+	_, r := newTestGateway(t, "routes:\n- prefix: /accounts\n  target: "+up.URL+"\n  rate_limit: {rate: 1000, burst: 1000}\n"+
+		"  links: {self: '{path}', orders: '{path}/orders', collection: '{prefix}', item: '/v2/accounts{rest}'}\n")
+
+	var doc map[string]any
+	if err := json.Unmarshal(serve(r, httptest.NewRequest(http.MethodGet, "/accounts/7", nil)).Body.Bytes(), &doc); err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]any{
+		"id": float64(7),
+		"_links": map[string]any{
+			// The upstream's own self is kept
+			"self":       map[string]any{"href": "/upstream/self"},
+			"orders":     map[string]any{"href": "/accounts/7/orders"},
+			"collection": map[string]any{"href": "/accounts"},
+			"item":       map[string]any{"href": "/v2/accounts/7"},
+		},
+	}
+	if !reflect.DeepEqual(doc, want) {
+		t.Errorf("response %v, want %v", doc, want)
+	}
+
+	for path, body := range map[string]string{
+		"/accounts/list":    `[1, 2]`,
+		"/accounts/text":    `{"not": "json typed"}`,
+		"/accounts/missing": `{"error": "no such account"}`,
+	} {
+		if got := serve(r, httptest.NewRequest(http.MethodGet, path, nil)).Body.String(); got != body {
+			t.Errorf("%s: body %s, want it unchanged", path, got)
+		}
+	}
+
+	if _, err := parseConfig([]byte("routes:\n- prefix: /x\n  target: " + up.URL + "\n  links: {self: '{id}'}\n")); err == nil {
+		t.Error("unknown placeholder accepted")
+	}
+}
@@ -0,0 +1,799 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/rs/zerolog/log"
+)
+
+// Listener refusing connections from an IP that already holds max of them
+type perIPListener struct {
+	net.Listener
+	max int
+
+	mu    sync.Mutex
+	conns map[string]int
+}
+
+func newPerIPListener(ln net.Listener, max int) *perIPListener {
+	return &perIPListener{Listener: ln, max: max, conns: make(map[string]int)}
+}
+
+func (l *perIPListener) Accept() (net.Conn, error) {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+
+		ip, _, err := net.SplitHostPort(conn.RemoteAddr().String())
+		if err != nil {
+			ip = conn.RemoteAddr().String()
+		}
+
+		l.mu.Lock()
+		if l.conns[ip] >= l.max {
+			l.mu.Unlock()
+			conn.Close()
+			rejectedConnections.WithLabelValues("per_ip_limit").Inc()
+			log.Warn().Str("remote_ip", ip).Int("limit", l.max).Msg("Connection rejected: per-IP connection limit reached")
+			continue
+		}
+		l.conns[ip]++
+		l.mu.Unlock()
+
+		return &trackedConn{Conn: conn, release: func() { l.release(ip) }}, nil
+	}
+}
+
+func (l *perIPListener) release(ip string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.conns[ip]--; l.conns[ip] <= 0 {
+		delete(l.conns, ip)
+	}
+}
+
+// Connection handing its slot back exactly once when closed
+type trackedConn struct {
+	net.Conn
+	once    sync.Once
+	release func()
+}
+
+func (c *trackedConn) Close() error {
+	c.once.Do(c.release)
+	return c.Conn.Close()
+}
+
+// Answer sent to request lines with an HTTP version the gateway doesn't speak
+type UnsupportedProtocolConfig struct {
+	Status      int    `yaml:"status"`
+	ContentType string `yaml:"content_type"`
+	Body        string `yaml:"body"`
+}
+
+func (cfg *UnsupportedProtocolConfig) setDefaults() {
+	if cfg.Status == 0 {
+		cfg.Status = http.StatusHTTPVersionNotSupported
+	}
+	if cfg.Body == "" {
+		cfg.ContentType, cfg.Body = "application/json", `{"error":"HTTP version not supported"}`
+	}
+	if cfg.ContentType == "" {
+		cfg.ContentType = "text/plain; charset=utf-8"
+	}
+}
+
+// Header blocks and chunk lines longer than this are left to net/http to reject
+const maxCheckedHeaderBytes = 1<<20 + 4096
+
+// Listener checking every request on HTTP/1 connections before net/http
+// parses it: unsupported HTTP versions get the configured answer, requests
+// with a malformed Content-Length a 400, and with strict framing, requests
+// whose body length is ambiguous (Content-Length together with
+// Transfer-Encoding, or Content-Length more than once) or that name more than
+// one Host get a 400 too. net/http would otherwise answer unknown versions
+// with a fixed text and silently pick one of the conflicting lengths.
+//
+// It has to sit below net/http: by the time a handler runs, net/http has
+// already dropped a Content-Length sent with chunked encoding, merged
+// repeated equal lengths into one and answered unknown versions itself, so
+// no handler or ConnState hook can tell such requests from clean ones. The
+// cost is a second reader of the framing, which must agree with net/http on
+// where every body ends; parseFraming copies its rules and
+// TestParseFramingMatchesNetHTTP holds the two to the same answers.
+type requestCheckListener struct {
+	net.Listener
+	unsupported   *rejection
+	strictFraming bool
+}
+
+func newRequestCheckListener(ln net.Listener, unsupported UnsupportedProtocolConfig, strictFraming bool) *requestCheckListener {
+	return &requestCheckListener{
+		Listener:      ln,
+		unsupported:   &rejection{"unsupported_protocol", unsupported.Status, unsupported.ContentType, unsupported.Body},
+		strictFraming: strictFraming,
+	}
+}
+
+func (l *requestCheckListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return l.wrap(conn), nil
+}
+
+func (l *requestCheckListener) wrap(conn net.Conn) *requestCheckConn {
+	return &requestCheckConn{Conn: conn, listener: l, r: bufio.NewReader(conn), token: randomHex(16), deadlineSet: make(chan struct{}, 1)}
+}
+
+// Answer to a request refused by the listener
+type rejection struct {
+	reason      string
+	status      int
+	contentType string
+	body        string
+}
+
+var (
+	ambiguousFramingRejection = &rejection{"ambiguous_framing", http.StatusBadRequest, "application/json", `{"error":"Ambiguous request framing"}`}
+	duplicateHostRejection    = &rejection{"duplicate_host", http.StatusBadRequest, "application/json", `{"error":"Multiple Host headers"}`}
+	invalidLengthRejection    = &rejection{"invalid_content_length", http.StatusBadRequest, "application/json", `{"error":"Invalid Content-Length"}`}
+)
+
+// Whether the request line names a version net/http can serve. Lines that
+// aren't recognizable request lines are passed on for net/http to reject.
+func supportedRequestLine(line string) bool {
+	parts := strings.Split(strings.TrimRight(line, "\r\n"), " ")
+	switch len(parts) {
+	case 2:
+		// "GET /": HTTP/0.9
+		return false
+	case 3:
+		version := parts[2]
+		if !strings.HasPrefix(version, "HTTP/") {
+			return true
+		}
+		// PRI is the HTTP/2 connection preface
+		return strings.HasPrefix(version, "HTTP/1.") || (parts[0] == "PRI" && version == "HTTP/2.0")
+	}
+	return true
+}
+
+// How the body of a request is delimited, from its header block
+type requestFraming struct {
+	ambiguous     bool
+	contentLength int64
+	chunked       bool
+	// Content-Length that isn't a single non-negative number
+	invalidLength bool
+	// The HTTP/2 preface; net/http closes the connection after answering it
+	h2Preface bool
+	// CONNECT or Upgrade, whose handler may hand the connection over to
+	// another protocol
+	switching bool
+	// Host repeated or listing several hosts, which proxies along the way
+	// may resolve differently
+	duplicateHost bool
+}
+
+// Read the framing the way net/http will: folded lines continue the header
+// before them, names are matched untrimmed, Transfer-Encoding is ignored on
+// HTTP/1.0 and Content-Length is an unsigned decimal, repeated only with the
+// same value. Any difference would let the two disagree on where a body
+// ends, and the bytes one takes for a body the other would read as a request.
+func parseFraming(block []byte) requestFraming {
+	lines := strings.Split(string(block), "\n")
+	var f requestFraming
+	if strings.HasPrefix(lines[0], "PRI ") {
+		f.h2Preface = true
+		return f
+	}
+	f.switching = strings.HasPrefix(lines[0], "CONNECT ")
+	var http10 bool
+	if requestLine := strings.Fields(lines[0]); len(requestLine) > 0 {
+		major, minor, _ := http.ParseHTTPVersion(requestLine[len(requestLine)-1])
+		http10 = major == 1 && minor == 0
+	}
+
+	type field struct{ name, value string }
+	var fields []field
+	for _, line := range lines[1:] {
+		line = strings.TrimRight(line, "\r")
+		if line != "" && (line[0] == ' ' || line[0] == '\t') && len(fields) > 0 {
+			// obs-fold, joined with a space like net/textproto does
+			last := &fields[len(fields)-1]
+			last.value = strings.TrimSpace(last.value + " " + strings.TrimSpace(line))
+			continue
+		}
+		name, value, ok := strings.Cut(line, ":")
+		if !ok {
+			continue
+		}
+		fields = append(fields, field{http.CanonicalHeaderKey(name), strings.TrimSpace(value)})
+	}
+
+	var lengths, encodings, hosts []string
+	for _, field := range fields {
+		switch field.name {
+		case "Content-Length":
+			lengths = append(lengths, field.value)
+		case "Transfer-Encoding":
+			encodings = append(encodings, field.value)
+		case "Host":
+			hosts = append(hosts, strings.Split(field.value, ",")...)
+		case "Upgrade":
+			f.switching = true
+		}
+	}
+
+	// A list like "5, 5" is as ambiguous as the header twice
+	f.ambiguous = len(lengths) > 1 || (len(lengths) > 0 && (len(encodings) > 0 || strings.Contains(lengths[0], ",")))
+	f.duplicateHost = len(hosts) > 1
+	switch {
+	case len(encodings) > 0 && !http10:
+		f.chunked = true
+	case len(lengths) > 0:
+		for _, length := range lengths[1:] {
+			if length != lengths[0] {
+				f.invalidLength = true
+				return f
+			}
+		}
+		n, err := strconv.ParseUint(lengths[0], 10, 63)
+		if err != nil {
+			f.invalidLength = true
+			return f
+		}
+		f.contentLength = int64(n)
+	}
+	return f
+}
+
+const (
+	stateHeader = iota
+	stateBody
+	stateChunkSize
+	stateChunkData
+	stateChunkEnd
+	stateTrailer
+	// Waiting for the handler of a CONNECT or Upgrade request to tell whether
+	// it switched protocols
+	stateSwitching
+	// Stop tracking and pass bytes through unchanged
+	statePassthrough
+	// Nothing more is read after a refused request
+	stateRejected
+)
+
+// Connection following request boundaries so every request's header block can
+// be checked. Bytes are handed to net/http unchanged.
+type requestCheckConn struct {
+	net.Conn
+	listener *requestCheckListener
+	r        *bufio.Reader
+
+	state     int
+	remaining int64
+	// Header lines of the current request and the line being read, kept
+	// across reads that fail, e.g. on the server's read deadline
+	block   []byte
+	partial []byte
+	// Checked bytes not yet returned to the server
+	pending []byte
+
+	// A refused request is replaced by a request carrying the token, so its
+	// answer is sent by RejectedRequestMiddleware in order after the
+	// responses to requests already read from the connection
+	token string
+
+	// The current request is a CONNECT or Upgrade; once its body is read,
+	// nothing more is parsed until its handler is done
+	switchAfterBody bool
+	// Guards the fields below, set by handlers and by net/http
+	mu        sync.Mutex
+	rejection *rejection
+	// Requests handed to net/http and requests whose handler is done; they
+	// are handled one at a time in order, so the counts tell them apart
+	read, handled int
+	// Closed once the handler of request switchRequest is done
+	switchRequest int
+	decided       chan struct{}
+	switched      bool
+	// Last request whose handler hijacked the connection
+	hijackedRequest int
+	// Read deadline, which waiting in stateSwitching honors like a read
+	readDeadline time.Time
+	deadlineSet  chan struct{}
+}
+
+var errLineTooLong = errors.New("line too long")
+
+// Read up to and including the next newline
+func (c *requestCheckConn) readLine() ([]byte, error) {
+	for {
+		chunk, err := c.r.ReadSlice('\n')
+		c.partial = append(c.partial, chunk...)
+		if err == nil {
+			line := c.partial
+			c.partial = nil
+			return line, nil
+		}
+		if err != bufio.ErrBufferFull {
+			return nil, err
+		}
+		if len(c.block)+len(c.partial) > maxCheckedHeaderBytes {
+			return nil, errLineTooLong
+		}
+	}
+}
+
+// Hand over what was collected unchecked and stop tracking the connection
+func (c *requestCheckConn) giveUp() {
+	c.pending = append(append(c.pending, c.block...), c.partial...)
+	c.block, c.partial = nil, nil
+	c.state = statePassthrough
+}
+
+// Collect the next header block and decide how its body is framed. Returns
+// the rejection to send, if any.
+func (c *requestCheckConn) readHeader() (*rejection, error) {
+	for {
+		line, err := c.readLine()
+		if err == errLineTooLong {
+			c.giveUp()
+			return nil, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		text := strings.TrimRight(string(line), "\r\n")
+		first := len(c.block) == 0
+		if first && text == "" {
+			// Stray empty line before a request; net/http decides
+			c.pending = line
+			return nil, nil
+		}
+		if first && !supportedRequestLine(text) {
+			return c.listener.unsupported, nil
+		}
+		c.block = append(c.block, line...)
+		if len(c.block) > maxCheckedHeaderBytes {
+			c.giveUp()
+			return nil, nil
+		}
+		if text != "" && !(first && strings.HasPrefix(text, "PRI ")) {
+			continue
+		}
+
+		framing := parseFraming(c.block)
+		if framing.ambiguous && c.listener.strictFraming {
+			return ambiguousFramingRejection, nil
+		}
+		if framing.invalidLength {
+			return invalidLengthRejection, nil
+		}
+		if framing.duplicateHost && c.listener.strictFraming {
+			return duplicateHostRejection, nil
+		}
+		c.pending, c.block = c.block, nil
+		c.mu.Lock()
+		c.read++
+		c.mu.Unlock()
+		c.switchAfterBody = framing.switching
+		switch {
+		case framing.h2Preface:
+			c.state = statePassthrough
+		case framing.chunked:
+			c.state = stateChunkSize
+		case framing.contentLength > 0:
+			c.state, c.remaining = stateBody, framing.contentLength
+		default:
+			c.nextRequest()
+		}
+		return nil, nil
+	}
+}
+
+// Move on past a request read to its end
+func (c *requestCheckConn) nextRequest() {
+	if !c.switchAfterBody {
+		c.state = stateHeader
+		return
+	}
+	c.switchAfterBody = false
+	c.mu.Lock()
+	c.switchRequest, c.decided, c.switched = c.read, make(chan struct{}), false
+	// The handler may be done before the body was read to its end
+	if c.hijackedRequest == c.read {
+		c.settle(true)
+	} else if c.handled >= c.read {
+		c.settle(false)
+	}
+	c.mu.Unlock()
+	c.state = stateSwitching
+}
+
+// Wait for the handler of the switching request, reporting whether it took
+// the connection over. Times out on the read deadline like a read would, so
+// net/http can still abort its background read, e.g. to hijack.
+func (c *requestCheckConn) awaitSwitch() (bool, error) {
+	for {
+		c.mu.Lock()
+		decided, deadline := c.decided, c.readDeadline
+		c.mu.Unlock()
+		var timer *time.Timer
+		var expired <-chan time.Time
+		if !deadline.IsZero() {
+			wait := time.Until(deadline)
+			if wait <= 0 {
+				return false, os.ErrDeadlineExceeded
+			}
+			timer = time.NewTimer(wait)
+			expired = timer.C
+		}
+		select {
+		case <-decided:
+		case <-c.deadlineSet:
+		case <-expired:
+		}
+		if timer != nil {
+			timer.Stop()
+		}
+		c.mu.Lock()
+		switched, settled := c.switched, isClosed(decided)
+		c.mu.Unlock()
+		if settled {
+			return switched, nil
+		}
+	}
+}
+
+func isClosed(ch chan struct{}) bool {
+	select {
+	case <-ch:
+		return true
+	default:
+		return false
+	}
+}
+
+// A request's handler took the connection over for another protocol
+func (c *requestCheckConn) hijacked() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.hijackedRequest = c.handled + 1
+	if c.decided != nil && c.hijackedRequest == c.switchRequest {
+		c.settle(true)
+	}
+}
+
+// A request's handler is done
+func (c *requestCheckConn) done() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.handled++
+	if c.decided != nil && c.handled == c.switchRequest {
+		c.settle(false)
+	}
+}
+
+func (c *requestCheckConn) settle(switched bool) {
+	if !isClosed(c.decided) {
+		c.switched = switched
+		close(c.decided)
+	}
+}
+
+func (c *requestCheckConn) SetDeadline(t time.Time) error {
+	c.noteDeadline(t)
+	return c.Conn.SetDeadline(t)
+}
+
+func (c *requestCheckConn) SetReadDeadline(t time.Time) error {
+	c.noteDeadline(t)
+	return c.Conn.SetReadDeadline(t)
+}
+
+func (c *requestCheckConn) noteDeadline(t time.Time) {
+	c.mu.Lock()
+	c.readDeadline = t
+	c.mu.Unlock()
+	select {
+	case c.deadlineSet <- struct{}{}:
+	default:
+	}
+}
+
+func (c *requestCheckConn) reject(r *rejection) {
+	rejectedConnections.WithLabelValues(r.reason).Inc()
+	log.Warn().Str("remote_addr", c.RemoteAddr().String()).Str("reason", r.reason).Msg("Request rejected before parsing")
+	c.mu.Lock()
+	c.rejection = r
+	c.read++
+	c.mu.Unlock()
+	c.pending = []byte("GET / HTTP/1.1\r\nHost: gateway\r\n" + rejectedRequestHeader + ": " + c.token + "\r\n\r\n")
+	c.state = stateRejected
+}
+
+func (c *requestCheckConn) Read(p []byte) (int, error) {
+	for len(c.pending) == 0 {
+		switch c.state {
+		case statePassthrough:
+			return c.r.Read(p)
+
+		case stateRejected:
+			return 0, io.EOF
+
+		case stateSwitching:
+			switched, err := c.awaitSwitch()
+			if err != nil {
+				return 0, err
+			}
+			if switched {
+				c.state = statePassthrough
+			} else {
+				c.state = stateHeader
+			}
+
+		case stateHeader:
+			r, err := c.readHeader()
+			if err != nil {
+				return 0, err
+			}
+			if r != nil {
+				c.reject(r)
+			}
+
+		case stateBody, stateChunkData:
+			n := int64(len(p))
+			if n > c.remaining {
+				n = c.remaining
+			}
+			n2, err := c.r.Read(p[:n])
+			c.remaining -= int64(n2)
+			if c.remaining == 0 {
+				if c.state == stateBody {
+					c.nextRequest()
+				} else {
+					c.state = stateChunkEnd
+				}
+			}
+			return n2, err
+
+		case stateChunkSize, stateChunkEnd, stateTrailer:
+			line, err := c.readLine()
+			if err == errLineTooLong {
+				c.giveUp()
+				continue
+			}
+			if err != nil {
+				return 0, err
+			}
+			c.pending = line
+			text := strings.TrimRight(string(line), "\r\n")
+			switch c.state {
+			case stateChunkEnd:
+				c.state = stateChunkSize
+			case stateTrailer:
+				if text == "" {
+					c.nextRequest()
+				}
+			case stateChunkSize:
+				sizeText, _, _ := strings.Cut(text, ";")
+				size, err := strconv.ParseInt(strings.TrimSpace(sizeText), 16, 64)
+				switch {
+				case err != nil || size < 0:
+					// Malformed; net/http rejects it
+					c.state = statePassthrough
+				case size == 0:
+					c.state = stateTrailer
+				default:
+					c.state, c.remaining = stateChunkData, size
+				}
+			}
+		}
+	}
+
+	n := copy(p, c.pending)
+	c.pending = c.pending[n:]
+	return n, nil
+}
+
+const rejectedRequestHeader = "X-Gateway-Rejected"
+
+type connKey struct{}
+
+// Keep the accepted connection in every request's context
+func connContext(ctx context.Context, conn net.Conn) context.Context {
+	return context.WithValue(ctx, connKey{}, conn)
+}
+
+// Tell the request check listener the handler took the connection over for
+// another protocol, e.g. a CONNECT tunnel; call after hijacking it
+func switchedProtocols(c *gin.Context) {
+	if conn, ok := c.Request.Context().Value(connKey{}).(*requestCheckConn); ok {
+		conn.hijacked()
+	}
+}
+
+// Middleware answering the requests that stand in for ones refused by the
+// request check listener, and telling it when a request is done without
+// switching protocols
+func RejectedRequestMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		conn, ok := c.Request.Context().Value(connKey{}).(*requestCheckConn)
+		if ok {
+			// Deferred to run after a recovered panic too
+			defer conn.done()
+		}
+		if !ok || c.GetHeader(rejectedRequestHeader) != conn.token {
+			c.Next()
+			return
+		}
+		conn.mu.Lock()
+		rejection := conn.rejection
+		conn.mu.Unlock()
+		if rejection == nil {
+			c.Next()
+			return
+		}
+		rejection.answer(c)
+	}
+}
+
+func (r *rejection) answer(c *gin.Context) {
+	c.Header("Connection", "close")
+	c.Data(r.status, r.contentType, []byte(r.body))
+	c.Abort()
+}
+
+// Middleware holding requests to the strict framing and Host rules once
+// net/http parsed them, in case they got past the request check listener.
+// net/http merges repeated equal Content-Lengths, drops Content-Length from
+// chunked requests and refuses a repeated Host itself, so for HTTP/1 the
+// listener is what sees them; this is a second layer, covering HTTP/2 too.
+func StrictFramingMiddleware(strict bool) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !strict {
+			c.Next()
+			return
+		}
+		lengths := c.Request.Header["Content-Length"]
+		if len(lengths) > 1 || (len(lengths) > 0 && len(c.Request.TransferEncoding) > 0) {
+			rejectedConnections.WithLabelValues(ambiguousFramingRejection.reason).Inc()
+			log.Warn().Str("remote_addr", c.Request.RemoteAddr).Str("reason", ambiguousFramingRejection.reason).Msg("Request rejected")
+			ambiguousFramingRejection.answer(c)
+			return
+		}
+		// net/http takes Host out of the header map for HTTP/1; a host header
+		// field next to HTTP/2's :authority stays in it
+		hosts := c.Request.Header.Values("Host")
+		if strings.Contains(c.Request.Host, ",") || len(hosts) > 1 || (len(hosts) == 1 && hosts[0] != c.Request.Host) {
+			rejectedConnections.WithLabelValues(duplicateHostRejection.reason).Inc()
+			log.Warn().Str("remote_addr", c.Request.RemoteAddr).Str("reason", duplicateHostRejection.reason).Msg("Request rejected")
+			duplicateHostRejection.answer(c)
+			return
+		}
+		c.Next()
+	}
+}
+
+// Time a client gets to complete the TLS handshake
+const tlsHandshakeTimeout = 10 * time.Second
+
+// Listener terminating TLS itself so HTTP/1 connections get the request
+// checks too; net/http would parse them on the *tls.Conn directly. HTTP/2
+// connections are handed over as they are: ALPN needs the *tls.Conn, and
+// their framing leaves nothing ambiguous. Handshakes run concurrently, a
+// slow client doesn't hold up Accept.
+type tlsCheckListener struct {
+	net.Listener
+	config *tls.Config
+	check  *requestCheckListener
+
+	ready     chan net.Conn
+	failed    chan error
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+func newTLSCheckListener(ln net.Listener, config *tls.Config, check *requestCheckListener) *tlsCheckListener {
+	l := &tlsCheckListener{
+		Listener: ln,
+		config:   config,
+		check:    check,
+		ready:    make(chan net.Conn),
+		failed:   make(chan error),
+		closed:   make(chan struct{}),
+	}
+	go l.acceptLoop()
+	return l
+}
+
+func (l *tlsCheckListener) acceptLoop() {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			select {
+			case l.failed <- err:
+			case <-l.closed:
+				return
+			}
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			continue
+		}
+		go l.handshake(conn)
+	}
+}
+
+func (l *tlsCheckListener) handshake(conn net.Conn) {
+	tlsConn := tls.Server(conn, l.config)
+	ctx, cancel := context.WithTimeout(context.Background(), tlsHandshakeTimeout)
+	defer cancel()
+	if err := tlsConn.HandshakeContext(ctx); err != nil {
+		// Reported like net/http would, for the handshake error metrics
+		fmt.Fprintf(serverErrorLog{}, "http: TLS handshake error from %s: %v", conn.RemoteAddr(), err)
+		tlsConn.Close()
+		return
+	}
+	var ready net.Conn = tlsConn
+	if tlsConn.ConnectionState().NegotiatedProtocol != "h2" {
+		ready = l.check.wrap(tlsConn)
+	}
+	select {
+	case l.ready <- ready:
+	case <-l.closed:
+		ready.Close()
+	}
+}
+
+func (l *tlsCheckListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.ready:
+		return conn, nil
+	case err := <-l.failed:
+		return nil, err
+	case <-l.closed:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *tlsCheckListener) Close() error {
+	l.closeOnce.Do(func() { close(l.closed) })
+	return l.Listener.Close()
+}
+
+// Handler giving requests on TLS connections wrapped by tlsCheckListener the
+// TLS state net/http only fills in for a *tls.Conn
+func tlsStateHandler(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.TLS == nil {
+			if conn, ok := r.Context().Value(connKey{}).(*requestCheckConn); ok {
+				if tlsConn, ok := conn.Conn.(*tls.Conn); ok {
+					state := tlsConn.ConnectionState()
+					r.TLS = &state
+				}
+			}
+		}
+		h.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,539 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Gateway-like server behind listen, answering 200 with whether the request
+// came with TLS state
+func startCheckServer(t *testing.T, cfg *Config, tlsConfig *tls.Config, extra ...gin.HandlerFunc) net.Addr {
+	t.Helper()
+	registerMetrics(MetricsConfig{})
+	gin.SetMode(gin.ReleaseMode)
+	r := gin.New()
+	r.Use(RejectedRequestMiddleware(), StrictFramingMiddleware(cfg.StrictFraming))
+	r.Use(extra...)
+	r.NoRoute(func(c *gin.Context) {
+		io.Copy(io.Discard, c.Request.Body)
+		c.String(http.StatusOK, "tls=%v", c.Request.TLS != nil)
+	})
+	server := &http.Server{Addr: "127.0.0.1:0", Handler: tlsStateHandler(r), ConnContext: connContext}
+	server.TLSConfig = tlsConfig
+	ln, err := listen(context.Background(), cfg, server)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go server.Serve(ln)
+	t.Cleanup(func() { server.Close() })
+	return ln.Addr()
+}
+
+// Send raw requests on one connection and read n responses
+func exchange(t *testing.T, conn net.Conn, raw string, n int) []*http.Response {
+	t.Helper()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.WriteString(conn, raw); err != nil {
+		t.Fatal(err)
+	}
+	br := bufio.NewReader(conn)
+	var responses []*http.Response
+	for i := 0; i < n; i++ {
+		resp, err := http.ReadResponse(br, nil)
+		if err != nil {
+			t.Fatalf("response %d: %v", i+1, err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body = io.NopCloser(strings.NewReader(string(body)))
+		responses = append(responses, resp)
+	}
+	return responses
+}
+
+func bodyOf(resp *http.Response) string {
+	b, _ := io.ReadAll(resp.Body)
+	return string(b)
+}
+
+const smuggled = "POST / HTTP/1.1\r\nHost: a\r\nContent-Length: 5\r\nTransfer-Encoding: chunked\r\n\r\n0\r\n\r\n"
+
+func TestUpgradeHeaderKeepsCheckingPipelinedRequests(t *testing.T) {
+	addr := startCheckServer(t, &Config{StrictFraming: true}, nil)
+	conn, err := net.Dial("tcp", addr.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	responses := exchange(t, conn, "GET / HTTP/1.1\r\nHost: a\r\nUpgrade: x\r\nConnection: upgrade\r\n\r\n"+smuggled, 2)
+	if responses[0].StatusCode != http.StatusOK {
+		t.Fatalf("upgrade request: status %d", responses[0].StatusCode)
+	}
+	if responses[1].StatusCode != http.StatusBadRequest || !strings.Contains(bodyOf(responses[1]), "Ambiguous") {
+		t.Fatalf("request after the upgrade header: status %d, want the ambiguous framing 400", responses[1].StatusCode)
+	}
+}
+
+func TestAmbiguousFramingRejected(t *testing.T) {
+	addr := startCheckServer(t, &Config{StrictFraming: true}, nil)
+	rejected := rejectedConnections.WithLabelValues("ambiguous_framing")
+	for name, raw := range map[string]string{
+		"length and chunked": smuggled,
+		"chunked and length": "POST / HTTP/1.1\r\nHost: a\r\nTransfer-Encoding: chunked\r\nContent-Length: 5\r\n\r\n0\r\n\r\n",
+		"equal lengths":      "POST / HTTP/1.1\r\nHost: a\r\nContent-Length: 5\r\nContent-Length: 5\r\n\r\nhello",
+		"different lengths":  "POST / HTTP/1.1\r\nHost: a\r\nContent-Length: 5\r\nContent-Length: 0\r\n\r\nhello",
+		"length list":        "POST / HTTP/1.1\r\nHost: a\r\nContent-Length: 5, 5\r\n\r\nhello",
+	} {
+		before := counterValue(t, rejected)
+		conn, err := net.Dial("tcp", addr.String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		// The 400 closes the connection, the request after it is never read
+		responses := exchange(t, conn, raw+"GET / HTTP/1.1\r\nHost: a\r\n\r\n", 1)
+		conn.Close()
+		if responses[0].StatusCode != http.StatusBadRequest || !strings.Contains(bodyOf(responses[0]), "Ambiguous") || !responses[0].Close {
+			t.Errorf("%s: status %d, want the ambiguous framing 400 closing the connection", name, responses[0].StatusCode)
+		}
+		if got := counterValue(t, rejected) - before; got != 1 {
+			t.Errorf("%s: rejections counted: %v, want 1", name, got)
+		}
+	}
+}
+
+func TestMalformedContentLengthRejected(t *testing.T) {
+	addr := startCheckServer(t, &Config{StrictFraming: true}, nil)
+	conn, err := net.Dial("tcp", addr.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	responses := exchange(t, conn, "POST / HTTP/1.1\r\nHost: a\r\nContent-Length: 5x\r\n\r\nhello"+smuggled, 1)
+	if responses[0].StatusCode != http.StatusBadRequest || !strings.Contains(bodyOf(responses[0]), "Invalid Content-Length") {
+		t.Fatalf("status %d, want the invalid Content-Length 400", responses[0].StatusCode)
+	}
+}
+
+func TestConnectTunnelPassesBytesThrough(t *testing.T) {
+	echo, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer echo.Close()
+	go func() {
+		for {
+			conn, err := echo.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+
+	proxy := ForwardProxyConfig{Enabled: true, AllowedHosts: []string{echo.Addr().String()}}
+	addr := startCheckServer(t, &Config{StrictFraming: true}, nil, ForwardProxyMiddleware(proxy))
+	conn, err := net.Dial("tcp", addr.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	io.WriteString(conn, "CONNECT "+echo.Addr().String()+" HTTP/1.1\r\nHost: "+echo.Addr().String()+"\r\n\r\n")
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, &http.Request{Method: http.MethodConnect})
+	if err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("CONNECT: %v %v", resp, err)
+	}
+	// Would be refused as a request; inside the tunnel it is just bytes
+	io.WriteString(conn, smuggled)
+	got := make([]byte, len(smuggled))
+	if _, err := io.ReadFull(br, got); err != nil || string(got) != smuggled {
+		t.Fatalf("tunnel echoed %q, %v", got, err)
+	}
+}
+
+func TestRefusedConnectKeepsChecking(t *testing.T) {
+	addr := startCheckServer(t, &Config{StrictFraming: true}, nil, ForwardProxyMiddleware(ForwardProxyConfig{Enabled: true}))
+	conn, err := net.Dial("tcp", addr.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	responses := exchange(t, conn, "CONNECT example.com:443 HTTP/1.1\r\nHost: example.com:443\r\n\r\n"+smuggled, 2)
+	if responses[0].StatusCode != http.StatusForbidden {
+		t.Fatalf("CONNECT: status %d, want 403", responses[0].StatusCode)
+	}
+	if responses[1].StatusCode != http.StatusBadRequest {
+		t.Fatalf("request after a refused CONNECT: status %d, want 400", responses[1].StatusCode)
+	}
+}
+
+func testTLSConfig(t *testing.T) *tls.Config {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "gateway"},
+		DNSNames:     []string{"gateway"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &tls.Config{
+		Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}},
+		NextProtos:   defaultALPN,
+	}
+}
+
+func TestFramingCheckedOverTLS(t *testing.T) {
+	addr := startCheckServer(t, &Config{StrictFraming: true}, testTLSConfig(t))
+
+	conn, err := tls.Dial("tcp", addr.String(), &tls.Config{InsecureSkipVerify: true, NextProtos: []string{"http/1.1"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	responses := exchange(t, conn, "GET / HTTP/1.1\r\nHost: a\r\n\r\n"+smuggled, 2)
+	if got := bodyOf(responses[0]); got != "tls=true" {
+		t.Fatalf("first request: %q, want the TLS state restored", got)
+	}
+	if responses[1].StatusCode != http.StatusBadRequest || !strings.Contains(bodyOf(responses[1]), "Ambiguous") {
+		t.Fatalf("ambiguous request over TLS: status %d, want the gateway's 400", responses[1].StatusCode)
+	}
+
+	// HTTP/2 connections still negotiate h2
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}, ForceAttemptHTTP2: true}}
+	resp, err := client.Get("https://" + addr.String() + "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.ProtoMajor != 2 {
+		t.Fatalf("negotiated %s, want HTTP/2", resp.Proto)
+	}
+}
+
+func TestStrictFramingMiddleware(t *testing.T) {
+	registerMetrics(MetricsConfig{})
+	gin.SetMode(gin.ReleaseMode)
+	r := gin.New()
+	r.Use(StrictFramingMiddleware(true))
+	r.NoRoute(func(c *gin.Context) { c.Status(http.StatusOK) })
+
+	for name, prepare := range map[string]func(*http.Request){
+		"two lengths": func(req *http.Request) { req.Header["Content-Length"] = []string{"5", "5"} },
+		"length and chunked": func(req *http.Request) {
+			req.Header.Set("Content-Length", "5")
+			req.TransferEncoding = []string{"chunked"}
+		},
+	} {
+		req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader("hello"))
+		prepare(req)
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		if w.Code != http.StatusBadRequest || w.Header().Get("Connection") != "close" {
+			t.Errorf("%s: status %d, want 400 closing the connection", name, w.Code)
+		}
+	}
+}
+
+const duplicateHost = "GET / HTTP/1.1\r\nHost: a\r\nHost: b\r\n\r\n"
+
+func TestDuplicateHostRejected(t *testing.T) {
+	addr := startCheckServer(t, &Config{StrictFraming: true}, nil)
+	rejected := rejectedConnections.WithLabelValues("duplicate_host")
+	for name, raw := range map[string]string{
+		"different hosts": duplicateHost,
+		"same host twice": "GET / HTTP/1.1\r\nHost: a\r\nHost: a\r\n\r\n",
+		"other case":      "GET / HTTP/1.1\r\nHost: a\r\nhost: b\r\n\r\n",
+	} {
+		before := counterValue(t, rejected)
+		conn, err := net.Dial("tcp", addr.String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		responses := exchange(t, conn, raw, 1)
+		conn.Close()
+		if responses[0].StatusCode != http.StatusBadRequest || !strings.Contains(bodyOf(responses[0]), "Multiple Host headers") || !responses[0].Close {
+			t.Errorf("%s: status %d, want the duplicate Host 400 closing the connection", name, responses[0].StatusCode)
+		}
+		if got := counterValue(t, rejected) - before; got != 1 {
+			t.Errorf("%s: rejections counted: %v, want 1", name, got)
+		}
+	}
+}
+
+func TestDuplicateHostAfterUpgradeHeader(t *testing.T) {
+	addr := startCheckServer(t, &Config{StrictFraming: true}, nil)
+	conn, err := net.Dial("tcp", addr.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	responses := exchange(t, conn, "GET / HTTP/1.1\r\nHost: a\r\nUpgrade: x\r\nConnection: upgrade\r\n\r\n"+duplicateHost, 2)
+	if responses[1].StatusCode != http.StatusBadRequest || !strings.Contains(bodyOf(responses[1]), "Multiple Host headers") {
+		t.Fatalf("duplicate Host after an upgrade header: status %d, want the gateway's 400", responses[1].StatusCode)
+	}
+}
+
+func TestDuplicateHostOverTLS(t *testing.T) {
+	addr := startCheckServer(t, &Config{StrictFraming: true}, testTLSConfig(t))
+	conn, err := tls.Dial("tcp", addr.String(), &tls.Config{InsecureSkipVerify: true, NextProtos: []string{"http/1.1"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	responses := exchange(t, conn, duplicateHost, 1)
+	if responses[0].StatusCode != http.StatusBadRequest || responses[0].Header.Get("Content-Type") != "application/json" ||
+		!strings.Contains(bodyOf(responses[0]), "Multiple Host headers") {
+		t.Fatalf("duplicate Host over TLS: status %d, want the gateway's JSON 400", responses[0].StatusCode)
+	}
+}
+
+func TestStrictFramingMiddlewareHost(t *testing.T) {
+	registerMetrics(MetricsConfig{})
+	gin.SetMode(gin.ReleaseMode)
+	r := gin.New()
+	r.Use(StrictFramingMiddleware(true))
+	r.NoRoute(func(c *gin.Context) { c.Status(http.StatusOK) })
+
+	for name, prepare := range map[string]func(*http.Request){
+		"host list":         func(req *http.Request) { req.Host = "a,b" },
+		"host header field": func(req *http.Request) { req.Host = "a"; req.Header.Set("Host", "b") },
+	} {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		prepare(req)
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), "Multiple Host headers") {
+			t.Errorf("%s: status %d, want the duplicate Host 400", name, w.Code)
+		}
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Errorf("single host: status %d", w.Code)
+	}
+}
+
+func TestPerIPConnectionLimit(t *testing.T) {
+	addr := startCheckServer(t, &Config{MaxConnsPerIP: 3}, nil)
+	rejected := rejectedConnections.WithLabelValues("per_ip_limit")
+	before := counterValue(t, rejected)
+	dial := func() net.Conn {
+		conn, err := net.Dial("tcp", addr.String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		return conn
+	}
+
+	var open []net.Conn
+	for range 3 {
+		conn := dial()
+		defer conn.Close()
+		// A served request proves the connection was accepted
+		exchange(t, conn, "GET / HTTP/1.1\r\nHost: a\r\n\r\n", 1)
+		open = append(open, conn)
+	}
+
+	over := dial()
+	defer over.Close()
+	over.SetDeadline(time.Now().Add(5 * time.Second))
+	io.WriteString(over, "GET / HTTP/1.1\r\nHost: a\r\n\r\n")
+	if _, err := http.ReadResponse(bufio.NewReader(over), nil); err == nil {
+		t.Fatal("connection over the per-IP cap was served")
+	}
+
+	// Closing one frees its slot, once the server has noticed
+	open[0].Close()
+	refused := 1
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		conn := dial()
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		io.WriteString(conn, "GET / HTTP/1.1\r\nHost: a\r\n\r\n")
+		_, err := http.ReadResponse(bufio.NewReader(conn), nil)
+		conn.Close()
+		if err == nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("no connection accepted after one was closed")
+		}
+		refused++
+	}
+	// Rejections are counted before the next connection is accepted
+	if got := counterValue(t, rejected) - before; got != float64(refused) {
+		t.Errorf("rejected connections counted: %v, want %d", got, refused)
+	}
+}
+
+func TestUnsupportedHTTPVersion(t *testing.T) {
+	cfg := &Config{}
+	cfg.UnsupportedProtocol.setDefaults()
+	addr := startCheckServer(t, cfg, nil)
+	rejected := rejectedConnections.WithLabelValues("unsupported_protocol")
+
+	for _, requestLine := range []string{"GET / HTTP/2.0", "GET / HTTP/3.0", "GET / HTTP/0.9", "GET /"} {
+		before := counterValue(t, rejected)
+		conn, err := net.Dial("tcp", addr.String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp := exchange(t, conn, requestLine+"\r\nHost: a\r\n\r\n", 1)[0]
+		conn.Close()
+		if body := bodyOf(resp); resp.StatusCode != http.StatusHTTPVersionNotSupported || body != `{"error":"HTTP version not supported"}` {
+			t.Errorf("%s: %d %s, want 505", requestLine, resp.StatusCode, body)
+		}
+		if got := counterValue(t, rejected) - before; got != 1 {
+			t.Errorf("%s: rejections counted: %v, want 1", requestLine, got)
+		}
+	}
+
+	// Supported versions still work
+	conn, err := net.Dial("tcp", addr.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if resp := exchange(t, conn, "GET / HTTP/1.0\r\nHost: a\r\n\r\n", 1)[0]; resp.StatusCode != http.StatusOK {
+		t.Errorf("HTTP/1.0: %d", resp.StatusCode)
+	}
+}
+
+func TestUnsupportedHTTPVersionConfiguredAnswer(t *testing.T) {
+	cfg := &Config{UnsupportedProtocol: UnsupportedProtocolConfig{Status: http.StatusBadRequest, Body: "upgrade your client"}}
+	cfg.UnsupportedProtocol.setDefaults()
+	addr := startCheckServer(t, cfg, nil)
+
+	conn, err := net.Dial("tcp", addr.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	resp := exchange(t, conn, "GET / HTTP/2.0\r\nHost: a\r\n\r\n", 1)[0]
+	if body := bodyOf(resp); resp.StatusCode != http.StatusBadRequest || body != "upgrade your client" || resp.Header.Get("Content-Type") != "text/plain; charset=utf-8" {
+		t.Errorf("%d %q %q", resp.StatusCode, resp.Header.Get("Content-Type"), body)
+	}
+}
+
+// Differential check of parseFraming against net/http over header variants:
+// whenever net/http accepts a request, both must see the same body framing.
+// Requests net/http refuses get an error and a closed connection, so the
+// checker may read them either way.
+func TestParseFramingMatchesNetHTTP(t *testing.T) {
+	var headers []string
+	for _, name := range []string{"Content-Length", "content-length", "Content-Length ", " Content-Length", "Content-Length\t"} {
+		for _, value := range []string{"5", "+5", "-5", "005", " 5 ", "\t5", "5,5", "5, 5", "", "0x5", "5 5", "5\x00", "9223372036854775808", "18446744073709551616"} {
+			headers = append(headers, name+":"+value+"\r\n")
+		}
+	}
+	headers = append(headers,
+		"Content-Length: 5\r\nContent-Length: 5\r\n",
+		"Content-Length: 5\r\nContent-Length: 05\r\n",
+		"Content-Length: 5\r\nContent-Length: 0\r\n",
+		"Transfer-Encoding: chunked\r\n",
+		"Transfer-Encoding: Chunked\r\n",
+		"Transfer-Encoding: gzip, chunked\r\n",
+		"Transfer-Encoding: chunked\r\nTransfer-Encoding: chunked\r\n",
+		"Transfer-Encoding : chunked\r\n",
+		"Transfer-Encoding: chunked\r\nContent-Length: 5\r\n",
+		"Content-Length: 5\r\nTransfer-Encoding: chunked\r\n",
+		"X-Folded: a\r\n Content-Length: 5\r\n",
+		"X-Folded: a\r\n\tTransfer-Encoding: chunked\r\nContent-Length: 5\r\n",
+		"Content-Length: 5\r\n 0\r\n",
+		"Content-Length: 5\r\n Transfer-Encoding: chunked\r\n",
+	)
+
+	for _, version := range []string{"HTTP/1.1", "HTTP/1.0"} {
+		for _, header := range headers {
+			block := "POST / " + version + "\r\nHost: a\r\n" + header + "\r\n"
+			req, err := http.ReadRequest(bufio.NewReader(strings.NewReader(block + "0\r\n\r\nhello")))
+			f := parseFraming([]byte(block))
+			if err != nil {
+				continue
+			}
+			chunked := len(req.TransferEncoding) > 0
+			switch {
+			case f.invalidLength:
+				t.Errorf("%q: refused as an invalid length, net/http reads Content-Length %d", block, req.ContentLength)
+			case f.chunked != chunked:
+				t.Errorf("%q: chunked %v, net/http %v", block, f.chunked, chunked)
+			case !chunked && f.contentLength != req.ContentLength:
+				t.Errorf("%q: Content-Length %d, net/http %d", block, f.contentLength, req.ContentLength)
+			}
+		}
+	}
+}
+
+// Lengths net/http refuses are refused up front too; the ones it reads
+// alike are passed on
+func TestParseFramingContentLengthSyntax(t *testing.T) {
+	for _, tc := range []struct {
+		value   string
+		length  int64
+		invalid bool
+	}{
+		{"5", 5, false},
+		{"005", 5, false},
+		{" 5\t", 5, false},
+		{"0", 0, false},
+		{"+5", 0, true},
+		{"-5", 0, true},
+		{"", 0, true},
+		{"5 5", 0, true},
+		{"0x5", 0, true},
+		{"9223372036854775808", 0, true},
+	} {
+		f := parseFraming([]byte("POST / HTTP/1.1\r\nHost: a\r\nContent-Length:" + tc.value + "\r\n\r\n"))
+		if f.invalidLength != tc.invalid || f.contentLength != tc.length {
+			t.Errorf("Content-Length %q: length %d, invalid %v, want %d, %v", tc.value, f.contentLength, f.invalidLength, tc.length, tc.invalid)
+		}
+	}
+
+	// Over the wire: the body of a refused length is never read as a request
+	addr := startCheckServer(t, &Config{}, nil)
+	for _, value := range []string{"+5", " +5"} {
+		conn, err := net.Dial("tcp", addr.String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		responses := exchange(t, conn, "POST / HTTP/1.1\r\nHost: a\r\nContent-Length:"+value+"\r\n\r\nhello"+smuggled, 1)
+		conn.Close()
+		if responses[0].StatusCode != http.StatusBadRequest || !strings.Contains(bodyOf(responses[0]), "Invalid Content-Length") || !responses[0].Close {
+			t.Errorf("Content-Length %q: status %d, want the invalid Content-Length 400 closing the connection", value, responses[0].StatusCode)
+		}
+	}
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// Buffering and batching of log lines pushed to Loki
+type LogShipperConfig struct {
+	// Lines held in memory; further lines are dropped while the buffer is full
+	BufferSize    int           `yaml:"buffer_size"`
+	BatchSize     int           `yaml:"batch_size"`
+	FlushInterval time.Duration `yaml:"flush_interval"`
+	// How long shutdown waits for the remaining lines to be pushed
+	FlushTimeout time.Duration `yaml:"flush_timeout"`
+}
+
+func (cfg *LogShipperConfig) setDefaults() {
+	if cfg.BufferSize <= 0 {
+		cfg.BufferSize = 1000
+	}
+	if cfg.BatchSize <= 0 {
+		cfg.BatchSize = 100
+	}
+	if cfg.FlushInterval <= 0 {
+		cfg.FlushInterval = time.Second
+	}
+	if cfg.FlushTimeout <= 0 {
+		cfg.FlushTimeout = 5 * time.Second
+	}
+}
+
+type lokiEntry struct {
+	labels map[string]string
+	time   time.Time
+	line   string
+}
+
+// Ships log lines to Loki in batches from a background goroutine, so request
+// handling never waits on Loki
+type lokiShipper struct {
+	url     string
+	cfg     LogShipperConfig
+	client  *http.Client
+	entries chan lokiEntry
+	stop    chan context.Context
+	done    chan struct{}
+}
+
+func newLokiShipper(url string, cfg LogShipperConfig) *lokiShipper {
+	s := &lokiShipper{
+		url:     url,
+		cfg:     cfg,
+		client:  &http.Client{Timeout: 5 * time.Second},
+		entries: make(chan lokiEntry, cfg.BufferSize),
+		stop:    make(chan context.Context),
+		done:    make(chan struct{}),
+	}
+	go s.run()
+	return s
+}
+
+// Queue a line without blocking; it is dropped if the buffer is full
+func (s *lokiShipper) send(line string, labels map[string]string) bool {
+	select {
+	case s.entries <- lokiEntry{labels: labels, time: time.Now(), line: line}:
+		return true
+	default:
+		return false
+	}
+}
+
+func (s *lokiShipper) run() {
+	defer close(s.done)
+	ticker := time.NewTicker(s.cfg.FlushInterval)
+	defer ticker.Stop()
+
+	batch := make([]lokiEntry, 0, s.cfg.BatchSize)
+	for {
+		select {
+		case entry := <-s.entries:
+			batch = append(batch, entry)
+			if len(batch) >= s.cfg.BatchSize {
+				s.push(context.Background(), batch)
+				batch = batch[:0]
+			}
+		case <-ticker.C:
+			if len(batch) > 0 {
+				s.push(context.Background(), batch)
+				batch = batch[:0]
+			}
+		case ctx := <-s.stop:
+			// Drain what is buffered and push it within the shutdown deadline
+			for {
+				select {
+				case entry := <-s.entries:
+					batch = append(batch, entry)
+					if len(batch) >= s.cfg.BatchSize {
+						s.push(ctx, batch)
+						batch = batch[:0]
+					}
+					continue
+				default:
+				}
+				break
+			}
+			if len(batch) > 0 {
+				s.push(ctx, batch)
+			}
+			return
+		}
+	}
+}
+
+func (s *lokiShipper) push(ctx context.Context, batch []lokiEntry) {
+	if ctx.Err() != nil {
+		log.Warn().Int("lines", len(batch)).Msg("Dropping logs for Loki: flush deadline exceeded")
+		return
+	}
+
+	// Loki groups lines into streams by their label set
+	streams := make(map[string]map[string]interface{})
+	var order []string
+	for _, entry := range batch {
+		key := labelsKey(entry.labels)
+		stream, ok := streams[key]
+		if !ok {
+			stream = map[string]interface{}{"stream": entry.labels, "values": []interface{}{}}
+			streams[key] = stream
+			order = append(order, key)
+		}
+		stream["values"] = append(stream["values"].([]interface{}),
+			[]interface{}{fmt.Sprintf("%d", entry.time.UnixNano()), entry.line})
+	}
+	list := make([]map[string]interface{}, 0, len(order))
+	for _, key := range order {
+		list = append(list, streams[key])
+	}
+
+	jsonData, err := json.Marshal(map[string]interface{}{"streams": list})
+	if err != nil {
+		log.Error().Err(err).Msg("Error marshaling log data to JSON")
+		return
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.url, bytes.NewReader(jsonData))
+	if err != nil {
+		log.Error().Err(err).Msg("Error sending log to Loki")
+		return
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := s.client.Do(req)
+	if err != nil {
+		log.Error().Err(err).Int("lines", len(batch)).Msg("Error sending log to Loki")
+		return
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode/100 != 2 {
+		log.Error().Int("status_code", resp.StatusCode).Msg("Failed to push log to Loki")
+	}
+}
+
+func labelsKey(labels map[string]string) string {
+	keys := make([]string, 0, len(labels))
+	for k, v := range labels {
+		keys = append(keys, k+"="+v)
+	}
+	sort.Strings(keys)
+	return strings.Join(keys, ",")
+}
+
+// Flush buffered lines and stop. Gives up when ctx is done so a slow Loki
+// can't hold up shutdown.
+func (s *lokiShipper) Close(ctx context.Context) error {
+	select {
+	case s.stop <- ctx:
+	case <-s.done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	select {
+	case <-s.done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestLokiShipperFlushesOnClose(t *testing.T) {
+	var (
+		mu    sync.Mutex
+		lines []string
+	)
+	loki := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var push struct {
+			Streams []struct {
+				Values [][2]string `json:"values"`
+			} `json:"streams"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&push); err != nil {
+			t.Error(err)
+		}
+		mu.Lock()
+		for _, stream := range push.Streams {
+			for _, value := range stream.Values {
+				lines = append(lines, value[1])
+			}
+		}
+		mu.Unlock()
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer loki.Close()
+
+	// Neither the batch size nor the interval is reached before shutdown
+	cfg := LogShipperConfig{FlushInterval: time.Hour}
+	cfg.setDefaults()
+	s := newLokiShipper(loki.URL, cfg)
+	for _, line := range []string{"one", "two", "three"} {
+		s.send(line, map[string]string{"level": "info"})
+	}
+	s.send("four", map[string]string{"level": "warn"})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := s.Close(ctx); err != nil {
+		t.Fatal(err)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if len(lines) != 4 {
+		t.Errorf("Loki received %v, want the 4 buffered lines", lines)
+	}
+}
+
+func TestLokiShipperCloseDeadline(t *testing.T) {
+	release := make(chan struct{})
+	loki := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-release:
+		case <-r.Context().Done():
+		}
+	}))
+	defer loki.Close()
+	defer close(release)
+
+	cfg := LogShipperConfig{BatchSize: 1, FlushInterval: time.Hour}
+	cfg.setDefaults()
+	s := newLokiShipper(loki.URL, cfg)
+	// The first push hangs on the slow Loki; the rest waits in the buffer
+	for range 10 {
+		s.send("line", map[string]string{"level": "info"})
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	started := time.Now()
+	if err := s.Close(ctx); err == nil {
+		t.Error("Close reported success although lines were still unsent")
+	}
+	if elapsed := time.Since(started); elapsed > time.Second {
+		t.Errorf("Close took %v past a 100ms deadline", elapsed)
+	}
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"github.com/rs/zerolog/log"
+)
+
+// Header counting the gateways a request passed through. An upstream URL
+// pointing back at the gateway, by mistake or through SSRF, shows up as the
+// count growing on every pass.
+const hopsHeader = "X-Gateway-Hops"
+
+const defaultMaxHops = 10
+
+// Middleware rejecting requests that passed through the gateway more than
+// maxHops times with a 508, and counting this pass on the others. 0 turns
+// loop detection off.
+func LoopDetectionMiddleware(maxHops int) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if maxHops <= 0 {
+			c.Next()
+			return
+		}
+		hops := 0
+		if value := c.GetHeader(hopsHeader); value != "" {
+			n, err := strconv.Atoi(value)
+			if err != nil || n < 0 {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "Bad request", "msg": "invalid " + hopsHeader + " header"})
+				c.Abort()
+				return
+			}
+			hops = n
+		}
+		if hops >= maxHops {
+			log.Warn().Str("path", c.Request.URL.Path).Int("hops", hops).Int("max_hops", maxHops).Msg("Routing loop detected")
+			sendLogToLoki("Routing loop detected", map[string]string{"level": "warn", "path": c.Request.URL.Path})
+			c.JSON(http.StatusLoopDetected, gin.H{"error": "Loop detected", "msg": "request passed through the gateway too many times"})
+			c.Abort()
+			return
+		}
+		c.Request.Header.Set(hopsHeader, strconv.Itoa(hops+1))
+		c.Next()
+	}
+}
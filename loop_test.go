@@ -0,0 +1,43 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+// A route whose upstream is the gateway itself comes back around until the
+// hop count reaches max_hops, and is then refused with a 508
+func TestRoutingLoopRejected(t *testing.T) {
+	gw := httptest.NewUnstartedServer(nil)
+	_, r := newTestGateway(t, "max_hops: 3\nroutes:\n- prefix: /loop\n  target: http://"+gw.Listener.Addr().String()+"\n"+
+		"  rate_limit: {rate: 1000, burst: 1000}\n  add_prefix: /loop\n")
+	var passes atomic.Int32
+	gw.Config.Handler = http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		passes.Add(1)
+		r.ServeHTTP(w, req)
+	})
+	gw.Start()
+	defer gw.Close()
+
+	resp, err := http.Get(gw.URL + "/loop/x")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusLoopDetected {
+		t.Errorf("status %d, want 508", resp.StatusCode)
+	}
+	// Three passes forwarded, the fourth refused
+	if n := passes.Load(); n != 4 {
+		t.Errorf("%d passes through the gateway, want 4", n)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/loop/x", nil)
+	req.Header.Set(hopsHeader, "many")
+	if w := serve(r, req); w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), hopsHeader) {
+		t.Errorf("invalid hop count: %d %s, want 400", w.Code, w.Body)
+	}
+}
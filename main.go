@@ -1,68 +1,46 @@
 package main
 
 import (
-	"bytes"
-	"encoding/json"
-	"errors"
+	"context"
 	"fmt"
-	"io"
+	"math"
+	"net"
 	"net/http"
-	"net/url"
+	"runtime/debug"
+	"strconv"
 	"time"
 
 	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
 
 	"github.com/gin-gonic/gin"
-	"github.com/prometheus/client_golang/prometheus"
-	"github.com/prometheus/client_golang/prometheus/promhttp"
-	"github.com/sony/gobreaker/v2"
-	"golang.org/x/time/rate"
 )
 
-// Configuration and setup for CircuitBreaker, Rate Limiter, and services
-var CircuitBreakerConfig map[string]*gobreaker.CircuitBreaker[any]
+// Configuration and setup for services
 var LokiURL = "http://loki:3100/loki/api/v1/push" // Loki URL
 
+// Shipper started from the config; logs sent before that are dropped
+var logShipper *lokiShipper
+
 // Function to send log to Loki
 func sendLogToLoki(logEntry string, streamLabels map[string]string) {
-	// Prepare the log entry for Loki
-	logData := map[string]interface{}{
-		"streams": []map[string]interface{}{
-			{
-				"stream": streamLabels,
-				"values": []interface{}{
-					[]interface{}{fmt.Sprintf("%d", time.Now().UnixNano()), logEntry},
-				},
-			},
-		},
-	}
-
-	// Marshal the log entry to JSON
-	jsonData, err := json.Marshal(logData)
-	if err != nil {
-		log.Error().Err(err).Msg("Error marshaling log data to JSON")
+	if logShipper == nil {
 		return
 	}
-
-	// Send the log to Loki using HTTP POST
-	resp, err := http.Post(LokiURL, "application/json", bytes.NewBuffer(jsonData))
-	if err != nil {
-		log.Error().Err(err).Msg("Error sending log to Loki")
-		return
-	}
-	defer resp.Body.Close()
-
-	if resp.StatusCode != http.StatusOK {
-		log.Error().Int("status_code", resp.StatusCode).Msg("Failed to push log to Loki")
+	if !logShipper.send(logEntry, streamLabels) {
+		log.Warn().Msg("Loki log buffer full, dropping log")
 	}
 }
 
 // Middleware for rate-limiting
-func RateLimterMiddleware(limiter *rate.Limiter) gin.HandlerFunc {
+func RateLimterMiddleware() gin.HandlerFunc {
 	return func(c *gin.Context) {
-		log.Print("Limit used: ", limiter.Limit())
-		if !limiter.Allow() && c.Request.Method != "POST" {
+		route := routeFromContext(c)
+		log.Print("Limit used: ", route.limiter.Limit())
+		if ok, retryAfter := route.allowRequest(c); !ok && c.Request.Method != "POST" {
+			if retryAfter > 0 {
+				c.Header("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+			}
 			c.JSON(http.StatusTooManyRequests, gin.H{"error": "Too many requests"})
 			c.Abort()
 			return
@@ -71,108 +49,122 @@ func RateLimterMiddleware(limiter *rate.Limiter) gin.HandlerFunc {
 	}
 }
 
-// Proxy request handler with Circuit Breaker and error handling
-func proxyRequest(c *gin.Context, serviceURL string, cb *gobreaker.CircuitBreaker[any]) {
-	proxyUrl, err := url.Parse(serviceURL)
-	log.Print("Proxy URL: ", proxyUrl.String()+c.Param("rest"))
-
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Invalid target URL"})
-		sendLogToLoki("Invalid target URL", map[string]string{"level": "error", "path": c.Request.URL.Path})
-		return
+// Access log line in gin's default layout, plus the tenant when one was resolved
+func accessLogFormatter(param gin.LogFormatterParams) string {
+	line := fmt.Sprintf("[GIN] %v | %3d | %13v | %15s | %-7s %#v",
+		param.TimeStamp.Format("2006/01/02 - 15:04:05"), param.StatusCode, param.Latency, param.ClientIP, param.Method, param.Path)
+	if tenant, ok := param.Keys[tenantKey].(string); ok {
+		line += " tenant=" + tenant
 	}
+	if param.ErrorMessage != "" {
+		line += "\n" + param.ErrorMessage
+	}
+	return line + "\n"
+}
 
-	_, err = cb.Execute(func() (interface{}, error) {
-		req, err := http.NewRequest(c.Request.Method, proxyUrl.String()+c.Param("rest"), c.Request.Body)
-		if err != nil {
-			sendLogToLoki("Error creating request", map[string]string{"level": "error", "path": c.Request.URL.Path})
-			return nil, errors.New("Error creating request")
-		}
-
-		req.Header = c.Request.Header
-		client := &http.Client{Timeout: 10 * time.Second}
-		resp, err := client.Do(req)
-
-		if err != nil {
-			sendLogToLoki("Error sending request", map[string]string{"level": "error", "path": c.Request.URL.Path})
-			return nil, errors.New("Error sending request")
-		}
-
-		for k, v := range resp.Header {
-			c.Header(k, v[0])
-		}
-
-		defer resp.Body.Close()
-		c.Status(resp.StatusCode)
-
-		j, err := io.Copy(c.Writer, resp.Body)
-		log.Print("Copied: ", j)
-
-		if err != nil {
-			sendLogToLoki("Error copying response body", map[string]string{"level": "ERROR", "path": c.Request.URL.Path})
-			return nil, errors.New("Error copying response body")
-		}
-
-		// Log successful proxy
-		sendLogToLoki("Proxy request successful", map[string]string{"level": "INFO", "path": c.Request.URL.Path})
-
-		return nil, nil
-	})
-
-	if err != nil {
-		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Service unavailable", "msg": err.Error()})
-		sendLogToLoki("Service unavailable", map[string]string{"level": "error", "path": c.Request.URL.Path})
-		return
+// Middleware recovering from panics. http.ErrAbortHandler is re-raised so
+// net/http drops the client connection as intended.
+func RecoveryMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		defer func() {
+			if err := recover(); err != nil {
+				if err == http.ErrAbortHandler {
+					panic(err)
+				}
+				log.Error().Interface("panic", err).Str("stack", string(debug.Stack())).Msg("Recovered from panic")
+				if !c.Writer.Written() {
+					c.AbortWithStatus(http.StatusInternalServerError)
+				} else {
+					c.Abort()
+				}
+			}
+		}()
+		c.Next()
 	}
 }
 
 // Main function to setup Gin server
 func main() {
-	var r *gin.Engine = gin.Default()
+	var r *gin.Engine = gin.New()
+	r.Use(gin.LoggerWithFormatter(accessLogFormatter), RecoveryMiddleware(), RejectedRequestMiddleware())
 
 	zerolog.TimeFieldFormat = zerolog.TimeFormatUnix
 
-	httpRequests := prometheus.NewCounterVec(prometheus.CounterOpts{
-		Name: "http_requests_total",
-		Help: "Total number of HTTP requests made.",
-	}, []string{"path", "method"})
-
-	prometheus.MustRegister(httpRequests)
-
-	r.GET("/metrics", gin.WrapH(promhttp.Handler()))
-
-	var services = map[string]string{
-		"/account": "http://accounts:8080",
-		"/loans":   "http://loans:8080",
+	var (
+		cfg     *Config
+		gateway *Gateway
+		server  *http.Server
+		ln      net.Listener
+	)
+
+	phases := []startupPhase{
+		{"config", func(ctx context.Context) error {
+			var err error
+			cfg, err = loadConfig(configPath())
+			if err != nil {
+				return err
+			}
+			LokiURL = cfg.LokiURL
+			logShipper = newLokiShipper(cfg.LokiURL, cfg.LogShipper)
+
+			gateway, err = newGateway(configPath(), cfg)
+			if err != nil {
+				return err
+			}
+			// gin trusts every peer's X-Forwarded-For unless told otherwise
+			if err := r.SetTrustedProxies(cfg.TrustedProxies); err != nil {
+				return err
+			}
+			r.Use(StrictFramingMiddleware(cfg.StrictFraming), HeaderCountMiddleware(cfg.MaxRequestHeaders), ForwardProxyMiddleware(cfg.ForwardProxy))
+			r.NoRoute(proxyHandlers(cfg, gateway)...)
+			if err := registerAdminRoutes(r, cfg.Admin, gateway); err != nil {
+				return err
+			}
+
+			server, err = newServer(cfg, r)
+			return err
+		}},
+		{"metrics", func(ctx context.Context) error {
+			registerMetrics(cfg.Metrics)
+			metricsPusher = newPushLoop(cfg.Metrics.Push)
+			r.GET("/metrics", gin.WrapH(metricsHandler(cfg.Metrics)))
+			return nil
+		}},
+		{"health", func(ctx context.Context) error {
+			registerHealthRoutes(r, gateway)
+			return nil
+		}},
+		{"warmup", func(ctx context.Context) error {
+			warmupRoutes(gateway.routes())
+			return nil
+		}},
+		{"listen", func(ctx context.Context) error {
+			var err error
+			ln, err = listen(ctx, cfg, server)
+			return err
+		}},
 	}
-	CircuitBreakerConfig = make(map[string]*gobreaker.CircuitBreaker[interface{}])
-	var RateLimiterConfig = make(map[string]*rate.Limiter)
-
-	for prefix := range services {
-		cbSetting := gobreaker.Settings{
-			Name: prefix,
-			ReadyToTrip: func(counts gobreaker.Counts) bool {
-				return counts.ConsecutiveFailures > 5
-			},
-			OnStateChange: func(name string, from, to gobreaker.State) {
-				log.Printf("Circuit breaker for %s changed state from %s to %s", name, from.String(), to.String())
-			},
-			MaxRequests: 5,
-			Timeout:     5 * time.Second,
-		}
 
-		CircuitBreakerConfig[prefix] = gobreaker.NewCircuitBreaker[any](cbSetting)
-		RateLimiterConfig[prefix] = rate.NewLimiter(10, 20)
+	startupTimeout := func() time.Duration {
+		if cfg != nil && cfg.StartupTimeout > 0 {
+			return cfg.StartupTimeout
+		}
+		return defaultStartupTimeout
 	}
-
-	for prefix, targetUrl := range services {
-		cb := CircuitBreakerConfig[prefix]
-		limter := RateLimiterConfig[prefix]
-
-		r.Any(prefix+"/*rest", RateLimterMiddleware(limter), func(c *gin.Context) {
-			proxyRequest(c, targetUrl, cb)
-		})
+	if err := runStartup(phases, startupTimeout); err != nil {
+		log.Fatal().Err(err).Msg("Startup failed")
 	}
 
-	r.Run(":8080")
+	gateway.watchSignals()
+	ready.Store(true)
+	log.Info().Str("addr", ln.Addr().String()).Msg("Gateway listening")
+	stopped := make(chan struct{})
+	go func() {
+		shutdownOnSignal(cfg, server, gateway)
+		close(stopped)
+	}()
+	if err := server.Serve(ln); err != nil && err != http.ErrServerClosed {
+		log.Fatal().Err(err).Msg("Server stopped")
+	}
+	<-stopped
 }
@@ -0,0 +1,368 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/rs/zerolog/log"
+)
+
+// Metric settings
+type MetricsConfig struct {
+	// Bucket boundaries in bytes for the request/response size histograms
+	SizeBuckets []float64 `yaml:"size_buckets"`
+	// Bucket boundaries for the per-route concurrency histogram
+	ConcurrencyBuckets []float64 `yaml:"concurrency_buckets"`
+	// Label combinations kept per metric, 10000 by default; further ones are
+	// reported with every label "other"
+	MaxSeries int `yaml:"max_series"`
+	// Pushgateway to push to, in addition to serving /metrics
+	Push PushConfig `yaml:"push"`
+	// Time a /metrics scrape may take before it is answered with a 503;
+	// 10s by default, Prometheus' own scrape timeout
+	ScrapeTimeout time.Duration `yaml:"scrape_timeout"`
+}
+
+const defaultScrapeTimeout = 10 * time.Second
+
+var defaultSizeBuckets = prometheus.ExponentialBuckets(64, 4, 10) // 64B .. 16MiB
+
+var defaultConcurrencyBuckets = prometheus.ExponentialBuckets(1, 2, 11) // 1 .. 1024
+
+// Only plain vectors, updated as requests are served: a scrape reads their
+// atomically kept values and computes nothing, so it never waits on the
+// gateway's own locks
+var (
+	httpRequests     *cappedVec[prometheus.Counter]
+	httpRequestSize  *cappedVec[prometheus.Observer]
+	httpResponseSize *cappedVec[prometheus.Observer]
+	inflightRequests *cappedVec[prometheus.Gauge]
+	requestDuration  *cappedVec[prometheus.Observer]
+	// In-flight count seen by each request on entry, itself included
+	requestConcurrency *cappedVec[prometheus.Observer]
+
+	upstreamTruncatedResponses *cappedVec[prometheus.Counter]
+	upstreamProtocolErrors     *cappedVec[prometheus.Counter]
+	rejectedConnections        *cappedVec[prometheus.Counter]
+	mirrorRequests             *cappedVec[prometheus.Counter]
+	upstreamConnWait           *cappedVec[prometheus.Observer]
+	tlsHandshakeErrors         *cappedVec[prometheus.Counter]
+	breakerRequests            *cappedVec[prometheus.Counter]
+	upstreamFallbacks          *cappedVec[prometheus.Counter]
+	connectTunnels             *cappedVec[prometheus.Counter]
+	requestTimeouts            *cappedVec[prometheus.Counter]
+	clientWriteErrors          *cappedVec[prometheus.Counter]
+	upstreamPoolConns          *cappedVec[prometheus.Gauge]
+	upstreamPoolWaiting        *cappedVec[prometheus.Gauge]
+	contentTypeMismatches      *cappedVec[prometheus.Counter]
+	pathParamRequests          *cappedVec[prometheus.Counter]
+	retryAttempts              *cappedVec[prometheus.Observer]
+	retrySuccesses             *cappedVec[prometheus.Counter]
+	retryExhausted             *cappedVec[prometheus.Counter]
+	abVariantRequests          *cappedVec[prometheus.Counter]
+	abVariantDuration          *cappedVec[prometheus.Observer]
+	rateLimitAdmitted          *cappedVec[prometheus.Gauge]
+	rateLimitRejected          *cappedVec[prometheus.Gauge]
+	rateLimitPeakUsage         *cappedVec[prometheus.Gauge]
+	rateLimitRateUsage         *cappedVec[prometheus.Gauge]
+)
+
+// Guards registerMetrics; registering a collector twice panics
+var metricsOnce sync.Once
+
+// Create and register the gateway metrics. Only the first call does
+// anything: the collectors live as long as the process, so series carry on
+// across config reloads and later calls can't trip a duplicate registration.
+// Metric settings, like other global ones, change on restart.
+func registerMetrics(cfg MetricsConfig) {
+	metricsOnce.Do(func() { createMetrics(cfg) })
+}
+
+func createMetrics(cfg MetricsConfig) {
+	sizeBuckets := cfg.SizeBuckets
+	if len(sizeBuckets) == 0 {
+		sizeBuckets = defaultSizeBuckets
+	}
+	concurrencyBuckets := cfg.ConcurrencyBuckets
+	if len(concurrencyBuckets) == 0 {
+		concurrencyBuckets = defaultConcurrencyBuckets
+	}
+
+	httpRequests = newCounterVec(cfg.MaxSeries, prometheus.CounterOpts{
+		Name: "http_requests_total",
+		Help: "Total number of HTTP requests made.",
+	}, []string{"path", "method", "tenant"})
+
+	httpRequestSize = newHistogramVec(cfg.MaxSeries, prometheus.HistogramOpts{
+		Name:    "http_request_size_bytes",
+		Help:    "Size of proxied request bodies in bytes.",
+		Buckets: sizeBuckets,
+	}, []string{"route"})
+
+	httpResponseSize = newHistogramVec(cfg.MaxSeries, prometheus.HistogramOpts{
+		Name:    "http_response_size_bytes",
+		Help:    "Size of response bodies written to clients in bytes.",
+		Buckets: sizeBuckets,
+	}, []string{"route"})
+
+	// Autoscaling signal: requests currently being served per route
+	inflightRequests = newGaugeVec(cfg.MaxSeries, prometheus.GaugeOpts{
+		Name: "gateway_inflight_requests",
+		Help: "Requests currently in flight per route.",
+	}, []string{"route"})
+
+	// How often a route runs hot, for sizing bulkheads; the gauge only shows the moment
+	requestConcurrency = newHistogramVec(cfg.MaxSeries, prometheus.HistogramOpts{
+		Name:    "gateway_request_concurrency",
+		Help:    "Requests in flight on the route when a request arrived, that one included.",
+		Buckets: concurrencyBuckets,
+	}, []string{"route"})
+
+	requestDuration = newHistogramVec(cfg.MaxSeries, prometheus.HistogramOpts{
+		Name:    "http_request_duration_seconds",
+		Help:    "Latency of proxied requests in seconds.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"route", "method", "status", "tenant"})
+
+	upstreamTruncatedResponses = newCounterVec(cfg.MaxSeries, prometheus.CounterOpts{
+		Name: "upstream_truncated_responses_total",
+		Help: "Responses cut off by the upstream after the status was sent to the client.",
+	}, []string{"route"})
+
+	upstreamProtocolErrors = newCounterVec(cfg.MaxSeries, prometheus.CounterOpts{
+		Name: "upstream_protocol_errors_total",
+		Help: "Upstream responses that could not be parsed as HTTP.",
+	}, []string{"route"})
+
+	rejectedConnections = newCounterVec(cfg.MaxSeries, prometheus.CounterOpts{
+		Name: "gateway_rejected_connections_total",
+		Help: "Client connections closed at accept time, by reason.",
+	}, []string{"reason"})
+
+	mirrorRequests = newCounterVec(cfg.MaxSeries, prometheus.CounterOpts{
+		Name: "gateway_mirror_requests_total",
+		Help: "Requests selected for mirroring, by outcome (sent, error, dropped, skipped).",
+	}, []string{"route", "outcome"})
+
+	upstreamConnWait = newHistogramVec(cfg.MaxSeries, prometheus.HistogramOpts{
+		Name:    "gateway_upstream_conn_wait_seconds",
+		Help:    "Time upstream requests waited for a connection, dials included.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"route"})
+
+	tlsHandshakeErrors = newCounterVec(cfg.MaxSeries, prometheus.CounterOpts{
+		Name: "tls_handshake_errors_total",
+		Help: "Failed TLS handshakes on the listener, by error type.",
+	}, []string{"type"})
+
+	breakerRequests = newCounterVec(cfg.MaxSeries, prometheus.CounterOpts{
+		Name: "gateway_breaker_requests_total",
+		Help: "Requests through a route's circuit breaker, by outcome (allowed, rejected, success, failure, half_open_probe).",
+	}, []string{"route", "outcome"})
+
+	upstreamFallbacks = newCounterVec(cfg.MaxSeries, prometheus.CounterOpts{
+		Name: "gateway_upstream_fallbacks_total",
+		Help: "Requests served by a fallback upstream because the ones before it in the chain failed or were unhealthy.",
+	}, []string{"route", "upstream"})
+
+	connectTunnels = newCounterVec(cfg.MaxSeries, prometheus.CounterOpts{
+		Name: "gateway_connect_tunnels_total",
+		Help: "CONNECT requests in forward-proxy mode, by outcome (established, denied, dial_error, invalid).",
+	}, []string{"outcome"})
+
+	requestTimeouts = newCounterVec(cfg.MaxSeries, prometheus.CounterOpts{
+		Name: "gateway_request_timeouts_total",
+		Help: "Proxied requests ended by a timeout or a departed client, by cause (upstream, connect_deadline, client_body, client_disconnect).",
+	}, []string{"route", "cause"})
+
+	clientWriteErrors = newCounterVec(cfg.MaxSeries, prometheus.CounterOpts{
+		Name: "gateway_client_write_errors_total",
+		Help: "Responses cut short because writing to the client failed, e.g. the client went away mid-body.",
+	}, []string{"route"})
+
+	// Only kept for routes with conn_pool.host_metrics
+	upstreamPoolConns = newGaugeVec(cfg.MaxSeries, prometheus.GaugeOpts{
+		Name: "gateway_upstream_pool_connections",
+		Help: "Upstream connections per route and host, by state (in_use, idle).",
+	}, []string{"route", "host", "state"})
+
+	upstreamPoolWaiting = newGaugeVec(cfg.MaxSeries, prometheus.GaugeOpts{
+		Name: "gateway_upstream_pool_waiting",
+		Help: "Upstream requests waiting for a connection to the host, dials included.",
+	}, []string{"route", "host"})
+
+	contentTypeMismatches = newCounterVec(cfg.MaxSeries, prometheus.CounterOpts{
+		Name: "gateway_content_type_mismatches_total",
+		Help: "Upstream responses whose content type is outside the route's content_types.response.",
+	}, []string{"route"})
+
+	pathParamRequests = newCounterVec(cfg.MaxSeries, prometheus.CounterOpts{
+		Name: "gateway_path_param_requests_total",
+		Help: "Requests per value of the route's path_params labels.",
+	}, []string{"route", "param", "value", "method", "status"})
+
+	// Only requests the retry settings allow resending are counted
+	retryAttempts = newHistogramVec(cfg.MaxSeries, prometheus.HistogramOpts{
+		Name:    "proxy_retry_attempts",
+		Help:    "Attempts made per retryable upstream request, the first one included.",
+		Buckets: []float64{1, 2, 3, 4, 5, 7, 10},
+	}, []string{"route"})
+
+	retrySuccesses = newCounterVec(cfg.MaxSeries, prometheus.CounterOpts{
+		Name: "proxy_retry_success_total",
+		Help: "Upstream requests that succeeded only after being retried.",
+	}, []string{"route"})
+
+	retryExhausted = newCounterVec(cfg.MaxSeries, prometheus.CounterOpts{
+		Name: "proxy_retry_exhausted_total",
+		Help: "Upstream requests that still failed after their last allowed attempt.",
+	}, []string{"route"})
+
+	// Metrics of their own, so experiment arms don't multiply every route's series
+	abVariantRequests = newCounterVec(cfg.MaxSeries, prometheus.CounterOpts{
+		Name: "gateway_ab_variant_requests_total",
+		Help: "Requests of A/B test routes per variant and status.",
+	}, []string{"route", "variant", "status"})
+
+	abVariantDuration = newHistogramVec(cfg.MaxSeries, prometheus.HistogramOpts{
+		Name:    "gateway_ab_variant_request_duration_seconds",
+		Help:    "Latency of A/B test route requests per variant in seconds.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"route", "variant"})
+
+	// rate_limit_report windows, set each interval when exported as metrics
+	rateLimitAdmitted = newGaugeVec(cfg.MaxSeries, prometheus.GaugeOpts{
+		Name: "gateway_rate_limit_admitted",
+		Help: "Requests the rate limit admitted during the last report window.",
+	}, []string{"route", "limit"})
+
+	rateLimitRejected = newGaugeVec(cfg.MaxSeries, prometheus.GaugeOpts{
+		Name: "gateway_rate_limit_rejected",
+		Help: "Requests the rate limit rejected during the last report window.",
+	}, []string{"route", "limit"})
+
+	rateLimitPeakUsage = newGaugeVec(cfg.MaxSeries, prometheus.GaugeOpts{
+		Name: "gateway_rate_limit_peak_usage",
+		Help: "Highest share of the rate limit's budget in use during the last report window, 1 when it rejected requests.",
+	}, []string{"route", "limit"})
+
+	rateLimitRateUsage = newGaugeVec(cfg.MaxSeries, prometheus.GaugeOpts{
+		Name: "gateway_rate_limit_rate_usage",
+		Help: "Admitted rate over the configured rate during the last report window, for limits shared by the route's clients.",
+	}, []string{"route", "limit"})
+
+	prometheus.MustRegister(httpRequests, httpRequestSize, httpResponseSize, inflightRequests, requestConcurrency, requestDuration,
+		upstreamTruncatedResponses, upstreamProtocolErrors, rejectedConnections, mirrorRequests, upstreamConnWait,
+		tlsHandshakeErrors, breakerRequests, upstreamFallbacks, connectTunnels,
+		requestTimeouts, clientWriteErrors, upstreamPoolConns, upstreamPoolWaiting,
+		contentTypeMismatches, pathParamRequests, retryAttempts, retrySuccesses, retryExhausted,
+		abVariantRequests, abVariantDuration, rateLimitAdmitted, rateLimitRejected, rateLimitPeakUsage, rateLimitRateUsage)
+}
+
+// Handler serving /metrics. A scrape running past the timeout is answered
+// with a 503 rather than left hanging; OpenMetrics is needed for exemplars to
+// be exposed.
+func metricsHandler(cfg MetricsConfig) http.Handler {
+	timeout := cfg.ScrapeTimeout
+	if timeout <= 0 {
+		timeout = defaultScrapeTimeout
+	}
+	return promhttp.HandlerFor(prometheus.DefaultGatherer, promhttp.HandlerOpts{
+		EnableOpenMetrics: true,
+		Timeout:           timeout,
+		ErrorLog:          promErrorLog{},
+	})
+}
+
+// Logs errors of the metrics handler, e.g. collectors failing mid-scrape
+type promErrorLog struct{}
+
+func (promErrorLog) Println(v ...interface{}) {
+	log.Warn().Msg(fmt.Sprint(v...))
+}
+
+// Request body wrapper counting the bytes actually read, for bodies without Content-Length
+type countingReader struct {
+	io.ReadCloser
+	n int64
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	r.n += int64(n)
+	return n, err
+}
+
+// Observe a value, attaching the trace ID as exemplar when the request is traced
+func observeWithTrace(observer prometheus.Observer, value float64, traceID string) {
+	if eo, ok := observer.(prometheus.ExemplarObserver); ok && traceID != "" {
+		eo.ObserveWithExemplar(value, prometheus.Labels{"trace_id": traceID})
+		return
+	}
+	observer.Observe(value)
+}
+
+// Middleware recording per-route request metrics, labeled by tenant when configured
+func MetricsMiddleware(tenants *tenantResolver) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		r := routeFromContext(c)
+		route := r.Prefix
+
+		// Inc and Dec rather than setting the route's count: concurrent requests
+		// could otherwise set it out of order and leave it off
+		inflight := inflightRequests.WithLabelValues(route)
+		inflight.Inc()
+		requestConcurrency.WithLabelValues(route).Observe(float64(r.inflight.Add(1)))
+		defer func() {
+			r.inflight.Add(-1)
+			inflight.Dec()
+		}()
+
+		var body *countingReader
+		if c.Request.ContentLength < 0 && c.Request.Body != nil {
+			body = &countingReader{ReadCloser: c.Request.Body}
+			c.Request.Body = body
+		}
+
+		// Before the chain may rewrite it
+		path := c.Request.URL.Path
+		started := time.Now()
+		c.Next()
+
+		// Resolved afterwards so claims set further down the chain are seen
+		tenant := tenants.resolve(c)
+		if tenant != "" {
+			c.Set(tenantKey, tenant)
+		}
+
+		httpRequests.WithLabelValues(route, c.Request.Method, tenant).Inc()
+		status := strconv.Itoa(c.Writer.Status())
+		observeWithTrace(requestDuration.WithLabelValues(route, c.Request.Method, status, tenant), time.Since(started).Seconds(), traceIDFromContext(c))
+		// A metric of its own, so the breakdown doesn't multiply the series above
+		r.pathParams.observe(c, route, path, status)
+		if variant := c.GetString(abVariantKey); variant != "" {
+			abVariantRequests.WithLabelValues(route, variant, status).Inc()
+			observeWithTrace(abVariantDuration.WithLabelValues(route, variant), time.Since(started).Seconds(), traceIDFromContext(c))
+		}
+
+		requestSize := c.Request.ContentLength
+		if body != nil {
+			requestSize = body.n
+		}
+		httpRequestSize.WithLabelValues(route).Observe(float64(requestSize))
+
+		// gin's writer counts body bytes as written, chunked or not
+		responseSize := c.Writer.Size()
+		if responseSize < 0 {
+			responseSize = 0
+		}
+		httpResponseSize.WithLabelValues(route).Observe(float64(responseSize))
+	}
+}
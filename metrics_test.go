@@ -0,0 +1,265 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+func gaugeValue(t *testing.T, g prometheus.Gauge) float64 {
+	t.Helper()
+	var m dto.Metric
+	if err := g.Write(&m); err != nil {
+		t.Fatal(err)
+	}
+	return m.GetGauge().GetValue()
+}
+
+func counterValue(t *testing.T, c prometheus.Counter) float64 {
+	t.Helper()
+	var m dto.Metric
+	if err := c.Write(&m); err != nil {
+		t.Fatal(err)
+	}
+	return m.GetCounter().GetValue()
+}
+
+// Observation count and sum of a histogram
+func histogramValue(t *testing.T, o prometheus.Observer) (uint64, float64) {
+	t.Helper()
+	var m dto.Metric
+	if err := o.(prometheus.Metric).Write(&m); err != nil {
+		t.Fatal(err)
+	}
+	return m.GetHistogram().GetSampleCount(), m.GetHistogram().GetSampleSum()
+}
+
+func TestBodySizeHistograms(t *testing.T) {
+	up := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(io.Discard, r.Body)
+		w.Write(bytes.Repeat([]byte("r"), 1000))
+	}))
+	defer up.Close()
+	_, r := newTestGateway(t, "routes:\n- prefix: /sizes\n  target: "+up.URL+"\n  rate_limit: {rate: 1000, burst: 1000}\n")
+	requestSize := httpRequestSize.WithLabelValues("/sizes")
+	responseSize := httpResponseSize.WithLabelValues("/sizes")
+
+	for _, tc := range []struct {
+		name string
+		body io.Reader
+		size int
+	}{
+		{"with Content-Length", bytes.NewReader(bytes.Repeat([]byte("q"), 300)), 300},
+		// Neither a bytes nor a strings reader, so the request goes out chunked
+		{"chunked", io.MultiReader(strings.NewReader(strings.Repeat("q", 500))), 500},
+		{"empty", nil, 0},
+	} {
+		reqCount, reqSum := histogramValue(t, requestSize)
+		respCount, respSum := histogramValue(t, responseSize)
+
+		req := httptest.NewRequest(http.MethodPost, "/sizes/", tc.body)
+		if tc.name == "chunked" {
+			req.ContentLength = -1
+		}
+		if w := serve(r, req); w.Code != http.StatusOK || w.Body.Len() != 1000 {
+			t.Fatalf("%s: %d, %d bytes", tc.name, w.Code, w.Body.Len())
+		}
+
+		count, sum := histogramValue(t, requestSize)
+		if count-reqCount != 1 || sum-reqSum != float64(tc.size) {
+			t.Errorf("%s: request size observed %v over %d observations, want %d", tc.name, sum-reqSum, count-reqCount, tc.size)
+		}
+		count, sum = histogramValue(t, responseSize)
+		if count-respCount != 1 || sum-respSum != 1000 {
+			t.Errorf("%s: response size observed %v over %d observations, want 1000", tc.name, sum-respSum, count-respCount)
+		}
+	}
+}
+
+func TestInflightGaugeUnderConcurrentRequests(t *testing.T) {
+	const requests = 50
+	arrived := make(chan struct{}, requests)
+	release := make(chan struct{})
+	up := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		arrived <- struct{}{}
+		<-release
+	}))
+	defer up.Close()
+	_, r := newTestGateway(t, "routes:\n- prefix: /inflight\n  target: "+up.URL+"\n  rate_limit: {rate: 1000, burst: 1000}\n")
+	gauge := inflightRequests.WithLabelValues("/inflight")
+
+	var wg sync.WaitGroup
+	for range requests {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			serve(r, httptest.NewRequest(http.MethodGet, "/inflight/", nil))
+		}()
+	}
+	for range requests {
+		<-arrived
+	}
+	if got := gaugeValue(t, gauge); got != requests {
+		t.Errorf("in flight while blocked: %v, want %d", got, requests)
+	}
+	close(release)
+	wg.Wait()
+	if got := gaugeValue(t, gauge); got != 0 {
+		t.Errorf("in flight once done: %v, want 0", got)
+	}
+}
+
+func TestMetricsCountEarlyRejections(t *testing.T) {
+	_, r := newTestGateway(t, "routes:\n- prefix: /limited\n  target: http://127.0.0.1:1\n  rate_limit: {rate: 0.001, burst: 1}\n")
+	requests := httpRequests.WithLabelValues("/limited", http.MethodGet, "")
+
+	serve(r, httptest.NewRequest(http.MethodGet, "/limited/", nil))
+	before := counterValue(t, requests)
+	if w := serve(r, httptest.NewRequest(http.MethodGet, "/limited/", nil)); w.Code != http.StatusTooManyRequests {
+		t.Fatalf("request past the burst: %d, want 429", w.Code)
+	}
+	if got := counterValue(t, requests) - before; got != 1 {
+		t.Fatalf("requests counted: %v, want 1", got)
+	}
+}
+
+// Cumulative observation counts of a histogram, by bucket upper bound
+func histogramBuckets(t *testing.T, o prometheus.Observer) map[float64]uint64 {
+	t.Helper()
+	var m dto.Metric
+	if err := o.(prometheus.Metric).Write(&m); err != nil {
+		t.Fatal(err)
+	}
+	buckets := map[float64]uint64{}
+	for _, b := range m.GetHistogram().GetBucket() {
+		buckets[b.GetUpperBound()] = b.GetCumulativeCount()
+	}
+	return buckets
+}
+
+// A request alone on the route observes 1; one of four held at once observes
+// the others too, so a burst fills the higher buckets
+func TestConcurrencyHistogram(t *testing.T) {
+	arrived, release := make(chan struct{}, 4), make(chan struct{}, 4)
+	up := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		arrived <- struct{}{}
+		<-release
+	}))
+	defer up.Close()
+	_, r := newTestGateway(t, "routes:\n- prefix: /conc\n  target: "+up.URL+"\n  rate_limit: {rate: 1000, burst: 1000}\n")
+	histogram := requestConcurrency.WithLabelValues("/conc")
+	before := histogramBuckets(t, histogram)
+	burst := func(n int) {
+		var wg sync.WaitGroup
+		for range n {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				serve(r, httptest.NewRequest(http.MethodGet, "/conc/", nil))
+			}()
+		}
+		for range n {
+			<-arrived
+		}
+		for range n {
+			release <- struct{}{}
+		}
+		wg.Wait()
+	}
+
+	burst(1)
+	burst(4)
+	// Observed 1, then 1, 2, 3 and 4
+	after := histogramBuckets(t, histogram)
+	for bound, want := range map[float64]uint64{1: 2, 2: 3, 4: 5, 8: 5} {
+		if got := after[bound] - before[bound]; got != want {
+			t.Errorf("observations up to %v: %d, want %d", bound, got, want)
+		}
+	}
+}
+
+// Reloading, metrics registration included, doesn't panic on a duplicate
+// registration, and series keep counting from where they were
+func TestMetricsSurviveReloads(t *testing.T) {
+	up := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer up.Close()
+	config := "routes:\n- prefix: /reloaded\n  target: " + up.URL + "\n  rate_limit: {rate: 1000, burst: 1000}\n"
+	g, r := newTestGateway(t, config)
+	requests := httpRequests.WithLabelValues("/reloaded", http.MethodGet, "")
+	before := counterValue(t, requests)
+
+	for i := range 5 {
+		registerMetrics(MetricsConfig{MaxSeries: 10})
+		reloadWith(t, g, config+fmt.Sprintf("  timeout: %ds\n", i+1))
+		serve(r, httptest.NewRequest(http.MethodGet, "/reloaded/", nil))
+	}
+	if got := counterValue(t, httpRequests.WithLabelValues("/reloaded", http.MethodGet, "")) - before; got != 5 {
+		t.Errorf("requests counted across reloads: %v, want 5", got)
+	}
+
+	scrape := serve(metricsHandler(MetricsConfig{}), httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	if !strings.Contains(scrape.Body.String(), `route="/reloaded"`) {
+		t.Errorf("scrape after reloads lacks the route's series:\n%s", scrape.Body)
+	}
+}
+
+// Collector stuck until released, standing in for a slow metrics source
+type blockingCollector struct{ release chan struct{} }
+
+func (c blockingCollector) Describe(ch chan<- *prometheus.Desc) {}
+
+func (c blockingCollector) Collect(ch chan<- prometheus.Metric) { <-c.release }
+
+// Scrapes finish quickly while requests are being served, and a scrape
+// stuck past scrape_timeout is answered with a 503 instead of hanging
+func TestMetricsScrapeBounded(t *testing.T) {
+	up := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer up.Close()
+	_, r := newTestGateway(t, "routes:\n- prefix: /scraped\n  target: "+up.URL+"\n  rate_limit: {rate: 100000, burst: 100000}\n")
+	handler := metricsHandler(MetricsConfig{ScrapeTimeout: time.Second})
+
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	for range 8 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+					serve(r, httptest.NewRequest(http.MethodGet, "/scraped/", nil))
+				}
+			}
+		}()
+	}
+	for range 20 {
+		start := time.Now()
+		w := serve(handler, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+		if took := time.Since(start); w.Code != http.StatusOK || took > 500*time.Millisecond {
+			t.Errorf("scrape under load: status %d after %s", w.Code, took)
+		}
+	}
+	close(stop)
+	wg.Wait()
+
+	stuck := blockingCollector{release: make(chan struct{})}
+	prometheus.MustRegister(stuck)
+	defer prometheus.Unregister(stuck)
+	defer close(stuck.release)
+	start := time.Now()
+	w := serve(metricsHandler(MetricsConfig{ScrapeTimeout: 100 * time.Millisecond}), httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	if took := time.Since(start); w.Code != http.StatusServiceUnavailable || took > time.Second {
+		t.Errorf("stuck scrape: status %d after %s, want a 503 at the 100ms timeout", w.Code, took)
+	}
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"math/rand/v2"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/rs/zerolog/log"
+)
+
+// Shadow copies of proxied requests sent to a second upstream. Responses from
+// the mirror are discarded and never affect the client.
+type MirrorConfig struct {
+	Target string `yaml:"target"`
+	// Fraction of matching requests that are mirrored, 0..1
+	SampleRate float64 `yaml:"sample_rate"`
+	// Only requests matching every condition are considered
+	Match   MirrorMatchConfig `yaml:"match"`
+	Timeout time.Duration     `yaml:"timeout"`
+	// Requests with larger bodies are not mirrored
+	MaxBody int64 `yaml:"max_body"`
+	// Mirror requests in flight at once; further ones are dropped
+	MaxInflight int `yaml:"max_inflight"`
+}
+
+type MirrorMatchConfig struct {
+	// Methods to mirror; all when empty
+	Methods []string `yaml:"methods"`
+	// Header name -> required value; an empty value only requires the header to be present
+	Headers map[string]string `yaml:"headers"`
+}
+
+type mirror struct {
+	cfg    MirrorConfig
+	client *http.Client
+	slots  chan struct{}
+	// Replaced in tests to make sampling deterministic
+	sample func() float64
+}
+
+func newMirror(cfg MirrorConfig) *mirror {
+	if cfg.Timeout <= 0 {
+		cfg.Timeout = 5 * time.Second
+	}
+	if cfg.MaxBody <= 0 {
+		cfg.MaxBody = 1 << 20
+	}
+	if cfg.MaxInflight <= 0 {
+		cfg.MaxInflight = 100
+	}
+	return &mirror{
+		cfg:    cfg,
+		client: &http.Client{Timeout: cfg.Timeout},
+		slots:  make(chan struct{}, cfg.MaxInflight),
+		sample: rand.Float64,
+	}
+}
+
+// Whether the request satisfies the match conditions
+func (m *mirror) matches(r *http.Request) bool {
+	if len(m.cfg.Match.Methods) > 0 {
+		found := false
+		for _, method := range m.cfg.Match.Methods {
+			if strings.EqualFold(method, r.Method) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	for name, want := range m.cfg.Match.Headers {
+		values, ok := r.Header[http.CanonicalHeaderKey(name)]
+		if !ok || (want != "" && values[0] != want) {
+			return false
+		}
+	}
+	return true
+}
+
+// Decide whether to mirror the request: conditions first, then the sample rate
+func (m *mirror) selected(r *http.Request) bool {
+	return m.matches(r) && m.sample() < m.cfg.SampleRate
+}
+
+func (m *mirror) send(route *Route, method, path string, header http.Header, body []byte) {
+	defer func() { <-m.slots }()
+
+	ctx, cancel := context.WithTimeout(context.Background(), m.cfg.Timeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, method, m.cfg.Target+path, bytes.NewReader(body))
+	if err != nil {
+		mirrorRequests.WithLabelValues(route.Prefix, "error").Inc()
+		return
+	}
+	req.Header = header
+	resp, err := m.client.Do(req)
+	if err != nil {
+		log.Debug().Err(err).Str("route", route.Prefix).Msg("Mirror request failed")
+		mirrorRequests.WithLabelValues(route.Prefix, "error").Inc()
+		return
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	mirrorRequests.WithLabelValues(route.Prefix, "sent").Inc()
+}
+
+// Middleware copying selected requests to the route's mirror. It runs last so
+// the mirror sees the request exactly as it is forwarded upstream.
+func MirrorMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		route := routeFromContext(c)
+		m := route.mirror
+		if m == nil || !m.selected(c.Request) {
+			c.Next()
+			return
+		}
+
+		var body []byte
+		if c.Request.Body != nil && c.Request.Body != http.NoBody {
+			buf, err := io.ReadAll(io.LimitReader(c.Request.Body, m.cfg.MaxBody+1))
+			// Put back what was read so the upstream request gets the whole body
+			c.Request.Body = struct {
+				io.Reader
+				io.Closer
+			}{io.MultiReader(bytes.NewReader(buf), c.Request.Body), c.Request.Body}
+			if err != nil || int64(len(buf)) > m.cfg.MaxBody {
+				mirrorRequests.WithLabelValues(route.Prefix, "skipped").Inc()
+				c.Next()
+				return
+			}
+			body = buf
+		}
+
+		select {
+		case m.slots <- struct{}{}:
+			go m.send(route, route.MethodMap.upstream(c.Request.Method), upstreamPath(c, route), c.Request.Header.Clone(), body)
+		default:
+			mirrorRequests.WithLabelValues(route.Prefix, "dropped").Inc()
+		}
+		c.Next()
+	}
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestMirrorSampling(t *testing.T) {
+	var mirrored atomic.Int64
+	shadow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if body, _ := io.ReadAll(r.Body); r.Method != http.MethodPost || r.URL.Path != "/orders" || string(body) != "payload" {
+			t.Errorf("mirror got %s %s %q", r.Method, r.URL.Path, body)
+		}
+		mirrored.Add(1)
+	}))
+	defer shadow.Close()
+	up := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(io.Discard, r.Body)
+	}))
+	defer up.Close()
+	g, r := newTestGateway(t, "routes:\n- prefix: /m\n  target: "+up.URL+"\n  rate_limit: {rate: 1000, burst: 1000}\n"+
+		"  mirror: {target: "+shadow.URL+", sample_rate: 0.5, match: {methods: [POST], headers: {X-Mirror: \"\"}}}\n")
+	// Every other draw falls under the sample rate
+	var draws atomic.Int64
+	g.routes()[0].mirror.sample = func() float64 {
+		if draws.Add(1)%2 == 0 {
+			return 0.75
+		}
+		return 0.25
+	}
+	sent := mirrorRequests.WithLabelValues("/m", "sent")
+	before := counterValue(t, sent)
+
+	send := func(method string, header bool) {
+		req := httptest.NewRequest(method, "/m/orders", strings.NewReader("payload"))
+		if header {
+			req.Header.Set("X-Mirror", "1")
+		}
+		if w := serve(r, req); w.Code != http.StatusOK {
+			t.Fatalf("%s: status %d", method, w.Code)
+		}
+	}
+	for range 10 {
+		send(http.MethodPost, true)
+		// Not matching the predicate, and not drawn for
+		send(http.MethodPost, false)
+		send(http.MethodGet, true)
+	}
+
+	for deadline := time.Now().Add(5 * time.Second); counterValue(t, sent)-before < 5 && time.Now().Before(deadline); {
+		time.Sleep(5 * time.Millisecond)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if got := mirrored.Load(); got != 5 {
+		t.Errorf("mirror received %d requests, want 5 of the 10 matching ones", got)
+	}
+	if got := draws.Load(); got != 10 {
+		t.Errorf("sampled %d requests, want only the 10 matching ones", got)
+	}
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Rewrites the forwarded path for backends that expect a canonical form
+type PathNormalizationConfig struct {
+	Lowercase bool `yaml:"lowercase"`
+	// Lowercase only these zero-based segments of the forwarded path
+	LowercaseSegments []int `yaml:"lowercase_segments"`
+	// "add" or "strip"; empty leaves trailing slashes alone
+	TrailingSlash string `yaml:"trailing_slash"`
+}
+
+func (p PathNormalizationConfig) enabled() bool {
+	return p.Lowercase || len(p.LowercaseSegments) > 0 || p.TrailingSlash != ""
+}
+
+func (p PathNormalizationConfig) validate() error {
+	switch p.TrailingSlash {
+	case "", "add", "strip":
+		return nil
+	}
+	return fmt.Errorf("unknown trailing_slash mode %q", p.TrailingSlash)
+}
+
+// Replace a path parameter so later handlers see the rewritten value
+func setParam(c *gin.Context, key, value string) {
+	for i := range c.Params {
+		if c.Params[i].Key == key {
+			c.Params[i].Value = value
+			return
+		}
+	}
+	c.Params = append(c.Params, gin.Param{Key: key, Value: value})
+}
+
+func normalizePath(path string, cfg PathNormalizationConfig) string {
+	switch {
+	case cfg.Lowercase:
+		path = strings.ToLower(path)
+	case len(cfg.LowercaseSegments) > 0:
+		segments := strings.Split(strings.TrimPrefix(path, "/"), "/")
+		for i := range segments {
+			if slices.Contains(cfg.LowercaseSegments, i) {
+				segments[i] = strings.ToLower(segments[i])
+			}
+		}
+		path = "/" + strings.Join(segments, "/")
+	}
+
+	switch cfg.TrailingSlash {
+	case "add":
+		if !strings.HasSuffix(path, "/") {
+			path += "/"
+		}
+	case "strip":
+		if len(path) > 1 {
+			path = strings.TrimRight(path, "/")
+		}
+	}
+	return path
+}
+
+// Middleware normalizing the path forwarded to the upstream
+func PathNormalizationMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		cfg := routeFromContext(c).PathNormalization
+		if cfg.enabled() {
+			setParam(c, "rest", normalizePath(c.Param("rest"), cfg))
+		}
+		c.Next()
+	}
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestNormalizePath(t *testing.T) {
+	for _, tc := range []struct {
+		cfg        PathNormalizationConfig
+		path, want string
+	}{
+		{PathNormalizationConfig{Lowercase: true}, "/Users/ABC/", "/users/abc/"},
+		{PathNormalizationConfig{LowercaseSegments: []int{0, 2}}, "/Users/ABC/Orders", "/users/ABC/orders"},
+		{PathNormalizationConfig{TrailingSlash: "add"}, "/users/ABC", "/users/ABC/"},
+		{PathNormalizationConfig{TrailingSlash: "add"}, "/users/", "/users/"},
+		{PathNormalizationConfig{TrailingSlash: "strip"}, "/users//", "/users"},
+		{PathNormalizationConfig{TrailingSlash: "strip"}, "/", "/"},
+		{PathNormalizationConfig{Lowercase: true, TrailingSlash: "strip"}, "/Users/", "/users"},
+		{PathNormalizationConfig{}, "/Users/", "/Users/"},
+	} {
+		if got := normalizePath(tc.path, tc.cfg); got != tc.want {
+			t.Errorf("%+v: %q -> %q, want %q", tc.cfg, tc.path, got, tc.want)
+		}
+	}
+}
+
+// The upstream sees the normalized path
+func TestPathNormalizationReachesUpstream(t *testing.T) {
+	paths := make(chan string, 1)
+	up := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		paths <- r.URL.Path
+	}))
+	defer up.Close()
+	_, r := newTestGateway(t, "routes:\n- prefix: /p\n  target: "+up.URL+"\n  rate_limit: {rate: 1000, burst: 1000}\n"+
+		"  path_normalization: {lowercase: true, trailing_slash: add}\n")
+
+	if w := serve(r, httptest.NewRequest(http.MethodGet, "/p/Users/ABC", nil)); w.Code != http.StatusOK {
+		t.Fatalf("status %d", w.Code)
+	}
+	if got := <-paths; got != "/users/abc/" {
+		t.Errorf("upstream saw %q, want /users/abc/", got)
+	}
+}
+
+func TestPathNormalizationUnknownMode(t *testing.T) {
+	if err := (PathNormalizationConfig{TrailingSlash: "keep"}).validate(); err == nil {
+		t.Error("unknown trailing_slash mode accepted")
+	}
+}
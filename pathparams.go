@@ -0,0 +1,127 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Named segments of the request path reported as labels of
+// gateway_path_param_requests_total, to break a route's traffic down by e.g.
+// resource type. Only allowlisted values are reported by name, so the
+// cardinality stays bounded however many paths clients send.
+type PathParamsConfig struct {
+	// Request path with {name} segments, ending in "/..." to match deeper
+	// paths too, e.g. /account/{resource}/...
+	Pattern string `yaml:"pattern"`
+	// Param -> values reported by name; any other value is reported as
+	// "other", and a path not matching the pattern as "none"
+	Labels map[string][]string `yaml:"labels"`
+}
+
+func (cfg PathParamsConfig) validate() error {
+	if cfg.Pattern == "" {
+		if len(cfg.Labels) > 0 {
+			return fmt.Errorf("path_params: labels need a pattern")
+		}
+		return nil
+	}
+	if !strings.HasPrefix(cfg.Pattern, "/") {
+		return fmt.Errorf("path_params: pattern must start with /")
+	}
+	pattern := newPathPattern(cfg)
+	var names []string
+	for i, segment := range pattern.segments {
+		switch {
+		case segment == "...":
+			if i != len(pattern.segments)-1 {
+				return fmt.Errorf("path_params: ... must end the pattern")
+			}
+		case strings.HasPrefix(segment, "{") && strings.HasSuffix(segment, "}"):
+			name := segment[1 : len(segment)-1]
+			if name == "" || slices.Contains(names, name) {
+				return fmt.Errorf("path_params: empty or repeated param in %q", cfg.Pattern)
+			}
+			names = append(names, name)
+		case strings.ContainsAny(segment, "{}"):
+			return fmt.Errorf("path_params: a param must be a whole segment in %q", cfg.Pattern)
+		}
+	}
+	if len(cfg.Labels) == 0 {
+		return fmt.Errorf("path_params: no labels configured")
+	}
+	for name, values := range cfg.Labels {
+		if !slices.Contains(names, name) {
+			return fmt.Errorf("path_params: label %q isn't a param of the pattern", name)
+		}
+		if len(values) == 0 {
+			return fmt.Errorf("path_params: label %q needs its allowed values to bound metric cardinality", name)
+		}
+	}
+	return nil
+}
+
+type pathPattern struct {
+	segments []string
+	known    map[string]map[string]bool
+}
+
+func newPathPattern(cfg PathParamsConfig) *pathPattern {
+	p := &pathPattern{
+		segments: strings.Split(strings.TrimPrefix(cfg.Pattern, "/"), "/"),
+		known:    make(map[string]map[string]bool, len(cfg.Labels)),
+	}
+	for name, values := range cfg.Labels {
+		p.known[name] = make(map[string]bool, len(values))
+		for _, value := range values {
+			p.known[name][value] = true
+		}
+	}
+	return p
+}
+
+// Params of path, nil when it doesn't match
+func (p *pathPattern) match(path string) map[string]string {
+	segments := strings.Split(strings.TrimPrefix(path, "/"), "/")
+	params := make(map[string]string, len(p.known))
+	for i, segment := range p.segments {
+		if segment == "..." {
+			return params
+		}
+		if i >= len(segments) {
+			return nil
+		}
+		if name, ok := strings.CutPrefix(segment, "{"); ok {
+			if segments[i] == "" {
+				return nil
+			}
+			params[strings.TrimSuffix(name, "}")] = segments[i]
+		} else if segment != segments[i] {
+			return nil
+		}
+	}
+	if len(segments) != len(p.segments) {
+		return nil
+	}
+	return params
+}
+
+// Count the request once per labeled param
+func (p *pathPattern) observe(c *gin.Context, route, path, status string) {
+	if p == nil {
+		return
+	}
+	params := p.match(path)
+	for name, known := range p.known {
+		value := "none"
+		if params != nil {
+			value = "other"
+			if known[params[name]] {
+				value = params[name]
+			}
+		}
+		pathParamRequests.WithLabelValues(route, name, value, c.Request.Method, status).Inc()
+	}
+}
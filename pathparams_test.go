@@ -0,0 +1,37 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// Requests are counted by the resource type in their path: allowlisted types
+// by name, others as "other" and paths outside the pattern as "none"
+func TestPathParamLabels(t *testing.T) {
+	up := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer up.Close()
+	_, r := newTestGateway(t, "routes:\n- prefix: /account\n  target: "+up.URL+"\n  rate_limit: {rate: 1000, burst: 1000}\n"+
+		"  path_params: {pattern: '/account/{resource}/...', labels: {resource: [orders, users]}}\n")
+	counted := func(value string) float64 {
+		return counterValue(t, pathParamRequests.WithLabelValues("/account", "resource", value, http.MethodGet, "200"))
+	}
+	before := map[string]float64{}
+	for _, value := range []string{"orders", "users", "other", "none"} {
+		before[value] = counted(value)
+	}
+
+	for _, path := range []string{"/account/orders/1", "/account/orders/2/items", "/account/users", "/account/invoices/9", "/account"} {
+		serve(r, httptest.NewRequest(http.MethodGet, path, nil))
+	}
+	for value, want := range map[string]float64{"orders": 2, "users": 1, "other": 1, "none": 1} {
+		if got := counted(value) - before[value]; got != want {
+			t.Errorf("resource=%s: %v requests, want %v", value, got, want)
+		}
+	}
+
+	if _, err := parseConfig([]byte("routes:\n- prefix: /account\n  target: " + up.URL + "\n" +
+		"  path_params: {pattern: '/account/{resource}', labels: {resource: []}}\n")); err == nil {
+		t.Error("label without allowed values accepted")
+	}
+}
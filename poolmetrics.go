@@ -0,0 +1,194 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"sync"
+)
+
+// Transport wrapper keeping the conn_pool.host_metrics gauges of a route: its
+// upstream connections per host, in use or idle, and the requests waiting for
+// one. Connections are followed from dial to close and are in use while a
+// request holds them, from getting one until its response body is done; an
+// HTTP/2 connection is in use while any of its streams is.
+type poolTracker struct {
+	*http.Transport
+	route string
+	// Guards the pooledConn counts, so a connection's state and the gauges
+	// change together
+	mu sync.Mutex
+}
+
+func trackPool(route string, transport *http.Transport) *poolTracker {
+	t := &poolTracker{Transport: transport, route: route}
+	dial := transport.DialContext
+	if dial == nil {
+		dial = (&net.Dialer{}).DialContext
+	}
+	transport.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		conn, err := dial(ctx, network, addr)
+		if err != nil {
+			return nil, err
+		}
+		upstreamPoolConns.WithLabelValues(t.route, addr, "idle").Inc()
+		return &pooledConn{Conn: conn, tracker: t, host: addr}, nil
+	}
+	return t
+}
+
+type pooledConn struct {
+	net.Conn
+	tracker *poolTracker
+	host    string
+	// Requests holding the connection
+	active int
+	closed bool
+}
+
+func (c *pooledConn) Close() error {
+	c.tracker.mu.Lock()
+	if !c.closed {
+		c.closed = true
+		upstreamPoolConns.WithLabelValues(c.tracker.route, c.host, c.state()).Dec()
+	}
+	c.tracker.mu.Unlock()
+	return c.Conn.Close()
+}
+
+func (c *pooledConn) state() string {
+	if c.active > 0 {
+		return "in_use"
+	}
+	return "idle"
+}
+
+func (c *pooledConn) acquire() {
+	c.tracker.mu.Lock()
+	defer c.tracker.mu.Unlock()
+	c.active++
+	if c.active == 1 && !c.closed {
+		upstreamPoolConns.WithLabelValues(c.tracker.route, c.host, "idle").Dec()
+		upstreamPoolConns.WithLabelValues(c.tracker.route, c.host, "in_use").Inc()
+	}
+}
+
+func (c *pooledConn) release() {
+	c.tracker.mu.Lock()
+	defer c.tracker.mu.Unlock()
+	c.active--
+	if c.active == 0 && !c.closed {
+		upstreamPoolConns.WithLabelValues(c.tracker.route, c.host, "in_use").Dec()
+		upstreamPoolConns.WithLabelValues(c.tracker.route, c.host, "idle").Inc()
+	}
+}
+
+// The pooledConn under conn, which is a TLS connection for https upstreams
+func pooledConnOf(conn net.Conn) *pooledConn {
+	for conn != nil {
+		if pc, ok := conn.(*pooledConn); ok {
+			return pc
+		}
+		inner, ok := conn.(interface{ NetConn() net.Conn })
+		if !ok {
+			return nil
+		}
+		conn = inner.NetConn()
+	}
+	return nil
+}
+
+// Pool use of one request
+type heldConn struct {
+	tracker *poolTracker
+	mu      sync.Mutex
+	waiting string
+	conn    *pooledConn
+}
+
+func (h *heldConn) wait(hostPort string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.stopWaitingLocked()
+	h.waiting = hostPort
+	upstreamPoolWaiting.WithLabelValues(h.tracker.route, hostPort).Inc()
+}
+
+func (h *heldConn) got(conn net.Conn) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.stopWaitingLocked()
+	// The transport retrying on another connection gave up the previous one
+	h.releaseLocked()
+	if h.conn = pooledConnOf(conn); h.conn != nil {
+		h.conn.acquire()
+	}
+}
+
+func (h *heldConn) stopWaiting() {
+	h.mu.Lock()
+	h.stopWaitingLocked()
+	h.mu.Unlock()
+}
+
+func (h *heldConn) stopWaitingLocked() {
+	if h.waiting != "" {
+		upstreamPoolWaiting.WithLabelValues(h.tracker.route, h.waiting).Dec()
+		h.waiting = ""
+	}
+}
+
+func (h *heldConn) release() {
+	h.mu.Lock()
+	h.releaseLocked()
+	h.mu.Unlock()
+}
+
+func (h *heldConn) releaseLocked() {
+	if h.conn != nil {
+		h.conn.release()
+		h.conn = nil
+	}
+}
+
+func (t *poolTracker) RoundTrip(req *http.Request) (*http.Response, error) {
+	h := &heldConn{tracker: t}
+	trace := &httptrace.ClientTrace{
+		GetConn: h.wait,
+		GotConn: func(info httptrace.GotConnInfo) { h.got(info.Conn) },
+	}
+	resp, err := t.Transport.RoundTrip(req.WithContext(httptrace.WithClientTrace(req.Context(), trace)))
+	// Failed dials never report a connection
+	h.stopWaiting()
+	if err != nil {
+		h.release()
+		return nil, err
+	}
+	// A switched protocol keeps the connection until it is closed
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		resp.Body = &releasingBody{ReadCloser: resp.Body, held: h}
+	}
+	return resp, nil
+}
+
+// Response body handing its connection back once read to the end or closed
+type releasingBody struct {
+	io.ReadCloser
+	held *heldConn
+}
+
+func (b *releasingBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if err == io.EOF {
+		b.held.release()
+	}
+	return n, err
+}
+
+func (b *releasingBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.held.release()
+	return err
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Each pool member's connections are counted under its own host, in use
+// while requests hold them and idle once they're done
+func TestPoolHostGauges(t *testing.T) {
+	arrived := make(chan struct{}, 10)
+	release := make(chan struct{})
+	blocking := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		arrived <- struct{}{}
+		<-release
+	})
+	a, b := httptest.NewServer(blocking), httptest.NewServer(blocking)
+	defer a.Close()
+	defer b.Close()
+	g, r := newTestGateway(t, "routes:\n- prefix: /pm\n  pool: ['"+a.URL+"', '"+b.URL+"']\n  rate_limit: {rate: 1000, burst: 1000}\n"+
+		"  conn_pool: {host_metrics: true}\n")
+	hostA, hostB := a.Listener.Addr().String(), b.Listener.Addr().String()
+	conns := func(host, state string) float64 {
+		return gaugeValue(t, upstreamPoolConns.WithLabelValues("/pm", host, state))
+	}
+	// Polls, connections are handed back after the responses are served
+	expect := func(when string, want map[[2]string]float64) {
+		t.Helper()
+		deadline := time.Now().Add(5 * time.Second)
+		for key, n := range want {
+			for conns(key[0], key[1]) != n && time.Now().Before(deadline) {
+				time.Sleep(time.Millisecond)
+			}
+			if got := conns(key[0], key[1]); got != n {
+				t.Errorf("%s: %s %s connections = %v, want %v", when, key[0], key[1], got, n)
+			}
+		}
+	}
+
+	// Round robin: a, b, a
+	var wg sync.WaitGroup
+	for range 3 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			serve(r, httptest.NewRequest(http.MethodGet, "/pm/", nil))
+		}()
+		<-arrived
+	}
+	expect("all blocked", map[[2]string]float64{{hostA, "in_use"}: 2, {hostB, "in_use"}: 1, {hostA, "idle"}: 0, {hostB, "idle"}: 0})
+	if got := gaugeValue(t, upstreamPoolWaiting.WithLabelValues("/pm", hostA)); got != 0 {
+		t.Errorf("waiting for %s: %v, want 0 once connected", hostA, got)
+	}
+
+	close(release)
+	wg.Wait()
+	expect("done", map[[2]string]float64{{hostA, "in_use"}: 0, {hostB, "in_use"}: 0, {hostA, "idle"}: 2, {hostB, "idle"}: 1})
+
+	g.routes()[0].closeIdleConnections()
+	expect("idle closed", map[[2]string]float64{{hostA, "idle"}: 0, {hostB, "idle"}: 0})
+}
@@ -0,0 +1,344 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"net/textproto"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/rs/zerolog/log"
+)
+
+// Proxy request handler with Circuit Breaker and error handling
+func proxyRequest(c *gin.Context, route *Route) {
+	started := time.Now()
+	if route.balancer != nil && c.GetString(upstreamKey) == "" {
+		member := route.balancer.pick(c)
+		defer route.balancer.release(member)
+		c.Set(upstreamKey, member)
+	}
+	// Targets are validated on load; this only guards the path
+	proxyUrl, err := url.Parse(upstreamTarget(c, route))
+	if err != nil {
+		c.JSON(http.StatusBadGateway, gin.H{"error": "Bad gateway", "msg": "invalid target URL"})
+		sendLogToLoki("Invalid target URL", map[string]string{"level": "error", "path": c.Request.URL.Path})
+		return
+	}
+	log.Print("Proxy URL: ", redactURL(proxyUrl.String()+upstreamPath(c, route)))
+
+	if route.poolSaturated() {
+		// Shed before the breaker: a full pool is the gateway queueing, not an upstream failure
+		log.Warn().Str("route", route.Prefix).Int("max_waiting", route.ConnPool.MaxWaiting).Msg("Upstream connection pool saturated")
+		sendLogToLoki("Upstream connection pool saturated", map[string]string{"level": "warn", "path": c.Request.URL.Path})
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Service unavailable", "msg": "upstream connection pool saturated"})
+		return
+	}
+
+	// Fetched outside the breaker: a failing token endpoint says nothing about the upstream
+	token, err := route.upstreamToken(c.Request.Context())
+	if err != nil {
+		log.Error().Err(err).Str("route", route.Prefix).Msg("Fetching upstream token failed")
+		sendLogToLoki("Fetching upstream token failed", map[string]string{"level": "error", "path": c.Request.URL.Path})
+		c.JSON(http.StatusBadGateway, gin.H{"error": "Bad gateway", "msg": errUpstreamToken.Error()})
+		return
+	}
+
+	reqBody := trackClientBody(c, route)
+	defer reqBody.finishEarly(c, route)
+	ctx, deadline := route.sizeDeadline(c.Request.Context(), c.Request.ContentLength)
+	defer deadline.stop()
+	ctx, cancel := route.longPollDeadline(ctx, c.Request)
+	defer cancel()
+	_, err = route.callBreaker(func() (interface{}, error) {
+		req, err := http.NewRequestWithContext(ctx, route.MethodMap.upstream(c.Request.Method), proxyUrl.String()+upstreamPath(c, route), c.Request.Body)
+		if err != nil {
+			sendLogToLoki("Error creating request", map[string]string{"level": "error", "path": c.Request.URL.Path})
+			return nil, errors.New("Error creating request")
+		}
+		// Sized bodies go out sized, not chunked: the stale connection resend
+		// can tell small ones from streams, and an upstream answering early
+		// that the rest is too long to drain
+		if c.Request.ContentLength > 0 {
+			req.ContentLength = c.Request.ContentLength
+		}
+
+		req, wait := route.traceConnWait(req)
+		req, hints := route.forwardEarlyHints(c, req)
+		req.Header = c.Request.Header
+		if route.URLCredentials == "override" {
+			// net/http fills it in from the upstream URL's user:pass, if any
+			req.Header.Del("Authorization")
+		}
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		if route.Decompression.Enabled {
+			req.Header.Set("Accept-Encoding", "gzip")
+		}
+		resp, err := route.sendChain(c, req)
+		wait.done()
+		hints.stop()
+		if route.balancer != nil {
+			// Retries may have moved to another member; served-by names the last
+			if member := route.balancer.memberOf(req); member != "" {
+				c.Set(upstreamKey, member)
+			}
+		}
+
+		if errors.Is(err, errFallbackExhausted) {
+			log.Error().Str("route", route.Prefix).Msg("Every upstream of the fallback chain failed")
+			sendLogToLoki("All fallback upstreams failed", map[string]string{"level": "error", "path": c.Request.URL.Path})
+			return nil, err
+		}
+
+		if err != nil && isProtocolError(err) {
+			log.Error().Err(err).Str("route", route.Prefix).Msg("Malformed upstream response")
+			sendLogToLoki("Malformed upstream response", map[string]string{"level": "error", "path": c.Request.URL.Path})
+			upstreamProtocolErrors.WithLabelValues(route.Prefix).Inc()
+			return nil, errUpstreamProtocol
+		}
+
+		if err != nil && isHeaderTimeout(err) {
+			log.Warn().Str("route", route.Prefix).Dur("timeout", route.ResponseHeaderTimeout).Msg("Upstream sent no response headers in time")
+			sendLogToLoki("Upstream response header timeout", map[string]string{"level": "error", "path": c.Request.URL.Path})
+			return nil, errUpstreamHeaderTimeout
+		}
+
+		if errors.Is(err, errConnectDeadline) {
+			log.Warn().Str("route", route.Prefix).Dur("min_connect_time", route.MinConnectTime).Msg("Deadline too short to connect to the upstream")
+			return nil, errConnectDeadline
+		}
+
+		var cooldown *cooldownError
+		if errors.As(err, &cooldown) {
+			log.Warn().Str("route", route.Prefix).Dur("remaining", cooldown.remaining).Msg("Upstream asked to retry later, not sending")
+			return nil, err
+		}
+
+		if errors.Is(err, errConnectBackoff) {
+			log.Warn().Str("route", route.Prefix).Dur("connect_backoff", route.ConnPool.ConnectBackoff).Msg("Not connecting to upstream that recently failed to connect")
+			sendLogToLoki("Upstream connect backoff", map[string]string{"level": "warn", "path": c.Request.URL.Path})
+			return nil, errConnectBackoff
+		}
+
+		if cause := timeoutCause(reqBody, err); err != nil && cause != nil {
+			log.Warn().Err(err).Str("route", route.Prefix).Msg(cause.Error())
+			sendLogToLoki("Request failed: "+cause.Error(), map[string]string{"level": "warn", "path": c.Request.URL.Path})
+			return nil, cause
+		}
+
+		if err != nil {
+			sendLogToLoki("Error sending request", map[string]string{"level": "error", "path": c.Request.URL.Path})
+			return nil, classifyClientError(ctx, errors.New("Error sending request"))
+		}
+		defer resp.Body.Close()
+		reqBody.stopEarly(c, route)
+		deadline.stretch(resp.ContentLength)
+		if resp.StatusCode == http.StatusUnauthorized && route.upstreamTokens != nil {
+			// Revoked or rotated early; the next request fetches a new one
+			route.upstreamTokens.invalidate()
+		}
+
+		if limit := route.MaxResponseHeaderBytes; limit > 0 {
+			if size := headerSize(resp.Header); size > limit {
+				log.Warn().Str("route", route.Prefix).Int("size", size).Int("limit", limit).Msg("Upstream response headers too large")
+				sendLogToLoki("Upstream response headers too large", map[string]string{"level": "warn", "path": c.Request.URL.Path})
+				return nil, errUpstreamHeadersTooLarge
+			}
+		}
+
+		// The breaker judges the upstream, not what a remapped status says
+		upstreamStatus := resp.StatusCode
+		for _, modify := range route.modifyResponse {
+			if err := modify(c, resp); err != nil {
+				// The upstream answered; a failing transformation is not its fault
+				log.Error().Err(err).Str("path", c.Request.URL.Path).Msg("Error transforming response")
+				sendLogToLoki("Error transforming response", map[string]string{"level": "error", "path": c.Request.URL.Path})
+				c.JSON(http.StatusBadGateway, gin.H{"error": "Bad gateway"})
+				return nil, nil
+			}
+		}
+
+		normalizeFraming(resp)
+		if route.TruncatedResponse == "trailer" {
+			// A trailer needs chunked framing, which a Content-Length rules out
+			resp.Header.Del("Content-Length")
+		}
+		for k, v := range resp.Header {
+			// Cookies set by the gateway itself (e.g. A/B assignment) must survive
+			if k == "Set-Cookie" {
+				for _, cookie := range v {
+					c.Writer.Header().Add(k, cookie)
+				}
+				continue
+			}
+			c.Header(k, v[0])
+		}
+
+		c.Status(resp.StatusCode)
+
+		body := &upstreamBody{Reader: resp.Body}
+		dst, stopFlushing := route.bodyWriter(c.Writer)
+		j, err := io.Copy(dst, body)
+		stopFlushing()
+		log.Print("Copied: ", j)
+		// A client hanging up cancels the upstream read too, that's no
+		// fault of the upstream
+		clientLeft := c.Request.Context().Err() != nil
+
+		if err != nil && body.err != nil && !clientLeft && c.Writer.Written() {
+			// Status and part of the body are already out, the client can't be told with a status
+			log.Error().Err(body.err).Str("route", route.Prefix).Int64("bytes", j).Msg("Upstream response truncated")
+			sendLogToLoki("Upstream response truncated", map[string]string{"level": "error", "path": c.Request.URL.Path})
+			return nil, errUpstreamTruncated
+		}
+
+		if err != nil && (body.err == nil || clientLeft) {
+			// The upstream body read fine, the client is what went away
+			log.Warn().Err(err).Str("route", route.Prefix).Int64("bytes", j).Msg("Writing response to client failed")
+			sendLogToLoki("Writing response to client failed", map[string]string{"level": "warn", "path": c.Request.URL.Path})
+			clientWriteErrors.WithLabelValues(route.Prefix).Inc()
+			return nil, errClientWrite
+		}
+
+		if err != nil {
+			sendLogToLoki("Error copying response body", map[string]string{"level": "ERROR", "path": c.Request.URL.Path})
+			return nil, classifyClientError(ctx, errors.New("Error copying response body"))
+		}
+
+		if route.CircuitBreaker.isFailureStatus(upstreamStatus) {
+			return nil, &upstreamStatusError{status: upstreamStatus}
+		}
+
+		// Log successful proxy
+		sendLogToLoki("Proxy request successful", map[string]string{"level": "INFO", "path": c.Request.URL.Path})
+
+		return nil, nil
+	})
+
+	var statusErr *upstreamStatusError
+	if errors.As(err, &statusErr) {
+		// Already forwarded to the client, only the breaker needed to know
+		sendLogToLoki("Upstream error response", map[string]string{"level": "error", "path": c.Request.URL.Path})
+		return
+	}
+
+	if errors.Is(err, errUpstreamTruncated) {
+		upstreamTruncatedResponses.WithLabelValues(route.Prefix).Inc()
+		signalTruncation(c, route.TruncatedResponse)
+		return
+	}
+
+	if err != nil && c.Writer.Written() {
+		return
+	}
+
+	var cooldown *cooldownError
+	if errors.As(err, &cooldown) {
+		c.Header("Retry-After", retryAfterValue(cooldown.remaining))
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Service unavailable", "msg": err.Error()})
+		return
+	}
+
+	if errors.Is(err, errUpstreamHeadersTooLarge) {
+		c.JSON(http.StatusBadGateway, gin.H{"error": "Bad gateway", "msg": err.Error()})
+		return
+	}
+
+	if errors.Is(err, errFallbackExhausted) {
+		c.JSON(http.StatusBadGateway, gin.H{"error": "Bad gateway", "msg": err.Error()})
+		return
+	}
+
+	if errors.Is(err, errUpstreamProtocol) {
+		// The backend is up but spoke garbage
+		c.JSON(http.StatusBadGateway, gin.H{"error": "Bad gateway", "msg": err.Error()})
+		return
+	}
+
+	if status, cause, message := timeoutStatus(err); status != 0 {
+		requestTimeouts.WithLabelValues(route.Prefix, cause).Inc()
+		sendLogToLoki(timeoutLogLine(ctx, message, cause, route.timeoutLimit(c.Request, err, deadline), started), map[string]string{"level": "warn", "path": c.Request.URL.Path})
+		c.JSON(status, gin.H{"error": message, "msg": err.Error()})
+		return
+	}
+
+	if err != nil {
+		c.Writer.Header().Del("Content-Length")
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Service unavailable", "msg": err.Error()})
+		sendLogToLoki("Service unavailable", map[string]string{"level": "error", "path": c.Request.URL.Path})
+		return
+	}
+}
+
+var (
+	errUpstreamTruncated       = errors.New("upstream response truncated")
+	errUpstreamProtocol        = errors.New("malformed upstream response")
+	errUpstreamHeadersTooLarge = errors.New("upstream response headers too large")
+	// Copying the response failed on the client's side, not the upstream's
+	errClientWrite = errors.New("writing response to client failed")
+	// Transport.ResponseHeaderTimeout expired
+	errUpstreamHeaderTimeout = errors.New("upstream response header timeout")
+)
+
+// Whether the transport gave up waiting for the upstream's response headers.
+// net/http reports it with an unexported error type, only its text tells it
+// apart from the client's overall timeout.
+func isHeaderTimeout(err error) bool {
+	return strings.Contains(err.Error(), "timeout awaiting response headers")
+}
+
+// Whether the transport failed to parse what the upstream sent
+func isProtocolError(err error) bool {
+	var protoErr textproto.ProtocolError
+	if errors.As(err, &protoErr) {
+		return true
+	}
+	// net/http reports bad status lines and headers as plain errors
+	msg := err.Error()
+	return strings.Contains(msg, "malformed HTTP") || strings.Contains(msg, "malformed MIME header")
+}
+
+// Drop framing headers contradicting how the upstream body is delimited, so
+// the response to the client is framed by net/http alone. A chunked response
+// that also carries Content-Length is invalid; the chunking wins and the
+// length must not be forwarded (RFC 9112 section 6.3). net/http's client
+// already discards it, this keeps it from coming back through a header copy.
+func normalizeFraming(resp *http.Response) {
+	if len(resp.TransferEncoding) > 0 || resp.ContentLength < 0 {
+		resp.Header.Del("Content-Length")
+	}
+	resp.Header.Del("Transfer-Encoding")
+}
+
+// Upstream body remembering read failures, so a broken upstream can be told
+// apart from a failing write to the client
+type upstreamBody struct {
+	io.Reader
+	err error
+}
+
+func (b *upstreamBody) Read(p []byte) (int, error) {
+	n, err := b.Reader.Read(p)
+	if err != nil && err != io.EOF {
+		b.err = err
+	}
+	return n, err
+}
+
+// Let the client notice a response cut short by the upstream. "trailer" ends the
+// response normally with an X-Gateway-Truncated trailer, the default "abort"
+// drops the connection so the body can't be mistaken for a complete one.
+func signalTruncation(c *gin.Context, mode string) {
+	// Flushing commits to chunked framing when no Content-Length was sent
+	c.Writer.Flush()
+	if mode == "trailer" {
+		c.Writer.Header().Set(http.TrailerPrefix+"X-Gateway-Truncated", "true")
+		return
+	}
+	panic(http.ErrAbortHandler)
+}
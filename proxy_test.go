@@ -0,0 +1,203 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Upstream promising 1000 bytes and hanging up after 10 of them
+func truncatingUpstream(t *testing.T) string {
+	t.Helper()
+	up := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, buf, err := http.NewResponseController(w).Hijack()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		buf.WriteString("HTTP/1.1 200 OK\r\nContent-Length: 1000\r\nContent-Type: text/plain\r\n\r\n0123456789")
+		buf.Flush()
+		conn.Close()
+	}))
+	t.Cleanup(up.Close)
+	return up.URL
+}
+
+func TestTruncatedUpstreamResponse(t *testing.T) {
+	target := truncatingUpstream(t)
+	for _, mode := range []string{"abort", "trailer"} {
+		_, r := newTestGateway(t, "routes:\n- prefix: /t\n  target: "+target+"\n  rate_limit: {rate: 1000, burst: 1000}\n"+
+			"  truncated_response: "+mode+"\n")
+		gateway := httptest.NewServer(r)
+		truncated := upstreamTruncatedResponses.WithLabelValues("/t")
+		before := counterValue(t, truncated)
+
+		resp, err := http.Get(gateway.URL + "/t/")
+		if err != nil {
+			t.Fatalf("%s: %v", mode, err)
+		}
+		body, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		switch mode {
+		case "abort":
+			// The client must not take the partial body for the whole response
+			if err == nil {
+				t.Errorf("abort: read %q without an error", body)
+			}
+		case "trailer":
+			if err != nil || string(body) != "0123456789" || resp.Trailer.Get("X-Gateway-Truncated") != "true" {
+				t.Errorf("trailer: body %q, err %v, trailers %v", body, err, resp.Trailer)
+			}
+		}
+		if got := counterValue(t, truncated) - before; got != 1 {
+			t.Errorf("%s: truncations counted: %v, want 1", mode, got)
+		}
+		gateway.Close()
+	}
+}
+
+// Backend answering every connection with bytes that aren't HTTP
+func garbageUpstream(t *testing.T) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				conn.Read(make([]byte, 4096))
+				conn.Write([]byte("\x00\x7fSSH-2.0 not a response\r\n\xff\xfe garbage\r\n\r\n"))
+			}()
+		}
+	}()
+	return "http://" + ln.Addr().String()
+}
+
+func TestMalformedUpstreamResponse(t *testing.T) {
+	_, r := newTestGateway(t, "routes:\n- prefix: /g\n  target: "+garbageUpstream(t)+"\n  rate_limit: {rate: 1000, burst: 1000}\n")
+	protocolErrors := upstreamProtocolErrors.WithLabelValues("/g")
+	before := counterValue(t, protocolErrors)
+
+	w := serve(r, httptest.NewRequest(http.MethodGet, "/g/", nil))
+	if w.Code != http.StatusBadGateway {
+		t.Errorf("status %d, want 502: %s", w.Code, w.Body)
+	}
+	if got := counterValue(t, protocolErrors) - before; got != 1 {
+		t.Errorf("protocol errors counted: %v, want 1", got)
+	}
+}
+
+// An upstream that takes longer than response_header_timeout to send its
+// headers gets a 504 at that timeout, well before the route timeout
+func TestUpstreamHeaderTimeout(t *testing.T) {
+	release := make(chan struct{})
+	up := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow" {
+			<-release
+		}
+		w.Write([]byte("ok"))
+	}))
+	defer up.Close()
+	defer close(release)
+	_, r := newTestGateway(t, "routes:\n- prefix: /h\n  target: "+up.URL+"\n  rate_limit: {rate: 1000, burst: 1000}\n"+
+		"  timeout: 10s\n  response_header_timeout: 100ms\n")
+	timeouts := requestTimeouts.WithLabelValues("/h", "upstream")
+	before := counterValue(t, timeouts)
+
+	started := time.Now()
+	w := serve(r, httptest.NewRequest(http.MethodGet, "/h/slow", nil))
+	elapsed := time.Since(started)
+	if w.Code != http.StatusGatewayTimeout {
+		t.Errorf("status %d, want 504: %s", w.Code, w.Body)
+	}
+	if elapsed < 100*time.Millisecond || elapsed > 2*time.Second {
+		t.Errorf("answered after %v, want about the 100ms header timeout", elapsed)
+	}
+	if got := counterValue(t, timeouts) - before; got != 1 {
+		t.Errorf("timeouts counted: %v, want 1", got)
+	}
+	if w := serve(r, httptest.NewRequest(http.MethodGet, "/h/fast", nil)); w.Code != http.StatusOK {
+		t.Errorf("prompt upstream: status %d, want 200", w.Code)
+	}
+}
+
+func TestOversizedUpstreamResponseHeaders(t *testing.T) {
+	up := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/big" {
+			w.Header().Set("X-Session-Dump", strings.Repeat("x", 8<<10))
+		}
+		w.Write([]byte("ok"))
+	}))
+	defer up.Close()
+	_, r := newTestGateway(t, "routes:\n- prefix: /o\n  target: "+up.URL+"\n  rate_limit: {rate: 1000, burst: 1000}\n"+
+		"  max_response_header_bytes: 4096\n")
+
+	w := serve(r, httptest.NewRequest(http.MethodGet, "/o/big", nil))
+	if w.Code != http.StatusBadGateway || w.Header().Get("X-Session-Dump") != "" {
+		t.Errorf("8KiB header: status %d, want a 502 without it", w.Code)
+	}
+	if w := serve(r, httptest.NewRequest(http.MethodGet, "/o/small", nil)); w.Code != http.StatusOK || w.Body.String() != "ok" {
+		t.Errorf("small headers: %d %q, want 200", w.Code, w.Body)
+	}
+}
+
+// An upstream sending both Transfer-Encoding: chunked and Content-Length: the
+// client gets the full body framed one way only
+func TestChunkedUpstreamWithContentLength(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				http.ReadRequest(bufio.NewReader(conn))
+				conn.Write([]byte("HTTP/1.1 200 OK\r\nTransfer-Encoding: chunked\r\nContent-Length: 3\r\n\r\na\r\n0123456789\r\n0\r\n\r\n"))
+			}()
+		}
+	}()
+	_, r := newTestGateway(t, "routes:\n- prefix: /m\n  target: http://"+ln.Addr().String()+"\n  rate_limit: {rate: 1000, burst: 1000}\n")
+	gw := httptest.NewServer(r)
+	defer gw.Close()
+
+	conn, err := net.Dial("tcp", gw.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	io.WriteString(conn, "GET /m/ HTTP/1.1\r\nHost: gw\r\nConnection: close\r\n\r\n")
+	raw, err := io.ReadAll(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	head, _, _ := strings.Cut(string(raw), "\r\n\r\n")
+	head = strings.ToLower(head)
+	if strings.Contains(head, "content-length:") && strings.Contains(head, "transfer-encoding:") {
+		t.Errorf("response framed both ways:\n%s", head)
+	}
+	resp, err := http.ReadResponse(bufio.NewReader(strings.NewReader(string(raw))), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if body, err := io.ReadAll(resp.Body); err != nil || string(body) != "0123456789" || resp.StatusCode != http.StatusOK {
+		t.Errorf("status %d, body %q, %v; want the whole chunked body", resp.StatusCode, body, err)
+	}
+}
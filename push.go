@@ -0,0 +1,88 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/push"
+	"github.com/rs/zerolog/log"
+)
+
+// Periodic push of all metrics to a Pushgateway, for instances that can't be
+// scraped. /metrics keeps working alongside it.
+type PushConfig struct {
+	URL      string        `yaml:"url"`
+	Job      string        `yaml:"job"`
+	Instance string        `yaml:"instance"`
+	Interval time.Duration `yaml:"interval"`
+}
+
+func (cfg *PushConfig) setDefaults() {
+	if cfg.Job == "" {
+		cfg.Job = "gateway"
+	}
+	if cfg.Instance == "" {
+		cfg.Instance, _ = os.Hostname()
+	}
+	if cfg.Interval <= 0 {
+		cfg.Interval = 15 * time.Second
+	}
+}
+
+// Started from the config when a push URL is set
+var metricsPusher *pushLoop
+
+type pushLoop struct {
+	pusher   *push.Pusher
+	interval time.Duration
+	stop     chan struct{}
+	done     chan struct{}
+}
+
+func newPushLoop(cfg PushConfig) *pushLoop {
+	if cfg.URL == "" {
+		return nil
+	}
+	cfg.setDefaults()
+	p := &pushLoop{
+		pusher: push.New(cfg.URL, cfg.Job).
+			Gatherer(prometheus.DefaultGatherer).
+			Grouping("instance", cfg.Instance).
+			Client(&http.Client{Timeout: cfg.Interval}),
+		interval: cfg.Interval,
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	go p.run()
+	return p
+}
+
+func (p *pushLoop) run() {
+	defer close(p.done)
+	ticker := time.NewTicker(p.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			// Push replaces the instance's group, a missed push is caught up by the next
+			if err := p.pusher.Push(); err != nil {
+				log.Warn().Err(err).Msg("Pushing metrics failed")
+			}
+		case <-p.stop:
+			return
+		}
+	}
+}
+
+// Stop pushing and send the final values once more, within ctx
+func (p *pushLoop) Close(ctx context.Context) error {
+	if p == nil {
+		return nil
+	}
+	close(p.stop)
+	<-p.done
+	return p.pusher.PushContext(ctx)
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Pushes reach the stub Pushgateway under the job and instance grouping, one
+// per interval, and Close sends a last one
+func TestMetricsPushedAtInterval(t *testing.T) {
+	var (
+		mu     sync.Mutex
+		pushes []time.Time
+	)
+	stub := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		at := time.Now()
+		body, _ := io.ReadAll(r.Body)
+		if r.Method != http.MethodPut || r.URL.Path != "/metrics/job/gw/instance/node-1" {
+			t.Errorf("push %s %s, want PUT to the gw/node-1 group", r.Method, r.URL.Path)
+		}
+		if !strings.Contains(string(body), "go_goroutines") {
+			t.Error("push without the default registry's metrics")
+		}
+		mu.Lock()
+		pushes = append(pushes, at)
+		mu.Unlock()
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer stub.Close()
+
+	started := time.Now()
+	p := newPushLoop(PushConfig{URL: stub.URL, Job: "gw", Instance: "node-1", Interval: 100 * time.Millisecond})
+	time.Sleep(350 * time.Millisecond)
+	closing := time.Now()
+	if err := p.Close(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	mu.Lock()
+	var periodic []time.Time
+	for _, at := range pushes {
+		if at.Before(closing) {
+			periodic = append(periodic, at)
+		}
+	}
+	final := len(pushes) - len(periodic)
+	mu.Unlock()
+	if len(periodic) < 2 || len(periodic) > 3 {
+		t.Fatalf("%d pushes in 350ms at a 100ms interval", len(periodic))
+	}
+	if first := periodic[0].Sub(started); first < 90*time.Millisecond {
+		t.Errorf("first push after %v, want one interval", first)
+	}
+	for i := 1; i < len(periodic); i++ {
+		if gap := periodic[i].Sub(periodic[i-1]); gap < 50*time.Millisecond {
+			t.Errorf("pushes %v apart, want about the 100ms interval", gap)
+		}
+	}
+	if final == 0 {
+		t.Error("no push from Close")
+	}
+
+	// With no tick due, Close's push is the only one
+	mu.Lock()
+	pushes = nil
+	mu.Unlock()
+	p = newPushLoop(PushConfig{URL: stub.URL, Job: "gw", Instance: "node-1", Interval: time.Hour})
+	if err := p.Close(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if len(pushes) != 1 {
+		t.Errorf("Close sent %d pushes, want 1", len(pushes))
+	}
+}
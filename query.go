@@ -0,0 +1,145 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/rs/zerolog/log"
+)
+
+// Path and query the upstream is asked for: the path after the route prefix
+// behind the route's add_prefix, and the client's query as sent plus the
+// route's default_query parameters the client didn't give
+func upstreamPath(c *gin.Context, route *Route) string {
+	path := c.Param("rest")
+	if route.AddPrefix != "" {
+		path = strings.TrimSuffix(route.AddPrefix, "/") + path
+	}
+	raw := c.Request.URL.RawQuery
+	if len(route.DefaultQuery) > 0 {
+		raw = withDefaultQuery(raw, route.DefaultQuery)
+	}
+	if raw == "" {
+		return path
+	}
+	return path + "?" + raw
+}
+
+// Append the defaults missing from raw, leaving the client's own encoding untouched
+func withDefaultQuery(raw string, defaults map[string]string) string {
+	given, _ := url.ParseQuery(raw)
+	names := make([]string, 0, len(defaults))
+	for name := range defaults {
+		if !given.Has(name) {
+			names = append(names, name)
+		}
+	}
+	// Sorted, so equal requests map to equal upstream URLs
+	slices.Sort(names)
+
+	var b strings.Builder
+	b.WriteString(raw)
+	for _, name := range names {
+		if b.Len() > 0 {
+			b.WriteByte('&')
+		}
+		b.WriteString(url.QueryEscape(name) + "=" + url.QueryEscape(defaults[name]))
+	}
+	return b.String()
+}
+
+// Upstream chosen by the value of a query parameter, e.g. ?region=eu to the
+// EU upstream. Matched after the path; requests without the parameter or with
+// an unlisted value go to Default, or the route's usual upstream without one.
+type QueryRoutingConfig struct {
+	Param string `yaml:"param"`
+	// Parameter value -> upstream base URL
+	Upstreams map[string]string `yaml:"upstreams"`
+	Default   string            `yaml:"default"`
+	// What a query that can't be matched gets, one that doesn't parse or
+	// gives the parameter conflicting values: "default" (the default) sends it
+	// to Default, "reject" answers 400
+	OnError string `yaml:"on_error"`
+}
+
+// The query couldn't be matched against query_routing
+var errQueryMatch = errors.New("query can't be matched")
+
+func (cfg QueryRoutingConfig) validate() error {
+	if cfg.Param == "" {
+		if len(cfg.Upstreams) > 0 || cfg.Default != "" {
+			return fmt.Errorf("query_routing: upstreams need a param")
+		}
+		return nil
+	}
+	if len(cfg.Upstreams) == 0 {
+		return fmt.Errorf("query_routing: no upstreams configured")
+	}
+	switch cfg.OnError {
+	case "", "default", "reject":
+	default:
+		return fmt.Errorf("query_routing: unknown on_error %q", cfg.OnError)
+	}
+	targets := make([]string, 0, len(cfg.Upstreams)+1)
+	for _, target := range cfg.Upstreams {
+		targets = append(targets, target)
+	}
+	if cfg.Default != "" {
+		targets = append(targets, cfg.Default)
+	}
+	return validateUpstreams("query_routing", targets)
+}
+
+// Middleware sending the request to the upstream its query parameter picks.
+// An open schedule window or a debug override takes precedence, A/B variants
+// don't.
+func QueryRoutingMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		cfg := routeFromContext(c).QueryRouting
+		if cfg.Param == "" || c.GetString(upstreamKey) != "" {
+			c.Next()
+			return
+		}
+		value, err := cfg.match(c.Request.URL.RawQuery)
+		if err != nil {
+			log.Warn().Err(err).Str("path", c.Request.URL.Path).Str("param", cfg.Param).Msg("Query routing failed")
+			sendLogToLoki("Query routing failed: "+err.Error(), map[string]string{"level": "warn", "path": c.Request.URL.Path})
+			if cfg.OnError == "reject" {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "Bad request", "msg": err.Error()})
+				c.Abort()
+				return
+			}
+		}
+		target := cfg.Upstreams[value]
+		if target == "" {
+			target = cfg.Default
+		}
+		if target != "" {
+			c.Set(upstreamKey, target)
+		}
+		c.Next()
+	}
+}
+
+// Value of the parameter in raw, "" without one
+func (cfg QueryRoutingConfig) match(raw string) (string, error) {
+	query, err := url.ParseQuery(raw)
+	if err != nil {
+		return "", fmt.Errorf("%w: %v", errQueryMatch, err)
+	}
+	values := query[cfg.Param]
+	for _, value := range values {
+		if value != values[0] {
+			return "", fmt.Errorf("%w: %s given conflicting values", errQueryMatch, cfg.Param)
+		}
+	}
+	if len(values) == 0 {
+		return "", nil
+	}
+	return values[0], nil
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// Defaults are added when the client leaves them out; a parameter the client
+// gives, even empty, is kept as sent
+func TestDefaultQuery(t *testing.T) {
+	up := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.URL.RawQuery))
+	}))
+	defer up.Close()
+	_, r := newTestGateway(t, "routes:\n- prefix: /q\n  target: "+up.URL+"\n  rate_limit: {rate: 1000, burst: 1000}\n"+
+		"  default_query: {format: json, limit: '50'}\n")
+
+	for query, want := range map[string]string{
+		"":                   "format=json&limit=50",
+		"?limit=10":          "limit=10&format=json",
+		"?format=xml&limit=": "format=xml&limit=",
+		"?q=a%20b":           "q=a%20b&format=json&limit=50",
+	} {
+		if got := serve(r, httptest.NewRequest(http.MethodGet, "/q/items"+query, nil)).Body.String(); got != want {
+			t.Errorf("%q: upstream got query %q, want %q", query, got, want)
+		}
+	}
+}
+
+// add_prefix goes in front of what's left once the route prefix is stripped
+func TestAddPrefix(t *testing.T) {
+	up := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.URL.RequestURI()))
+	}))
+	defer up.Close()
+	_, r := newTestGateway(t, "routes:\n- prefix: /acct\n  target: "+up.URL+"\n  rate_limit: {rate: 1000, burst: 1000}\n"+
+		"  add_prefix: /api/v1/account/\n")
+
+	for path, want := range map[string]string{
+		"/acct/users/7":      "/api/v1/account/users/7",
+		"/acct/":             "/api/v1/account/",
+		"/acct/users?page=2": "/api/v1/account/users?page=2",
+	} {
+		if got := serve(r, httptest.NewRequest(http.MethodGet, path, nil)).Body.String(); got != want {
+			t.Errorf("%s: upstream got %q, want %q", path, got, want)
+		}
+	}
+
+	for _, bad := range []string{"api/v1", "/api?v=1", "/api#x"} {
+		if _, err := parseConfig([]byte("routes:\n- prefix: /acct\n  target: " + up.URL + "\n  add_prefix: '" + bad + "'\n")); err == nil {
+			t.Errorf("add_prefix %q accepted", bad)
+		}
+	}
+}
+
+// The region parameter picks the upstream; without it, or with a value not
+// listed, the request goes to the default
+func TestQueryRouting(t *testing.T) {
+	named := func(name string) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(name))
+		}))
+	}
+	usual, eu, us, fallback := named("usual"), named("eu"), named("us"), named("default")
+	for _, s := range []*httptest.Server{usual, eu, us, fallback} {
+		defer s.Close()
+	}
+	_, r := newTestGateway(t, "routes:\n"+
+		"- prefix: /geo\n  target: "+usual.URL+"\n  rate_limit: {rate: 1000, burst: 1000}\n"+
+		"  query_routing: {param: region, upstreams: {eu: '"+eu.URL+"', us: '"+us.URL+"'}, default: '"+fallback.URL+"'}\n"+
+		"- prefix: /nodefault\n  target: "+usual.URL+"\n  rate_limit: {rate: 1000, burst: 1000}\n"+
+		"  query_routing: {param: region, upstreams: {eu: '"+eu.URL+"'}}\n")
+
+	for path, want := range map[string]string{
+		"/geo/items?region=eu":         "eu",
+		"/geo/items?page=2&region=us":  "us",
+		"/geo/items":                   "default",
+		"/geo/items?region=apac":       "default",
+		"/geo/items?region=":           "default",
+		"/nodefault/items?region=eu":   "eu",
+		"/nodefault/items":             "usual",
+		"/nodefault/items?region=apac": "usual",
+	} {
+		if got := serve(r, httptest.NewRequest(http.MethodGet, path, nil)).Body.String(); got != want {
+			t.Errorf("%s: served by %q, want %q", path, got, want)
+		}
+	}
+}
+
+// A query that can't be matched goes to the default upstream, or gets a 400
+// with on_error: reject, instead of failing the request some other way
+func TestQueryRoutingMatchError(t *testing.T) {
+	named := func(name string) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(name))
+		}))
+	}
+	eu, fallback := named("eu"), named("default")
+	defer eu.Close()
+	defer fallback.Close()
+	routing := "{param: region, upstreams: {eu: '" + eu.URL + "'}, default: '" + fallback.URL + "'"
+	_, r := newTestGateway(t, "routes:\n"+
+		"- prefix: /soft\n  target: "+fallback.URL+"\n  rate_limit: {rate: 1000, burst: 1000}\n  query_routing: "+routing+"}\n"+
+		"- prefix: /strict\n  target: "+fallback.URL+"\n  rate_limit: {rate: 1000, burst: 1000}\n  query_routing: "+routing+", on_error: reject}\n")
+
+	for _, query := range []string{"region=%zz", "region=eu&region=us"} {
+		if w := serve(r, httptest.NewRequest(http.MethodGet, "/soft/?"+query, nil)); w.Code != http.StatusOK || w.Body.String() != "default" {
+			t.Errorf("/soft ?%s: %d %q, want the default upstream", query, w.Code, w.Body)
+		}
+		if w := serve(r, httptest.NewRequest(http.MethodGet, "/strict/?"+query, nil)); w.Code != http.StatusBadRequest {
+			t.Errorf("/strict ?%s: %d %q, want 400", query, w.Code, w.Body)
+		}
+	}
+	// Repeating the same value is no conflict
+	if got := serve(r, httptest.NewRequest(http.MethodGet, "/strict/?region=eu&region=eu", nil)).Body.String(); got != "eu" {
+		t.Errorf("repeated region=eu: served by %q, want eu", got)
+	}
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	"golang.org/x/time/rate"
+)
+
+// Periodic report of how close each route's rate limits ran to their limit,
+// for sizing them on real traffic. Every interval, each limit's window is
+// exported: requests admitted and rejected, the peak share of its budget in
+// use and, for limits shared by the route's clients, the admitted rate over
+// the configured one.
+type RateLimitReportConfig struct {
+	// Length of a window; 0 (default) turns reports off
+	Interval time.Duration `yaml:"interval"`
+	// "log" for one structured line per limit with traffic in the window,
+	// "metrics" for the gateway_rate_limit_* gauges; log by default
+	Export []string `yaml:"export"`
+}
+
+func (cfg RateLimitReportConfig) validate() error {
+	if cfg.Interval < 0 {
+		return fmt.Errorf("rate_limit_report: interval can't be negative")
+	}
+	if cfg.Interval == 0 && len(cfg.Export) > 0 {
+		return fmt.Errorf("rate_limit_report: export needs an interval")
+	}
+	for _, export := range cfg.Export {
+		if export != "log" && export != "metrics" {
+			return fmt.Errorf("rate_limit_report: unknown export %q", export)
+		}
+	}
+	return nil
+}
+
+func (cfg RateLimitReportConfig) exports(to string) bool {
+	if len(cfg.Export) == 0 {
+		return to == "log"
+	}
+	return slices.Contains(cfg.Export, to)
+}
+
+// Activity of a routeLimiter over a window
+type limiterStats struct {
+	since    time.Time
+	admitted int
+	rejected int
+	// Highest Usage seen after an admission, 1 once a request was rejected
+	peak float64
+}
+
+// Count a request l admitted or rejected
+func (rl *routeLimiter) observe(l Limiter, allowed bool) {
+	var usage float64 = 1
+	if allowed {
+		usage = l.Usage()
+	}
+	rl.statsMu.Lock()
+	defer rl.statsMu.Unlock()
+	if allowed {
+		rl.stats.admitted++
+	} else {
+		rl.stats.rejected++
+	}
+	rl.stats.peak = max(rl.stats.peak, usage)
+}
+
+type limiterReport struct {
+	admitted, rejected int
+	peakUsage          float64
+	// Admitted rate over the limit's rate, -1 for per-client limits whose
+	// rate applies to each client
+	rateUsage float64
+	// Clients with a limiter of their own, for per-client limits
+	clients int
+}
+
+// Report of the window ending now, starting the next one
+func (rl *routeLimiter) takeReport(now time.Time) limiterReport {
+	rl.statsMu.Lock()
+	stats := rl.stats
+	rl.stats = limiterStats{since: now}
+	rl.statsMu.Unlock()
+
+	report := limiterReport{admitted: stats.admitted, rejected: stats.rejected, peakUsage: stats.peak, rateUsage: -1}
+	limit := rl.Limit()
+	rl.mu.Lock()
+	keyed := rl.shared == nil
+	report.clients = len(rl.keyed)
+	rl.mu.Unlock()
+	if !keyed {
+		report.rateUsage = 0
+		// Windows of limiters created since the last report are shorter
+		if elapsed := now.Sub(stats.since).Seconds(); !stats.since.IsZero() && elapsed > 0 && limit > 0 && limit != rate.Inf {
+			report.rateUsage = float64(stats.admitted) / elapsed / float64(limit)
+		}
+	}
+	return report
+}
+
+// Export a window of every limit of the current routes each interval, until
+// the gateway closes
+func (g *Gateway) rateLimitReportLoop(cfg RateLimitReportConfig) {
+	ticker := time.NewTicker(cfg.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case now := <-ticker.C:
+			for _, route := range g.routes() {
+				route.reportLimits(cfg, now)
+			}
+		case <-g.stopBackground:
+			return
+		}
+	}
+}
+
+func (route *Route) reportLimits(cfg RateLimitReportConfig, now time.Time) {
+	limits := append([]*routeLimiter{route.limiter}, route.limiters...)
+	for i, l := range limits {
+		name := "rate_limit"
+		if i > 0 {
+			name = "rate_limits." + strconv.Itoa(i-1)
+		}
+		exportLimiterReport(cfg, route.Prefix, name, l.takeReport(now))
+	}
+}
+
+func exportLimiterReport(cfg RateLimitReportConfig, prefix, limit string, report limiterReport) {
+	if cfg.exports("metrics") {
+		rateLimitAdmitted.WithLabelValues(prefix, limit).Set(float64(report.admitted))
+		rateLimitRejected.WithLabelValues(prefix, limit).Set(float64(report.rejected))
+		rateLimitPeakUsage.WithLabelValues(prefix, limit).Set(report.peakUsage)
+		if report.rateUsage >= 0 {
+			rateLimitRateUsage.WithLabelValues(prefix, limit).Set(report.rateUsage)
+		}
+	}
+	if cfg.exports("log") && report.admitted+report.rejected > 0 {
+		entry := log.Info().Str("route", prefix).Str("limit", limit).
+			Int("admitted", report.admitted).Int("rejected", report.rejected).
+			Float64("peak_usage", report.peakUsage)
+		if report.rateUsage >= 0 {
+			entry = entry.Float64("rate_usage", report.rateUsage)
+		} else {
+			entry = entry.Int("clients", report.clients)
+		}
+		entry.Dur("window", cfg.Interval).Msg("Rate limit report")
+	}
+}
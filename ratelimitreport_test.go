@@ -0,0 +1,67 @@
+package main
+
+import (
+	"encoding/json"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Report windows driven by hand: 40 requests on a 100 burst show as 40% of the
+// budget and twice the 10/s rate over 2s; 100 more overrun it
+func TestRateLimitReportSaturation(t *testing.T) {
+	up := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer up.Close()
+	g, r := newTestGateway(t, "routes:\n- prefix: /rl\n  target: "+up.URL+"\n  rate_limit: {rate: 10, burst: 100}\n")
+	route := g.routes()[0]
+	cfg := RateLimitReportConfig{Interval: 2 * time.Second, Export: []string{"metrics", "log"}}
+	logs := captureLogs(t)
+	send := func(n int) {
+		for range n {
+			serve(r, httptest.NewRequest(http.MethodGet, "/rl/", nil))
+		}
+	}
+	gauges := func() (admitted, rejected, peak, rateUsage float64) {
+		return gaugeValue(t, rateLimitAdmitted.WithLabelValues("/rl", "rate_limit")),
+			gaugeValue(t, rateLimitRejected.WithLabelValues("/rl", "rate_limit")),
+			gaugeValue(t, rateLimitPeakUsage.WithLabelValues("/rl", "rate_limit")),
+			gaugeValue(t, rateLimitRateUsage.WithLabelValues("/rl", "rate_limit"))
+	}
+
+	start := time.Now()
+	route.limiter.takeReport(start)
+	send(40)
+	route.reportLimits(cfg, start.Add(2*time.Second))
+	admitted, rejected, peak, rateUsage := gauges()
+	// The bucket refills 10/s, a little while the requests are sent
+	if admitted != 40 || rejected != 0 || peak < 0.35 || peak > 0.4 || math.Abs(rateUsage-2) > 1e-9 {
+		t.Errorf("first window: admitted %v, rejected %v, peak %.3f, rate usage %.3f, want 40, 0, about 0.4, 2", admitted, rejected, peak, rateUsage)
+	}
+
+	send(100)
+	route.reportLimits(cfg, start.Add(4*time.Second))
+	admitted, rejected, peak, rateUsage = gauges()
+	if admitted < 60 || admitted > 65 || admitted+rejected != 100 || peak != 1 || math.Abs(rateUsage-admitted/20) > 1e-9 {
+		t.Errorf("second window: admitted %v, rejected %v, peak %.3f, rate usage %.3f, want about 60, 40, 1, 3", admitted, rejected, peak, rateUsage)
+	}
+
+	// Quiet window: zeroed gauges and no log line
+	route.reportLimits(cfg, start.Add(6*time.Second))
+	if admitted, rejected, peak, rateUsage = gauges(); admitted+rejected+peak+rateUsage != 0 {
+		t.Errorf("quiet window: admitted %v, rejected %v, peak %v, rate usage %v, want 0", admitted, rejected, peak, rateUsage)
+	}
+
+	var lines []map[string]any
+	for _, line := range strings.Split(strings.TrimSpace(logs.String()), "\n") {
+		var entry map[string]any
+		if json.Unmarshal([]byte(line), &entry) == nil && entry["message"] == "Rate limit report" {
+			lines = append(lines, entry)
+		}
+	}
+	if len(lines) != 2 || lines[0]["admitted"] != 40.0 || lines[1]["peak_usage"] != 1.0 || lines[1]["route"] != "/rl" {
+		t.Errorf("report lines %v, want the two windows with traffic", lines)
+	}
+}
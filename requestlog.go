@@ -0,0 +1,299 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/rs/zerolog/log"
+)
+
+// Detailed records of a route's requests, e.g. payments, written to a sink of
+// their own for analytics: a JSON lines file or an HTTP endpoint taking JSON
+// lines batches. They don't depend on the log level and never go to Loki.
+type RequestLogConfig struct {
+	File string `yaml:"file"`
+	URL  string `yaml:"url"`
+	// Request headers copied into records; nothing else of the headers is kept
+	Headers []string `yaml:"headers"`
+	// File size in bytes at which the file is moved to <file>.1, replacing
+	// the previous one (0 = never rotate)
+	MaxSize int64 `yaml:"max_size"`
+}
+
+func (cfg RequestLogConfig) configured() bool {
+	return cfg.File != "" || cfg.URL != ""
+}
+
+func (cfg RequestLogConfig) validate() error {
+	if cfg.File != "" && cfg.URL != "" {
+		return fmt.Errorf("request_log: file and url are exclusive")
+	}
+	if cfg.URL != "" {
+		if u, err := url.Parse(cfg.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("request_log: invalid url %q", cfg.URL)
+		}
+	}
+	if cfg.MaxSize < 0 {
+		return fmt.Errorf("request_log: max_size can't be negative")
+	}
+	if cfg.MaxSize > 0 && cfg.File == "" {
+		return fmt.Errorf("request_log: max_size needs a file")
+	}
+	return nil
+}
+
+// Schema of the records; Version changes when fields change meaning or go away
+type requestRecord struct {
+	Version    int               `json:"v"`
+	Time       time.Time         `json:"time"`
+	Route      string            `json:"route"`
+	Method     string            `json:"method"`
+	Path       string            `json:"path"`
+	Query      string            `json:"query,omitempty"`
+	ClientIP   string            `json:"client_ip"`
+	Tenant     string            `json:"tenant,omitempty"`
+	TraceID    string            `json:"trace_id,omitempty"`
+	Upstream   string            `json:"upstream,omitempty"`
+	Status     int               `json:"status"`
+	DurationMS float64           `json:"duration_ms"`
+	BytesIn    int64             `json:"bytes_in"`
+	BytesOut   int               `json:"bytes_out"`
+	Headers    map[string]string `json:"headers,omitempty"`
+}
+
+const requestRecordVersion = 1
+
+// Records held per sink; further ones are dropped while it is full
+const requestLogBuffer = 1000
+
+// Writes records from a background goroutine, so requests never wait on the
+// file or the endpoint
+type requestLogSink struct {
+	cfg     RequestLogConfig
+	client  *http.Client
+	records chan []byte
+	stop    chan context.Context
+	done    chan struct{}
+
+	file *os.File
+	size int64
+}
+
+// Sinks by destination, shared by the routes writing there and kept across
+// reloads so a file is never opened twice
+var (
+	requestLogsMu sync.Mutex
+	requestLogs   = map[requestLogKey]*requestLogSink{}
+)
+
+type requestLogKey struct {
+	file, url string
+	maxSize   int64
+}
+
+func requestLogSinkFor(cfg RequestLogConfig) *requestLogSink {
+	key := requestLogKey{file: cfg.File, url: cfg.URL, maxSize: cfg.MaxSize}
+	requestLogsMu.Lock()
+	defer requestLogsMu.Unlock()
+	if sink, ok := requestLogs[key]; ok {
+		return sink
+	}
+	sink := &requestLogSink{
+		cfg:     RequestLogConfig{File: cfg.File, URL: cfg.URL, MaxSize: cfg.MaxSize},
+		client:  &http.Client{Timeout: 5 * time.Second},
+		records: make(chan []byte, requestLogBuffer),
+		stop:    make(chan context.Context),
+		done:    make(chan struct{}),
+	}
+	go sink.run()
+	requestLogs[key] = sink
+	return sink
+}
+
+// Queue a record without blocking
+func (s *requestLogSink) send(record requestRecord) {
+	line, err := json.Marshal(record)
+	if err != nil {
+		log.Error().Err(err).Msg("Encoding request record failed")
+		return
+	}
+	select {
+	case s.records <- line:
+	default:
+		log.Warn().Str("route", record.Route).Msg("Request log buffer full, dropping record")
+	}
+}
+
+func (s *requestLogSink) run() {
+	defer close(s.done)
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	var batch [][]byte
+	for {
+		select {
+		case line := <-s.records:
+			batch = append(batch, line)
+			if len(batch) >= 100 {
+				s.write(context.Background(), batch)
+				batch = batch[:0]
+			}
+		case <-ticker.C:
+			if len(batch) > 0 {
+				s.write(context.Background(), batch)
+				batch = batch[:0]
+			}
+		case ctx := <-s.stop:
+			for len(s.records) > 0 {
+				batch = append(batch, <-s.records)
+			}
+			if len(batch) > 0 {
+				s.write(ctx, batch)
+			}
+			if s.file != nil {
+				s.file.Close()
+			}
+			return
+		}
+	}
+}
+
+func (s *requestLogSink) write(ctx context.Context, batch [][]byte) {
+	var body bytes.Buffer
+	for _, line := range batch {
+		body.Write(line)
+		body.WriteByte('\n')
+	}
+	if s.cfg.URL != "" {
+		s.post(ctx, body.Bytes(), len(batch))
+		return
+	}
+	if err := s.append(body.Bytes()); err != nil {
+		log.Error().Err(err).Str("file", s.cfg.File).Int("records", len(batch)).Msg("Writing request log failed")
+	}
+}
+
+func (s *requestLogSink) post(ctx context.Context, body []byte, records int) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.cfg.URL, bytes.NewReader(body))
+	if err != nil {
+		log.Error().Err(err).Msg("Sending request log failed")
+		return
+	}
+	req.Header.Set("Content-Type", "application/x-ndjson")
+	resp, err := s.client.Do(req)
+	if err != nil {
+		log.Error().Err(err).Str("url", redactURL(s.cfg.URL)).Int("records", records).Msg("Sending request log failed")
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		log.Error().Int("status_code", resp.StatusCode).Str("url", redactURL(s.cfg.URL)).Int("records", records).Msg("Request log endpoint refused records")
+	}
+}
+
+// Append to the file, opening it on first use and rotating it past max_size
+func (s *requestLogSink) append(data []byte) error {
+	if s.file != nil && s.cfg.MaxSize > 0 && s.size+int64(len(data)) > s.cfg.MaxSize && s.size > 0 {
+		s.file.Close()
+		s.file = nil
+		if err := os.Rename(s.cfg.File, s.cfg.File+".1"); err != nil {
+			return err
+		}
+	}
+	if s.file == nil {
+		f, err := os.OpenFile(s.cfg.File, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o600)
+		if err != nil {
+			return err
+		}
+		info, err := f.Stat()
+		if err != nil {
+			f.Close()
+			return err
+		}
+		s.file, s.size = f, info.Size()
+	}
+	n, err := s.file.Write(data)
+	s.size += int64(n)
+	return err
+}
+
+func (s *requestLogSink) close(ctx context.Context) error {
+	select {
+	case s.stop <- ctx:
+	case <-s.done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	select {
+	case <-s.done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Write out what every sink holds; part of the flush_logs shutdown phase
+func closeRequestLogs(ctx context.Context) error {
+	requestLogsMu.Lock()
+	defer requestLogsMu.Unlock()
+	var errs []error
+	for key, sink := range requestLogs {
+		errs = append(errs, sink.close(ctx))
+		delete(requestLogs, key)
+	}
+	return errors.Join(errs...)
+}
+
+// Middleware recording the requests of routes with a request_log, rejected
+// ones included
+func RequestLogMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		route := routeFromContext(c)
+		if route.requestLog == nil {
+			c.Next()
+			return
+		}
+		started := time.Now()
+		c.Next()
+
+		record := requestRecord{
+			Version:    requestRecordVersion,
+			Time:       started.UTC(),
+			Route:      route.Prefix,
+			Method:     c.Request.Method,
+			Path:       c.Request.URL.Path,
+			Query:      c.Request.URL.RawQuery,
+			ClientIP:   c.ClientIP(),
+			Tenant:     c.GetString(tenantKey),
+			TraceID:    traceIDFromContext(c),
+			Status:     c.Writer.Status(),
+			DurationMS: float64(time.Since(started).Microseconds()) / 1000,
+			BytesIn:    max(c.Request.ContentLength, 0),
+			BytesOut:   max(c.Writer.Size(), 0),
+		}
+		if upstream := c.GetString(upstreamKey); upstream != "" {
+			record.Upstream = redactURL(upstream)
+		} else if route.Target != "" {
+			record.Upstream = redactURL(route.Target)
+		}
+		for _, name := range route.RequestLog.Headers {
+			if value := c.GetHeader(name); value != "" {
+				if record.Headers == nil {
+					record.Headers = make(map[string]string, len(route.RequestLog.Headers))
+				}
+				record.Headers[http.CanonicalHeaderKey(name)] = value
+			}
+		}
+		route.requestLog.send(record)
+	}
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// Only routes with a request_log write records, and they all land in its file
+func TestRequestLogOnlyConfiguredRoutes(t *testing.T) {
+	up := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+	defer up.Close()
+	file := filepath.Join(t.TempDir(), "payments.jsonl")
+	_, r := newTestGateway(t, "routes:\n"+
+		"- prefix: /pay\n  target: "+up.URL+"\n  rate_limit: {rate: 1000, burst: 1000}\n"+
+		"  request_log: {file: "+file+", headers: [X-Merchant]}\n"+
+		"- prefix: /other\n  target: "+up.URL+"\n  rate_limit: {rate: 1000, burst: 1000}\n")
+
+	for _, path := range []string{"/pay/charge?id=1", "/other/a", "/pay/refund", "/other/b"} {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		req.Header.Set("X-Merchant", "m-42")
+		req.Header.Set("Authorization", "Bearer secret")
+		if w := serve(r, req); w.Code != http.StatusOK {
+			t.Fatalf("%s: status %d", path, w.Code)
+		}
+	}
+	if err := closeRequestLogs(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := os.Open(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var records []requestRecord
+	for scanner := bufio.NewScanner(f); scanner.Scan(); {
+		var record requestRecord
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			t.Fatalf("bad record %q: %v", scanner.Text(), err)
+		}
+		records = append(records, record)
+	}
+	if len(records) != 2 {
+		t.Fatalf("got %d records, want the 2 for /pay: %+v", len(records), records)
+	}
+	for i, want := range []string{"/charge", "/refund"} {
+		rec := records[i]
+		if rec.Route != "/pay" || rec.Path != "/pay"+want || rec.Status != http.StatusOK || rec.Version != requestRecordVersion {
+			t.Errorf("record %d: %+v", i, rec)
+		}
+		if len(rec.Headers) != 1 || rec.Headers["X-Merchant"] != "m-42" {
+			t.Errorf("record %d headers %v, want only X-Merchant", i, rec.Headers)
+		}
+	}
+	if records[0].Query != "id=1" {
+		t.Errorf("query %q, want id=1", records[0].Query)
+	}
+}
@@ -0,0 +1,260 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"math/rand/v2"
+	"net/http"
+	"net/http/httptrace"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// Retries of failed upstream attempts. Only requests whose body could be
+// buffered are retried, and by default only idempotent methods.
+type RetryConfig struct {
+	// Total attempts including the first; 0 or 1 disables retries
+	Attempts int `yaml:"attempts"`
+	// Upstream statuses worth another attempt; transport errors always are
+	OnStatuses []int `yaml:"on_statuses"`
+	// Methods that may be retried; GET, HEAD, OPTIONS, PUT and DELETE when empty
+	Methods []string `yaml:"methods"`
+	// Requests with larger bodies are sent once
+	MaxBody int64         `yaml:"max_body"`
+	Backoff BackoffConfig `yaml:"backoff"`
+}
+
+// Delay before each retry. Strategies: fixed (always base), exponential
+// (base doubling per retry), full_jitter (uniform in [0, exponential]) and
+// decorrelated_jitter (uniform in [base, 3*previous delay]); all capped at cap.
+type BackoffConfig struct {
+	Strategy string        `yaml:"strategy"`
+	Base     time.Duration `yaml:"base"`
+	Cap      time.Duration `yaml:"cap"`
+}
+
+var idempotentMethods = []string{http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodPut, http.MethodDelete}
+
+func (cfg BackoffConfig) validate() error {
+	switch cfg.Strategy {
+	case "", "fixed", "exponential", "full_jitter", "decorrelated_jitter":
+	default:
+		return fmt.Errorf("unknown backoff strategy %q", cfg.Strategy)
+	}
+	if cfg.Cap > 0 && cfg.Cap < cfg.Base {
+		return fmt.Errorf("backoff cap below base")
+	}
+	return nil
+}
+
+func (cfg RetryConfig) validate() error {
+	if err := cfg.Backoff.validate(); err != nil {
+		return fmt.Errorf("retry: %w", err)
+	}
+	return nil
+}
+
+func (cfg RetryConfig) retryableMethod(method string) bool {
+	methods := cfg.Methods
+	if len(methods) == 0 {
+		methods = idempotentMethods
+	}
+	return slices.ContainsFunc(methods, func(m string) bool { return strings.EqualFold(m, method) })
+}
+
+// Delays for one request's retries
+type backoff struct {
+	cfg BackoffConfig
+	// Uniform in [0, 1); replaced in tests
+	rand func() float64
+	prev time.Duration
+}
+
+func newBackoff(cfg BackoffConfig) *backoff {
+	return &backoff{cfg: cfg, rand: rand.Float64, prev: cfg.Base}
+}
+
+// Delay before retry number n, counting from 0
+func (b *backoff) next(n int) time.Duration {
+	base, limit := float64(b.cfg.Base), float64(b.cfg.Cap)
+	if limit <= 0 {
+		limit = math.MaxInt64
+	}
+	exp := math.Min(limit, base*math.Pow(2, float64(n)))
+
+	var d float64
+	switch b.cfg.Strategy {
+	case "fixed":
+		d = math.Min(limit, base)
+	case "full_jitter":
+		d = b.rand() * exp
+	case "decorrelated_jitter":
+		d = math.Min(limit, base+b.rand()*(3*float64(b.prev)-base))
+	default:
+		d = exp
+	}
+	b.prev = time.Duration(d)
+	return b.prev
+}
+
+// Make the request body replayable, unless it already is. Reports false, leaving the body intact,
+// when it is larger than max.
+func bufferBody(req *http.Request, max int64) bool {
+	if req.GetBody != nil {
+		return true
+	}
+	if req.Body == nil || req.Body == http.NoBody {
+		req.GetBody = func() (io.ReadCloser, error) { return http.NoBody, nil }
+		return true
+	}
+	buf, err := io.ReadAll(io.LimitReader(req.Body, max+1))
+	if err != nil || int64(len(buf)) > max {
+		req.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(buf), req.Body), req.Body}
+		return false
+	}
+	req.Body.Close()
+	req.GetBody = func() (io.ReadCloser, error) { return io.NopCloser(bytes.NewReader(buf)), nil }
+	req.Body, _ = req.GetBody()
+	return true
+}
+
+// Largest body buffered only for the stale connection resend, on routes
+// without retries
+const staleResendMaxBody = 64 << 10
+
+// Whether req's body is absent or sized at most max
+func smallBody(req *http.Request, max int64) bool {
+	return req.Body == nil || req.Body == http.NoBody || (req.ContentLength > 0 && req.ContentLength <= max)
+}
+
+// Whether an attempt's outcome is worth retrying
+func (cfg RetryConfig) shouldRetry(ctx context.Context, resp *http.Response, err error) bool {
+	if ctx.Err() != nil {
+		return false
+	}
+	if err != nil {
+		// A backend that speaks garbage will most likely do so again, and a
+		// deadline too short to connect only gets shorter
+		return !isProtocolError(err) && !errors.Is(err, errConnectDeadline)
+	}
+	return slices.Contains(cfg.OnStatuses, resp.StatusCode)
+}
+
+// Send req upstream, retrying per the route's retry settings. The last
+// attempt's response or error is returned.
+func (route *Route) send(req *http.Request) (*http.Response, error) {
+	cfg := route.Retry
+	attempts := 1
+	if cfg.Attempts > 1 && cfg.retryableMethod(req.Method) && bufferBody(req, cfg.MaxBody) {
+		attempts = cfg.Attempts
+	} else if slices.Contains(idempotentMethods, req.Method) && smallBody(req, min(cfg.MaxBody, staleResendMaxBody)) {
+		// Replayable bodies let a request lost to a stale connection be
+		// resent. Only bodies known to be small are held for it: buffering
+		// would end streaming uploads, which go without the resend.
+		bufferBody(req, cfg.MaxBody)
+	}
+
+	ctx := req.Context()
+	delays := newBackoff(cfg.Backoff)
+	for attempt := 1; ; attempt++ {
+		var (
+			resp *http.Response
+			err  error
+		)
+		if left := route.cooldowns.remaining(req.URL); left > 0 {
+			err = &cooldownError{remaining: left}
+		} else {
+			resp, err = route.do(req)
+		}
+		retry := cfg.shouldRetry(ctx, resp, err)
+		// Resending only makes sense to another pool member
+		if (route.cooldowns.observe(req.URL, resp) || errors.As(err, new(*cooldownError))) && route.balancer == nil {
+			retry = false
+		}
+		if attempt >= attempts || !retry {
+			if attempts > 1 {
+				route.observeRetries(attempt, err == nil && !retry, retry)
+			}
+			return resp, err
+		}
+		if resp != nil {
+			io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+			resp.Body.Close()
+		}
+
+		delay := delays.next(attempt - 1)
+		log.Warn().Err(err).Str("route", route.Prefix).Int("attempt", attempt).Dur("backoff", delay).Msg("Retrying upstream request")
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			route.observeRetries(attempt, false, false)
+			return nil, ctx.Err()
+		}
+		if req.Body, err = req.GetBody(); err != nil {
+			return nil, err
+		}
+		route.rotateUpstream(req)
+	}
+}
+
+// Record the retry metrics of a request allowed retries that took attempts
+// tries: succeeded when a retry got the answer, exhausted when the last one
+// still failed
+func (route *Route) observeRetries(attempts int, succeeded, exhausted bool) {
+	retryAttempts.WithLabelValues(route.Prefix).Observe(float64(attempts))
+	switch {
+	case succeeded && attempts > 1:
+		retrySuccesses.WithLabelValues(route.Prefix).Inc()
+	case exhausted:
+		retryExhausted.WithLabelValues(route.Prefix).Inc()
+	}
+}
+
+// Whether err is what a kept-alive connection the upstream closed while idle
+// looks like to the request that was sent on it
+func isStaleConnError(err error) bool {
+	return errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.Is(err, syscall.ECONNRESET) || errors.Is(err, syscall.EPIPE) ||
+		strings.Contains(err.Error(), "server closed idle connection")
+}
+
+// Send one attempt. An idempotent request that failed on a reused connection
+// the upstream had already closed is sent once more right away, on a fresh
+// connection; the transport only does this for some of these failures.
+func (route *Route) do(req *http.Request) (*http.Response, error) {
+	var reused atomic.Bool
+	traced := req.WithContext(httptrace.WithClientTrace(req.Context(), &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) { reused.Store(info.Reused) },
+	}))
+	resp, err := route.httpClient().Do(traced)
+	if err == nil || !reused.Load() || !isStaleConnError(err) || traced.Context().Err() != nil ||
+		!slices.Contains(idempotentMethods, req.Method) {
+		return resp, err
+	}
+
+	if req.Body != nil && req.Body != http.NoBody {
+		if req.GetBody == nil {
+			// Already consumed and can't be replayed
+			return resp, err
+		}
+		body, bodyErr := req.GetBody()
+		if bodyErr != nil {
+			return resp, err
+		}
+		traced.Body = body
+	}
+	log.Warn().Err(err).Str("route", route.Prefix).Msg("Upstream closed idle connection, resending request")
+	return route.httpClient().Do(traced)
+}
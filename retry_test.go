@@ -0,0 +1,212 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"math"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestBackoffStrategies(t *testing.T) {
+	base, limit := 100*time.Millisecond, time.Second
+	for _, tc := range []struct {
+		strategy string
+		rand     float64
+		want     []time.Duration
+	}{
+		{"fixed", 0.5, []time.Duration{100 * time.Millisecond, 100 * time.Millisecond, 100 * time.Millisecond}},
+		{"exponential", 0.5, []time.Duration{100 * time.Millisecond, 200 * time.Millisecond, 400 * time.Millisecond, 800 * time.Millisecond, time.Second}},
+		{"full_jitter", 0.5, []time.Duration{50 * time.Millisecond, 100 * time.Millisecond, 200 * time.Millisecond, 400 * time.Millisecond, 500 * time.Millisecond}},
+		{"full_jitter", 0, []time.Duration{0, 0}},
+		// base + r*(3*previous - base), starting from previous = base
+		{"decorrelated_jitter", 0.5, []time.Duration{200 * time.Millisecond, 350 * time.Millisecond, 575 * time.Millisecond, 912500 * time.Microsecond, time.Second}},
+		{"decorrelated_jitter", 0, []time.Duration{100 * time.Millisecond, 100 * time.Millisecond}},
+	} {
+		b := newBackoff(BackoffConfig{Strategy: tc.strategy, Base: base, Cap: limit})
+		b.rand = func() float64 { return tc.rand }
+		for n, want := range tc.want {
+			if got := b.next(n); got != want {
+				t.Errorf("%s with rand %v: retry %d waits %v, want %v", tc.strategy, tc.rand, n, got, want)
+			}
+		}
+	}
+}
+
+// Delays drawn with real randomness stay within each strategy's range, and
+// spread over it rather than clustering
+func TestBackoffJitterDistribution(t *testing.T) {
+	const samples = 10000
+	base, limit := 100*time.Millisecond, 10*time.Second
+
+	// full_jitter: uniform in [0, base*2^n)
+	full := newBackoff(BackoffConfig{Strategy: "full_jitter", Base: base, Cap: limit})
+	var sum float64
+	for range samples {
+		d := full.next(3)
+		if d < 0 || d >= 800*time.Millisecond {
+			t.Fatalf("full_jitter delay %v outside [0, 800ms)", d)
+		}
+		sum += float64(d)
+	}
+	if mean := time.Duration(sum / samples); math.Abs(float64(mean-400*time.Millisecond)) > float64(20*time.Millisecond) {
+		t.Errorf("full_jitter mean %v, want about 400ms", mean)
+	}
+
+	// decorrelated_jitter: uniform in [base, 3*previous), capped
+	decorrelated := newBackoff(BackoffConfig{Strategy: "decorrelated_jitter", Base: base, Cap: limit})
+	below := 0
+	for n := range samples {
+		prev := decorrelated.prev
+		d := decorrelated.next(n)
+		if d < base || d > min(limit, 3*prev) {
+			t.Fatalf("decorrelated_jitter delay %v after %v outside [%v, %v]", d, prev, base, min(limit, 3*prev))
+		}
+		if d < prev {
+			below++
+		}
+	}
+	// Unlike exponential backoff it also moves back down
+	if below == 0 {
+		t.Error("decorrelated_jitter delays never decreased")
+	}
+}
+
+// An upstream that closes a kept-alive connection as the next request is sent
+// on it: the request is resent on a fresh connection and the client never
+// notices, body included
+func TestIdleClosedUpstreamConnection(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	var conns atomic.Int64
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			n := conns.Add(1)
+			go func() {
+				defer conn.Close()
+				br := bufio.NewReader(conn)
+				for i := 0; ; i++ {
+					req, err := http.ReadRequest(br)
+					if err != nil {
+						return
+					}
+					body, _ := io.ReadAll(req.Body)
+					if n == 1 && i == 1 {
+						// Gone idle on our side: the second request is dropped unanswered
+						return
+					}
+					resp := http.Response{StatusCode: http.StatusOK, ProtoMajor: 1, ProtoMinor: 1,
+						ContentLength: int64(len(body)), Body: io.NopCloser(bytes.NewReader(body))}
+					resp.Write(conn)
+				}
+			}()
+		}
+	}()
+	_, r := newTestGateway(t, "routes:\n- prefix: /i\n  target: http://"+ln.Addr().String()+"\n  rate_limit: {rate: 1000, burst: 1000}\n")
+
+	for _, body := range []string{"first", "second"} {
+		w := serve(r, httptest.NewRequest(http.MethodPut, "/i/", strings.NewReader(body)))
+		if w.Code != http.StatusOK || w.Body.String() != body {
+			t.Fatalf("%s request: %d %q, want 200 %q", body, w.Code, w.Body, body)
+		}
+	}
+	if conns.Load() != 2 {
+		t.Errorf("%d upstream connections, want the second request resent on a new one", conns.Load())
+	}
+}
+
+// A request answered on its second attempt is observed with 2 attempts and
+// counted as a retry success; one failing every attempt as exhausted
+func TestRetryMetrics(t *testing.T) {
+	var calls atomic.Int32
+	up := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/down" || calls.Add(1) == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer up.Close()
+	_, r := newTestGateway(t, "routes:\n- prefix: /rm\n  target: "+up.URL+"\n  rate_limit: {rate: 1000, burst: 1000}\n"+
+		"  retry: {attempts: 3, on_statuses: [503], backoff: {strategy: fixed, base: 1ms}}\n")
+	attempts := retryAttempts.WithLabelValues("/rm")
+	successes, exhausted := retrySuccesses.WithLabelValues("/rm"), retryExhausted.WithLabelValues("/rm")
+	buckets := histogramBuckets(t, attempts)
+
+	if w := serve(r, httptest.NewRequest(http.MethodGet, "/rm/", nil)); w.Code != http.StatusOK {
+		t.Fatalf("status %d, want the second attempt's 200", w.Code)
+	}
+	if got := counterValue(t, successes); got != 1 {
+		t.Errorf("retry successes %v, want 1", got)
+	}
+	if got := counterValue(t, exhausted); got != 0 {
+		t.Errorf("retries exhausted %v, want 0", got)
+	}
+	after := histogramBuckets(t, attempts)
+	if after[1]-buckets[1] != 0 || after[2]-buckets[2] != 1 {
+		t.Errorf("attempts observed: le=1 +%d, le=2 +%d, want one request at 2", after[1]-buckets[1], after[2]-buckets[2])
+	}
+
+	if w := serve(r, httptest.NewRequest(http.MethodGet, "/rm/down", nil)); w.Code != http.StatusServiceUnavailable {
+		t.Fatalf("status %d, want the last attempt's 503", w.Code)
+	}
+	if got := counterValue(t, exhausted); got != 1 {
+		t.Errorf("retries exhausted %v, want 1", got)
+	}
+	if got := counterValue(t, successes); got != 1 {
+		t.Errorf("retry successes %v after a failed request, want still 1", got)
+	}
+	if final := histogramBuckets(t, attempts); final[2]-after[2] != 0 || final[3]-after[3] != 1 {
+		t.Errorf("exhausted request not observed with 3 attempts")
+	}
+}
+
+// Without retries, a PUT body that isn't known to be small streams to the
+// upstream as it arrives instead of being buffered for the stale connection
+// resend
+func TestUnsizedBodyStreamsWithoutRetries(t *testing.T) {
+	got := make(chan string)
+	up := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		buf := make([]byte, 5)
+		io.ReadFull(r.Body, buf)
+		got <- string(buf)
+		io.Copy(io.Discard, r.Body)
+	}))
+	defer up.Close()
+	_, r := newTestGateway(t, "routes:\n- prefix: /s\n  target: "+up.URL+"\n  rate_limit: {rate: 1000, burst: 1000}\n")
+
+	for name, length := range map[string]int64{"unsized": -1, "large": 1 << 20} {
+		pr, pw := io.Pipe()
+		req := httptest.NewRequest(http.MethodPut, "/s/", pr)
+		req.ContentLength = length
+		done := make(chan *httptest.ResponseRecorder)
+		go func() { done <- serve(r, req) }()
+		pw.Write([]byte("part1"))
+		select {
+		case first := <-got:
+			if first != "part1" {
+				t.Errorf("%s: upstream read %q first", name, first)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%s: upstream saw nothing while the client was still sending", name)
+		}
+		if length > 0 {
+			pw.Write(make([]byte, length-5))
+		}
+		pw.Close()
+		if w := <-done; w.Code != http.StatusOK {
+			t.Errorf("%s: status %d", name, w.Code)
+		}
+	}
+}
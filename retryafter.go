@@ -0,0 +1,130 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Cooldowns upstreams ask for with a 503 and a Retry-After header. Honored,
+// the gateway sends nothing to such an upstream until the time it gave is
+// up, answering 503 with the remaining Retry-After itself; pool members and
+// fallbacks not cooling down still take the requests.
+type RetryAfterConfig struct {
+	Honor bool `yaml:"honor"`
+	// Longest cooldown taken from an upstream, 1m by default
+	Max time.Duration `yaml:"max"`
+}
+
+func (cfg RetryAfterConfig) validate() error {
+	if cfg.Max < 0 {
+		return fmt.Errorf("retry_after: max can't be negative")
+	}
+	return nil
+}
+
+// The request wasn't sent, the upstream asked to be left alone for remaining
+type cooldownError struct {
+	remaining time.Duration
+}
+
+func (e *cooldownError) Error() string {
+	return "upstream asked to retry later"
+}
+
+// Parse a Retry-After value: delay seconds or an HTTP date
+func parseRetryAfter(value string, now time.Time) (time.Duration, bool) {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return 0, false
+	}
+	if seconds, err := strconv.Atoi(value); err == nil {
+		return time.Duration(max(seconds, 0)) * time.Second, true
+	}
+	if at, err := http.ParseTime(value); err == nil {
+		return max(at.Sub(now), 0), true
+	}
+	return 0, false
+}
+
+// Retry-After value for d, in whole seconds rounded up
+func retryAfterValue(d time.Duration) string {
+	return strconv.Itoa(int(math.Ceil(d.Seconds())))
+}
+
+// Upstreams of a route cooling down, by scheme and host
+type upstreamCooldowns struct {
+	max   time.Duration
+	mu    sync.Mutex
+	until map[string]time.Time
+}
+
+// Cooldowns for cfg, nil unless honored
+func newUpstreamCooldowns(cfg RetryAfterConfig) *upstreamCooldowns {
+	if !cfg.Honor {
+		return nil
+	}
+	if cfg.Max <= 0 {
+		cfg.Max = time.Minute
+	}
+	return &upstreamCooldowns{max: cfg.Max, until: make(map[string]time.Time)}
+}
+
+func cooldownKey(u *url.URL) string {
+	return u.Scheme + "://" + canonicalHost(u.Host)
+}
+
+// How long the upstream of u is still cooling down
+func (cd *upstreamCooldowns) remaining(u *url.URL) time.Duration {
+	if cd == nil {
+		return 0
+	}
+	cd.mu.Lock()
+	defer cd.mu.Unlock()
+	key := cooldownKey(u)
+	left := time.Until(cd.until[key])
+	if left <= 0 {
+		delete(cd.until, key)
+		return 0
+	}
+	return left
+}
+
+// Start the cooldown resp asks for; reports whether it asked for one
+func (cd *upstreamCooldowns) observe(u *url.URL, resp *http.Response) bool {
+	if cd == nil || resp == nil || resp.StatusCode != http.StatusServiceUnavailable {
+		return false
+	}
+	now := time.Now()
+	d, ok := parseRetryAfter(resp.Header.Get("Retry-After"), now)
+	if !ok || d <= 0 {
+		return false
+	}
+	until := now.Add(min(d, cd.max))
+	cd.mu.Lock()
+	defer cd.mu.Unlock()
+	if key := cooldownKey(u); until.After(cd.until[key]) {
+		cd.until[key] = until
+	}
+	return true
+}
+
+// When the client may try again after an upstream call that failed with
+// resp or err, 0 when it didn't say
+func retryAfterOf(resp *http.Response, err error) time.Duration {
+	var cooldown *cooldownError
+	if errors.As(err, &cooldown) {
+		return cooldown.remaining
+	}
+	if resp != nil && resp.StatusCode == http.StatusServiceUnavailable {
+		d, _ := parseRetryAfter(resp.Header.Get("Retry-After"), time.Now())
+		return d
+	}
+	return 0
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// The upstream's Retry-After reaches the client either way; honored, the
+// gateway also holds requests back until the cooldown is over
+func TestRetryAfter(t *testing.T) {
+	var hits atomic.Int32
+	up := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if hits.Add(1) == 1 {
+			w.Header().Set("Retry-After", "1")
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte("ok"))
+	}))
+	defer up.Close()
+
+	for _, tc := range []struct {
+		name   string
+		honor  bool
+		second int
+	}{
+		{"passed through", false, http.StatusOK},
+		{"honored", true, http.StatusServiceUnavailable},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			hits.Store(0)
+			config := "routes:\n- prefix: /api\n  target: " + up.URL + "\n  rate_limit: {rate: 1000, burst: 1000}\n"
+			if tc.honor {
+				config += "  retry_after: {honor: true}\n"
+			}
+			_, r := newTestGateway(t, config)
+
+			w := serve(r, httptest.NewRequest(http.MethodGet, "/api/", nil))
+			if w.Code != http.StatusServiceUnavailable || w.Header().Get("Retry-After") != "1" {
+				t.Fatalf("first: status %d, Retry-After %q, want 503 with the upstream's 1", w.Code, w.Header().Get("Retry-After"))
+			}
+
+			w = serve(r, httptest.NewRequest(http.MethodGet, "/api/", nil))
+			if w.Code != tc.second {
+				t.Fatalf("second: status %d, want %d", w.Code, tc.second)
+			}
+			if !tc.honor {
+				if hits.Load() != 2 {
+					t.Errorf("upstream hit %d times, want 2", hits.Load())
+				}
+				return
+			}
+			if hits.Load() != 1 || w.Header().Get("Retry-After") != "1" {
+				t.Errorf("during cooldown: upstream hit %d times, Retry-After %q, want 1 hit and 1", hits.Load(), w.Header().Get("Retry-After"))
+			}
+
+			time.Sleep(1100 * time.Millisecond)
+			if w := serve(r, httptest.NewRequest(http.MethodGet, "/api/", nil)); w.Code != http.StatusOK || hits.Load() != 2 {
+				t.Errorf("after cooldown: status %d, upstream hit %d times, want 200 and 2", w.Code, hits.Load())
+			}
+		})
+	}
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	for _, tc := range []struct {
+		value string
+		want  time.Duration
+		ok    bool
+	}{
+		{"120", 2 * time.Minute, true},
+		{" 5 ", 5 * time.Second, true},
+		{"-3", 0, true},
+		{now.Add(30 * time.Second).Format(http.TimeFormat), 30 * time.Second, true},
+		{now.Add(-time.Hour).Format(http.TimeFormat), 0, true},
+		{"", 0, false},
+		{"soon", 0, false},
+	} {
+		if got, ok := parseRetryAfter(tc.value, now); got != tc.want || ok != tc.ok {
+			t.Errorf("parseRetryAfter(%q) = %s, %v, want %s, %v", tc.value, got, ok, tc.want, tc.ok)
+		}
+	}
+}
@@ -0,0 +1,236 @@
+package main
+
+import (
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/sony/gobreaker/v2"
+)
+
+// Runtime state of a configured route
+type Route struct {
+	RouteConfig
+
+	breaker *gobreaker.CircuitBreaker[any]
+	// Follows breaker's closing, nil without recovery_ramp
+	ramp    *recoveryRamp
+	limiter *routeLimiter
+	// rate_limits, checked together with limiter
+	limiters []*routeLimiter
+	// Built on first use so configured but idle routes hold no connection pool
+	clientOnce     sync.Once
+	client         atomic.Pointer[http.Client]
+	extAuthz       *extAuthzClient
+	bulkhead       *bulkhead
+	cache          *responseCache
+	dedup          *dedup
+	mirror         *mirror
+	faults         *faultInjector
+	latency        *latencyInjector
+	abTest         *abTest
+	schedule       *schedule
+	fallback       *upstreamChain
+	balancer       *balancer
+	upstreamTokens *tokenSource
+	wasm           *wasmPlugin
+	pathParams     *pathPattern
+	requestLog     *requestLogSink
+	cooldowns      *upstreamCooldowns
+	modifyResponse []responseModifier
+
+	// Requests currently being served
+	inflight atomic.Int64
+	// Upstream requests waiting for a pooled or new connection
+	connWaiting atomic.Int64
+}
+
+func newRoute(rc RouteConfig) *Route {
+	route := &Route{
+		RouteConfig: rc,
+		ramp:        newRecoveryRamp(rc.CircuitBreaker),
+		limiter:     newRouteLimiter(rc.RateLimit),
+		cooldowns:   newUpstreamCooldowns(rc.RetryAfter),
+	}
+	route.breaker = newBreaker(rc.Prefix, rc.CircuitBreaker, route.ramp)
+	for _, cfg := range rc.RateLimits {
+		route.limiters = append(route.limiters, newRouteLimiter(cfg))
+	}
+
+	if rc.ExtAuthz.URL != "" {
+		route.extAuthz = newExtAuthzClient(rc.ExtAuthz)
+	}
+
+	if rc.Bulkhead.MaxConcurrent > 0 {
+		route.bulkhead = newBulkhead(rc.Bulkhead)
+	}
+
+	if rc.Cache.TTL > 0 {
+		route.cache = newResponseCache(rc.Cache)
+	}
+
+	if rc.Dedup.Window > 0 {
+		route.dedup = newDedup(rc.Dedup)
+	}
+
+	if rc.RequestLog.configured() {
+		route.requestLog = requestLogSinkFor(rc.RequestLog)
+	}
+
+	if len(rc.Schedule) > 0 {
+		// Validated with the config
+		route.schedule, _ = newSchedule(rc.Schedule)
+	}
+
+	if rc.UpstreamAuth.TokenURL != "" {
+		route.upstreamTokens = newTokenSource(rc.UpstreamAuth)
+	}
+
+	if rc.PathParams.Pattern != "" {
+		route.pathParams = newPathPattern(rc.PathParams)
+	}
+
+	if len(rc.Pool) > 0 {
+		route.balancer = newBalancer(rc)
+	}
+
+	if len(rc.Fallback) > 0 {
+		route.fallback = newUpstreamChain(rc)
+	}
+
+	if len(rc.ABTest.Variants) > 0 {
+		route.abTest = newABTest(rc.ABTest)
+	}
+
+	if rc.Fault.configured() {
+		route.faults = newFaultInjector(rc.Fault)
+	}
+
+	if rc.Mirror.Target != "" {
+		route.mirror = newMirror(rc.Mirror)
+	}
+
+	if rc.Latency.configured() {
+		route.latency = newLatencyInjector(rc.Latency)
+		route.modifyResponse = append(route.modifyResponse, route.latency.modifier())
+	}
+
+	// Ahead of the checks and transformations, so they see the type the client gets
+	if rc.ContentTypes.Default != "" {
+		route.modifyResponse = append(route.modifyResponse, contentTypeDefaulter(rc.ContentTypes.Default))
+	}
+
+	// Ahead of the transformations, so the upstream's own answer is judged
+	if len(rc.ContentTypes.Response) > 0 {
+		route.modifyResponse = append(route.modifyResponse, contentTypeChecker(rc.Prefix, rc.ContentTypes.Response))
+	}
+
+	if rc.Decompression.Enabled {
+		route.modifyResponse = append(route.modifyResponse, decompressor(rc.Decompression))
+	}
+
+	// Before normalization, so normalized bodies carry the status the client gets
+	if len(rc.StatusMap) > 0 {
+		route.modifyResponse = append(route.modifyResponse, statusRemapper(rc.StatusMap))
+	}
+
+	if rc.ErrorNormalization.Enabled {
+		route.modifyResponse = append(route.modifyResponse, errorNormalizer(rc.ErrorNormalization))
+	}
+
+	// Before formatting, so the links come out formatted like the rest
+	if len(rc.Links) > 0 {
+		route.modifyResponse = append(route.modifyResponse, linkInjector(rc.Prefix, rc.Links))
+	}
+
+	if rc.JSONFormat.Response != "" {
+		route.modifyResponse = append(route.modifyResponse, jsonFormatter(rc.JSONFormat.Response))
+	}
+
+	if rc.WASM.Module != "" {
+		// Validated, and compiled, with the config
+		route.wasm, _ = loadWASMPlugin(rc.WASM)
+		if route.wasm.onResponse {
+			route.modifyResponse = append(route.modifyResponse, route.wasm.modifier())
+		}
+	}
+
+	// Last, so the digest covers the body exactly as the client receives it
+	if rc.ContentDigest {
+		route.modifyResponse = append(route.modifyResponse, contentDigester())
+	}
+	return route
+}
+
+// Upstream client of the route, created on first use
+func (route *Route) httpClient() *http.Client {
+	route.clientOnce.Do(func() {
+		route.client.Store(&http.Client{
+			Timeout:       route.clientTimeout(),
+			Transport:     newTransport(route.RouteConfig),
+			CheckRedirect: checkRedirect(route.RouteConfig),
+		})
+	})
+	return route.client.Load()
+}
+
+// Overall limit of the upstream client; with size_timeout or long_poll each
+// request's own deadline enforces the route's timeout and the client only the ceiling
+func (route *Route) clientTimeout() time.Duration {
+	if route.SizeTimeout.PerKB > 0 {
+		return route.SizeTimeout.Max
+	}
+	if route.LongPoll.configured() {
+		return max(route.Timeout, route.LongPoll.limit())
+	}
+	return route.Timeout
+}
+
+// Drop idle upstream connections, if the client was ever used
+func (route *Route) closeIdleConnections() {
+	if client := route.client.Load(); client != nil {
+		client.CloseIdleConnections()
+	}
+}
+
+// Handler chain shared by all proxied routes. Everything after RouteMiddleware
+// reads the matched route from the context and skips features it doesn't enable.
+func proxyHandlers(cfg *Config, g *Gateway) []gin.HandlerFunc {
+	return []gin.HandlerFunc{
+		LoopDetectionMiddleware(cfg.MaxHops),
+		RouteMiddleware(g),
+		// First, so requests rejected by any later middleware are counted
+		MetricsMiddleware(newTenantResolver(cfg.Tenant)),
+		UnexpectedBodyMiddleware(),
+		TracingMiddleware(cfg.Tracing),
+		DebugUpstreamMiddleware(cfg.DebugUpstream, cfg.Admin.Auth),
+		TLSPolicyMiddleware(),
+		ScheduleMiddleware(),
+		QueryRoutingMiddleware(),
+		GatewayHeadersMiddleware(cfg.GatewayHeaders),
+		RequestLogMiddleware(),
+		FaultMiddleware(),
+		RateLimterMiddleware(),
+		ExtAuthzMiddleware(),
+		ABTestMiddleware(),
+		FeatureFlagsMiddleware(cfg.FeatureFlags),
+		ContentTypeMiddleware(),
+		CacheMiddleware(),
+		RequestDecompressionMiddleware(),
+		DedupMiddleware(),
+		BulkheadMiddleware(),
+		PathNormalizationMiddleware(),
+		GeoIPMiddleware(),
+		CookieHeadersMiddleware(),
+		WASMMiddleware(),
+		HeaderLimitMiddleware(),
+		JSONFormatMiddleware(),
+		TimestampMiddleware(),
+		MirrorMiddleware(),
+		func(c *gin.Context) {
+			proxyRequest(c, routeFromContext(c))
+		},
+	}
+}
@@ -0,0 +1,259 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"path"
+	"slices"
+	"sort"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/rs/zerolog/log"
+)
+
+// Context key holding the *Route matched for the request
+const routeKey = "route"
+
+// Context key holding the *gatewayState the request was routed with
+const stateKey = "gateway_state"
+
+// Prefix-matched route set. The most specific (longest) prefix wins and
+// matching only happens on path segment boundaries. Among routes of the same
+// prefix, one limited to the request's host wins over one without hosts.
+type routeTable struct {
+	// Most specific first
+	routes []*Route
+	root   *routeNode
+}
+
+// Segment trie over route prefixes; matching walks the request path once,
+// so its cost depends on the path depth rather than the number of routes
+type routeNode struct {
+	children map[string]*routeNode
+	// Routes of the prefix, for different hosts
+	routes []*Route
+}
+
+// Identity of a route across reloads: its prefix, preceded by its hosts when
+// it is limited to some
+func (rc RouteConfig) id() string {
+	if len(rc.Hosts) == 0 {
+		return rc.Prefix
+	}
+	hosts := make([]string, len(rc.Hosts))
+	for i, host := range rc.Hosts {
+		hosts[i] = canonicalHost(host)
+	}
+	slices.Sort(hosts)
+	return strings.Join(hosts, ",") + rc.Prefix
+}
+
+func validateRouteHosts(hosts []string) error {
+	for _, host := range hosts {
+		if host == "" || strings.ContainsAny(host, "/ ") {
+			return fmt.Errorf("hosts: invalid host %q", host)
+		}
+	}
+	return nil
+}
+
+// Whether two routes of the same prefix claim the same hosts: both none, or
+// a common entry
+func hostsOverlap(a, b *Route) bool {
+	if len(a.Hosts) == 0 || len(b.Hosts) == 0 {
+		return len(a.Hosts) == len(b.Hosts)
+	}
+	return slices.ContainsFunc(a.Hosts, func(host string) bool {
+		return slices.ContainsFunc(b.Hosts, func(other string) bool { return canonicalHost(host) == canonicalHost(other) })
+	})
+}
+
+// Whether one of hosts matches host, and whether by name rather than by a
+// *.domain wildcard
+func hostMatch(hosts []string, host string) (matched, exact bool) {
+	for _, entry := range hosts {
+		if hostAllowed([]string{entry}, host) {
+			if !strings.HasPrefix(entry, "*.") {
+				return true, true
+			}
+			matched = true
+		}
+	}
+	return matched, false
+}
+
+// Append the node's routes matching host. Matches are tried from the end, so
+// routes without hosts go first, then those matching by wildcard, then by name.
+func (n *routeNode) appendMatches(matched []*Route, host string) []*Route {
+	for _, route := range n.routes {
+		if len(route.Hosts) == 0 {
+			matched = append(matched, route)
+		}
+	}
+	for _, wantExact := range []bool{false, true} {
+		for _, route := range n.routes {
+			if ok, exact := hostMatch(route.Hosts, host); ok && exact == wantExact {
+				matched = append(matched, route)
+			}
+		}
+	}
+	return matched
+}
+
+func normalizePrefix(prefix string) string {
+	return "/" + strings.Trim(prefix, "/")
+}
+
+// Path segments of a normalized prefix; none for "/"
+func prefixSegments(prefix string) []string {
+	if prefix == "/" {
+		return nil
+	}
+	return strings.Split(prefix[1:], "/")
+}
+
+func newRouteTable(routes []*Route) (*routeTable, error) {
+	root := &routeNode{}
+	for i, route := range routes {
+		node := root
+		for _, segment := range prefixSegments(route.Prefix) {
+			child, ok := node.children[segment]
+			if !ok {
+				if node.children == nil {
+					node.children = make(map[string]*routeNode)
+				}
+				child = &routeNode{}
+				node.children[segment] = child
+			}
+			node = child
+		}
+		for _, other := range node.routes {
+			if hostsOverlap(other, route) {
+				j := slices.Index(routes, other)
+				return nil, fmt.Errorf("duplicate route prefix %q (routes %d and %d)", route.Prefix, j+1, i+1)
+			}
+		}
+		node.routes = append(node.routes, route)
+	}
+
+	for _, route := range routes {
+		node := root
+		var parent *Route
+		for _, segment := range prefixSegments(route.Prefix) {
+			if len(node.routes) > 0 {
+				parent = node.routes[0]
+			}
+			node = node.children[segment]
+		}
+		if parent != nil {
+			log.Info().Str("route", route.Prefix).Str("parent", parent.Prefix).Msg("Route takes precedence over overlapping prefix")
+		}
+	}
+
+	sorted := make([]*Route, len(routes))
+	copy(sorted, routes)
+	// Stable so equally long prefixes keep their config order
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return len(sorted[i].Prefix) > len(sorted[j].Prefix)
+	})
+	return &routeTable{routes: sorted, root: root}, nil
+}
+
+// Find the route for a request to host and path, and the remainder
+// forwarded upstream. A route excluding the path is passed over for the next
+// less specific one.
+func (t *routeTable) match(host, path string) (*Route, string) {
+	node := t.root
+	// Routes whose prefix covers path, least specific first
+	var buf [8]*Route
+	matched := node.appendMatches(buf[:0], host)
+	for rest := strings.TrimPrefix(path, "/"); node.children != nil; {
+		segment, next, more := strings.Cut(rest, "/")
+		child, ok := node.children[segment]
+		if !ok {
+			break
+		}
+		node = child
+		matched = node.appendMatches(matched, host)
+		if !more {
+			break
+		}
+		rest = next
+	}
+
+	for i := len(matched) - 1; i >= 0; i-- {
+		route := matched[i]
+		switch {
+		case route.excludes(path):
+			continue
+		case route.Prefix == "/":
+			return route, path
+		}
+		return route, path[len(route.Prefix):]
+	}
+	return nil, ""
+}
+
+// Whether one of the route's exclude patterns matches path or one of its
+// parent paths, so /api/internal/* excludes everything below /api/internal
+func (route *Route) excludes(reqPath string) bool {
+	if len(route.Exclude) == 0 {
+		return false
+	}
+	for end := 1; end <= len(reqPath); end++ {
+		if end < len(reqPath) && reqPath[end] != '/' {
+			continue
+		}
+		for _, pattern := range route.Exclude {
+			if ok, _ := path.Match(pattern, reqPath[:end]); ok {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Check exclude patterns: absolute paths in path.Match syntax
+func validateExclude(patterns []string) error {
+	for _, pattern := range patterns {
+		if _, err := path.Match(pattern, ""); err != nil || !strings.HasPrefix(pattern, "/") {
+			return fmt.Errorf("exclude: invalid pattern %q", pattern)
+		}
+	}
+	return nil
+}
+
+// Middleware resolving the route for the request and exposing the forwarded path as "rest"
+func RouteMiddleware(g *Gateway) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		// Loaded once: the route and everything else a reload swaps stay fixed
+		// for the request even if a reload happens while it is served
+		state := g.state.Load()
+		route, rest := state.table.match(c.Request.Host, c.Request.URL.Path)
+		if route == nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Not found"})
+			c.Abort()
+			return
+		}
+		if !route.Enabled {
+			c.JSON(route.DisabledStatus, gin.H{"error": "Route disabled"})
+			c.Abort()
+			return
+		}
+		c.Set(routeKey, route)
+		c.Set(stateKey, state)
+		setParam(c, "rest", rest)
+		c.Next()
+	}
+}
+
+func routeFromContext(c *gin.Context) *Route {
+	route, _ := c.Get(routeKey)
+	return route.(*Route)
+}
+
+func stateFromContext(c *gin.Context) *gatewayState {
+	state, _ := c.Get(stateKey)
+	return state.(*gatewayState)
+}
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// Table of 1000 routes: /svc-N for 100 services, each with nine versioned
+// children /svc-N/vM
+func thousandRoutes(t testing.TB) *routeTable {
+	t.Helper()
+	routes := make([]*Route, 0, 1000)
+	for svc := range 100 {
+		routes = append(routes, &Route{RouteConfig: RouteConfig{Prefix: fmt.Sprintf("/svc-%d", svc)}})
+		for v := 1; v <= 9; v++ {
+			routes = append(routes, &Route{RouteConfig: RouteConfig{Prefix: fmt.Sprintf("/svc-%d/v%d", svc, v)}})
+		}
+	}
+	table, err := newRouteTable(routes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return table
+}
+
+func TestRouteMatch1000(t *testing.T) {
+	table := thousandRoutes(t)
+	for _, tc := range []struct{ path, prefix, rest string }{
+		{"/svc-42/v7/orders/1", "/svc-42/v7", "/orders/1"},
+		{"/svc-42/v10/orders", "/svc-42", "/v10/orders"},
+		{"/svc-99", "/svc-99", ""},
+		{"/svc-420/v1", "", ""},
+	} {
+		route, rest := table.match("", tc.path)
+		prefix := ""
+		if route != nil {
+			prefix = route.Prefix
+		}
+		if prefix != tc.prefix || rest != tc.rest {
+			t.Errorf("%s: matched %q with rest %q, want %q with %q", tc.path, prefix, rest, tc.prefix, tc.rest)
+		}
+	}
+}
+
+func TestRouteOverlapPrecedence(t *testing.T) {
+	var routes []*Route
+	for _, prefix := range []string{"/", "/api", "/api/v1", "/api/v1/admin"} {
+		routes = append(routes, &Route{RouteConfig: RouteConfig{Prefix: prefix}})
+	}
+	table, err := newRouteTable(routes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct{ path, prefix, rest string }{
+		{"/api/v1/admin/users", "/api/v1/admin", "/users"},
+		{"/api/v1/users", "/api/v1", "/users"},
+		{"/api/v2", "/api", "/v2"},
+		{"/api", "/api", ""},
+		// Prefixes match whole segments only
+		{"/apiv1", "/", "/apiv1"},
+		{"/api/v1admin", "/api", "/v1admin"},
+		{"/other", "/", "/other"},
+	} {
+		route, rest := table.match("", tc.path)
+		if route == nil || route.Prefix != tc.prefix || rest != tc.rest {
+			t.Errorf("%s: matched %v with rest %q, want %q with %q", tc.path, route, rest, tc.prefix, tc.rest)
+		}
+	}
+}
+
+func TestRouteDuplicatePrefixRejected(t *testing.T) {
+	routes := []*Route{
+		{RouteConfig: RouteConfig{Prefix: normalizePrefix("/api/")}},
+		{RouteConfig: RouteConfig{Prefix: normalizePrefix("/users")}},
+		{RouteConfig: RouteConfig{Prefix: normalizePrefix("api")}},
+	}
+	if _, err := newRouteTable(routes); err == nil {
+		t.Fatal("duplicate prefixes /api/ and api accepted")
+	}
+}
+
+func BenchmarkRouteMatch1000(b *testing.B) {
+	table := thousandRoutes(b)
+	paths := make([]string, 1000)
+	for i := range paths {
+		paths[i] = fmt.Sprintf("/svc-%d/v%d/orders/%d", i%100, i%10, i)
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if route, _ := table.match("api.example.com", paths[i%len(paths)]); route == nil {
+			b.Fatal("no route matched")
+		}
+	}
+	b.StopTimer()
+	if perOp := b.Elapsed() / time.Duration(b.N); b.N > 1 && perOp >= time.Microsecond {
+		b.Fatalf("matching took %v per path with 1000 routes, want under 1µs", perOp)
+	}
+}
+
+func TestRouteMatchHosts(t *testing.T) {
+	route := func(prefix string, hosts ...string) *Route {
+		return &Route{RouteConfig: RouteConfig{Prefix: prefix, Hosts: hosts}}
+	}
+	plain, api, wildcard, apiV2 := route("/api"), route("/api", "api.example.com"), route("/api", "*.example.com"), route("/api/v2", "API.example.com.")
+	table, err := newRouteTable([]*Route{plain, api, wildcard, apiV2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		host, path string
+		want       *Route
+		rest       string
+	}{
+		{"api.example.com", "/api/x", api, "/x"},
+		{"api.example.com.", "/api/x", api, "/x"},
+		{"API.Example.COM.", "/api/x", api, "/x"},
+		{"api.example.com.:8443", "/api/x", api, "/x"},
+		{"www.example.com", "/api/x", wildcard, "/x"},
+		{"WWW.example.com.", "/api/x", wildcard, "/x"},
+		{"example.org", "/api/x", plain, "/x"},
+		{"api.example.com.", "/api/v2/y", apiV2, "/y"},
+		{"example.org", "/api/v2/y", plain, "/v2/y"},
+	} {
+		got, rest := table.match(tc.host, tc.path)
+		if got != tc.want || rest != tc.rest {
+			t.Errorf("%s%s: matched %s %v with rest %q, want %s %v with %q", tc.host, tc.path, got.Prefix, got.Hosts, rest, tc.want.Prefix, tc.want.Hosts, tc.rest)
+		}
+	}
+
+	if _, err := newRouteTable([]*Route{route("/api", "api.example.com"), route("/api", "API.example.com.")}); err == nil {
+		t.Error("routes for the same prefix and host accepted")
+	}
+}
+
+func TestHostRouteServesTrailingDotHost(t *testing.T) {
+	upstream := func(name string) string {
+		up := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { w.Write([]byte(name)) }))
+		t.Cleanup(up.Close)
+		return up.URL
+	}
+	_, r := newTestGateway(t, "routes:\n"+
+		"- prefix: /h\n  target: "+upstream("default")+"\n  rate_limit: {rate: 1000, burst: 1000}\n"+
+		"- prefix: /h\n  hosts: [api.example.com]\n  target: "+upstream("api")+"\n  rate_limit: {rate: 1000, burst: 1000}\n")
+
+	for host, want := range map[string]string{"api.example.com": "api", "API.Example.com.": "api", "other.example.com": "default"} {
+		if body := serve(r, httptest.NewRequest(http.MethodGet, "http://"+host+"/h/", nil)).Body.String(); body != want {
+			t.Errorf("Host %s: answered by %q, want %q", host, body, want)
+		}
+	}
+}
+
+func TestDisabledRoute(t *testing.T) {
+	var hits atomic.Int64
+	up := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		w.Write([]byte("upstream"))
+	}))
+	defer up.Close()
+	route := func(prefix, extra string) string {
+		return "- prefix: " + prefix + "\n  target: " + up.URL + "\n  rate_limit: {rate: 1000, burst: 1000}\n" + extra
+	}
+	_, r := newTestGateway(t, "routes:\n"+
+		route("/on", "")+
+		route("/off", "  enabled: false\n")+
+		route("/maintenance", "  enabled: false\n  disabled_status: 503\n"))
+
+	for path, want := range map[string]int{"/on/": 200, "/off/": 404, "/maintenance/": 503} {
+		w := serve(r, httptest.NewRequest(http.MethodGet, path, nil))
+		if w.Code != want {
+			t.Errorf("%s: %d, want %d", path, w.Code, want)
+		}
+		if want != http.StatusOK && !strings.Contains(w.Body.String(), "Route disabled") {
+			t.Errorf("%s: body %s", path, w.Body)
+		}
+	}
+	if hits.Load() != 1 {
+		t.Errorf("upstream hit %d times, want only by the enabled route", hits.Load())
+	}
+
+	if _, err := parseConfig([]byte("routes:\n" + route("/x", "  enabled: false\n  disabled_status: 500\n"))); err == nil {
+		t.Error("disabled_status 500 accepted")
+	}
+}
+
+// Excluded paths fall through to the next less specific route, or match
+// nothing; the rest of the prefix stays with the route
+func TestRouteExclude(t *testing.T) {
+	table, err := newRouteTable([]*Route{
+		{RouteConfig: RouteConfig{Prefix: "/"}},
+		{RouteConfig: RouteConfig{Prefix: "/api", Exclude: []string{"/api/internal/*", "/api/*/debug"}}},
+		{RouteConfig: RouteConfig{Prefix: "/admin", Exclude: []string{"/admin/private"}}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct{ path, prefix, rest string }{
+		{"/api/users", "/api", "/users"},
+		{"/api/internal", "/api", "/internal"},
+		{"/api/internal/keys", "/", "/api/internal/keys"},
+		{"/api/internal/keys/1", "/", "/api/internal/keys/1"},
+		{"/api/v2/debug", "/", "/api/v2/debug"},
+		{"/api/v2/debugger", "/api", "/v2/debugger"},
+		{"/admin/private/x", "/", "/admin/private/x"},
+		{"/admin/privateer", "/admin", "/privateer"},
+	} {
+		route, rest := table.match("", tc.path)
+		if route == nil || route.Prefix != tc.prefix || rest != tc.rest {
+			t.Errorf("%s: matched %v with rest %q, want %q with %q", tc.path, route, rest, tc.prefix, tc.rest)
+		}
+	}
+
+	alone, err := newRouteTable([]*Route{{RouteConfig: RouteConfig{Prefix: "/api", Exclude: []string{"/api/internal/*"}}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if route, _ := alone.match("", "/api/internal/keys"); route != nil {
+		t.Errorf("excluded path matched %s, want no route", route.Prefix)
+	}
+
+	if _, err := parseConfig([]byte("routes:\n- prefix: /api\n  target: http://api:8080\n  exclude: ['internal/*']\n")); err == nil {
+		t.Error("relative exclude pattern accepted")
+	}
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/rs/zerolog/log"
+)
+
+// Upstream that replaces the route's target while the window is open, e.g. a
+// read-only replica during nightly maintenance
+type ScheduleWindowConfig struct {
+	Name   string `yaml:"name"`
+	Target string `yaml:"target"`
+	// Days the window opens on (mon..sun); every day when empty
+	Days []string `yaml:"days"`
+	// HH:MM in Timezone. An end before the start closes the window the next day.
+	Start    string `yaml:"start"`
+	End      string `yaml:"end"`
+	Timezone string `yaml:"timezone"`
+}
+
+// Context key holding the name of the open schedule window
+const scheduleWindowKey = "schedule_window"
+
+var weekdays = []string{"sun", "mon", "tue", "wed", "thu", "fri", "sat"}
+
+// Minutes since midnight of an HH:MM clock time
+func parseClock(s string) (int, error) {
+	t, err := time.Parse("15:04", s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid time %q, want HH:MM", s)
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+type scheduleWindow struct {
+	name   string
+	target string
+	// Indexed by time.Weekday
+	days       [7]bool
+	start, end int
+	loc        *time.Location
+}
+
+func newScheduleWindow(cfg ScheduleWindowConfig) (scheduleWindow, error) {
+	w := scheduleWindow{name: cfg.Name, target: cfg.Target, loc: time.UTC}
+	if cfg.Name == "" || cfg.Target == "" {
+		return w, fmt.Errorf("schedule: windows need a name and target")
+	}
+	if err := validateUpstreams("schedule "+cfg.Name, []string{cfg.Target}); err != nil {
+		return w, err
+	}
+	var err error
+	if w.start, err = parseClock(cfg.Start); err != nil {
+		return w, fmt.Errorf("schedule %s: %w", cfg.Name, err)
+	}
+	if w.end, err = parseClock(cfg.End); err != nil {
+		return w, fmt.Errorf("schedule %s: %w", cfg.Name, err)
+	}
+	if w.start == w.end {
+		return w, fmt.Errorf("schedule %s: start and end are equal", cfg.Name)
+	}
+	if cfg.Timezone != "" {
+		if w.loc, err = time.LoadLocation(cfg.Timezone); err != nil {
+			return w, fmt.Errorf("schedule %s: %w", cfg.Name, err)
+		}
+	}
+	for _, day := range cfg.Days {
+		i := slices.Index(weekdays, strings.ToLower(day))
+		if i < 0 {
+			return w, fmt.Errorf("schedule %s: unknown day %q", cfg.Name, day)
+		}
+		w.days[i] = true
+	}
+	if len(cfg.Days) == 0 {
+		w.days = [7]bool{true, true, true, true, true, true, true}
+	}
+	return w, nil
+}
+
+func (w scheduleWindow) open(t time.Time) bool {
+	t = t.In(w.loc)
+	minute := t.Hour()*60 + t.Minute()
+	today := t.Weekday()
+	if w.start < w.end {
+		return w.days[today] && minute >= w.start && minute < w.end
+	}
+	// Past midnight: open from the start on a listed day until the end the day after
+	yesterday := (today + 6) % 7
+	return (w.days[today] && minute >= w.start) || (w.days[yesterday] && minute < w.end)
+}
+
+type schedule struct {
+	windows []scheduleWindow
+	// Replaced in tests
+	now func() time.Time
+}
+
+func newSchedule(cfgs []ScheduleWindowConfig) (*schedule, error) {
+	s := &schedule{now: time.Now}
+	for _, cfg := range cfgs {
+		w, err := newScheduleWindow(cfg)
+		if err != nil {
+			return nil, err
+		}
+		s.windows = append(s.windows, w)
+	}
+	return s, nil
+}
+
+// First window open now, if any
+func (s *schedule) active() (scheduleWindow, bool) {
+	now := s.now()
+	for _, w := range s.windows {
+		if w.open(now) {
+			return w, true
+		}
+	}
+	return scheduleWindow{}, false
+}
+
+// Middleware sending requests to the upstream of the route's open schedule
+// window. Takes precedence over A/B variants; a debug override still wins.
+func ScheduleMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		s := routeFromContext(c).schedule
+		if s == nil || c.GetString(upstreamKey) != "" {
+			c.Next()
+			return
+		}
+		if w, ok := s.active(); ok {
+			log.Debug().Str("window", w.name).Str("target", redactURL(w.target)).Msg("Routing to scheduled upstream")
+			c.Set(upstreamKey, w.target)
+			c.Set(scheduleWindowKey, w.name)
+		}
+		c.Next()
+	}
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// Requests go to the window's target while it is open, across midnight, and
+// back to the route's own target outside it
+func TestScheduleWindowRouting(t *testing.T) {
+	upstream := func(name string) string {
+		up := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(name))
+		}))
+		t.Cleanup(up.Close)
+		return up.URL
+	}
+	g, r := newTestGateway(t, "routes:\n- prefix: /s\n  target: "+upstream("primary")+"\n  rate_limit: {rate: 1000, burst: 1000}\n"+
+		"  schedule:\n  - {name: maintenance, target: '"+upstream("replica")+"', days: [fri], start: '23:00', end: '02:00'}\n")
+	// Friday 2026-10-16, a minute before the window opens
+	clock := &fakeClock{t: time.Date(2026, 10, 16, 22, 59, 0, 0, time.UTC)}
+	g.routes()[0].schedule.now = clock.now
+
+	for _, step := range []struct {
+		after time.Duration
+		want  string
+	}{
+		{0, "primary"},
+		{time.Minute, "replica"},
+		{2*time.Hour + 59*time.Minute, "replica"}, // Saturday 01:59
+		{time.Minute, "primary"},
+		{21*time.Hour + 30*time.Minute, "primary"}, // Saturday 23:30, not a window day
+		{6 * 24 * time.Hour, "replica"},            // the next Friday 23:30
+	} {
+		clock.advance(step.after)
+		if got := serve(r, httptest.NewRequest(http.MethodGet, "/s/", nil)).Body.String(); got != step.want {
+			t.Errorf("%s: answered by %q, want %q", clock.now().Format("Mon 15:04"), got, step.want)
+		}
+	}
+}
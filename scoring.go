@@ -0,0 +1,111 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Upstream selection for a route's pool by weighted score: every scorer rates
+// each member for the request, the member with the highest weighted sum wins
+// and ties go round robin. This covers region affinity, least connections
+// and canaries alike.
+type ScoringConfig struct {
+	// Attributes of pool members by member URL, e.g. region: eu, version: canary
+	Upstreams map[string]map[string]string `yaml:"upstreams"`
+	Scorers   []ScorerConfig               `yaml:"scorers"`
+}
+
+type ScorerConfig struct {
+	// attribute_match: 1 when the request attribute equals the member's
+	// attribute, else 0. least_connections: 1/(1+requests in flight).
+	Type string `yaml:"type"`
+	// Factor of this scorer's score; 1 by default
+	Weight float64 `yaml:"weight"`
+	// attribute_match: request attribute ("header:<name>", "cookie:<name>",
+	// "claim:<name>" or "ip") and the member attribute it is compared with,
+	// e.g. header:X-Geo-Region and region
+	Request  string `yaml:"request"`
+	Upstream string `yaml:"upstream"`
+}
+
+// Rates a pool member for a request; higher is better
+type upstreamScorer interface {
+	score(c *gin.Context, b *balancer, member string) float64
+}
+
+type weightedScorer struct {
+	scorer upstreamScorer
+	weight float64
+}
+
+// Built-in scorers by type; a new one only needs an entry here
+var scorerTypes = map[string]func(ScorerConfig) (upstreamScorer, error){
+	"attribute_match":   newAttributeMatchScorer,
+	"least_connections": func(ScorerConfig) (upstreamScorer, error) { return leastConnectionsScorer{}, nil },
+}
+
+func (cfg ScoringConfig) validate(pool []string) error {
+	if len(cfg.Scorers) == 0 && len(cfg.Upstreams) == 0 {
+		return nil
+	}
+	if len(pool) == 0 {
+		return fmt.Errorf("scoring: needs a pool")
+	}
+	for member := range cfg.Upstreams {
+		if !slices.Contains(pool, member) {
+			return fmt.Errorf("scoring: upstream %q is not a pool member", member)
+		}
+	}
+	for _, scorer := range cfg.Scorers {
+		build, ok := scorerTypes[scorer.Type]
+		if !ok {
+			return fmt.Errorf("scoring: unknown scorer %q", scorer.Type)
+		}
+		if scorer.Weight < 0 {
+			return fmt.Errorf("scoring: %s weight can't be negative", scorer.Type)
+		}
+		if _, err := build(scorer); err != nil {
+			return fmt.Errorf("scoring: %w", err)
+		}
+	}
+	return nil
+}
+
+// Weighted score of member for the request
+func (b *balancer) score(c *gin.Context, member string) float64 {
+	var total float64
+	for _, s := range b.scorers {
+		total += s.weight * s.scorer.score(c, b, member)
+	}
+	return total
+}
+
+type attributeMatchScorer struct {
+	request, upstream string
+}
+
+func newAttributeMatchScorer(cfg ScorerConfig) (upstreamScorer, error) {
+	if !validAttribute(cfg.Request) {
+		return nil, fmt.Errorf("attribute_match: invalid request attribute %q", cfg.Request)
+	}
+	if cfg.Upstream == "" {
+		return nil, fmt.Errorf("attribute_match: upstream attribute is required")
+	}
+	return attributeMatchScorer{request: cfg.Request, upstream: cfg.Upstream}, nil
+}
+
+func (s attributeMatchScorer) score(c *gin.Context, b *balancer, member string) float64 {
+	value := requestAttribute(c, s.request)
+	if value != "" && value == b.attributes[member][s.upstream] {
+		return 1
+	}
+	return 0
+}
+
+type leastConnectionsScorer struct{}
+
+func (leastConnectionsScorer) score(c *gin.Context, b *balancer, member string) float64 {
+	return 1 / float64(1+b.inflight[member].Load())
+}
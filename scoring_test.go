@@ -0,0 +1,61 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Region match outweighs load; among matching members the least loaded wins
+func TestScoringPicksUpstream(t *testing.T) {
+	const eu, us1, us2 = "http://eu:8080", "http://us-1:8080", "http://us-2:8080"
+	b := newBalancer(RouteConfig{Pool: []string{eu, us1, us2}, Scoring: ScoringConfig{
+		Upstreams: map[string]map[string]string{eu: {"region": "eu"}, us1: {"region": "us"}, us2: {"region": "us"}},
+		Scorers: []ScorerConfig{
+			{Type: "attribute_match", Weight: 2, Request: "header:X-Region", Upstream: "region"},
+			{Type: "least_connections"},
+		},
+	}})
+	pick := func(region string, inflight map[string]int64) string {
+		for member, n := range b.inflight {
+			n.Store(inflight[member])
+		}
+		c, _ := gin.CreateTestContext(httptest.NewRecorder())
+		c.Request = httptest.NewRequest(http.MethodGet, "/", nil)
+		if region != "" {
+			c.Request.Header.Set("X-Region", region)
+		}
+		member := b.pick(c)
+		b.release(member)
+		return member
+	}
+
+	for _, tc := range []struct {
+		region   string
+		inflight map[string]int64
+		want     string
+	}{
+		{"eu", nil, eu},
+		// 2 + 1/11 still beats 0 + 1
+		{"eu", map[string]int64{eu: 10}, eu},
+		{"us", map[string]int64{us1: 1}, us2},
+		{"us", map[string]int64{us2: 3}, us1},
+		// No region: least connections alone
+		{"", map[string]int64{eu: 2, us1: 1, us2: 4}, us1},
+	} {
+		if got := pick(tc.region, tc.inflight); got != tc.want {
+			t.Errorf("region %q, in flight %v: picked %s, want %s", tc.region, tc.inflight, got, tc.want)
+		}
+	}
+
+	// Ties go round robin
+	seen := map[string]int{}
+	for range 4 {
+		seen[pick("us", nil)]++
+	}
+	if seen[us1] != 2 || seen[us2] != 2 {
+		t.Errorf("tied picks %v, want us-1 and us-2 alternating", seen)
+	}
+}
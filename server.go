@@ -0,0 +1,218 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	stdlog "log"
+	"net"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/rs/zerolog/log"
+)
+
+// TLS termination settings for the gateway listener
+type TLSConfig struct {
+	CertFile     string `yaml:"cert_file"`
+	KeyFile      string `yaml:"key_file"`
+	ClientCAFile string `yaml:"client_ca_file"`
+	// Advertised ALPN protocols in preference order; defaults to h2, http/1.1
+	ALPN []string `yaml:"alpn"`
+	// Lowest TLS version clients may connect with, 1.2 by default. Set lower
+	// to let legacy clients in for routes' tls_policy to reject or redirect.
+	MinVersion string `yaml:"min_version"`
+}
+
+var defaultALPN = []string{"h2", "http/1.1"}
+
+func (t TLSConfig) enabled() bool {
+	return t.CertFile != "" || t.KeyFile != ""
+}
+
+// Build the server-side tls.Config. Client certificates are verified when
+// presented but not required, so the data plane keeps working without them.
+func buildTLSConfig(cfg TLSConfig) (*tls.Config, error) {
+	if cfg.CertFile == "" || cfg.KeyFile == "" {
+		return nil, errors.New("tls: both cert_file and key_file are required")
+	}
+	cert, err := tls.LoadX509KeyPair(cfg.CertFile, cfg.KeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("tls: loading key pair: %w", err)
+	}
+
+	alpn := cfg.ALPN
+	if len(alpn) == 0 {
+		alpn = defaultALPN
+	}
+	for _, proto := range alpn {
+		if !slices.Contains(defaultALPN, proto) {
+			return nil, fmt.Errorf("tls: unsupported ALPN protocol %q", proto)
+		}
+	}
+
+	minVersion := uint16(tls.VersionTLS12)
+	if cfg.MinVersion != "" {
+		if minVersion = parseTLSVersion(cfg.MinVersion); minVersion == 0 {
+			return nil, fmt.Errorf("tls: unknown min_version %q", cfg.MinVersion)
+		}
+	}
+
+	tlsConfig := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   minVersion,
+		NextProtos:   alpn,
+	}
+
+	if cfg.ClientCAFile != "" {
+		pem, err := os.ReadFile(cfg.ClientCAFile)
+		if err != nil {
+			return nil, fmt.Errorf("tls: reading client CA: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, errors.New("tls: no certificates found in client CA file")
+		}
+		tlsConfig.ClientCAs = pool
+		tlsConfig.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+	return tlsConfig, nil
+}
+
+func newServer(cfg *Config, handler *gin.Engine) (*http.Server, error) {
+	server := &http.Server{
+		Addr:        cfg.Listen,
+		Handler:     tlsStateHandler(handler),
+		ConnContext: connContext,
+		ErrorLog:    stdlog.New(serverErrorLog{}, "", 0),
+	}
+	if cfg.TLS.enabled() {
+		tlsConfig, err := buildTLSConfig(cfg.TLS)
+		if err != nil {
+			return nil, err
+		}
+		server.TLSConfig = tlsConfig
+		if !slices.Contains(tlsConfig.NextProtos, "h2") {
+			// A non-nil map keeps net/http from enabling HTTP/2 on its own
+			server.TLSNextProto = map[string]func(*http.Server, *tls.Conn, http.Handler){}
+		}
+	}
+	return server, nil
+}
+
+// Writer behind the server's ErrorLog. net/http reports failed TLS handshakes
+// only there; they are counted by type and shipped to Loki, anything else is
+// passed on to the regular log.
+type serverErrorLog struct{}
+
+func (serverErrorLog) Write(p []byte) (int, error) {
+	msg := strings.TrimSpace(string(p))
+	rest, ok := strings.CutPrefix(msg, "http: TLS handshake error from ")
+	if !ok {
+		log.Warn().Msg(msg)
+		return len(p), nil
+	}
+	addr, cause, _ := strings.Cut(rest, ": ")
+	kind := handshakeErrorType(cause)
+	log.Warn().Str("remote_addr", addr).Str("type", kind).Str("error", cause).Msg("TLS handshake failed")
+	sendLogToLoki("TLS handshake failed: "+cause, map[string]string{"level": "warn", "type": kind})
+	tlsHandshakeErrors.WithLabelValues(kind).Inc()
+	return len(p), nil
+}
+
+// Coarse type of a handshake error, to keep the metric's labels bounded
+func handshakeErrorType(cause string) string {
+	switch {
+	case strings.Contains(cause, "HTTP request to an HTTPS server"), strings.Contains(cause, "does not look like a TLS handshake"):
+		return "not_tls"
+	case strings.Contains(cause, "EOF"), strings.Contains(cause, "connection reset"):
+		return "client_closed"
+	case strings.Contains(cause, "timeout"):
+		return "timeout"
+	case strings.Contains(cause, "remote error"):
+		// The client refused the handshake, typically our certificate
+		return "client_alert"
+	case strings.Contains(cause, "certificate"):
+		return "bad_client_certificate"
+	case strings.Contains(cause, "protocol version"), strings.Contains(cause, "unsupported versions"):
+		return "protocol_version"
+	case strings.Contains(cause, "cipher suite"), strings.Contains(cause, "no application protocol"), strings.Contains(cause, "curve"):
+		return "no_common_parameters"
+	}
+	return "other"
+}
+
+// Retries of the listener bind while the address is taken
+type ListenRetryConfig struct {
+	// How long to keep trying; 0 (the default) fails on the first attempt
+	Window time.Duration `yaml:"window"`
+	// Delays between attempts; exponential from 100ms up to 2s unless set
+	Backoff BackoffConfig `yaml:"backoff"`
+}
+
+func (cfg ListenRetryConfig) validate() error {
+	if cfg.Window < 0 {
+		return errors.New("listen_retry: window can't be negative")
+	}
+	if err := cfg.Backoff.validate(); err != nil {
+		return fmt.Errorf("listen_retry: %w", err)
+	}
+	return nil
+}
+
+// Bind addr. While it is in use, attempts are repeated with backoff until the
+// window has passed or ctx ends; other errors fail right away.
+func bindListener(ctx context.Context, addr string, cfg ListenRetryConfig) (net.Listener, error) {
+	backoff := cfg.Backoff
+	if backoff.Base <= 0 {
+		backoff.Base = 100 * time.Millisecond
+	}
+	if backoff.Cap <= 0 {
+		backoff.Cap = max(2*time.Second, backoff.Base)
+	}
+	delays := newBackoff(backoff)
+	deadline := time.Now().Add(cfg.Window)
+
+	for attempt := 0; ; attempt++ {
+		ln, err := net.Listen("tcp", addr)
+		if err == nil || !errors.Is(err, syscall.EADDRINUSE) {
+			return ln, err
+		}
+		delay := min(delays.next(attempt), time.Until(deadline))
+		if delay <= 0 {
+			return nil, err
+		}
+		log.Warn().Err(err).Str("addr", addr).Dur("retry_in", delay).Msg("Listen address in use, retrying")
+		sendLogToLoki("Listen address in use, retrying", map[string]string{"level": "warn"})
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return nil, err
+		}
+	}
+}
+
+// Bind the server address, terminating TLS when configured. TLS is handled on
+// our own listener so NextProtos is advertised exactly as configured.
+func listen(ctx context.Context, cfg *Config, server *http.Server) (net.Listener, error) {
+	ln, err := bindListener(ctx, server.Addr, cfg.ListenRetry)
+	if err != nil {
+		return nil, err
+	}
+	// Count raw TCP connections, before any TLS handshake work is spent on them
+	if cfg.MaxConnsPerIP > 0 {
+		ln = newPerIPListener(ln, cfg.MaxConnsPerIP)
+	}
+	check := newRequestCheckListener(ln, cfg.UnsupportedProtocol, cfg.StrictFraming)
+	if server.TLSConfig != nil {
+		return newTLSCheckListener(ln, server.TLSConfig, check), nil
+	}
+	return check, nil
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// TLSConfig pointing at a freshly generated self-signed key pair
+func testTLSFiles(t *testing.T) TLSConfig {
+	t.Helper()
+	cert := testTLSConfig(t).Certificates[0]
+	key, err := x509.MarshalPKCS8PrivateKey(cert.PrivateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	cfg := TLSConfig{CertFile: filepath.Join(dir, "cert.pem"), KeyFile: filepath.Join(dir, "key.pem")}
+	if err := os.WriteFile(cfg.CertFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Certificate[0]}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(cfg.KeyFile, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: key}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return cfg
+}
+
+// The server's preference order decides the protocol among those the client offers
+func TestALPNPreference(t *testing.T) {
+	registerMetrics(MetricsConfig{})
+	gin.SetMode(gin.ReleaseMode)
+	files := testTLSFiles(t)
+	for _, tc := range []struct {
+		alpn   []string
+		client []string
+		want   string
+	}{
+		{nil, []string{"http/1.1", "h2"}, "h2"},
+		{[]string{"http/1.1", "h2"}, []string{"h2", "http/1.1"}, "http/1.1"},
+		{[]string{"http/1.1"}, []string{"h2", "http/1.1"}, "http/1.1"},
+		{[]string{"h2"}, []string{"http/1.1", "h2"}, "h2"},
+	} {
+		cfg := &Config{Listen: "127.0.0.1:0", TLS: files}
+		cfg.TLS.ALPN = tc.alpn
+		server, err := newServer(cfg, gin.New())
+		if err != nil {
+			t.Fatal(err)
+		}
+		ln, err := listen(context.Background(), cfg, server)
+		if err != nil {
+			t.Fatal(err)
+		}
+		go server.Serve(ln)
+
+		conn, err := tls.Dial("tcp", ln.Addr().String(), &tls.Config{InsecureSkipVerify: true, NextProtos: tc.client})
+		if err != nil {
+			t.Fatalf("alpn %v: %v", tc.alpn, err)
+		}
+		if got := conn.ConnectionState().NegotiatedProtocol; got != tc.want {
+			t.Errorf("alpn %v, client offering %v: negotiated %q, want %q", tc.alpn, tc.client, got, tc.want)
+		}
+		conn.Close()
+		server.Close()
+	}
+}
+
+func TestALPNUnsupportedProtocol(t *testing.T) {
+	cfg := testTLSFiles(t)
+	cfg.ALPN = []string{"h3"}
+	if _, err := buildTLSConfig(cfg); err == nil {
+		t.Error("unsupported ALPN protocol accepted")
+	}
+}
+
+// Failed handshakes on the listener are counted by type
+func TestTLSHandshakeErrorMetric(t *testing.T) {
+	registerMetrics(MetricsConfig{})
+	gin.SetMode(gin.ReleaseMode)
+	cfg := &Config{Listen: "127.0.0.1:0", TLS: testTLSFiles(t)}
+	server, err := newServer(cfg, gin.New())
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln, err := listen(context.Background(), cfg, server)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go server.Serve(ln)
+	defer server.Close()
+	addr := ln.Addr().String()
+
+	for kind, handshake := range map[string]func() error{
+		"not_tls": func() error {
+			conn, err := net.Dial("tcp", addr)
+			if err != nil {
+				return err
+			}
+			defer conn.Close()
+			fmt.Fprint(conn, "GET / HTTP/1.1\r\nHost: a\r\n\r\n")
+			io.ReadAll(conn)
+			return nil
+		},
+		// The self-signed certificate fails the client's verification
+		"client_alert": func() error {
+			conn, err := tls.Dial("tcp", addr, &tls.Config{ServerName: "gateway.test"})
+			if err == nil {
+				conn.Close()
+				return errors.New("handshake with an untrusted certificate succeeded")
+			}
+			return nil
+		},
+		"protocol_version": func() error {
+			conn, err := tls.Dial("tcp", addr, &tls.Config{InsecureSkipVerify: true, MinVersion: tls.VersionTLS10, MaxVersion: tls.VersionTLS10})
+			if err == nil {
+				conn.Close()
+				return errors.New("TLS 1.0 handshake succeeded")
+			}
+			return nil
+		},
+	} {
+		counter := tlsHandshakeErrors.WithLabelValues(kind)
+		before := counterValue(t, counter)
+		if err := handshake(); err != nil {
+			t.Fatalf("%s: %v", kind, err)
+		}
+		// Counted by the server once it gives up on the connection
+		deadline := time.Now().Add(5 * time.Second)
+		for counterValue(t, counter) == before && time.Now().Before(deadline) {
+			time.Sleep(time.Millisecond)
+		}
+		if got := counterValue(t, counter) - before; got != 1 {
+			t.Errorf("%s: handshake errors counted: %v, want 1", kind, got)
+		}
+	}
+}
+
+// While the address is taken the bind is retried, and succeeds once it is
+// freed within the window; without a window it fails right away
+func TestListenRetry(t *testing.T) {
+	held, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := held.Addr().String()
+
+	if ln, err := bindListener(context.Background(), addr, ListenRetryConfig{}); err == nil {
+		ln.Close()
+		t.Fatal("bound an address in use")
+	}
+	if ln, err := bindListener(context.Background(), addr, ListenRetryConfig{Window: 100 * time.Millisecond}); err == nil {
+		ln.Close()
+		t.Fatal("bound an address in use for the whole window")
+	}
+
+	time.AfterFunc(300*time.Millisecond, func() { held.Close() })
+	start := time.Now()
+	ln, err := bindListener(context.Background(), addr, ListenRetryConfig{Window: 5 * time.Second, Backoff: BackoffConfig{Base: 20 * time.Millisecond, Cap: 50 * time.Millisecond}})
+	if err != nil {
+		t.Fatalf("bind once the port freed up: %v", err)
+	}
+	defer ln.Close()
+	if took := time.Since(start); took < 300*time.Millisecond || took > 2*time.Second {
+		t.Errorf("bound after %s, want shortly after the port was freed at 300ms", took)
+	}
+}
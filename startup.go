@@ -0,0 +1,148 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// Used for phases that run before the config (and its startup_timeout) is known
+const defaultStartupTimeout = 30 * time.Second
+
+// One step of the startup sequence
+type startupPhase struct {
+	name string
+	run  func(ctx context.Context) error
+}
+
+// Run phases in order. Each gets its own deadline from timeout(), so a hanging
+// phase fails startup instead of leaving a process that looks up but isn't ready.
+func runStartup(phases []startupPhase, timeout func() time.Duration) error {
+	for _, phase := range phases {
+		d := timeout()
+		ctx, cancel := context.WithTimeout(context.Background(), d)
+		started := time.Now()
+
+		done := make(chan error, 1)
+		go func() { done <- phase.run(ctx) }()
+
+		select {
+		case err := <-done:
+			cancel()
+			if err != nil {
+				return fmt.Errorf("startup phase %s: %w", phase.name, err)
+			}
+			log.Info().Str("phase", phase.name).Dur("took", time.Since(started)).Msg("Startup phase complete")
+		case <-ctx.Done():
+			cancel()
+			return fmt.Errorf("startup phase %s timed out after %s", phase.name, d)
+		}
+	}
+	return nil
+}
+
+// Used when shutdown_timeout is not configured
+const defaultShutdownTimeout = 30 * time.Second
+
+// Used for shutdown phases without a configured or derived timeout
+const defaultShutdownPhaseTimeout = 5 * time.Second
+
+// Shutdown phases in the order they run
+var shutdownPhaseNames = []string{"unready", "drain", "flush_logs", "push_metrics", "stop_background", "close_transports"}
+
+// One step of the shutdown sequence
+type shutdownPhase struct {
+	name    string
+	timeout time.Duration
+	run     func(ctx context.Context) error
+}
+
+// Limit of a shutdown phase: shutdown_phase_timeouts, else what the phase
+// used before it had its own setting
+func shutdownPhaseTimeout(cfg *Config, name string) time.Duration {
+	if d := cfg.ShutdownPhaseTimeouts[name]; d > 0 {
+		return d
+	}
+	switch name {
+	case "drain":
+		if cfg.ShutdownTimeout > 0 {
+			return cfg.ShutdownTimeout
+		}
+		return defaultShutdownTimeout
+	case "flush_logs", "push_metrics":
+		if cfg.LogShipper.FlushTimeout > 0 {
+			return cfg.LogShipper.FlushTimeout
+		}
+	}
+	return defaultShutdownPhaseTimeout
+}
+
+// The shutdown sequence. The order matters: nothing new may arrive while
+// in-flight requests drain, their logs and metrics must be out before the
+// process ends, and upstream connections may only go once nothing uses them.
+func shutdownPhases(cfg *Config, server *http.Server, g *Gateway) []shutdownPhase {
+	steps := map[string]func(ctx context.Context) error{
+		"unready": func(ctx context.Context) error {
+			ready.Store(false)
+			return nil
+		},
+		// Stops accepting connections and waits for in-flight requests
+		"drain": server.Shutdown,
+		"flush_logs": func(ctx context.Context) error {
+			return errors.Join(logShipper.Close(ctx), closeRequestLogs(ctx))
+		},
+		"push_metrics": func(ctx context.Context) error {
+			return metricsPusher.Close(ctx)
+		},
+		"stop_background": g.Close,
+		"close_transports": func(ctx context.Context) error {
+			g.closeIdleConnections()
+			return nil
+		},
+	}
+	phases := make([]shutdownPhase, 0, len(shutdownPhaseNames))
+	for _, name := range shutdownPhaseNames {
+		phases = append(phases, shutdownPhase{name: name, timeout: shutdownPhaseTimeout(cfg, name), run: steps[name]})
+	}
+	return phases
+}
+
+// Run phases in order, each within its own timeout. Unlike startup, a phase
+// that fails or overruns doesn't end the sequence; the ones after it still run.
+func runShutdown(phases []shutdownPhase) {
+	for _, phase := range phases {
+		ctx, cancel := context.WithTimeout(context.Background(), phase.timeout)
+		started := time.Now()
+
+		done := make(chan error, 1)
+		go func() { done <- phase.run(ctx) }()
+
+		select {
+		case err := <-done:
+			if err != nil {
+				log.Error().Err(err).Str("phase", phase.name).Msg("Shutdown phase failed")
+			} else {
+				log.Info().Str("phase", phase.name).Dur("took", time.Since(started)).Msg("Shutdown phase complete")
+			}
+		case <-ctx.Done():
+			log.Error().Str("phase", phase.name).Dur("timeout", phase.timeout).Msg("Shutdown phase timed out")
+		}
+		cancel()
+	}
+}
+
+// Wait for SIGINT or SIGTERM, then run the shutdown phases
+func shutdownOnSignal(cfg *Config, server *http.Server, g *Gateway) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	sig := <-signals
+	log.Info().Str("signal", sig.String()).Msg("Shutting down")
+	runShutdown(shutdownPhases(cfg, server, g))
+}
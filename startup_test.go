@@ -0,0 +1,178 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func recordingPhases(ran *[]string, names ...string) []startupPhase {
+	phases := make([]startupPhase, 0, len(names))
+	for _, name := range names {
+		phases = append(phases, startupPhase{name, func(ctx context.Context) error {
+			*ran = append(*ran, name)
+			return nil
+		}})
+	}
+	return phases
+}
+
+func TestStartupPhasesRunInOrder(t *testing.T) {
+	var ran []string
+	names := []string{"config", "metrics", "health", "warmup", "listen"}
+	if err := runStartup(recordingPhases(&ran, names...), func() time.Duration { return time.Second }); err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(ran, names) {
+		t.Errorf("ran %v, want %v", ran, names)
+	}
+}
+
+func TestStartupHangingPhaseTimesOut(t *testing.T) {
+	var ran []string
+	stuck := make(chan struct{})
+	defer close(stuck)
+	phases := recordingPhases(&ran, "config")
+	phases = append(phases, startupPhase{"warmup", func(ctx context.Context) error {
+		// Ignores its context, like a phase stuck in a call without one
+		<-stuck
+		return nil
+	}})
+	phases = append(phases, recordingPhases(&ran, "listen")...)
+
+	started := time.Now()
+	err := runStartup(phases, func() time.Duration { return 50 * time.Millisecond })
+	if err == nil || !strings.Contains(err.Error(), "startup phase warmup timed out") {
+		t.Fatalf("error %v, want the warmup phase timing out", err)
+	}
+	if elapsed := time.Since(started); elapsed > time.Second {
+		t.Errorf("startup gave up after %v, want about the 50ms phase timeout", elapsed)
+	}
+	if !slices.Equal(ran, []string{"config"}) {
+		t.Errorf("ran %v, want only the phases before the hanging one", ran)
+	}
+}
+
+func TestStartupFailingPhase(t *testing.T) {
+	var ran []string
+	phases := append(recordingPhases(&ran, "config"), startupPhase{"metrics", func(ctx context.Context) error {
+		return errors.New("boom")
+	}})
+	phases = append(phases, recordingPhases(&ran, "health")...)
+	if err := runStartup(phases, func() time.Duration { return time.Second }); err == nil || err.Error() != "startup phase metrics: boom" {
+		t.Fatalf("error %v", err)
+	}
+	if !slices.Equal(ran, []string{"config"}) {
+		t.Errorf("ran %v after a failed phase", ran)
+	}
+}
+
+// Phases after the config one get the timeout it loaded
+func TestStartupTimeoutReadPerPhase(t *testing.T) {
+	timeout := time.Second
+	phases := []startupPhase{
+		{"config", func(ctx context.Context) error {
+			timeout = 20 * time.Millisecond
+			return nil
+		}},
+		{"listen", func(ctx context.Context) error {
+			<-ctx.Done()
+			return ctx.Err()
+		}},
+	}
+	started := time.Now()
+	if err := runStartup(phases, func() time.Duration { return timeout }); err == nil {
+		t.Fatal("hanging listen phase succeeded")
+	}
+	if elapsed := time.Since(started); elapsed > 500*time.Millisecond {
+		t.Errorf("listen phase ran %v, want the 20ms loaded by config", elapsed)
+	}
+}
+
+// Shutdown runs its phases in order, and drain lets an in-flight request
+// finish before the upstream connections are closed
+func TestShutdownPhaseOrder(t *testing.T) {
+	loki := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer loki.Close()
+	shipperCfg := LogShipperConfig{}
+	shipperCfg.setDefaults()
+	logShipper = newLokiShipper(loki.URL, shipperCfg)
+	wasReady := ready.Load()
+	t.Cleanup(func() {
+		logShipper = nil
+		ready.Store(wasReady)
+	})
+
+	arrived, release := make(chan struct{}), make(chan struct{})
+	up := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(arrived)
+		<-release
+	}))
+	defer up.Close()
+	g, r := newTestGateway(t, "routes:\n- prefix: /s\n  target: "+up.URL+"\n  rate_limit: {rate: 1000, burst: 1000}\n")
+
+	var (
+		mu     sync.Mutex
+		events []string
+	)
+	record := func(event string) {
+		mu.Lock()
+		defer mu.Unlock()
+		events = append(events, event)
+	}
+	server := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		r.ServeHTTP(w, req)
+		record("request done")
+	})}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go server.Serve(ln)
+	status := make(chan int, 1)
+	go func() {
+		resp, err := http.Get("http://" + ln.Addr().String() + "/s/")
+		if err != nil {
+			status <- 0
+			return
+		}
+		resp.Body.Close()
+		status <- resp.StatusCode
+	}()
+	<-arrived
+
+	phases := shutdownPhases(&Config{}, server, g)
+	for i := range phases {
+		phase := phases[i]
+		phases[i].run = func(ctx context.Context) error {
+			record(phase.name)
+			if phase.name == "drain" {
+				// Still waiting on the request when it is let go
+				time.AfterFunc(50*time.Millisecond, func() { close(release) })
+			}
+			return phase.run(ctx)
+		}
+	}
+	runShutdown(phases)
+
+	want := []string{"unready", "drain", "request done", "flush_logs", "push_metrics", "stop_background", "close_transports"}
+	if !slices.Equal(events, want) {
+		t.Errorf("shutdown went %v, want %v", events, want)
+	}
+	if code := <-status; code != http.StatusOK {
+		t.Errorf("in-flight request: status %d, want 200", code)
+	}
+	if ready.Load() {
+		t.Error("still ready after shutdown")
+	}
+	if err := g.requestReload(); !errors.Is(err, errGatewayClosed) {
+		t.Errorf("reload after shutdown: %v, want %v", err, errGatewayClosed)
+	}
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"fmt"
+	"hash/fnv"
+	"net"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Tenant label for metrics and logs. To keep metric cardinality bounded the
+// extracted value is either checked against Known or hashed into HashBuckets.
+type TenantConfig struct {
+	// "header:<name>", "subdomain" or "claim:<name>" (claims returned by ext_authz)
+	Source string `yaml:"source"`
+	// Tenants reported by name; any other value is reported as "other"
+	Known []string `yaml:"known"`
+	// Without Known, tenants are reported as one of this many hash buckets
+	HashBuckets int `yaml:"hash_buckets"`
+}
+
+// Context key holding the tenant the request was labeled with
+const tenantKey = "tenant"
+
+func (cfg TenantConfig) validate() error {
+	if cfg.Source == "" {
+		return nil
+	}
+	if cfg.Source != "subdomain" && !strings.HasPrefix(cfg.Source, "header:") && !strings.HasPrefix(cfg.Source, "claim:") {
+		return fmt.Errorf("tenant: unknown source %q", cfg.Source)
+	}
+	if len(cfg.Known) == 0 && cfg.HashBuckets <= 0 {
+		return fmt.Errorf("tenant: set known tenants or hash_buckets to bound metric cardinality")
+	}
+	return nil
+}
+
+type tenantResolver struct {
+	cfg   TenantConfig
+	known map[string]bool
+}
+
+// Resolver for cfg, nil when tenant tagging is off
+func newTenantResolver(cfg TenantConfig) *tenantResolver {
+	if cfg.Source == "" {
+		return nil
+	}
+	t := &tenantResolver{cfg: cfg, known: make(map[string]bool, len(cfg.Known))}
+	for _, tenant := range cfg.Known {
+		t.known[tenant] = true
+	}
+	return t
+}
+
+// Raw tenant of the request according to the configured source
+func (t *tenantResolver) extract(c *gin.Context) string {
+	if name, ok := strings.CutPrefix(t.cfg.Source, "header:"); ok {
+		return c.GetHeader(name)
+	}
+	if name, ok := strings.CutPrefix(t.cfg.Source, "claim:"); ok {
+		claims, _ := c.Value(authClaimsKey).(map[string]string)
+		return claims[name]
+	}
+
+	// subdomain: first label of a host with at least three labels
+	host := c.Request.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	labels := strings.Split(host, ".")
+	if len(labels) < 3 || net.ParseIP(host) != nil {
+		return ""
+	}
+	return strings.ToLower(labels[0])
+}
+
+// Label value for the request: "" when tagging is off, "none" without a tenant
+func (t *tenantResolver) resolve(c *gin.Context) string {
+	if t == nil {
+		return ""
+	}
+	tenant := t.extract(c)
+	switch {
+	case tenant == "":
+		return "none"
+	case len(t.known) > 0:
+		if t.known[tenant] {
+			return tenant
+		}
+		return "other"
+	}
+	h := fnv.New32a()
+	h.Write([]byte(tenant))
+	return fmt.Sprintf("bucket-%d", h.Sum32()%uint32(t.cfg.HashBuckets))
+}
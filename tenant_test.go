@@ -0,0 +1,69 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestTenantSources(t *testing.T) {
+	request := func(host string, header map[string]string, claims map[string]string) *gin.Context {
+		c, _ := gin.CreateTestContext(httptest.NewRecorder())
+		c.Request = httptest.NewRequest(http.MethodGet, "http://"+host+"/", nil)
+		for k, v := range header {
+			c.Request.Header.Set(k, v)
+		}
+		if claims != nil {
+			c.Set(authClaimsKey, claims)
+		}
+		return c
+	}
+	known := []string{"acme", "globex"}
+	for _, tc := range []struct {
+		name   string
+		source string
+		c      *gin.Context
+		want   string
+	}{
+		{"header", "header:X-Tenant", request("api.example.com", map[string]string{"X-Tenant": "acme"}, nil), "acme"},
+		{"header, unknown tenant", "header:X-Tenant", request("api.example.com", map[string]string{"X-Tenant": "initech"}, nil), "other"},
+		{"header missing", "header:X-Tenant", request("api.example.com", nil, nil), "none"},
+		{"subdomain", "subdomain", request("Globex.api.example.com:8443", nil, nil), "globex"},
+		{"subdomain of a short host", "subdomain", request("example.com", nil, nil), "none"},
+		{"subdomain of an IP", "subdomain", request("10.0.0.1", nil, nil), "none"},
+		{"claim", "claim:org", request("api.example.com", nil, map[string]string{"org": "acme"}), "acme"},
+		{"claim missing", "claim:org", request("api.example.com", nil, map[string]string{"sub": "u-1"}), "none"},
+	} {
+		if got := newTenantResolver(TenantConfig{Source: tc.source, Known: known}).resolve(tc.c); got != tc.want {
+			t.Errorf("%s: tenant %q, want %q", tc.name, got, tc.want)
+		}
+	}
+
+	// Hashed tenants always land in the same bucket
+	hashed := newTenantResolver(TenantConfig{Source: "header:X-Tenant", HashBuckets: 8})
+	c := request("api.example.com", map[string]string{"X-Tenant": "initech"}, nil)
+	if first := hashed.resolve(c); first != hashed.resolve(c) || first == "none" {
+		t.Errorf("hashed tenant %q", first)
+	}
+	if newTenantResolver(TenantConfig{}).resolve(c) != "" {
+		t.Error("tenant label set with tagging off")
+	}
+}
+
+func TestTenantLabelsRequestMetrics(t *testing.T) {
+	up := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer up.Close()
+	_, r := newTestGateway(t, "tenant: {source: \"header:X-Tenant\", known: [acme]}\n"+
+		"routes:\n- prefix: /tn\n  target: "+up.URL+"\n  rate_limit: {rate: 1000, burst: 1000}\n")
+	acme := httpRequests.WithLabelValues("/tn", http.MethodGet, "acme")
+	before := counterValue(t, acme)
+
+	req := httptest.NewRequest(http.MethodGet, "/tn/", nil)
+	req.Header.Set("X-Tenant", "acme")
+	serve(r, req)
+	if got := counterValue(t, acme) - before; got != 1 {
+		t.Errorf("requests labeled acme: %v, want 1", got)
+	}
+}
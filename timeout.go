@@ -0,0 +1,295 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Nginx's status for requests the client gave up on
+const statusClientClosedRequest = 499
+
+var (
+	// The client didn't send the request body within the route's body_timeout
+	errClientBodyTimeout = errors.New("client request body timeout")
+	// Reading the request body failed, the client went away
+	errClientGone = errors.New("client disconnected while sending the request body")
+	// The route's timeout expired with the request fully sent
+	errUpstreamTimeout = errors.New("upstream timeout")
+	// Less of the deadline was left than the route's min_connect_time
+	errConnectDeadline = errors.New("deadline too short to connect to the upstream")
+	// A connect to the upstream failed within the route's connect_backoff
+	errConnectBackoff = errors.New("upstream recently refused connections")
+)
+
+// Request body remembering why reading it failed, so a failed upstream call
+// can be put down to the client when it was the body that stalled
+type clientBody struct {
+	io.ReadCloser
+	err error
+
+	// Read by the transport's goroutine while the handler looks on, for
+	// upstreams answering before they got the whole body
+	mu      sync.Mutex
+	read    int64
+	eof     bool
+	stopped bool
+	closed  chan struct{}
+}
+
+func (b *clientBody) Read(p []byte) (int, error) {
+	b.mu.Lock()
+	stopped := b.stopped
+	b.mu.Unlock()
+	if stopped {
+		return 0, errEarlyResponse
+	}
+	n, err := b.ReadCloser.Read(p)
+	if err != nil && err != io.EOF {
+		b.err = err
+	}
+	b.mu.Lock()
+	b.read += int64(n)
+	b.eof = b.eof || err == io.EOF
+	b.mu.Unlock()
+	return n, err
+}
+
+// Once stopped the body stays open, the handler drains it
+func (b *clientBody) Close() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	select {
+	case <-b.closed:
+		return nil
+	default:
+		close(b.closed)
+	}
+	if b.stopped {
+		return nil
+	}
+	return b.ReadCloser.Close()
+}
+
+// Wrap the request body, starting the route's body_timeout. nil without a body.
+func trackClientBody(c *gin.Context, route *Route) *clientBody {
+	if c.Request.Body == nil || c.Request.Body == http.NoBody {
+		return nil
+	}
+	if route.BodyTimeout > 0 {
+		// net/http resets the deadline before reading the next request
+		http.NewResponseController(c.Writer).SetReadDeadline(time.Now().Add(route.BodyTimeout))
+	}
+	body := &clientBody{ReadCloser: c.Request.Body, closed: make(chan struct{})}
+	c.Request.Body = body
+	return body
+}
+
+// Which side a failed upstream call is down to, when one of them timed out or
+// the client left. nil for other failures.
+func timeoutCause(body *clientBody, err error) error {
+	if body != nil && body.err != nil {
+		if errors.Is(body.err, os.ErrDeadlineExceeded) {
+			return errClientBodyTimeout
+		}
+		return errClientGone
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return errUpstreamTimeout
+	}
+	return nil
+}
+
+// Status, metric cause and message for errors telling who timed out or
+// left; status is 0 for other errors
+func timeoutStatus(err error) (status int, cause, message string) {
+	switch {
+	case errors.Is(err, errUpstreamHeaderTimeout), errors.Is(err, errUpstreamTimeout):
+		return http.StatusGatewayTimeout, "upstream", "Gateway timeout"
+	case errors.Is(err, errConnectDeadline):
+		return http.StatusGatewayTimeout, "connect_deadline", "Gateway timeout"
+	case errors.Is(err, errClientBodyTimeout):
+		return http.StatusRequestTimeout, "client_body", "Request timeout"
+	case errors.Is(err, errClientGone), errors.Is(err, errClientCanceled):
+		return statusClientClosedRequest, "client_disconnect", "Client closed request"
+	}
+	return 0, "", ""
+}
+
+// Limit that ran out for a timeout error on route's request req, with
+// deadline the request's size_timeout deadline if any; 0 when the client just left
+func (route *Route) timeoutLimit(req *http.Request, err error, deadline *sizeDeadline) time.Duration {
+	switch {
+	case errors.Is(err, errUpstreamHeaderTimeout):
+		return route.ResponseHeaderTimeout
+	case errors.Is(err, errUpstreamTimeout):
+		if deadline != nil {
+			return deadline.limit
+		}
+		if route.LongPoll.configured() && route.LongPoll.matches(req) {
+			return route.LongPoll.limit()
+		}
+		return route.Timeout
+	case errors.Is(err, errClientBodyTimeout):
+		return route.BodyTimeout
+	}
+	return 0
+}
+
+// Loki line for a request ended by a timeout or a departed client: the cause,
+// the limit that applied and the deadline it set, and how long the request
+// ran. The deadline is ctx's when it has one, else limit past started.
+func timeoutLogLine(ctx context.Context, message, cause string, limit time.Duration, started time.Time) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s: cause=%s", message, cause)
+	deadline, ok := ctx.Deadline()
+	if !ok && limit > 0 {
+		deadline, ok = started.Add(limit), true
+	}
+	if limit > 0 {
+		fmt.Fprintf(&b, " limit=%s", limit)
+	}
+	if ok {
+		fmt.Fprintf(&b, " deadline=%s", deadline.UTC().Format(time.RFC3339Nano))
+	}
+	fmt.Fprintf(&b, " elapsed=%s", time.Since(started).Round(time.Millisecond))
+	return b.String()
+}
+
+// Time added to the route's timeout per KiB of request and response body, so
+// big transfers aren't cut off by a timeout sized for small ones. The
+// upstream client then allows up to Max and every request gets a deadline of
+// its own, stretched as its body sizes become known.
+type SizeTimeoutConfig struct {
+	PerKB time.Duration `yaml:"per_kb"`
+	// Ceiling of the stretched timeout, at least the route's timeout
+	Max time.Duration `yaml:"max"`
+}
+
+func (cfg SizeTimeoutConfig) validate(timeout time.Duration) error {
+	if cfg.PerKB < 0 {
+		return fmt.Errorf("size_timeout: per_kb can't be negative")
+	}
+	if cfg.PerKB > 0 && cfg.Max < timeout {
+		return fmt.Errorf("size_timeout: max must be at least timeout")
+	}
+	return nil
+}
+
+// Deadline of one upstream exchange; nil on routes without size_timeout
+type sizeDeadline struct {
+	cfg     SizeTimeoutConfig
+	started time.Time
+	limit   time.Duration
+	timer   *time.Timer
+	cancel  context.CancelCauseFunc
+}
+
+// Context for an upstream exchange sending requestBytes, ending with
+// errUpstreamTimeout as its cause once the stretched timeout passes
+func (route *Route) sizeDeadline(parent context.Context, requestBytes int64) (context.Context, *sizeDeadline) {
+	if route.SizeTimeout.PerKB <= 0 {
+		return parent, nil
+	}
+	ctx, cancel := context.WithCancelCause(parent)
+	d := &sizeDeadline{cfg: route.SizeTimeout, started: time.Now(), limit: route.Timeout, cancel: cancel}
+	d.stretch(requestBytes)
+	d.timer = time.AfterFunc(d.limit, func() { cancel(errUpstreamTimeout) })
+	return ctx, d
+}
+
+// Extend the deadline for another body of n bytes, up to Max
+func (d *sizeDeadline) stretch(n int64) {
+	if d == nil || n <= 0 {
+		return
+	}
+	kb := (n + 1023) / 1024
+	if kb > int64(d.cfg.Max/d.cfg.PerKB) {
+		d.limit = d.cfg.Max
+	} else {
+		d.limit = min(d.cfg.Max, d.limit+time.Duration(kb)*d.cfg.PerKB)
+	}
+	if d.timer != nil {
+		d.timer.Reset(d.limit - time.Since(d.started))
+	}
+}
+
+func (d *sizeDeadline) stop() {
+	if d == nil {
+		return
+	}
+	d.timer.Stop()
+	d.cancel(nil)
+}
+
+// Long-polling requests, held open by the upstream until it has something to
+// send. They get a timeout of their own, longer than the route's, which
+// still bounds them so a stuck exchange doesn't stay open for good.
+type LongPollConfig struct {
+	// Every request of the route is a long-poll
+	Enabled bool `yaml:"enabled"`
+	// Or only requests carrying this header, whatever its value, e.g. X-Long-Poll
+	Header string `yaml:"header"`
+	// Limit of a long-poll, 60s by default; other requests keep the route's timeout
+	Timeout time.Duration `yaml:"timeout"`
+}
+
+func (cfg LongPollConfig) configured() bool {
+	return cfg.Enabled || cfg.Header != ""
+}
+
+func (cfg LongPollConfig) limit() time.Duration {
+	if cfg.Timeout > 0 {
+		return cfg.Timeout
+	}
+	return time.Minute
+}
+
+func (cfg LongPollConfig) validate(rc RouteConfig) error {
+	if !cfg.configured() {
+		if cfg.Timeout != 0 {
+			return fmt.Errorf("long_poll: timeout needs enabled or a header")
+		}
+		return nil
+	}
+	if cfg.Timeout < 0 {
+		return fmt.Errorf("long_poll: timeout can't be negative")
+	}
+	if rc.Timeout > 0 && cfg.limit() < rc.Timeout {
+		return fmt.Errorf("long_poll: timeout must be at least the route's timeout")
+	}
+	// Both set the upstream client's limit
+	if rc.SizeTimeout.PerKB > 0 {
+		return fmt.Errorf("long_poll: can't be combined with size_timeout")
+	}
+	// The transport's header timeout holds for every request, long-polls too
+	if rc.ResponseHeaderTimeout > 0 && rc.ResponseHeaderTimeout < cfg.limit() {
+		return fmt.Errorf("long_poll: response_header_timeout would cut long-polls short")
+	}
+	return nil
+}
+
+// Whether req is a long-poll on a route with long_poll
+func (cfg LongPollConfig) matches(req *http.Request) bool {
+	return cfg.Enabled || (cfg.Header != "" && req.Header.Get(cfg.Header) != "")
+}
+
+// Context for an upstream exchange on a long_poll route. The upstream client
+// allows up to the long-poll limit, so any other request is held to the
+// route's timeout by a deadline of its own, ending with errUpstreamTimeout.
+func (route *Route) longPollDeadline(parent context.Context, req *http.Request) (context.Context, context.CancelFunc) {
+	if !route.LongPoll.configured() || route.LongPoll.matches(req) || route.Timeout <= 0 {
+		return parent, func() {}
+	}
+	return context.WithTimeoutCause(parent, route.Timeout, errUpstreamTimeout)
+}
@@ -0,0 +1,317 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Who timed out or left decides the status and the cause counted: a slow
+// upstream is a 504, a client stalling on its body a 408, and a client that
+// left is counted as a disconnect
+func TestTimeoutCauses(t *testing.T) {
+	release := make(chan struct{})
+	defer close(release)
+	up := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.ReadAll(r.Body)
+		if r.URL.Path == "/slow" {
+			select {
+			case <-release:
+			case <-r.Context().Done():
+			}
+		}
+	}))
+	defer up.Close()
+	_, r := newTestGateway(t, "routes:\n- prefix: /t\n  target: "+up.URL+"\n  rate_limit: {rate: 1000, burst: 1000}\n"+
+		"  timeout: 200ms\n  body_timeout: 100ms\n")
+	gw := httptest.NewServer(r)
+	defer gw.Close()
+	timeouts := func(cause string) float64 { return counterValue(t, requestTimeouts.WithLabelValues("/t", cause)) }
+	// Waits for the cause to be counted once, the handler may still be finishing
+	counted := func(cause string, before float64) {
+		t.Helper()
+		for deadline := time.Now().Add(5 * time.Second); timeouts(cause) == before && time.Now().Before(deadline); {
+			time.Sleep(time.Millisecond)
+		}
+		if got := timeouts(cause) - before; got != 1 {
+			t.Errorf("%s timeouts counted: %v, want 1", cause, got)
+		}
+	}
+	// Sends a POST announcing 100 bytes of body but only 10 of them
+	partialBody := func(path string) (net.Conn, *bufio.Reader) {
+		conn, err := net.Dial("tcp", gw.Listener.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		fmt.Fprintf(conn, "POST %s HTTP/1.1\r\nHost: gw\r\nContent-Length: 100\r\n\r\n0123456789", path)
+		return conn, bufio.NewReader(conn)
+	}
+
+	t.Run("upstream", func(t *testing.T) {
+		before := timeouts("upstream")
+		resp, err := http.Get(gw.URL + "/t/slow")
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusGatewayTimeout {
+			t.Errorf("status %d, want 504", resp.StatusCode)
+		}
+		counted("upstream", before)
+	})
+
+	t.Run("client body", func(t *testing.T) {
+		before := timeouts("client_body")
+		conn, br := partialBody("/t/")
+		defer conn.Close()
+		resp, err := http.ReadResponse(br, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.StatusCode != http.StatusRequestTimeout {
+			t.Errorf("status %d, want 408", resp.StatusCode)
+		}
+		counted("client_body", before)
+	})
+
+	t.Run("client gone mid-body", func(t *testing.T) {
+		before := timeouts("client_disconnect")
+		conn, _ := partialBody("/t/")
+		time.Sleep(20 * time.Millisecond)
+		conn.Close()
+		counted("client_disconnect", before)
+	})
+
+	t.Run("client canceled", func(t *testing.T) {
+		before := timeouts("client_disconnect")
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		defer cancel()
+		req, _ := http.NewRequestWithContext(ctx, http.MethodGet, gw.URL+"/t/slow", nil)
+		if resp, err := http.DefaultClient.Do(req); err == nil {
+			resp.Body.Close()
+			t.Fatalf("status %d for a request the client gave up on", resp.StatusCode)
+		}
+		counted("client_disconnect", before)
+	})
+}
+
+// With size_timeout a big upload gets more time than the route's timeout;
+// a small one doesn't
+func TestSizeTimeout(t *testing.T) {
+	up := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.ReadAll(r.Body)
+		select {
+		case <-time.After(300 * time.Millisecond):
+		case <-r.Context().Done():
+		}
+	}))
+	defer up.Close()
+	_, r := newTestGateway(t, "routes:\n- prefix: /s\n  target: "+up.URL+"\n  rate_limit: {rate: 1000, burst: 1000}\n"+
+		"  timeout: 100ms\n  size_timeout: {per_kb: 2ms, max: 5s}\n")
+	post := func(size int) int {
+		return serve(r, httptest.NewRequest(http.MethodPost, "/s/", bytes.NewReader(make([]byte, size)))).Code
+	}
+
+	if got := post(1 << 10); got != http.StatusGatewayTimeout {
+		t.Errorf("1KiB request: %d, want the route's 100ms timeout to hit", got)
+	}
+	// 500KiB: 100ms + 1s
+	if got := post(500 << 10); got != http.StatusOK {
+		t.Errorf("500KiB request: %d, want it given time enough", got)
+	}
+
+	route := &Route{RouteConfig: RouteConfig{Timeout: 100 * time.Millisecond, SizeTimeout: SizeTimeoutConfig{PerKB: 2 * time.Millisecond, Max: 5 * time.Second}}}
+	for size, want := range map[int64]time.Duration{
+		0:         100 * time.Millisecond,
+		1 << 10:   102 * time.Millisecond,
+		500 << 10: 1100 * time.Millisecond,
+		1 << 30:   5 * time.Second,
+	} {
+		_, d := route.sizeDeadline(context.Background(), size)
+		d.stop()
+		if d.limit != want {
+			t.Errorf("%d bytes: deadline %s, want %s", size, d.limit, want)
+		}
+	}
+}
+
+// The Loki line of a timed-out request carries the limit, the deadline it
+// set and how long the request ran
+func TestTimeoutLokiLine(t *testing.T) {
+	var (
+		mu    sync.Mutex
+		lines []string
+	)
+	loki := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var push struct {
+			Streams []struct {
+				Values [][2]string `json:"values"`
+			} `json:"streams"`
+		}
+		json.NewDecoder(r.Body).Decode(&push)
+		mu.Lock()
+		for _, stream := range push.Streams {
+			for _, value := range stream.Values {
+				lines = append(lines, value[1])
+			}
+		}
+		mu.Unlock()
+	}))
+	defer loki.Close()
+	cfg := LogShipperConfig{FlushInterval: time.Hour}
+	cfg.setDefaults()
+	prev := logShipper
+	logShipper = newLokiShipper(loki.URL, cfg)
+	defer func() { logShipper = prev }()
+
+	up := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-r.Context().Done()
+	}))
+	defer up.Close()
+	_, r := newTestGateway(t, "routes:\n- prefix: /lt\n  target: "+up.URL+"\n  rate_limit: {rate: 1000, burst: 1000}\n  timeout: 150ms\n")
+	start := time.Now()
+	if w := serve(r, httptest.NewRequest(http.MethodGet, "/lt/", nil)); w.Code != http.StatusGatewayTimeout {
+		t.Fatalf("status %d, want 504", w.Code)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := logShipper.Close(ctx); err != nil {
+		t.Fatal(err)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	var line string
+	for _, l := range lines {
+		if strings.Contains(l, "cause=upstream") {
+			line = l
+		}
+	}
+	fields := map[string]string{}
+	for _, field := range strings.Fields(line) {
+		if k, v, ok := strings.Cut(field, "="); ok {
+			fields[k] = v
+		}
+	}
+	if fields["limit"] != "150ms" {
+		t.Errorf("limit %q in %q, want 150ms", fields["limit"], line)
+	}
+	deadline, err := time.Parse(time.RFC3339Nano, fields["deadline"])
+	if err != nil || deadline.Sub(start) < 100*time.Millisecond || deadline.Sub(start) > time.Second {
+		t.Errorf("deadline %q in %q, want about 150ms past the start", fields["deadline"], line)
+	}
+	if elapsed, err := time.ParseDuration(fields["elapsed"]); err != nil || elapsed < 150*time.Millisecond {
+		t.Errorf("elapsed %q in %q, want at least the 150ms limit", fields["elapsed"], line)
+	}
+}
+
+// A long-poll answered after the route's timeout still gets through on a
+// long_poll route; other requests, and long-polls past their own limit, time
+// out. The upstream holds a request named by ?hold= until the test releases
+// it, and a request on a route without long_poll timing out marks the point
+// where the route's timeout has passed, so nothing depends on sleeps.
+func TestLongPollTimeout(t *testing.T) {
+	var mu sync.Mutex
+	holds := map[string]chan struct{}{}
+	hold := func(name string) chan struct{} {
+		mu.Lock()
+		defer mu.Unlock()
+		if holds[name] == nil {
+			holds[name] = make(chan struct{})
+		}
+		return holds[name]
+	}
+	arrived := make(chan string, 10)
+	up := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if name := r.URL.Query().Get("hold"); name != "" {
+			arrived <- name
+			select {
+			case <-hold(name):
+			case <-r.Context().Done():
+				return
+			}
+		}
+		w.Write([]byte("event"))
+	}))
+	defer up.Close()
+	route := func(prefix, longPoll string) string {
+		return "- prefix: " + prefix + "\n  target: " + up.URL + "\n  rate_limit: {rate: 1000, burst: 1000}\n  timeout: 50ms\n" + longPoll
+	}
+	_, r := newTestGateway(t, "routes:\n"+
+		route("/plain", "")+
+		route("/poll", "  long_poll: {enabled: true, timeout: 1m}\n")+
+		route("/mixed", "  long_poll: {header: X-Long-Poll, timeout: 1m}\n")+
+		route("/short", "  long_poll: {enabled: true, timeout: 100ms}\n"))
+	get := func(path string, longPoll bool) int {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		if longPoll {
+			req.Header.Set("X-Long-Poll", "1")
+		}
+		return serve(r, req).Code
+	}
+
+	// Held forever: the route's timeout, or the long-poll's own, answers
+	for _, tc := range []struct {
+		path     string
+		longPoll bool
+	}{
+		{"/plain/?hold=forever", false},
+		{"/mixed/?hold=forever", false},
+		{"/short/?hold=forever", false},
+	} {
+		if code := get(tc.path, tc.longPoll); code != http.StatusGatewayTimeout {
+			t.Errorf("%s (long-poll header %v) held by the upstream: status %d, want 504", tc.path, tc.longPoll, code)
+		}
+		<-arrived
+	}
+	if code := get("/mixed/", false); code != http.StatusOK {
+		t.Errorf("/mixed/ answered at once: status %d, want 200", code)
+	}
+
+	// Released only once a request started after them timed out at the route's timeout
+	for _, tc := range []struct {
+		path     string
+		longPoll bool
+	}{
+		{"/poll/?hold=poll", false},
+		{"/mixed/?hold=mixed", true},
+	} {
+		done := make(chan int)
+		go func() { done <- get(tc.path, tc.longPoll) }()
+		<-arrived
+		if code := get("/plain/?hold=forever", false); code != http.StatusGatewayTimeout {
+			t.Fatalf("/plain/ held by the upstream: status %d, want 504", code)
+		}
+		<-arrived
+		select {
+		case code := <-done:
+			t.Fatalf("%s (long-poll header %v) ended with %d before the upstream answered", tc.path, tc.longPoll, code)
+		default:
+		}
+		close(hold(tc.path[strings.Index(tc.path, "=")+1:]))
+		if code := <-done; code != http.StatusOK {
+			t.Errorf("%s (long-poll header %v) answered past the route's timeout: status %d, want 200", tc.path, tc.longPoll, code)
+		}
+	}
+
+	for _, longPoll := range []string{
+		"  long_poll: {enabled: true, timeout: 10ms}\n",
+		"  long_poll: {timeout: 1s}\n",
+		"  long_poll: {enabled: true}\n  size_timeout: {per_kb: 1ms}\n",
+		"  long_poll: {enabled: true}\n  response_header_timeout: 5s\n",
+	} {
+		if _, err := parseConfig([]byte("routes:\n" + route("/x", longPoll))); err == nil {
+			t.Errorf("accepted %s", longPoll)
+		}
+	}
+}
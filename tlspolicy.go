@@ -0,0 +1,118 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net/http"
+	"slices"
+
+	"github.com/gin-gonic/gin"
+	"github.com/rs/zerolog/log"
+)
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// Version of a min_version setting, 0 for an unknown one
+func parseTLSVersion(name string) uint16 {
+	return tlsVersions[name]
+}
+
+// TLS a client must have negotiated with the gateway to use a route. Clients
+// short of it, plaintext ones included, are rejected with a 403 or sent to a
+// restricted upstream. Older versions only reach the gateway when the
+// listener's tls.min_version lets them in.
+type TLSPolicyConfig struct {
+	// Lowest version accepted: 1.0, 1.1, 1.2 or 1.3
+	MinVersion string `yaml:"min_version"`
+	// Cipher suites accepted by their Go names, e.g.
+	// TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256; none accepts any. TLS 1.3
+	// connections always pass, their suites are all considered secure.
+	Ciphers []string `yaml:"ciphers"`
+	// Upstream for clients short of the policy instead of the 403
+	Legacy string `yaml:"legacy_upstream"`
+}
+
+func (cfg TLSPolicyConfig) configured() bool {
+	return cfg.MinVersion != "" || len(cfg.Ciphers) > 0
+}
+
+func (cfg TLSPolicyConfig) validate() error {
+	if !cfg.configured() {
+		if cfg.Legacy != "" {
+			return fmt.Errorf("tls_policy: legacy_upstream needs min_version or ciphers")
+		}
+		return nil
+	}
+	if cfg.MinVersion != "" && parseTLSVersion(cfg.MinVersion) == 0 {
+		return fmt.Errorf("tls_policy: unknown min_version %q", cfg.MinVersion)
+	}
+	for _, name := range cfg.Ciphers {
+		if cipherSuiteID(name) == 0 {
+			return fmt.Errorf("tls_policy: unknown cipher suite %q", name)
+		}
+	}
+	if cfg.Legacy != "" {
+		return validateUpstreams("tls_policy", []string{cfg.Legacy})
+	}
+	return nil
+}
+
+// ID of the named suite, 0 for an unknown name
+func cipherSuiteID(name string) uint16 {
+	for _, suite := range append(tls.CipherSuites(), tls.InsecureCipherSuites()...) {
+		if suite.Name == name {
+			return suite.ID
+		}
+	}
+	return 0
+}
+
+// Why state falls short of the policy, "" when it doesn't
+func (cfg TLSPolicyConfig) check(state *tls.ConnectionState) string {
+	if state == nil {
+		return "route requires TLS"
+	}
+	if state.Version < parseTLSVersion(cfg.MinVersion) {
+		return "route requires TLS " + cfg.MinVersion + " or newer, connection uses " + tls.VersionName(state.Version)
+	}
+	if len(cfg.Ciphers) > 0 && state.Version < tls.VersionTLS13 && !slices.ContainsFunc(cfg.Ciphers, func(name string) bool {
+		return cipherSuiteID(name) == state.CipherSuite
+	}) {
+		return "cipher suite " + tls.CipherSuiteName(state.CipherSuite) + " not accepted by the route"
+	}
+	return ""
+}
+
+// Middleware holding clients to the route's tls_policy. Legacy clients go to
+// the restricted upstream whatever the schedule, query routing or A/B test
+// would pick; only a debug override comes first.
+func TLSPolicyMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		cfg := routeFromContext(c).TLSPolicy
+		if !cfg.configured() {
+			c.Next()
+			return
+		}
+		reason := cfg.check(c.Request.TLS)
+		if reason == "" {
+			c.Next()
+			return
+		}
+		if cfg.Legacy != "" {
+			if c.GetString(upstreamKey) == "" {
+				c.Set(upstreamKey, cfg.Legacy)
+			}
+			c.Next()
+			return
+		}
+		log.Warn().Str("path", c.Request.URL.Path).Str("reason", reason).Msg("Client TLS rejected by route policy")
+		sendLogToLoki("Client TLS rejected: "+reason, map[string]string{"level": "warn", "path": c.Request.URL.Path})
+		c.JSON(http.StatusForbidden, gin.H{"error": "Forbidden", "msg": reason})
+		c.Abort()
+	}
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"crypto/tls"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// Clients are held to each route's tls_policy by the version and cipher
+// suite they negotiated: sent to the legacy upstream when there is one,
+// refused with a 403 otherwise
+func TestTLSPolicyTiering(t *testing.T) {
+	named := func(name string) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(name))
+		}))
+	}
+	primary, legacy := named("primary"), named("legacy")
+	defer primary.Close()
+	defer legacy.Close()
+	_, r := newTestGateway(t, "routes:\n"+
+		"- prefix: /modern\n  target: "+primary.URL+"\n  rate_limit: {rate: 1000, burst: 1000}\n  tls_policy: {min_version: '1.3'}\n"+
+		"- prefix: /tiered\n  target: "+primary.URL+"\n  rate_limit: {rate: 1000, burst: 1000}\n"+
+		"  tls_policy: {min_version: '1.3', legacy_upstream: '"+legacy.URL+"'}\n"+
+		"- prefix: /ciphers\n  target: "+primary.URL+"\n  rate_limit: {rate: 1000, burst: 1000}\n"+
+		"  tls_policy: {ciphers: [TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384]}\n")
+	gw := httptest.NewUnstartedServer(r)
+	gw.TLS = testTLSConfig(t)
+	gw.StartTLS()
+	defer gw.Close()
+
+	client := func(version uint16, suite uint16) *http.Client {
+		cfg := &tls.Config{InsecureSkipVerify: true, MinVersion: version, MaxVersion: version}
+		if suite != 0 {
+			cfg.CipherSuites = []uint16{suite}
+		}
+		return &http.Client{Transport: &http.Transport{TLSClientConfig: cfg}}
+	}
+	tls12, tls13 := client(tls.VersionTLS12, 0), client(tls.VersionTLS13, 0)
+	aes128 := client(tls.VersionTLS12, tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256)
+	aes256 := client(tls.VersionTLS12, tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384)
+
+	for _, tc := range []struct {
+		name   string
+		client *http.Client
+		path   string
+		status int
+		body   string
+	}{
+		{"TLS 1.3", tls13, "/modern/", http.StatusOK, "primary"},
+		{"TLS 1.2", tls12, "/modern/", http.StatusForbidden, ""},
+		{"TLS 1.3", tls13, "/tiered/", http.StatusOK, "primary"},
+		{"TLS 1.2", tls12, "/tiered/", http.StatusOK, "legacy"},
+		{"TLS 1.2 AES-256", aes256, "/ciphers/", http.StatusOK, "primary"},
+		{"TLS 1.2 AES-128", aes128, "/ciphers/", http.StatusForbidden, ""},
+		// TLS 1.3 suites all pass
+		{"TLS 1.3", tls13, "/ciphers/", http.StatusOK, "primary"},
+	} {
+		resp, err := tc.client.Get(gw.URL + tc.path)
+		if err != nil {
+			t.Fatalf("%s to %s: %v", tc.name, tc.path, err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != tc.status || (tc.body != "" && string(body) != tc.body) {
+			t.Errorf("%s to %s: %d %q, want %d %q", tc.name, tc.path, resp.StatusCode, body, tc.status, tc.body)
+		}
+	}
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// W3C trace context propagation
+type TracingConfig struct {
+	Enabled bool `yaml:"enabled"`
+}
+
+// Context key holding the request's trace ID
+const traceIDKey = "trace_id"
+
+func randomHex(n int) string {
+	b := make([]byte, n)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// Extract the trace ID from a version 00 traceparent header
+func parseTraceparent(header string) (traceID, flags string, ok bool) {
+	parts := strings.Split(strings.TrimSpace(header), "-")
+	if len(parts) != 4 || parts[0] != "00" || len(parts[1]) != 32 || len(parts[2]) != 16 || len(parts[3]) != 2 {
+		return "", "", false
+	}
+	if _, err := hex.DecodeString(parts[1] + parts[2] + parts[3]); err != nil || parts[1] == strings.Repeat("0", 32) {
+		return "", "", false
+	}
+	return parts[1], parts[3], true
+}
+
+func traceIDFromContext(c *gin.Context) string {
+	return c.GetString(traceIDKey)
+}
+
+// Middleware continuing the caller's trace (or starting one) and passing it upstream
+func TracingMiddleware(cfg TracingConfig) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !cfg.Enabled {
+			c.Next()
+			return
+		}
+
+		traceID, flags, ok := parseTraceparent(c.GetHeader("traceparent"))
+		if !ok {
+			traceID, flags = randomHex(16), "01"
+		}
+		// The gateway hop gets its own span ID
+		c.Request.Header.Set("traceparent", "00-"+traceID+"-"+randomHex(8)+"-"+flags)
+		c.Set(traceIDKey, traceID)
+		c.Next()
+	}
+}
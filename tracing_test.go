@@ -0,0 +1,69 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// Trace IDs of the exemplars on a histogram's buckets
+func exemplarTraceIDs(t *testing.T, o prometheus.Observer) []string {
+	t.Helper()
+	var m dto.Metric
+	if err := o.(prometheus.Metric).Write(&m); err != nil {
+		t.Fatal(err)
+	}
+	var ids []string
+	for _, bucket := range m.GetHistogram().GetBucket() {
+		for _, label := range bucket.GetExemplar().GetLabel() {
+			if label.GetName() == "trace_id" {
+				ids = append(ids, label.GetValue())
+			}
+		}
+	}
+	return ids
+}
+
+func TestTraceIDExemplar(t *testing.T) {
+	const traceID = "4bf92f3577b34da6a3ce929d0e0e4736"
+	forwarded := make(chan string, 1)
+	up := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		forwarded <- r.Header.Get("traceparent")
+	}))
+	defer up.Close()
+	_, r := newTestGateway(t, "tracing: {enabled: true}\nroutes:\n- prefix: /tr\n  target: "+up.URL+"\n  rate_limit: {rate: 1000, burst: 1000}\n")
+
+	req := httptest.NewRequest(http.MethodGet, "/tr/", nil)
+	req.Header.Set("traceparent", "00-"+traceID+"-00f067aa0ba902b7-01")
+	if w := serve(r, req); w.Code != http.StatusOK {
+		t.Fatalf("status %d", w.Code)
+	}
+
+	// The upstream continues the trace from the gateway's own span
+	tp := <-forwarded
+	if !strings.HasPrefix(tp, "00-"+traceID+"-") || !strings.HasSuffix(tp, "-01") || strings.Contains(tp, "00f067aa0ba902b7") {
+		t.Errorf("upstream traceparent %q", tp)
+	}
+	ids := exemplarTraceIDs(t, requestDuration.WithLabelValues("/tr", http.MethodGet, "200", ""))
+	if len(ids) != 1 || ids[0] != traceID {
+		t.Errorf("exemplar trace IDs %v, want [%s]", ids, traceID)
+	}
+}
+
+func TestParseTraceparent(t *testing.T) {
+	for header, valid := range map[string]bool{
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01": true,
+		"01-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01": false,
+		"00-00000000000000000000000000000000-00f067aa0ba902b7-01": false,
+		"00-4bf92f3577b34da6a3ce929d0e0e473z-00f067aa0ba902b7-01": false,
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7":    false,
+	} {
+		if _, _, ok := parseTraceparent(header); ok != valid {
+			t.Errorf("%s: valid %v, want %v", header, ok, valid)
+		}
+	}
+}
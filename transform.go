@@ -0,0 +1,426 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/rs/zerolog/log"
+)
+
+// Hook applied to an upstream response before it is written to the client
+type responseModifier func(c *gin.Context, resp *http.Response) error
+
+// Largest upstream body a transformer buffers; bigger bodies pass through untouched
+const maxTransformBodySize = 1 << 20
+
+// Rewrites upstream JSON error bodies into the gateway's error format
+type ErrorNormalizationConfig struct {
+	Enabled bool `yaml:"enabled"`
+	// Dotted paths probed in order for the error message
+	MessageFields []string `yaml:"message_fields"`
+}
+
+var defaultMessageFields = []string{"error.message", "error", "message", "detail", "title", "errors.0.message"}
+
+func isJSONContentType(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	return mediaType == "application/json" || strings.HasSuffix(mediaType, "+json")
+}
+
+func isTextContentType(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	return isJSONContentType(contentType) || strings.HasPrefix(mediaType, "text/") ||
+		mediaType == "application/xml" || strings.HasSuffix(mediaType, "+xml") ||
+		mediaType == "application/x-www-form-urlencoded"
+}
+
+// Read the response body for transformation. ok is false when the body is too
+// large or encoded, in which case resp.Body is left readable from the start.
+func readBody(resp *http.Response) (body []byte, ok bool, err error) {
+	if enc := resp.Header.Get("Content-Encoding"); enc != "" && enc != "identity" {
+		return nil, false, nil
+	}
+	return bufferResponse(resp)
+}
+
+// Read the response body as it is, encoded or not, up to maxTransformBodySize.
+// ok is false for bigger bodies, leaving resp.Body readable from the start.
+func bufferResponse(resp *http.Response) (body []byte, ok bool, err error) {
+	body, err = io.ReadAll(io.LimitReader(resp.Body, maxTransformBodySize+1))
+	if err != nil {
+		return nil, false, err
+	}
+	if len(body) > maxTransformBodySize {
+		resp.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(body), resp.Body), resp.Body}
+		return nil, false, nil
+	}
+	return body, true, nil
+}
+
+// Swap the response body and keep the framing headers consistent
+func replaceBody(resp *http.Response, body []byte) {
+	resp.Body.Close()
+	resp.Body = io.NopCloser(bytes.NewReader(body))
+	resp.ContentLength = int64(len(body))
+	resp.Header.Set("Content-Length", strconv.Itoa(len(body)))
+	resp.Header.Del("Transfer-Encoding")
+	resp.TransferEncoding = nil
+}
+
+// Look up a dotted path such as "error.message" or "errors.0.message"
+func lookupField(doc any, path string) any {
+	for _, key := range strings.Split(path, ".") {
+		switch node := doc.(type) {
+		case map[string]any:
+			doc = node[key]
+		case []any:
+			i, err := strconv.Atoi(key)
+			if err != nil || i < 0 || i >= len(node) {
+				return nil
+			}
+			doc = node[i]
+		default:
+			return nil
+		}
+	}
+	return doc
+}
+
+func errorNormalizer(cfg ErrorNormalizationConfig) responseModifier {
+	fields := cfg.MessageFields
+	if len(fields) == 0 {
+		fields = defaultMessageFields
+	}
+
+	return func(c *gin.Context, resp *http.Response) error {
+		if resp.StatusCode < 400 || !isJSONContentType(resp.Header.Get("Content-Type")) {
+			return nil
+		}
+
+		body, ok, err := readBody(resp)
+		if err != nil || !ok {
+			return err
+		}
+
+		var cause any
+		if err := json.Unmarshal(body, &cause); err != nil {
+			// Not valid JSON after all, forward it as it came
+			replaceBody(resp, body)
+			return nil
+		}
+
+		message := http.StatusText(resp.StatusCode)
+		for _, field := range fields {
+			if s, ok := lookupField(cause, field).(string); ok && s != "" {
+				message = s
+				break
+			}
+		}
+
+		normalized, err := json.Marshal(gin.H{
+			"error":  message,
+			"status": resp.StatusCode,
+			"cause":  cause,
+		})
+		if err != nil {
+			return err
+		}
+		resp.Header.Set("Content-Type", "application/json; charset=utf-8")
+		replaceBody(resp, normalized)
+		return nil
+	}
+}
+
+// Add a Content-Digest header (RFC 9530) carrying the SHA-256 of the body as
+// sent, so clients can verify it arrived intact. Bodies too large to buffer go
+// out without one.
+func contentDigester() responseModifier {
+	return func(c *gin.Context, resp *http.Response) error {
+		if c.Request.Method == http.MethodHead {
+			return nil
+		}
+		body, ok, err := bufferResponse(resp)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			log.Debug().Str("path", c.Request.URL.Path).Msg("Response too large for a content digest")
+			return nil
+		}
+		sum := sha256.Sum256(body)
+		resp.Header.Set("Content-Digest", "sha-256=:"+base64.StdEncoding.EncodeToString(sum[:])+":")
+		replaceBody(resp, body)
+		return nil
+	}
+}
+
+// Gateway-side decompression: the upstream is asked for gzip and responses are
+// served to clients uncompressed
+type DecompressionConfig struct {
+	Enabled bool `yaml:"enabled"`
+	// Also decode gzip request bodies before they are transformed or forwarded
+	Requests bool `yaml:"requests"`
+	// Largest decompressed body accepted; larger responses get a 502, larger requests a 413
+	MaxSize int64 `yaml:"max_size"`
+}
+
+func (cfg DecompressionConfig) limit() int64 {
+	if cfg.MaxSize <= 0 {
+		return 10 << 20
+	}
+	return cfg.MaxSize
+}
+
+var errDecompressedTooLarge = errors.New("decompressed response exceeds limit")
+
+// Decompress gzip responses into memory, refusing bodies that inflate beyond
+// the limit. Of the modifiers only latency injection and the content-type
+// ones, which go by headers, run before it; the rest see plain bodies.
+func decompressor(cfg DecompressionConfig) responseModifier {
+	limit := cfg.limit()
+	return func(c *gin.Context, resp *http.Response) error {
+		if !strings.EqualFold(resp.Header.Get("Content-Encoding"), "gzip") {
+			return nil
+		}
+		zr, err := gzip.NewReader(resp.Body)
+		if err != nil {
+			return fmt.Errorf("decompressing response: %w", err)
+		}
+		body, err := io.ReadAll(io.LimitReader(zr, limit+1))
+		if err != nil {
+			return fmt.Errorf("decompressing response: %w", err)
+		}
+		if int64(len(body)) > limit {
+			log.Warn().Str("path", c.Request.URL.Path).Int64("limit", limit).Msg("Upstream response decompresses beyond limit")
+			sendLogToLoki("Upstream response decompresses beyond limit", map[string]string{"level": "warn", "path": c.Request.URL.Path})
+			return errDecompressedTooLarge
+		}
+		resp.Header.Del("Content-Encoding")
+		replaceBody(resp, body)
+		return nil
+	}
+}
+
+// Status codes some clients can't handle, mapped to ones they can
+type StatusMap map[int]int
+
+func (m StatusMap) validate() error {
+	for from, to := range m {
+		if from < 100 || from > 599 || to < 100 || to > 599 {
+			return fmt.Errorf("status_map: invalid mapping %d -> %d", from, to)
+		}
+	}
+	return nil
+}
+
+// Rewrite the status of responses whose code is in the map; others pass as they came
+func statusRemapper(m StatusMap) responseModifier {
+	return func(c *gin.Context, resp *http.Response) error {
+		if to, ok := m[resp.StatusCode]; ok {
+			resp.StatusCode = to
+			resp.Status = fmt.Sprintf("%d %s", to, http.StatusText(to))
+		}
+		return nil
+	}
+}
+
+// Client method -> method sent upstream, for backends that only take some
+// methods, e.g. PUT: POST
+type MethodMap map[string]string
+
+func (m MethodMap) validate() error {
+	for from, to := range m {
+		if !validMethod(from) || !validMethod(to) {
+			return fmt.Errorf("method_map: invalid mapping %s -> %s", from, to)
+		}
+	}
+	return nil
+}
+
+func validMethod(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodPost, http.MethodPut, http.MethodPatch,
+		http.MethodDelete, http.MethodOptions:
+		return true
+	}
+	return false
+}
+
+// Method to send upstream for a client request. Routing, metrics and the
+// cache keep using the client's method; retry decisions follow the upstream one.
+func (m MethodMap) upstream(method string) string {
+	if to, ok := m[method]; ok {
+		return to
+	}
+	return method
+}
+
+// Middleware decoding gzip request bodies for routes with decompression.requests,
+// so later steps and the upstream see plain bodies. The body is decoded in full
+// before forwarding: one that isn't what its Content-Encoding says, or gzip sent
+// without saying so, gets a 400 instead of reaching the upstream as garbage.
+func RequestDecompressionMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		cfg := routeFromContext(c).Decompression
+		req := c.Request
+		if !cfg.Requests || req.Body == nil || req.Body == http.NoBody {
+			c.Next()
+			return
+		}
+
+		encoding := strings.ToLower(strings.TrimSpace(req.Header.Get("Content-Encoding")))
+		switch encoding {
+		case "", "identity":
+			// Only textual bodies are checked, gzip files are legitimate uploads
+			br := bufio.NewReader(req.Body)
+			if magic, _ := br.Peek(2); bytes.Equal(magic, []byte{0x1f, 0x8b}) && isTextContentType(req.Header.Get("Content-Type")) {
+				rejectRequestBody(c, http.StatusBadRequest, "Request body is gzip-compressed but Content-Encoding doesn't say so")
+				return
+			}
+			req.Body = struct {
+				io.Reader
+				io.Closer
+			}{br, req.Body}
+			c.Next()
+			return
+		case "gzip", "x-gzip":
+		default:
+			rejectRequestBody(c, http.StatusUnsupportedMediaType, "Unsupported request Content-Encoding")
+			return
+		}
+
+		limit := cfg.limit()
+		zr, err := gzip.NewReader(req.Body)
+		if err != nil {
+			rejectRequestBody(c, http.StatusBadRequest, "Request body is not valid gzip")
+			return
+		}
+		body, err := io.ReadAll(io.LimitReader(zr, limit+1))
+		if err != nil {
+			rejectRequestBody(c, http.StatusBadRequest, "Request body is not valid gzip")
+			return
+		}
+		if int64(len(body)) > limit {
+			rejectRequestBody(c, http.StatusRequestEntityTooLarge, "Decompressed request body too large")
+			return
+		}
+		req.Body.Close()
+		req.Body = io.NopCloser(bytes.NewReader(body))
+		req.ContentLength = int64(len(body))
+		req.Header.Del("Content-Encoding")
+		req.Header.Set("Content-Length", strconv.Itoa(len(body)))
+		req.Header.Del("Transfer-Encoding")
+		c.Next()
+	}
+}
+
+func rejectRequestBody(c *gin.Context, status int, msg string) {
+	log.Warn().Str("path", c.Request.URL.Path).Str("content_encoding", c.Request.Header.Get("Content-Encoding")).Msg(msg)
+	sendLogToLoki(msg, map[string]string{"level": "warn", "path": c.Request.URL.Path})
+	c.JSON(status, gin.H{"error": msg})
+	c.Abort()
+}
+
+// Rewrites JSON bodies per route: "minify" strips insignificant whitespace,
+// "pretty" indents. Bodies that aren't valid JSON pass unchanged.
+type JSONFormatConfig struct {
+	Request  string `yaml:"request"`
+	Response string `yaml:"response"`
+}
+
+func (cfg JSONFormatConfig) validate() error {
+	for _, mode := range []string{cfg.Request, cfg.Response} {
+		if mode != "" && mode != "minify" && mode != "pretty" {
+			return fmt.Errorf("json_format: unknown mode %q", mode)
+		}
+	}
+	return nil
+}
+
+func formatJSON(body []byte, mode string) ([]byte, bool) {
+	var buf bytes.Buffer
+	var err error
+	if mode == "pretty" {
+		err = json.Indent(&buf, body, "", "  ")
+	} else {
+		err = json.Compact(&buf, body)
+	}
+	if err != nil {
+		return nil, false
+	}
+	return buf.Bytes(), true
+}
+
+func jsonFormatter(mode string) responseModifier {
+	return func(c *gin.Context, resp *http.Response) error {
+		if !isJSONContentType(resp.Header.Get("Content-Type")) {
+			return nil
+		}
+		body, ok, err := readBody(resp)
+		if err != nil || !ok {
+			return err
+		}
+		if formatted, ok := formatJSON(body, mode); ok {
+			body = formatted
+		}
+		replaceBody(resp, body)
+		return nil
+	}
+}
+
+// Middleware formatting JSON request bodies for routes with json_format.request
+func JSONFormatMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		mode := routeFromContext(c).JSONFormat.Request
+		req := c.Request
+		if mode == "" || req.Body == nil || req.Body == http.NoBody || !isJSONContentType(req.Header.Get("Content-Type")) {
+			c.Next()
+			return
+		}
+		if enc := req.Header.Get("Content-Encoding"); enc != "" && enc != "identity" {
+			c.Next()
+			return
+		}
+
+		body, err := io.ReadAll(io.LimitReader(req.Body, maxTransformBodySize+1))
+		if err != nil || len(body) > maxTransformBodySize {
+			// Forward what was read followed by the rest, untouched
+			req.Body = struct {
+				io.Reader
+				io.Closer
+			}{io.MultiReader(bytes.NewReader(body), req.Body), req.Body}
+			c.Next()
+			return
+		}
+		if formatted, ok := formatJSON(body, mode); ok {
+			body = formatted
+		}
+		req.Body.Close()
+		req.Body = io.NopCloser(bytes.NewReader(body))
+		req.ContentLength = int64(len(body))
+		req.Header.Set("Content-Length", strconv.Itoa(len(body)))
+		req.Header.Del("Transfer-Encoding")
+		c.Next()
+	}
+}
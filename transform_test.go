@@ -0,0 +1,303 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+// Upstreams that report errors differently come out in one shape: the message
+// found in the configured fields, the status, and the original body as cause
+func TestErrorNormalization(t *testing.T) {
+	bodies := map[string]string{
+		"/nested": `{"error":{"code":"E42","message":"quota exceeded"}}`,
+		"/list":   `{"errors":[{"message":"quota exceeded","field":"plan"}]}`,
+	}
+	up := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/problem+json")
+		w.WriteHeader(http.StatusTooManyRequests)
+		w.Write([]byte(bodies[r.URL.Path]))
+	}))
+	defer up.Close()
+	_, r := newTestGateway(t, "routes:\n- prefix: /n\n  target: "+up.URL+"\n  rate_limit: {rate: 1000, burst: 1000}\n"+
+		"  error_normalization: {enabled: true}\n")
+
+	for path, body := range bodies {
+		w := serve(r, httptest.NewRequest(http.MethodGet, "/n"+path, nil))
+		if w.Code != http.StatusTooManyRequests || w.Header().Get("Content-Type") != "application/json; charset=utf-8" {
+			t.Errorf("%s: %d %s", path, w.Code, w.Header().Get("Content-Type"))
+		}
+		var got struct {
+			Error  string `json:"error"`
+			Status int    `json:"status"`
+			Cause  any    `json:"cause"`
+		}
+		if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil {
+			t.Fatalf("%s: %v: %s", path, err, w.Body)
+		}
+		var cause any
+		json.Unmarshal([]byte(body), &cause)
+		if got.Error != "quota exceeded" || got.Status != http.StatusTooManyRequests {
+			t.Errorf("%s: normalized to %s", path, w.Body)
+		}
+		gotCause, _ := json.Marshal(got.Cause)
+		wantCause, _ := json.Marshal(cause)
+		if string(gotCause) != string(wantCause) {
+			t.Errorf("%s: cause %s, want %s", path, gotCause, body)
+		}
+	}
+}
+
+func TestErrorNormalizationFallsBackToStatusText(t *testing.T) {
+	up := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadGateway)
+		w.Write([]byte(`{"code":17}`))
+	}))
+	defer up.Close()
+	_, r := newTestGateway(t, "routes:\n- prefix: /n\n  target: "+up.URL+"\n  rate_limit: {rate: 1000, burst: 1000}\n"+
+		"  error_normalization: {enabled: true}\n")
+
+	w := serve(r, httptest.NewRequest(http.MethodGet, "/n/", nil))
+	if want := `{"cause":{"code":17},"error":"Bad Gateway","status":502}`; w.Body.String() != want {
+		t.Errorf("got %s, want %s", w.Body, want)
+	}
+}
+
+// Gzip of n zero bytes, a few KB however large n is
+// Codes in status_map come out remapped, the rest exactly as the upstream sent them
+func TestStatusRemap(t *testing.T) {
+	up := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		code, _ := strconv.Atoi(strings.TrimPrefix(r.URL.Path, "/"))
+		w.WriteHeader(code)
+		w.Write([]byte("from upstream"))
+	}))
+	defer up.Close()
+	_, r := newTestGateway(t, "routes:\n- prefix: /s\n  target: "+up.URL+"\n  rate_limit: {rate: 1000, burst: 1000}\n"+
+		"  status_map: {451: 404, 422: 400}\n")
+
+	for from, want := range map[int]int{451: 404, 422: 400, 200: 200, 404: 404, 503: 503} {
+		w := serve(r, httptest.NewRequest(http.MethodGet, "/s/"+strconv.Itoa(from), nil))
+		if w.Code != want || w.Body.String() != "from upstream" {
+			t.Errorf("upstream %d: got %d %q, want %d", from, w.Code, w.Body, want)
+		}
+	}
+	if _, err := parseConfig([]byte("routes:\n- prefix: /s\n  target: " + up.URL + "\n  status_map: {451: 99}\n")); err == nil {
+		t.Error("a mapping to an invalid status was accepted")
+	}
+}
+
+// Minify and pretty turn the same document into the expected text, both still
+// equal to the original as JSON; non-JSON bodies pass unchanged
+func TestJSONFormat(t *testing.T) {
+	const doc = `{ "name": "gw",  "tags": [ "a", "b" ],
+	"nested": {"n": 1} }`
+	up := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/echo" {
+			// As text, so the response formatting leaves the echoed request alone
+			w.Header().Set("Content-Type", "text/plain")
+			io.Copy(w, r.Body)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(doc))
+	}))
+	defer up.Close()
+	_, r := newTestGateway(t, "routes:\n"+
+		"- prefix: /m\n  target: "+up.URL+"\n  rate_limit: {rate: 1000, burst: 1000}\n  json_format: {request: minify, response: minify}\n"+
+		"- prefix: /p\n  target: "+up.URL+"\n  rate_limit: {rate: 1000, burst: 1000}\n  json_format: {request: pretty, response: pretty}\n")
+
+	want := map[string]string{
+		"/m": `{"name":"gw","tags":["a","b"],"nested":{"n":1}}`,
+		"/p": "{\n  \"name\": \"gw\",\n  \"tags\": [\n    \"a\",\n    \"b\"\n  ],\n  \"nested\": {\n    \"n\": 1\n  }\n}",
+	}
+	var original any
+	json.Unmarshal([]byte(doc), &original)
+	for prefix, formatted := range want {
+		req := httptest.NewRequest(http.MethodPost, prefix+"/echo", strings.NewReader(doc))
+		req.Header.Set("Content-Type", "application/json")
+		sent := serve(r, req).Body.String()
+		received := serve(r, httptest.NewRequest(http.MethodGet, prefix+"/doc", nil)).Body.String()
+		for what, got := range map[string]string{"request": sent, "response": received} {
+			if got != formatted {
+				t.Errorf("%s %s: got %q, want %q", prefix, what, got, formatted)
+			}
+			var parsed any
+			if err := json.Unmarshal([]byte(got), &parsed); err != nil || !reflect.DeepEqual(parsed, original) {
+				t.Errorf("%s %s: not the same document: %s", prefix, what, got)
+			}
+		}
+	}
+
+	req := httptest.NewRequest(http.MethodPost, "/m/echo", strings.NewReader(doc))
+	req.Header.Set("Content-Type", "text/plain")
+	if got := serve(r, req).Body.String(); got != doc {
+		t.Errorf("text body: got %q, want it unchanged", got)
+	}
+}
+
+// The upstream gets the mapped method; the request is counted under the
+// method the client sent, and unmapped methods pass as they are
+func TestMethodRewrite(t *testing.T) {
+	up := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		w.Write([]byte(r.Method + " " + string(body)))
+	}))
+	defer up.Close()
+	_, r := newTestGateway(t, "routes:\n- prefix: /mm\n  target: "+up.URL+"\n  rate_limit: {rate: 1000, burst: 1000}\n"+
+		"  method_map: {PUT: POST}\n")
+	put, post := httpRequests.WithLabelValues("/mm", http.MethodPut, ""), httpRequests.WithLabelValues("/mm", http.MethodPost, "")
+	putBefore, postBefore := counterValue(t, put), counterValue(t, post)
+
+	if got := serve(r, httptest.NewRequest(http.MethodPut, "/mm/", strings.NewReader("doc"))).Body.String(); got != "POST doc" {
+		t.Errorf("PUT reached the upstream as %q, want POST with the body", got)
+	}
+	if got := serve(r, httptest.NewRequest(http.MethodDelete, "/mm/", nil)).Body.String(); got != "DELETE " {
+		t.Errorf("unmapped DELETE reached the upstream as %q", got)
+	}
+	if got := counterValue(t, put) - putBefore; got != 1 {
+		t.Errorf("requests counted as PUT: %v, want 1", got)
+	}
+	if got := counterValue(t, post) - postBefore; got != 0 {
+		t.Errorf("requests counted as POST: %v, want 0", got)
+	}
+}
+
+// The digest is that of the body the client gets, after the other response
+// transforms, and replaces any the upstream sent
+func TestContentDigest(t *testing.T) {
+	up := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Content-Digest", "sha-256=:bogus:")
+		w.Write([]byte(`{ "id": 7,  "name": "gw" }`))
+	}))
+	defer up.Close()
+	_, r := newTestGateway(t, "routes:\n- prefix: /cd\n  target: "+up.URL+"\n  rate_limit: {rate: 1000, burst: 1000}\n"+
+		"  content_digest: true\n  json_format: {response: minify}\n")
+
+	w := serve(r, httptest.NewRequest(http.MethodGet, "/cd/", nil))
+	sum := sha256.Sum256(w.Body.Bytes())
+	if want := "sha-256=:" + base64.StdEncoding.EncodeToString(sum[:]) + ":"; w.Header().Get("Content-Digest") != want {
+		t.Errorf("Content-Digest %q, want %q for %s", w.Header().Get("Content-Digest"), want, w.Body)
+	}
+	if w.Body.String() != `{"id":7,"name":"gw"}` {
+		t.Errorf("body %s, want it minified", w.Body)
+	}
+}
+
+func gzipZeros(t *testing.T, n int) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	if _, err := io.CopyN(zw, zeroReader{}, int64(n)); err != nil {
+		t.Fatal(err)
+	}
+	zw.Close()
+	return buf.Bytes()
+}
+
+type zeroReader struct{}
+
+func (zeroReader) Read(p []byte) (int, error) {
+	clear(p)
+	return len(p), nil
+}
+
+func TestDecompressionBomb(t *testing.T) {
+	bomb := gzipZeros(t, 32<<20)
+	small := gzipZeros(t, 1000)
+	up := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Accept-Encoding") != "gzip" {
+			t.Errorf("Accept-Encoding %q, want the transport's gzip", r.Header.Get("Accept-Encoding"))
+		}
+		io.Copy(io.Discard, r.Body)
+		w.Header().Set("Content-Encoding", "gzip")
+		if r.URL.Path == "/bomb" {
+			w.Write(bomb)
+		} else {
+			w.Write(small)
+		}
+	}))
+	defer up.Close()
+	_, r := newTestGateway(t, "routes:\n- prefix: /z\n  target: "+up.URL+"\n  rate_limit: {rate: 1000, burst: 1000}\n"+
+		"  decompression: {enabled: true, requests: true, max_size: 1048576}\n")
+	if len(bomb) > 100<<10 {
+		t.Fatalf("bomb is %d bytes compressed", len(bomb))
+	}
+
+	if w := serve(r, httptest.NewRequest(http.MethodGet, "/z/bomb", nil)); w.Code != http.StatusBadGateway {
+		t.Errorf("response bomb: %d, want 502", w.Code)
+	}
+	if w := serve(r, httptest.NewRequest(http.MethodGet, "/z/small", nil)); w.Code != http.StatusOK || w.Body.Len() != 1000 || w.Header().Get("Content-Encoding") != "" {
+		t.Errorf("small gzip response: %d, %d bytes, Content-Encoding %q", w.Code, w.Body.Len(), w.Header().Get("Content-Encoding"))
+	}
+
+	req := httptest.NewRequest(http.MethodPost, "/z/small", bytes.NewReader(bomb))
+	req.Header.Set("Content-Encoding", "gzip")
+	if w := serve(r, req); w.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("request bomb: %d, want 413", w.Code)
+	}
+}
+
+// With request decompression on, a body that isn't what Content-Encoding says
+// gets a 400 and never reaches the upstream; a real gzip body arrives decoded
+func TestMislabeledRequestEncoding(t *testing.T) {
+	var calls atomic.Int64
+	up := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		w.Header().Set("X-Content-Encoding", r.Header.Get("Content-Encoding"))
+		io.Copy(w, r.Body)
+	}))
+	defer up.Close()
+	_, r := newTestGateway(t, "routes:\n- prefix: /e\n  target: "+up.URL+"\n  rate_limit: {rate: 1000, burst: 1000}\n"+
+		"  decompression: {enabled: true, requests: true}\n")
+	var gz bytes.Buffer
+	zw := gzip.NewWriter(&gz)
+	zw.Write([]byte("hello"))
+	zw.Close()
+	send := func(body []byte, contentType, encoding string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/e/", bytes.NewReader(body))
+		req.Header.Set("Content-Type", contentType)
+		if encoding != "" {
+			req.Header.Set("Content-Encoding", encoding)
+		}
+		return serve(r, req)
+	}
+
+	for name, tc := range map[string]struct {
+		body                  []byte
+		contentType, encoding string
+		status                int
+	}{
+		"plain labeled gzip":   {[]byte("hello"), "text/plain", "gzip", http.StatusBadRequest},
+		"truncated gzip":       {gz.Bytes()[:gz.Len()-6], "text/plain", "gzip", http.StatusBadRequest},
+		"unlabeled gzip text":  {gz.Bytes(), "application/json", "", http.StatusBadRequest},
+		"unsupported encoding": {[]byte("hello"), "text/plain", "br", http.StatusUnsupportedMediaType},
+	} {
+		before := calls.Load()
+		if w := send(tc.body, tc.contentType, tc.encoding); w.Code != tc.status {
+			t.Errorf("%s: status %d, want %d: %s", name, w.Code, tc.status, w.Body)
+		}
+		if calls.Load() != before {
+			t.Errorf("%s: forwarded to the upstream", name)
+		}
+	}
+
+	if w := send(gz.Bytes(), "text/plain", "gzip"); w.Code != http.StatusOK || w.Body.String() != "hello" || w.Header().Get("X-Content-Encoding") != "" {
+		t.Errorf("gzip body: %d %q, Content-Encoding %q upstream, want it decoded", w.Code, w.Body, w.Header().Get("X-Content-Encoding"))
+	}
+	// A gzip file upload is just binary data
+	if w := send(gz.Bytes(), "application/octet-stream", ""); w.Code != http.StatusOK || !bytes.Equal(w.Body.Bytes(), gz.Bytes()) {
+		t.Errorf("gzip upload: %d, want it forwarded as is", w.Code)
+	}
+}
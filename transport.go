@@ -0,0 +1,328 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// Pre-established upstream connections opened before the gateway starts serving
+type WarmupConfig struct {
+	Connections int           `yaml:"connections"`
+	Path        string        `yaml:"path"`
+	Timeout     time.Duration `yaml:"timeout"`
+}
+
+// Per-route transport so pools and settings don't leak between upstreams
+func newTransport(rc RouteConfig) http.RoundTripper {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.MaxIdleConnsPerHost = max(transport.MaxIdleConnsPerHost, http.DefaultMaxIdleConnsPerHost, rc.Warmup.Connections)
+	// The gateway decompresses itself, with a size limit
+	transport.DisableCompression = rc.Decompression.Enabled
+	transport.ResponseHeaderTimeout = rc.ResponseHeaderTimeout
+	transport.MaxConnsPerHost = rc.ConnPool.MaxConns
+	var rt http.RoundTripper = transport
+	if rc.ConnPool.HostMetrics {
+		rt = trackPool(rc.Prefix, transport)
+	}
+	if rc.ConnPool.ConnectBackoff > 0 {
+		transport.DialContext = newConnectBackoff(rc.ConnPool.ConnectBackoff).dialer(transport.DialContext)
+	}
+	if rc.MinConnectTime > 0 {
+		transport.DialContext = deadlineDialer(transport.DialContext, rc.MinConnectTime)
+		rt = connectDeadlineTransport{rt}
+	}
+	if len(rc.ConnPool.CloseOnStatuses) > 0 {
+		dial := transport.DialContext
+		transport.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+			conn, err := dial(ctx, network, addr)
+			if err != nil {
+				return nil, err
+			}
+			return &closableConn{Conn: conn}, nil
+		}
+		rt = connClosingTransport{RoundTripper: rt, statuses: rc.ConnPool.CloseOnStatuses}
+	}
+	return rt
+}
+
+// Context key carrying the deadline of the request a dial is for. The
+// transport dials without the request's deadline, so a dial outlives the
+// request it was started for and its connection can serve the next one.
+type connectDeadlineKey struct{}
+
+// Transport refusing to open a connection for a request that has less than
+// min of its deadline left; a pooled connection needs no dial and is still used
+type connectDeadlineTransport struct {
+	http.RoundTripper
+}
+
+func (t connectDeadlineTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	// Taken here, past the client's own timeout
+	if deadline, ok := req.Context().Deadline(); ok {
+		req = req.WithContext(context.WithValue(req.Context(), connectDeadlineKey{}, deadline))
+	}
+	return t.RoundTripper.RoundTrip(req)
+}
+
+func (t connectDeadlineTransport) CloseIdleConnections() {
+	closeIdleConnections(t.RoundTripper)
+}
+
+// Close the idle connections of a wrapped transport; http.Client only sees
+// the outermost one
+func closeIdleConnections(rt http.RoundTripper) {
+	if closer, ok := rt.(interface{ CloseIdleConnections() }); ok {
+		closer.CloseIdleConnections()
+	}
+}
+
+func deadlineDialer(dial func(ctx context.Context, network, addr string) (net.Conn, error), min time.Duration) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	if dial == nil {
+		dial = (&net.Dialer{}).DialContext
+	}
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		if deadline, ok := ctx.Value(connectDeadlineKey{}).(time.Time); ok && time.Until(deadline) < min {
+			return nil, errConnectDeadline
+		}
+		return dial(ctx, network, addr)
+	}
+}
+
+// Failed connects of a route's transport, per upstream address
+type connectBackoff struct {
+	cooldown time.Duration
+	mu       sync.Mutex
+	failed   map[string]time.Time
+}
+
+func newConnectBackoff(cooldown time.Duration) *connectBackoff {
+	return &connectBackoff{cooldown: cooldown, failed: make(map[string]time.Time)}
+}
+
+func (b *connectBackoff) dialer(dial func(ctx context.Context, network, addr string) (net.Conn, error)) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	if dial == nil {
+		dial = (&net.Dialer{}).DialContext
+	}
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		b.mu.Lock()
+		failed, ok := b.failed[addr]
+		b.mu.Unlock()
+		if ok && time.Since(failed) < b.cooldown {
+			return nil, errConnectBackoff
+		}
+		// Past the cooldown this dial is the one finding out whether the
+		// upstream is back
+		conn, err := dial(ctx, network, addr)
+		b.mu.Lock()
+		if err != nil && !errors.Is(err, errConnectDeadline) {
+			b.failed[addr] = time.Now()
+		} else if err == nil {
+			delete(b.failed, addr)
+		}
+		b.mu.Unlock()
+		return conn, err
+	}
+}
+
+// Upstream connection pool limits
+type ConnPoolConfig struct {
+	// Connections per upstream host (0 = unlimited); further requests wait for one
+	MaxConns int `yaml:"max_conns"`
+	// Requests allowed to wait for a connection; more get a 503 right away
+	// instead of queueing (0 = no limit)
+	MaxWaiting int `yaml:"max_waiting"`
+	// Report the pool's in-use and idle connections and waiting requests per
+	// upstream host, not just the route's connection wait
+	HostMetrics bool `yaml:"host_metrics"`
+	// Upstream statuses after which the HTTP/1 connection is closed rather
+	// than reused, e.g. [502, 503] for a backend that keeps a broken
+	// connection open; net/http already drops connections that errored
+	CloseOnStatuses []int `yaml:"close_on_statuses"`
+	// After a failed connect to an upstream address, fail further connects to
+	// it for this long instead of having each wait out its own attempt
+	// (0 = always dial). Unlike the circuit breaker, requests on pooled
+	// connections to it still go through.
+	ConnectBackoff time.Duration `yaml:"connect_backoff"`
+}
+
+func (cfg ConnPoolConfig) validate() error {
+	if cfg.ConnectBackoff < 0 {
+		return fmt.Errorf("conn_pool: connect_backoff can't be negative")
+	}
+	for _, status := range cfg.CloseOnStatuses {
+		if status < 100 || status > 599 {
+			return fmt.Errorf("conn_pool: invalid status %d in close_on_statuses", status)
+		}
+	}
+	return nil
+}
+
+// Whether new upstream requests should be refused rather than queue for a connection
+func (route *Route) poolSaturated() bool {
+	return route.ConnPool.MaxWaiting > 0 && route.connWaiting.Load() >= int64(route.ConnPool.MaxWaiting)
+}
+
+// Connection wait of one upstream request, across its attempts
+type connWait struct {
+	route   *Route
+	started time.Time
+	waiting atomic.Bool
+}
+
+func (w *connWait) done() {
+	if w.waiting.CompareAndSwap(true, false) {
+		w.route.connWaiting.Add(-1)
+	}
+}
+
+// Track req's wait for a connection, from asking the pool (dials included) to
+// getting one. done must be called once the request was sent, as failed dials
+// never report a connection.
+func (route *Route) traceConnWait(req *http.Request) (*http.Request, *connWait) {
+	w := &connWait{route: route}
+	trace := &httptrace.ClientTrace{
+		GetConn: func(string) {
+			w.started = time.Now()
+			if w.waiting.CompareAndSwap(false, true) {
+				route.connWaiting.Add(1)
+			}
+		},
+		GotConn: func(httptrace.GotConnInfo) {
+			upstreamConnWait.WithLabelValues(route.Prefix).Observe(time.Since(w.started).Seconds())
+			w.done()
+		},
+	}
+	return req.WithContext(httptrace.WithClientTrace(req.Context(), trace)), w
+}
+
+// Host in the form hosts are compared in: lowercase and without the
+// trailing dot of a fully qualified name, so api.example.com. and
+// API.example.com are both api.example.com. A port is kept.
+func canonicalHost(host string) string {
+	host = strings.ToLower(host)
+	if hostname, port, err := net.SplitHostPort(host); err == nil {
+		return net.JoinHostPort(strings.TrimSuffix(hostname, "."), port)
+	}
+	return strings.TrimSuffix(host, ".")
+}
+
+// Whether host matches an allowlist entry: "host", "host:port" or "*.domain"
+func hostAllowed(allowed []string, host string) bool {
+	host = canonicalHost(host)
+	hostname := host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		hostname = h
+	}
+	for _, entry := range allowed {
+		entry = canonicalHost(entry)
+		switch {
+		case strings.HasPrefix(entry, "*."):
+			if strings.HasSuffix(hostname, entry[1:]) {
+				return true
+			}
+		case strings.Contains(entry, ":"):
+			if host == entry {
+				return true
+			}
+		default:
+			if hostname == entry {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Redirect policy of the route's client. Redirects are followed only to the
+// host the request was sent to and the configured hosts, so an upstream can't
+// point the gateway at internal services; anything else is handed to the
+// client as it came. A redirect from https to plain http is only followed to
+// the configured hosts, not even to the same host: the request would go out
+// unencrypted.
+func checkRedirect(rc RouteConfig) func(req *http.Request, via []*http.Request) error {
+	return func(req *http.Request, via []*http.Request) error {
+		if !rc.FollowRedirects {
+			return http.ErrUseLastResponse
+		}
+		if len(via) >= 10 {
+			return errors.New("stopped after 10 redirects")
+		}
+		if canonicalHost(req.URL.Host) != canonicalHost(via[0].URL.Host) && !hostAllowed(rc.RedirectHosts, req.URL.Host) {
+			log.Warn().Str("route", rc.Prefix).Str("location", req.URL.String()).Msg("Not following redirect to host outside redirect_hosts")
+			return http.ErrUseLastResponse
+		}
+		downgrade := req.URL.Scheme == "http" && slices.ContainsFunc(via, func(prev *http.Request) bool { return prev.URL.Scheme == "https" })
+		if downgrade && !hostAllowed(rc.RedirectHosts, req.URL.Host) {
+			log.Warn().Str("route", rc.Prefix).Str("location", req.URL.String()).Msg("Not following redirect from https to http")
+			return http.ErrUseLastResponse
+		}
+		return nil
+	}
+}
+
+// Open the configured number of connections to the route's upstream by issuing
+// concurrent HEAD requests; the transport keeps them idle in its pool afterwards.
+func warmupRoute(route *Route) int {
+	cfg := route.Warmup
+	if cfg.Connections <= 0 {
+		return 0
+	}
+	timeout := cfg.Timeout
+	if timeout <= 0 {
+		timeout = 5 * time.Second
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	var (
+		wg     sync.WaitGroup
+		mu     sync.Mutex
+		warmed int
+	)
+	for range cfg.Connections {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			req, err := http.NewRequestWithContext(ctx, http.MethodHead, route.Target+cfg.Path, nil)
+			if err != nil {
+				return
+			}
+			resp, err := route.httpClient().Do(req)
+			if err != nil {
+				log.Warn().Err(err).Str("route", route.Prefix).Msg("Upstream warm-up request failed")
+				return
+			}
+			// Drain so the connection goes back to the pool
+			io.Copy(io.Discard, resp.Body)
+			resp.Body.Close()
+			mu.Lock()
+			warmed++
+			mu.Unlock()
+		}()
+	}
+	wg.Wait()
+	return warmed
+}
+
+// Warm every route's upstream pool
+func warmupRoutes(routes []*Route) {
+	for _, route := range routes {
+		if !route.Enabled || route.Warmup.Connections <= 0 {
+			continue
+		}
+		warmed := warmupRoute(route)
+		log.Info().Str("route", route.Prefix).Int("connections", warmed).Msg("Upstream connections warmed")
+	}
+}
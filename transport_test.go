@@ -0,0 +1,280 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestCheckRedirectRefusesSchemeDowngrade(t *testing.T) {
+	rc := RouteConfig{Prefix: "/api", FollowRedirects: true, RedirectHosts: []string{"legacy.internal"}}
+	follow := checkRedirect(rc)
+	for _, tc := range []struct {
+		from, to string
+		followed bool
+	}{
+		{"https://api.internal/a", "https://api.internal/b", true},
+		{"http://api.internal/a", "http://api.internal/b", true},
+		{"http://api.internal/a", "https://api.internal/b", true},
+		{"https://api.internal/a", "http://api.internal/b", false},
+		{"https://api.internal/a", "http://API.internal./b", false},
+		{"https://api.internal/a", "http://legacy.internal/b", true},
+		{"https://api.internal/a", "http://other.internal/b", false},
+	} {
+		via := []*http.Request{httptest.NewRequest(http.MethodGet, tc.from, nil)}
+		err := follow(httptest.NewRequest(http.MethodGet, tc.to, nil), via)
+		if followed := err == nil; followed != tc.followed {
+			t.Errorf("%s -> %s: followed %v, want %v", tc.from, tc.to, followed, tc.followed)
+		}
+	}
+}
+
+func TestCheckRedirectRefusesDowngradeLaterInChain(t *testing.T) {
+	follow := checkRedirect(RouteConfig{Prefix: "/api", FollowRedirects: true, RedirectHosts: []string{"auth.internal"}})
+	via := []*http.Request{
+		httptest.NewRequest(http.MethodGet, "https://api.internal/a", nil),
+		httptest.NewRequest(http.MethodGet, "http://auth.internal/login", nil),
+	}
+	if err := follow(httptest.NewRequest(http.MethodGet, "http://api.internal/b", nil), via); err == nil {
+		t.Fatal("followed back to http after a chain that started on https")
+	}
+}
+
+// Warm-up opens the configured connections before traffic arrives, and the
+// first requests reuse them instead of dialing
+func TestWarmupOpensConnections(t *testing.T) {
+	const conns = 3
+	var opened atomic.Int64
+	heads := make(chan struct{}, conns)
+	up := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodHead {
+			// Hold every warm-up request until all have arrived, so each needs its own connection
+			heads <- struct{}{}
+			for len(heads) < conns {
+				time.Sleep(time.Millisecond)
+			}
+		}
+	}))
+	up.Config.ConnState = func(_ net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			opened.Add(1)
+		}
+	}
+	up.Start()
+	defer up.Close()
+	g, r := newTestGateway(t, "routes:\n- prefix: /w\n  target: "+up.URL+"\n  rate_limit: {rate: 1000, burst: 1000}\n"+
+		"  warmup: {connections: 3, path: /health, timeout: 2s}\n")
+
+	if got := warmupRoute(g.routes()[0]); got != conns {
+		t.Fatalf("warmed %d connections, want %d", got, conns)
+	}
+	if got := opened.Load(); got != conns {
+		t.Fatalf("upstream saw %d connections after warm-up, want %d", got, conns)
+	}
+	for range conns {
+		if w := serve(r, httptest.NewRequest(http.MethodGet, "/w/", nil)); w.Code != http.StatusOK {
+			t.Fatalf("status %d", w.Code)
+		}
+	}
+	if got := opened.Load(); got != conns {
+		t.Errorf("upstream saw %d connections after serving, want the %d warmed ones", got, conns)
+	}
+}
+
+// Through the proxy: a redirect to a host in redirect_hosts is followed and
+// the client gets the final answer; one to any other host reaches the client as is
+func TestRedirectFollowedOnlyToAllowedHosts(t *testing.T) {
+	target := func(name string) *httptest.Server {
+		s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(name))
+		}))
+		t.Cleanup(s.Close)
+		return s
+	}
+	allowed, other := target("allowed"), target("other")
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/allowed":
+			http.Redirect(w, r, allowed.URL+"/landing", http.StatusFound)
+		case "/other":
+			http.Redirect(w, r, other.URL+"/landing", http.StatusFound)
+		}
+	}))
+	defer origin.Close()
+	_, r := newTestGateway(t, "routes:\n- prefix: /r\n  target: "+origin.URL+"\n  rate_limit: {rate: 1000, burst: 1000}\n"+
+		"  follow_redirects: true\n  redirect_hosts: ['"+allowed.Listener.Addr().String()+"']\n")
+
+	if w := serve(r, httptest.NewRequest(http.MethodGet, "/r/allowed", nil)); w.Code != http.StatusOK || w.Body.String() != "allowed" {
+		t.Errorf("allowed host: %d %q, want the redirect followed", w.Code, w.Body)
+	}
+	w := serve(r, httptest.NewRequest(http.MethodGet, "/r/other", nil))
+	if w.Code != http.StatusFound || w.Header().Get("Location") != other.URL+"/landing" {
+		t.Errorf("other host: %d to %q, want the 302 passed to the client", w.Code, w.Header().Get("Location"))
+	}
+}
+
+// With the one upstream connection busy, the next request waits for it and
+// that wait is observed; one more than max_waiting gets a 503 at once
+func TestConnPoolWaitAndFailFast(t *testing.T) {
+	arrived := make(chan struct{}, 10)
+	release := make(chan struct{})
+	up := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		arrived <- struct{}{}
+		<-release
+	}))
+	defer up.Close()
+	g, r := newTestGateway(t, "routes:\n- prefix: /w\n  target: "+up.URL+"\n  rate_limit: {rate: 1000, burst: 1000}\n"+
+		"  conn_pool: {max_conns: 1, max_waiting: 1}\n")
+	route := g.routes()[0]
+	wait := upstreamConnWait.WithLabelValues("/w")
+	waitsBefore, sumBefore := histogramValue(t, wait)
+
+	codes := make(chan int, 2)
+	send := func() {
+		go func() { codes <- serve(r, httptest.NewRequest(http.MethodGet, "/w/", nil)).Code }()
+	}
+	send()
+	<-arrived
+	send()
+	for deadline := time.Now().Add(5 * time.Second); route.connWaiting.Load() < 1; time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("second request never waited for the connection")
+		}
+	}
+
+	if w := serve(r, httptest.NewRequest(http.MethodGet, "/w/", nil)); w.Code != http.StatusServiceUnavailable {
+		t.Errorf("beyond max_waiting: status %d, want 503", w.Code)
+	}
+	time.Sleep(20 * time.Millisecond)
+	close(release)
+	for range 2 {
+		if code := <-codes; code != http.StatusOK {
+			t.Errorf("queued request: status %d, want 200", code)
+		}
+	}
+
+	waits, sum := histogramValue(t, wait)
+	if waits-waitsBefore != 2 {
+		t.Errorf("connection waits observed: %d, want 2", waits-waitsBefore)
+	}
+	if sum-sumBefore < 0.02 {
+		t.Errorf("total wait %vs, want at least the 20ms the connection was held", sum-sumBefore)
+	}
+}
+
+// Allowlist entries and hosts compare without case or a trailing dot
+func TestHostAllowedTrailingDotAndCase(t *testing.T) {
+	allowed := []string{"api.example.com", "Files.Example.com.:8443", "*.internal.example.com"}
+	for host, want := range map[string]bool{
+		"api.example.com":          true,
+		"api.example.com.":         true,
+		"API.Example.COM.":         true,
+		"api.example.com.:443":     true,
+		"files.example.com:8443":   true,
+		"FILES.example.com.:8443":  true,
+		"files.example.com:9443":   false,
+		"db.internal.example.com.": true,
+		"DB.Internal.Example.com":  true,
+		"api.example.com..":        false,
+		"evil-api.example.com":     false,
+		"internal.example.com":     false,
+	} {
+		if got := hostAllowed(allowed, host); got != want {
+			t.Errorf("%s: allowed %v, want %v", host, got, want)
+		}
+	}
+}
+
+// A request with less of its deadline left than min_connect_time fails with
+// a 504 at once, without dialing the upstream
+func TestConnectDeadlineTooShort(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var dials atomic.Int32
+	up := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}), ConnState: func(_ net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			dials.Add(1)
+		}
+	}}
+	go up.Serve(ln)
+	defer up.Close()
+	_, r := newTestGateway(t, "routes:\n- prefix: /near\n  target: http://"+ln.Addr().String()+"\n  rate_limit: {rate: 1000, burst: 1000}\n"+
+		"  min_connect_time: 500ms\n")
+	timeouts := requestTimeouts.WithLabelValues("/near", "connect_deadline")
+	before := counterValue(t, timeouts)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	w := serve(r, httptest.NewRequest(http.MethodGet, "/near/", nil).WithContext(ctx))
+	if took := time.Since(start); w.Code != http.StatusGatewayTimeout || took > 50*time.Millisecond {
+		t.Errorf("near-expired deadline: %d after %s, want an immediate 504", w.Code, took)
+	}
+	if got := counterValue(t, timeouts) - before; got != 1 {
+		t.Errorf("connect_deadline timeouts counted: %v, want 1", got)
+	}
+	if n := dials.Load(); n != 0 {
+		t.Errorf("%d connections to the upstream, want none", n)
+	}
+
+	// With time enough it connects as usual
+	if w := serve(r, httptest.NewRequest(http.MethodGet, "/near/", nil)); w.Code != http.StatusOK || dials.Load() != 1 {
+		t.Errorf("without a deadline: %d with %d connections, want 200 over one", w.Code, dials.Load())
+	}
+}
+
+// After a failed connect, requests within connect_backoff fail without
+// dialing even once the upstream is back; past it they connect again
+func TestConnectBackoff(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+	_, r := newTestGateway(t, "routes:\n- prefix: /cb\n  target: http://"+addr+"\n  rate_limit: {rate: 1000, burst: 1000}\n"+
+		"  conn_pool: {connect_backoff: 300ms}\n")
+	get := func() int { return serve(r, httptest.NewRequest(http.MethodGet, "/cb/", nil)).Code }
+
+	failedAt := time.Now()
+	if code := get(); code == http.StatusOK {
+		t.Fatal("connected to a closed port")
+	}
+	// Back up, but still within the cooldown
+	ln, err = net.Listen("tcp", addr)
+	if err != nil {
+		t.Skipf("port %s taken meanwhile: %v", addr, err)
+	}
+	var dials atomic.Int32
+	up := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}), ConnState: func(_ net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			dials.Add(1)
+		}
+	}}
+	go up.Serve(ln)
+	defer up.Close()
+
+	for range 5 {
+		start := time.Now()
+		if code := get(); code == http.StatusOK || time.Since(start) > 50*time.Millisecond {
+			t.Errorf("within the cooldown: %d after %s, want a fast failure", code, time.Since(start))
+		}
+	}
+	if time.Since(failedAt) > 300*time.Millisecond {
+		t.Fatal("test too slow to check the cooldown")
+	}
+	if n := dials.Load(); n != 0 {
+		t.Errorf("%d connections within the cooldown, want none", n)
+	}
+
+	time.Sleep(time.Until(failedAt.Add(350 * time.Millisecond)))
+	if code := get(); code != http.StatusOK || dials.Load() != 1 {
+		t.Errorf("past the cooldown: %d with %d connections, want 200 over a new one", code, dials.Load())
+	}
+}
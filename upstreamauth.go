@@ -0,0 +1,151 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// OAuth2 client credentials the gateway authenticates to the upstream with:
+// a token is fetched from TokenURL, cached and sent as a bearer token,
+// replacing the client's Authorization header
+type UpstreamAuthConfig struct {
+	TokenURL     string   `yaml:"token_url"`
+	ClientID     string   `yaml:"client_id"`
+	ClientSecret string   `yaml:"client_secret"`
+	Scopes       []string `yaml:"scopes"`
+	// How long before its expiry a token is replaced, at most half its
+	// lifetime; 30s by default
+	RefreshBefore time.Duration `yaml:"refresh_before"`
+	// Limit of a token request; 5s by default
+	Timeout time.Duration `yaml:"timeout"`
+}
+
+func (cfg UpstreamAuthConfig) validate() error {
+	if cfg.TokenURL == "" {
+		return nil
+	}
+	if u, err := url.Parse(cfg.TokenURL); err != nil || u.Scheme == "" || u.Host == "" {
+		return fmt.Errorf("upstream_auth: invalid token_url %q", cfg.TokenURL)
+	}
+	if cfg.ClientID == "" {
+		return fmt.Errorf("upstream_auth: client_id is required")
+	}
+	return nil
+}
+
+// Lifetime assumed for tokens issued without expires_in
+const defaultTokenLifetime = 5 * time.Minute
+
+var errUpstreamToken = errors.New("upstream token unavailable")
+
+// Token endpoint answer (RFC 6749 section 5.1)
+type tokenResponse struct {
+	AccessToken string `json:"access_token"`
+	TokenType   string `json:"token_type"`
+	ExpiresIn   int64  `json:"expires_in"`
+}
+
+// Cached client credentials token, fetched again once it is within
+// RefreshBefore of expiring
+type tokenSource struct {
+	cfg    UpstreamAuthConfig
+	client *http.Client
+	// Replaced in tests
+	now func() time.Time
+
+	// Held while fetching, so concurrent requests wait for one token request
+	mu        sync.Mutex
+	token     string
+	refreshAt time.Time
+}
+
+func newTokenSource(cfg UpstreamAuthConfig) *tokenSource {
+	if cfg.RefreshBefore <= 0 {
+		cfg.RefreshBefore = 30 * time.Second
+	}
+	timeout := cfg.Timeout
+	if timeout <= 0 {
+		timeout = 5 * time.Second
+	}
+	return &tokenSource{cfg: cfg, client: &http.Client{Timeout: timeout}, now: time.Now}
+}
+
+// Token to send upstream, fetching a new one when there is none or it is
+// about to expire
+func (s *tokenSource) get(ctx context.Context) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.token != "" && s.now().Before(s.refreshAt) {
+		return s.token, nil
+	}
+	token, lifetime, err := s.fetch(ctx)
+	if err != nil {
+		return "", fmt.Errorf("%w: %v", errUpstreamToken, err)
+	}
+	s.token, s.refreshAt = token, s.now().Add(lifetime-min(s.cfg.RefreshBefore, lifetime/2))
+	return token, nil
+}
+
+// Forget the cached token, e.g. after the upstream refused it
+func (s *tokenSource) invalidate() {
+	s.mu.Lock()
+	s.token = ""
+	s.mu.Unlock()
+}
+
+func (s *tokenSource) fetch(ctx context.Context) (string, time.Duration, error) {
+	form := url.Values{"grant_type": {"client_credentials"}}
+	if len(s.cfg.Scopes) > 0 {
+		form.Set("scope", strings.Join(s.cfg.Scopes, " "))
+	}
+	// Not tied to the request that needed the token: one client giving up
+	// mustn't fail the fetch for everyone waiting on it
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), s.client.Timeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.cfg.TokenURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", 0, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.SetBasicAuth(url.QueryEscape(s.cfg.ClientID), url.QueryEscape(s.cfg.ClientSecret))
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return "", 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", 0, fmt.Errorf("token endpoint responded with status %d", resp.StatusCode)
+	}
+	var tr tokenResponse
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 64<<10)).Decode(&tr); err != nil {
+		return "", 0, fmt.Errorf("decoding token response: %w", err)
+	}
+	if tr.AccessToken == "" {
+		return "", 0, errors.New("token response without access_token")
+	}
+	if tr.TokenType != "" && !strings.EqualFold(tr.TokenType, "bearer") {
+		return "", 0, fmt.Errorf("unsupported token type %q", tr.TokenType)
+	}
+	lifetime := defaultTokenLifetime
+	if tr.ExpiresIn > 0 {
+		lifetime = time.Duration(tr.ExpiresIn) * time.Second
+	}
+	return tr.AccessToken, lifetime, nil
+}
+
+// Bearer token for the route's upstream, "" without upstream_auth
+func (route *Route) upstreamToken(ctx context.Context) (string, error) {
+	if route.upstreamTokens == nil {
+		return "", nil
+	}
+	return route.upstreamTokens.get(ctx)
+}
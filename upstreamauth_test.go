@@ -0,0 +1,58 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// The client credentials token replaces the client's Authorization header and
+// is fetched again once within refresh_before of its expiry
+func TestUpstreamTokenInjectedAndRefreshed(t *testing.T) {
+	var issued atomic.Int32
+	tokens := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id, secret, _ := r.BasicAuth()
+		if r.Method != http.MethodPost || r.FormValue("grant_type") != "client_credentials" || id != "gw" || secret != "hush" {
+			http.Error(w, "bad token request", http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprintf(w, `{"access_token": "tok-%d", "token_type": "Bearer", "expires_in": 120}`, issued.Add(1))
+	}))
+	defer tokens.Close()
+	up := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.Header.Get("Authorization")))
+	}))
+	defer up.Close()
+	g, r := newTestGateway(t, "routes:\n- prefix: /o\n  target: "+up.URL+"\n  rate_limit: {rate: 1000, burst: 1000}\n"+
+		"  upstream_auth: {token_url: "+tokens.URL+", client_id: gw, client_secret: hush}\n")
+	clock := newFakeClock()
+	g.routes()[0].upstreamTokens.now = clock.now
+
+	sent := func() string {
+		req := httptest.NewRequest(http.MethodGet, "/o/", nil)
+		req.Header.Set("Authorization", "Bearer client-token")
+		return serve(r, req).Body.String()
+	}
+	for _, step := range []struct {
+		after time.Duration
+		want  string
+	}{
+		{0, "Bearer tok-1"},
+		// Cached until refresh_before (30s) ahead of expiry
+		{89 * time.Second, "Bearer tok-1"},
+		{2 * time.Second, "Bearer tok-2"},
+		{time.Second, "Bearer tok-2"},
+	} {
+		clock.advance(step.after)
+		if got := sent(); got != step.want {
+			t.Fatalf("after %s: upstream got %q, want %q", step.after, got, step.want)
+		}
+	}
+	if n := issued.Load(); n != 2 {
+		t.Errorf("%d tokens fetched, want 2", n)
+	}
+}
@@ -0,0 +1,263 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/rs/zerolog/log"
+	"github.com/tetratelabs/wazero"
+	"github.com/tetratelabs/wazero/api"
+)
+
+// WebAssembly module run on the route's requests and responses. It exports
+// its memory and on_request and/or on_response, both without parameters or
+// results, and may only import the gateway's host functions (module
+// "gateway"); there is no WASI, so it has no clock, files or network:
+//
+//	get_header(name_ptr, name_len, buf_ptr, buf_len i32) i32
+//	set_header(name_ptr, name_len, value_ptr, value_len i32)
+//	del_header(name_ptr, name_len i32)
+//	get_path(buf_ptr, buf_len i32) i32
+//	set_path(ptr, len i32)
+//
+// Headers are the request's in on_request and the response's in
+// on_response. The path is the one forwarded upstream, after the prefix is
+// stripped, and can only be set in on_request. get_header and get_path
+// return the value's length, -1 for a missing header, and only write it when
+// it fits in buf_len bytes. Every call gets a fresh instance, so nothing
+// carries over between requests.
+type WASMConfig struct {
+	Module string `yaml:"module"`
+	// Limit of one on_request or on_response call; 50ms by default
+	Timeout time.Duration `yaml:"timeout"`
+}
+
+func (cfg WASMConfig) validate() error {
+	if cfg.Module == "" {
+		return nil
+	}
+	if cfg.Timeout < 0 {
+		return fmt.Errorf("wasm: timeout can't be negative")
+	}
+	_, err := loadWASMPlugin(cfg)
+	return err
+}
+
+// Linear memory a module instance may grow to, in 64KiB pages
+const wasmMemoryPages = 256
+
+var errWASMMemory = errors.New("wasm: pointer out of module memory")
+
+var wasmHostFunctions = map[string]bool{
+	"get_header": true, "set_header": true, "del_header": true,
+	"get_path": true, "set_path": true,
+}
+
+// One runtime serves every route. Compiled modules are kept by content, so
+// reloads that leave a module unchanged don't compile it again.
+var wasmHost struct {
+	once    sync.Once
+	runtime wazero.Runtime
+	err     error
+
+	mu      sync.Mutex
+	modules map[[sha256.Size]byte]wazero.CompiledModule
+}
+
+func wasmRuntime() (wazero.Runtime, error) {
+	wasmHost.once.Do(func() {
+		ctx := context.Background()
+		rtCfg := wazero.NewRuntimeConfig().
+			WithMemoryLimitPages(wasmMemoryPages).
+			// Lets the call timeout stop modules stuck in a loop
+			WithCloseOnContextDone(true)
+		runtime := wazero.NewRuntimeWithConfig(ctx, rtCfg)
+		_, err := runtime.NewHostModuleBuilder("gateway").
+			NewFunctionBuilder().WithFunc(wasmGetHeader).Export("get_header").
+			NewFunctionBuilder().WithFunc(wasmSetHeader).Export("set_header").
+			NewFunctionBuilder().WithFunc(wasmDelHeader).Export("del_header").
+			NewFunctionBuilder().WithFunc(wasmGetPath).Export("get_path").
+			NewFunctionBuilder().WithFunc(wasmSetPath).Export("set_path").
+			Instantiate(ctx)
+		wasmHost.runtime, wasmHost.err = runtime, err
+		wasmHost.modules = make(map[[sha256.Size]byte]wazero.CompiledModule)
+	})
+	return wasmHost.runtime, wasmHost.err
+}
+
+type wasmPlugin struct {
+	module     wazero.CompiledModule
+	timeout    time.Duration
+	onRequest  bool
+	onResponse bool
+}
+
+// Read, compile and check the module of cfg
+func loadWASMPlugin(cfg WASMConfig) (*wasmPlugin, error) {
+	code, err := os.ReadFile(cfg.Module)
+	if err != nil {
+		return nil, fmt.Errorf("wasm: %w", err)
+	}
+	runtime, err := wasmRuntime()
+	if err != nil {
+		return nil, fmt.Errorf("wasm: host module: %w", err)
+	}
+
+	sum := sha256.Sum256(code)
+	wasmHost.mu.Lock()
+	module, ok := wasmHost.modules[sum]
+	if !ok {
+		module, err = runtime.CompileModule(context.Background(), code)
+		if err == nil {
+			wasmHost.modules[sum] = module
+		}
+	}
+	wasmHost.mu.Unlock()
+	if err != nil {
+		return nil, fmt.Errorf("wasm: %s: %w", cfg.Module, err)
+	}
+
+	for _, fn := range module.ImportedFunctions() {
+		moduleName, name, _ := fn.Import()
+		if moduleName != "gateway" || !wasmHostFunctions[name] {
+			return nil, fmt.Errorf("wasm: %s imports unknown function %s.%s", cfg.Module, moduleName, name)
+		}
+	}
+	if len(module.ExportedMemories()) == 0 {
+		return nil, fmt.Errorf("wasm: %s doesn't export its memory", cfg.Module)
+	}
+	plugin := &wasmPlugin{module: module, timeout: cfg.Timeout}
+	if plugin.timeout <= 0 {
+		plugin.timeout = 50 * time.Millisecond
+	}
+	exports := module.ExportedFunctions()
+	for name, hook := range map[string]*bool{"on_request": &plugin.onRequest, "on_response": &plugin.onResponse} {
+		fn, ok := exports[name]
+		if !ok {
+			continue
+		}
+		if len(fn.ParamTypes()) > 0 || len(fn.ResultTypes()) > 0 {
+			return nil, fmt.Errorf("wasm: %s: %s must take and return nothing", cfg.Module, name)
+		}
+		*hook = true
+	}
+	if !plugin.onRequest && !plugin.onResponse {
+		return nil, fmt.Errorf("wasm: %s exports neither on_request nor on_response", cfg.Module)
+	}
+	return plugin, nil
+}
+
+// What the host functions of one call act on
+type wasmCall struct {
+	c      *gin.Context
+	header http.Header
+	// Only on_request may rewrite the path
+	request bool
+}
+
+type wasmCallKey struct{}
+
+// Run hook in a fresh instance of the module
+func (p *wasmPlugin) run(c *gin.Context, hook string, call *wasmCall) error {
+	ctx, cancel := context.WithTimeout(c.Request.Context(), p.timeout)
+	defer cancel()
+	ctx = context.WithValue(ctx, wasmCallKey{}, call)
+
+	runtime, _ := wasmRuntime()
+	// Unnamed, so instances of one module can run side by side; no start
+	// functions, the hooks are the only entry points
+	mod, err := runtime.InstantiateModule(ctx, p.module, wazero.NewModuleConfig().WithName("").WithStartFunctions())
+	if err != nil {
+		return err
+	}
+	defer mod.Close(context.Background())
+	_, err = mod.ExportedFunction(hook).Call(ctx)
+	return err
+}
+
+// Response modifier calling on_response
+func (p *wasmPlugin) modifier() responseModifier {
+	return func(c *gin.Context, resp *http.Response) error {
+		return p.run(c, "on_response", &wasmCall{c: c, header: resp.Header})
+	}
+}
+
+// Middleware calling the route's on_request before the request is forwarded
+func WASMMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		plugin := routeFromContext(c).wasm
+		if plugin == nil || !plugin.onRequest {
+			c.Next()
+			return
+		}
+		if err := plugin.run(c, "on_request", &wasmCall{c: c, header: c.Request.Header, request: true}); err != nil {
+			log.Error().Err(err).Str("path", c.Request.URL.Path).Msg("WASM request plugin failed")
+			sendLogToLoki("WASM request plugin failed", map[string]string{"level": "error", "path": c.Request.URL.Path})
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal server error"})
+			c.Abort()
+			return
+		}
+		c.Next()
+	}
+}
+
+// Host function helpers. Panics become traps, failing the call.
+
+func wasmString(m api.Module, ptr, size uint32) string {
+	b, ok := m.Memory().Read(ptr, size)
+	if !ok {
+		panic(errWASMMemory)
+	}
+	return string(b)
+}
+
+func wasmReturn(m api.Module, value string, ptr, size uint32) int32 {
+	if uint32(len(value)) <= size && !m.Memory().Write(ptr, []byte(value)) {
+		panic(errWASMMemory)
+	}
+	return int32(len(value))
+}
+
+func wasmCallOf(ctx context.Context) *wasmCall {
+	return ctx.Value(wasmCallKey{}).(*wasmCall)
+}
+
+func wasmGetHeader(ctx context.Context, m api.Module, namePtr, nameLen, bufPtr, bufLen uint32) int32 {
+	values := wasmCallOf(ctx).header.Values(wasmString(m, namePtr, nameLen))
+	if len(values) == 0 {
+		return -1
+	}
+	return wasmReturn(m, strings.Join(values, ", "), bufPtr, bufLen)
+}
+
+func wasmSetHeader(ctx context.Context, m api.Module, namePtr, nameLen, valuePtr, valueLen uint32) {
+	wasmCallOf(ctx).header.Set(wasmString(m, namePtr, nameLen), wasmString(m, valuePtr, valueLen))
+}
+
+func wasmDelHeader(ctx context.Context, m api.Module, namePtr, nameLen uint32) {
+	wasmCallOf(ctx).header.Del(wasmString(m, namePtr, nameLen))
+}
+
+func wasmGetPath(ctx context.Context, m api.Module, bufPtr, bufLen uint32) int32 {
+	return wasmReturn(m, wasmCallOf(ctx).c.Param("rest"), bufPtr, bufLen)
+}
+
+func wasmSetPath(ctx context.Context, m api.Module, ptr, size uint32) {
+	call := wasmCallOf(ctx)
+	if !call.request {
+		panic(errors.New("wasm: set_path is only allowed in on_request"))
+	}
+	path := wasmString(m, ptr, size)
+	if !strings.HasPrefix(path, "/") || strings.ContainsAny(path, "?#") {
+		panic(fmt.Errorf("wasm: invalid path %q", path))
+	}
+	setParam(call.c, "rest", path)
+}
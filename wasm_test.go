@@ -0,0 +1,63 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// Smallest plugin there is: on_request calls set_header("X-Via", "wasm")
+var addHeaderModule = []byte{
+	0x00, 0x61, 0x73, 0x6d, 0x01, 0x00, 0x00, 0x00,
+	// Types: (i32, i32, i32, i32) -> () and () -> ()
+	0x01, 0x0b, 0x02, 0x60, 0x04, 0x7f, 0x7f, 0x7f, 0x7f, 0x00, 0x60, 0x00, 0x00,
+	// Import gateway.set_header, function 0
+	0x02, 0x16, 0x01, 0x07, 'g', 'a', 't', 'e', 'w', 'a', 'y',
+	0x0a, 's', 'e', 't', '_', 'h', 'e', 'a', 'd', 'e', 'r', 0x00, 0x00,
+	// Function 1 of type 1
+	0x03, 0x02, 0x01, 0x01,
+	// One page of memory
+	0x05, 0x03, 0x01, 0x00, 0x01,
+	// Export memory and function 1 as on_request
+	0x07, 0x17, 0x02, 0x06, 'm', 'e', 'm', 'o', 'r', 'y', 0x02, 0x00,
+	0x0a, 'o', 'n', '_', 'r', 'e', 'q', 'u', 'e', 's', 't', 0x00, 0x01,
+	// set_header(0, 5, 16, 4)
+	0x0a, 0x0e, 0x01, 0x0c, 0x00, 0x41, 0x00, 0x41, 0x05, 0x41, 0x10, 0x41, 0x04, 0x10, 0x00, 0x0b,
+	// "X-Via" at 0, "wasm" at 16
+	0x0b, 0x14, 0x02, 0x00, 0x41, 0x00, 0x0b, 0x05, 'X', '-', 'V', 'i', 'a',
+	0x00, 0x41, 0x10, 0x0b, 0x04, 'w', 'a', 's', 'm',
+}
+
+func TestWASMPluginSetsHeader(t *testing.T) {
+	module := filepath.Join(t.TempDir(), "add-header.wasm")
+	if err := os.WriteFile(module, addHeaderModule, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	up := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.Header.Get("X-Via")))
+	}))
+	defer up.Close()
+	_, r := newTestGateway(t, "routes:\n- prefix: /w\n  target: "+up.URL+"\n  rate_limit: {rate: 1000, burst: 1000}\n"+
+		"  wasm: {module: "+module+"}\n"+
+		"- prefix: /plain\n  target: "+up.URL+"\n  rate_limit: {rate: 1000, burst: 1000}\n")
+
+	for path, want := range map[string]string{"/w/": "wasm", "/plain/": ""} {
+		w := serve(r, httptest.NewRequest(http.MethodGet, path, nil))
+		if w.Code != http.StatusOK || w.Body.String() != want {
+			t.Errorf("%s: status %d, upstream X-Via %q, want %q", path, w.Code, w.Body, want)
+		}
+	}
+
+	// A module importing anything but the gateway's functions is refused
+	bad := append([]byte(nil), addHeaderModule...)
+	copy(bad[25:], "gatewax")
+	if err := os.WriteFile(module, bad, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := loadWASMPlugin(WASMConfig{Module: module}); err == nil || !strings.Contains(err.Error(), "unknown function gatewax.set_header") {
+		t.Errorf("module importing gatewax.set_header: %v, want it refused", err)
+	}
+}